@@ -27,6 +27,7 @@ import (
 		"github.com/dzch/go-utils/logger"
 		"net/http"
 		"time"
+		"fmt"
 	   )
 
 type AddHandler struct {
@@ -39,71 +40,117 @@ func newAddHandler(bs *BinStore) *AddHandler {
 
 func (h *AddHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     startTime := time.Now()
-	/* check query */
-	if r.ContentLength <= 0 {
+	/* check query, ContentLength is -1 for chunked body */
+	if r.ContentLength == 0 {
 		logger.Warning("invalid query, need post data: %s", r.URL.String())
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "need post data")
 		return
 	}
-    // qv := r.URL.Query()
 	bs := h.bs
+	maxSize := bs.config.httpServerMaxBodySize
+	if r.ContentLength > maxSize {
+		logger.Warning("invalid query, body too large: %s, %d", r.URL.String(), r.ContentLength)
+		writeError(w, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, fmt.Sprintf("body exceeds the max size of %d bytes", maxSize))
+		return
+	}
+	ns, err := bs.namespaceOf(r)
+	if err != nil {
+		logger.Warning("invalid query, unknown namespace: %s", r.URL.String())
+		writeError(w, http.StatusBadRequest, errCodeUnknownNamespace, err.Error())
+		return
+	}
+    // qv := r.URL.Query()
 	ad := bs.adp.fetch()
 	defer bs.adp.put(ad)
-	ad.buffer.Reset()
-	nr, err := ad.buffer.ReadFrom(r.Body)
-	if int64(nr) != r.ContentLength || err != nil {
-		logger.Warning("fail to read body: %s, %s", r.URL.String(), err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+	err = ad.meta.parseRequest(r)
+	if err != nil {
+		logger.Warning("invalid query, bad meta: %s, %s", r.URL.String(), err.Error())
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
 		return
 	}
-	ad.checksum()
-	ad.Key = "";
-	err = bs.dd.checkDup(ad)
-	id := uint64(0)
+	ad.meta.Ctime = time.Now().Unix()
+	err = ad.want.parseHeader(r.Header)
 	if err != nil {
-		logger.Warning("fail to dd.checkDup: %s, %s", r.URL.String(), err.Error())
-		// TODO: continue ?
+		logger.Warning("invalid query, bad checksum header: %s, %s", r.URL.String(), err.Error())
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
 	}
-	if len(ad.Key) > 0 {
-		// duplication
-		// done
-	} else {
-		// new data
-		id, err = bs.km.getNewId()
-		if err != nil {
-			logger.Warning("fail to getNewId: %s", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		p, o, err := bs.broker.addNewData(id, ad)
-		if err != nil {
-			logger.Warning("fail to addNewData: %s", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		key, err := bs.km.generateKey(id, p, o) 
-		if err != nil {
-			logger.Warning("fail to generateKey: %s", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		ad.Key = key
-        err = bs.dd.insertNew(ad)
-		if err != nil {
-			logger.Warning("fail to dd.insertNew: %s", err.Error())
-			// only warning here
-		}
+	nr, err := ad.readFrom(r.Body, maxSize)
+	if err == errBodyTooLarge {
+		logger.Warning("invalid query, body too large: %s, more than %d", r.URL.String(), maxSize)
+		writeError(w, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, fmt.Sprintf("body exceeds the max size of %d bytes", maxSize))
+		return
+	}
+	if err != nil {
+		logger.Warning("fail to read body: %s, %s", r.URL.String(), err.Error())
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "fail to read body")
+		return
+	}
+	if nr == 0 || (r.ContentLength > 0 && nr != r.ContentLength) {
+		logger.Warning("invalid query, body length mismatch: %s, content_length=%d, read=%d", r.URL.String(), r.ContentLength, nr)
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "body length mismatch")
+		return
+	}
+	id, ae := bs.addData(ns, ad)
+	if ae != nil {
+		logger.Warning("fail to add: %s, %s", r.URL.String(), ae.Error())
+		writeApiError(w, ae)
+		return
 	}
 	// response ok
 	w.WriteHeader(http.StatusOK)
 	_, err = w.Write([]byte(ad.Key))
 	if err != nil {
 		logger.Warning("fail to write response: %s, %s", r.URL.String(), err.Error())
-	    w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
     endTime := time.Now() 
 	costTimeUS := endTime.Sub(startTime)/time.Microsecond
-	logger.Notice("success process add: %s, cost_us=%d, datalen=%d, id=%d, md5a=%d, md5b=%d, fnv1a32=%d, key=%s", r.URL.String(), costTimeUS, nr, id, ad.md5a, ad.md5b, ad.fnv1a32, ad.Key)
+	logger.Notice("success process add: %s, ns=%s, cost_us=%d, datalen=%d, id=%d, md5a=%d, md5b=%d, fnv1a32=%d, key=%s", r.URL.String(), ns.name, costTimeUS, nr, id, ad.md5a, ad.md5b, ad.fnv1a32, ad.Key)
 	return
 }
+
+// the steps after a body is read into ad, shared by /add and grpc Add. the
+// key is left in ad.Key, id is 0 if the body was a duplicate.
+func (bs *BinStore) addData(ns *Namespace, ad *AddData) (uint64, *apiError) {
+	// before any id is taken, a corrupted body must never become an object
+	err := ad.verify()
+	if err != nil {
+		return 0, newApiError(http.StatusBadRequest, errCodeChecksumMismatch, err.Error())
+	}
+	ad.Key = "";
+	err = ns.dd.checkDup(ad)
+	id := uint64(0)
+	if err != nil {
+		logger.Warning("fail to dd.checkDup: ns=%s, %s", ns.name, err.Error())
+		// TODO: continue ?
+	}
+	if len(ad.Key) > 0 {
+		// duplication
+		// done
+		return 0, nil
+	}
+	// new data
+	id, err = ns.km.getNewId()
+	if err != nil {
+		logger.Warning("fail to getNewId: %s", err.Error())
+		return 0, newApiError(http.StatusServiceUnavailable, errCodeIdAllocFailed, "fail to allocate id")
+	}
+	p, o, err := ns.broker.addNewData(id, ad)
+	if err != nil {
+		logger.Warning("fail to addNewData: %s", err.Error())
+		return 0, newApiError(http.StatusServiceUnavailable, brokerErrorCode(err), "fail to add data to broker")
+	}
+	key, err := ns.km.generateKey(id, p, o) 
+	if err != nil {
+		logger.Warning("fail to generateKey: %s", err.Error())
+		return 0, newApiError(http.StatusInternalServerError, errCodeInternal, "fail to generate key")
+	}
+	ad.Key = key
+	err = ns.dd.insertNew(ad)
+	if err != nil {
+		logger.Warning("fail to dd.insertNew: %s", err.Error())
+		// only warning here
+	}
+	return id, nil
+}
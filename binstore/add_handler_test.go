@@ -0,0 +1,82 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"net/http"
+		"net/http/httptest"
+		"io"
+		"io/ioutil"
+		"strings"
+		"bytes"
+		"testing"
+	   )
+
+// body is sent with length as its Content-Length, -1 for a chunked one
+func serveTest(bs *BinStore, method string, url string, body io.Reader, length int64) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, body)
+	r.ContentLength = length
+	w := httptest.NewRecorder()
+	bs.server.Handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestAddHandlerChunked(t *testing.T) {
+	bs := newTestBinStore(t)
+	data := bytes.Repeat([]byte("streamed "), 1000)
+	// only a reader, the length is not known up front
+	w := serveTest(bs, "POST", "/add", ioutil.NopCloser(bytes.NewReader(data)), -1)
+	if w.Code != http.StatusOK {
+		t.Fatalf("add: %d %s", w.Code, w.Body)
+	}
+	key := w.Body.String()
+	w = serveTest(bs, "GET", "/get?key=" + key, nil, 0)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("get: %d, %d bytes", w.Code, w.Body.Len())
+	}
+}
+
+func TestAddHandlerBody(t *testing.T) {
+	bs := newTestBinStore(t)
+	maxSize := bs.config.httpServerMaxBodySize
+	cases := []struct {
+		name string
+		body string
+		length int64
+		code int
+	}{
+		{"empty", "", 0, http.StatusBadRequest},
+		{"empty chunked", "", -1, http.StatusBadRequest},
+		{"short", "abc", 10, http.StatusBadRequest},
+		{"declared too large", "abc", maxSize+1, http.StatusRequestEntityTooLarge},
+		{"chunked too large", strings.Repeat("x", int(maxSize)+1), -1, http.StatusRequestEntityTooLarge},
+		{"chunked at the max", strings.Repeat("y", int(maxSize)), -1, http.StatusOK},
+	}
+	for _, c := range cases {
+		w := serveTest(bs, "POST", "/add", strings.NewReader(c.body), c.length)
+		if w.Code != c.code {
+			t.Fatalf("%s: %d, want %d, %s", c.name, w.Code, c.code, w.Body)
+		}
+	}
+}
@@ -24,48 +24,93 @@
 package binstore
 
 import (
-		"github.com/Shopify/sarama"
 		"github.com/tinylib/msgp/msgp"
 		"sync"
 		"bytes"
 		"hash"
 		"hash/fnv"
 		"crypto/md5"
+		"crypto/sha256"
 		"encoding/binary"
+		"errors"
+		"io"
 	   )
 
 var (
 		gAddDataBufferMaxLen = 2*1024*1024
+		errBodyTooLarge = errors.New("body too large")
 	)
 
 type AddData struct {
 	fnv1a hash.Hash32
 	md5 hash.Hash
+	// only fed when the client sent a sha256
+	sha256 hash.Hash
 	// data
 	buffer *bytes.Buffer
 	// check sum
-	fnv1a32 uint32
-	md5a uint64
-	md5b uint64
+	dataSum
+	// checksums given by the client, checked by verify
+	want clientSums
+	// content type, filename etc. given with the body
+	meta ObjectMeta
 	// key
 	Key string "key"
+	// the data compressed, see encodeBlob
+	encBuffer *bytes.Buffer
+	// the data encrypted, see Keyring.seal
+	sealBuffer *bytes.Buffer
 	// broker
-	pmsg *sarama.ProducerMessage
-	brokerErr error
-	brokerDoneChan chan int
 	msgpBuffer *bytes.Buffer
 	msgpWriter *msgp.Writer
 }
 
-func (ad *AddData) checksum() {
+// read the whole body, checksums are computed on the way.
+// returns errBodyTooLarge if there is more than maxSize bytes.
+func (ad *AddData) readFrom(r io.Reader, maxSize int64) (int64, error) {
+	ad.buffer.Reset()
 	ad.fnv1a.Reset()
-    ad.fnv1a.Write(ad.buffer.Bytes())
-	ad.fnv1a32 = ad.fnv1a.Sum32()
 	ad.md5.Reset()
-	ad.md5.Write(ad.buffer.Bytes())
+	w := io.MultiWriter(ad.buffer, ad.fnv1a, ad.md5)
+	if len(ad.want.sha256) > 0 {
+		ad.sha256.Reset()
+		w = io.MultiWriter(w, ad.sha256)
+	}
+	nr, err := io.Copy(w, io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nr, err
+	}
+	if nr > maxSize {
+		return nr, errBodyTooLarge
+	}
+	ad.fnv1a32 = ad.fnv1a.Sum32()
 	md5 := ad.md5.Sum(nil)
 	ad.md5a = binary.LittleEndian.Uint64(md5[0:8])
 	ad.md5b = binary.LittleEndian.Uint64(md5[8:16])
+	return nr, nil
+}
+
+// the md5 of the body read, as md5a and md5b were taken from it
+func (ad *AddData) md5Sum() []byte {
+	sum := make([]byte, 16)
+	binary.LittleEndian.PutUint64(sum[0:8], ad.md5a)
+	binary.LittleEndian.PutUint64(sum[8:16], ad.md5b)
+	return sum
+}
+
+// compare the checksums of the body read with the ones the client sent
+func (ad *AddData) verify() error {
+	if len(ad.want.md5) > 0 {
+		if binary.LittleEndian.Uint64(ad.want.md5[0:8]) != ad.md5a || binary.LittleEndian.Uint64(ad.want.md5[8:16]) != ad.md5b {
+			return errChecksumMismatch
+		}
+	}
+	if len(ad.want.sha256) > 0 {
+		if !bytes.Equal(ad.sha256.Sum(nil), ad.want.sha256) {
+			return errChecksumMismatch
+		}
+	}
+	return nil
 }
 
 type AddDataPool struct {
@@ -86,14 +131,25 @@ func (adp *AddDataPool) fetch() *AddData {
 }
 
 func (adp *AddDataPool) put(ad *AddData) {
-	ad.buffer.Reset()
-	ad.msgpBuffer.Reset()
-	if ad.buffer.Len() > gAddDataBufferMaxLen {
+	ad.meta.reset()
+	ad.want.reset()
+	if ad.encBuffer.Cap() > gAddDataBufferMaxLen {
+		ad.encBuffer = &bytes.Buffer{}
+	}
+	if ad.sealBuffer.Cap() > gAddDataBufferMaxLen {
+		ad.sealBuffer = &bytes.Buffer{}
+	}
+	// oversized buffers are dropped, not kept in the pool
+	if ad.buffer.Cap() > gAddDataBufferMaxLen {
 		ad.buffer = &bytes.Buffer{}
+	} else {
+		ad.buffer.Reset()
 	}
-	if ad.msgpBuffer.Len() > gAddDataBufferMaxLen {
+	if ad.msgpBuffer.Cap() > gAddDataBufferMaxLen {
 		ad.msgpBuffer = &bytes.Buffer{}
         ad.msgpWriter = msgp.NewWriter(ad.msgpBuffer)
+	} else {
+		ad.msgpBuffer.Reset()
 	}
 	adp.pool.Put(ad)
 }
@@ -101,12 +157,13 @@ func (adp *AddDataPool) put(ad *AddData) {
 func newAddData() interface{} {
     ad := &AddData {
 		buffer: &bytes.Buffer{},
+		encBuffer: &bytes.Buffer{},
+		sealBuffer: &bytes.Buffer{},
 		msgpBuffer: &bytes.Buffer{},
 	    fnv1a: fnv.New32a(),
 		md5: md5.New(),
+		sha256: sha256.New(),
 		Key: "",
-		pmsg: &sarama.ProducerMessage{Topic: gBrokerTopic},
-		brokerDoneChan: make(chan int, 1),
     }
     ad.msgpWriter = msgp.NewWriter(ad.msgpBuffer)
 	return ad
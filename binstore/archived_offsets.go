@@ -0,0 +1,147 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/dzch/go-utils/logger"
+		"errors"
+		"fmt"
+		"sync"
+		"time"
+	   )
+
+// ArchivedOffsetSource tells up to where each partition has been archived to the store.
+// Load fills offsets[partition] with the first offset not archived yet.
+type ArchivedOffsetSource interface {
+	Load(offsets []int64) error
+}
+
+// sources fed by the /store path itself
+type archivedOffsetRecorder interface {
+	record(partition int32, offset int64) error
+}
+
+// ArchivedOffsets polls the source and decides whether a blob is still read from the broker
+type ArchivedOffsets struct {
+	config *Config
+	log MessageLog
+	source ArchivedOffsetSource
+	recorder archivedOffsetRecorder
+	offsets []int64
+	offsetsTmp []int64
+	offsetsLock *sync.RWMutex
+}
+
+func newArchivedOffsets(config *Config, log MessageLog) (*ArchivedOffsets, error) {
+    ao := &ArchivedOffsets {
+        config: config,
+		log: log,
+		offsetsLock: &sync.RWMutex{},
+	}
+	err := ao.init()
+	if err != nil {
+		return nil, err
+	}
+    return ao, nil
+}
+
+func (ao *ArchivedOffsets) init() error {
+    err := ao.initSource()
+	if err != nil {
+		return err
+	}
+    err = ao.initOffsets()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ao *ArchivedOffsets) initSource() error {
+	var err error
+	switch ao.config.archiveSource {
+		case "zk":
+			ao.source, err = newZKOffsetSource(ao.config)
+		case "kafka_group":
+			ao.source, err = newKafkaGroupOffsetSource(ao.config)
+		case "store_watermark":
+			ao.source, err = newStoreWatermarkOffsetSource(ao.config, ao.log)
+		default:
+			err = errors.New(fmt.Sprintf("unknown archive source: %s", ao.config.archiveSource))
+	}
+	if err != nil {
+		return err
+	}
+	ao.recorder, _ = ao.source.(archivedOffsetRecorder)
+	return nil
+}
+
+func (ao *ArchivedOffsets) initOffsets() error {
+	ao.offsets = make([]int64, gPartitionMaxValue+1)
+	ao.offsetsTmp = make([]int64, gPartitionMaxValue+1)
+    return ao.updateOffsets()
+}
+
+func (ao *ArchivedOffsets) updateOffsets() error {
+	err := ao.source.Load(ao.offsetsTmp)
+	if err != nil {
+		return err
+	}
+	ao.offsetsLock.Lock()
+	defer ao.offsetsLock.Unlock()
+	copy(ao.offsets, ao.offsetsTmp)
+	return nil
+}
+
+func (ao *ArchivedOffsets) run() {
+	for {
+        err := ao.updateOffsets()
+		if err != nil {
+			logger.Warning("fail to updateOffsets: ns=%s, %s", ao.config.nsName, err.Error())
+			time.Sleep(ao.config.archiveFailRetryInterval)
+		}
+		time.Sleep(ao.config.archiveUpdateInterval)
+	}
+}
+
+// called by /store after the blob at partition/offset is archived
+func (ao *ArchivedOffsets) recordArchived(partition int32, offset int64) error {
+	if ao.recorder == nil {
+		return nil
+	}
+	return ao.recorder.record(partition, offset)
+}
+
+func (ao *ArchivedOffsets) dataInBroker(partition int32, offset int64) (bool, error) {
+	if partition < 0 || partition > gPartitionMaxValue {
+		return false, errors.New("partition is toooo big")
+	}
+	ao.offsetsLock.RLock()
+	defer ao.offsetsLock.RUnlock()
+	// consumer offset is next need to be commit, so need =
+	if offset >= ao.offsets[partition] {
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,438 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/dzch/go-utils/logger"
+		"github.com/tinylib/msgp/msgp"
+		"encoding/json"
+		"net/http"
+		"bytes"
+		"mime"
+		"sync"
+		"time"
+		"io"
+		"io/ioutil"
+		"errors"
+		"fmt"
+	   )
+
+/*
+   /batch_add takes either
+     multipart/form-data: one blob per part, with the Content-Type, filename,
+                          X-Binstore-Meta-*, Content-MD5 and X-Binstore-Sha256
+                          headers of the part
+     application/x-msgpack: an array of bin, or of {data, content_type, filename,
+                            headers, md5, sha256} with raw md5 and sha256
+   and answers a json {"items": [{"name", "key", "code", "error"}]} in the order of
+   the blobs, code is one of the error codes of http_error.go. a blob whose
+   checksum does not match fails with checksum_mismatch, like /add.
+   ?ttl= or ?expire= applies to every blob of the batch.
+*/
+var (
+		gBatchAddConcurrency = 32
+		errBatchTooManyItems = errors.New("too many items")
+	)
+
+type BatchAddHandler struct {
+	bs *BinStore
+}
+
+type BatchAddItem struct {
+	Name string `json:"name,omitempty"`
+	Key string `json:"key,omitempty"`
+	Code string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type BatchAddResponse struct {
+	Items []*BatchAddItem `json:"items"`
+}
+
+// one blob of the batch, ad is nil if it could not be read
+type batchAddEntry struct {
+	ad *AddData
+	item *BatchAddItem
+}
+
+func newBatchAddHandler(bs *BinStore) *BatchAddHandler {
+	return &BatchAddHandler {bs: bs}
+}
+
+func (h *BatchAddHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    startTime := time.Now()
+	bs := h.bs
+	maxSize := bs.config.httpServerMaxBatchBodySize
+	if r.ContentLength > maxSize {
+		logger.Warning("invalid query, body too large: %s, %d", r.URL.String(), r.ContentLength)
+		writeError(w, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, fmt.Sprintf("body exceeds the max size of %d bytes", maxSize))
+		return
+	}
+	ns, err := bs.namespaceOf(r)
+	if err != nil {
+		logger.Warning("invalid query, unknown namespace: %s", r.URL.String())
+		writeError(w, http.StatusBadRequest, errCodeUnknownNamespace, err.Error())
+		return
+	}
+	expiry := &ObjectMeta{}
+	err = expiry.parseExpire(r.URL.Query(), time.Now())
+	if err != nil {
+		logger.Warning("invalid query, bad expire: %s, %s", r.URL.String(), err.Error())
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		logger.Warning("invalid query, bad Content-Type: %s, %s", r.URL.String(), err.Error())
+		writeError(w, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, err.Error())
+		return
+	}
+	var entries []*batchAddEntry
+	defer func() {
+		for _, e := range entries {
+			if e.ad != nil {
+				bs.adp.put(e.ad)
+			}
+		}
+	}()
+	switch mt {
+		case "multipart/form-data":
+			err = h.readMultipart(r, &entries)
+		case "application/x-msgpack", "application/msgpack":
+			err = h.readMsgp(r, &entries)
+		default:
+			logger.Warning("invalid query, unsupported Content-Type: %s, %s", r.URL.String(), mt)
+			writeError(w, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, "need multipart/form-data or application/x-msgpack")
+			return
+	}
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		logger.Warning("invalid query, body too large: %s, more than %d", r.URL.String(), maxSize)
+		writeError(w, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, fmt.Sprintf("body exceeds the max size of %d bytes", maxSize))
+		return
+	}
+	if err != nil {
+		logger.Warning("invalid query, fail to read batch: %s, %s", r.URL.String(), err.Error())
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	for _, e := range entries {
+		if e.ad != nil {
+			e.ad.meta.Expire = expiry.Expire
+		}
+	}
+	h.addEntries(ns, entries)
+	rsp := &BatchAddResponse {
+        Items: make([]*BatchAddItem, len(entries)),
+	}
+	nfail := 0
+	for i, e := range entries {
+		rsp.Items[i] = e.item
+		if len(e.item.Error) > 0 {
+			nfail ++
+		}
+	}
+	body, err := json.Marshal(rsp)
+	if err != nil {
+		logger.Warning("fail to json.Marshal: %s, %s", r.URL.String(), err.Error())
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(body)
+	if err != nil {
+		logger.Warning("fail to write response: %s, %s", r.URL.String(), err.Error())
+		return
+	}
+    endTime := time.Now()
+	costTimeUS := endTime.Sub(startTime)/time.Microsecond
+	logger.Notice("success process batch_add: %s, ns=%s, cost_us=%d, items=%d, failed=%d", r.URL.String(), ns.name, costTimeUS, len(entries), nfail)
+	return
+}
+
+func (h *BatchAddHandler) readMultipart(r *http.Request, entries *[]*batchAddEntry) error {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(*entries) >= h.bs.config.httpServerMaxBatchItems {
+			return errBatchTooManyItems
+		}
+		e := &batchAddEntry {
+            ad: h.bs.adp.fetch(),
+			item: &BatchAddItem{Name: part.FormName()},
+		}
+		*entries = append(*entries, e)
+		err = e.ad.meta.parseHeader(http.Header(part.Header), "")
+		if err == nil {
+			err = e.ad.want.parseHeader(http.Header(part.Header))
+		}
+		if err != nil {
+			h.fail(e, errCodeInvalidRequest, err.Error())
+		} else {
+			err = h.readOne(e, part)
+		}
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// items are decoded off the body one at a time, a bin straight into its
+// AddData, so the body is never held twice
+func (h *BatchAddHandler) readMsgp(r *http.Request, entries *[]*batchAddEntry) error {
+	mr := msgp.NewReader(r.Body)
+	n, err := mr.ReadArrayHeader()
+	if err != nil {
+		return msgpBodyError(err, "msgpack body shall be an array")
+	}
+	if int(n) > h.bs.config.httpServerMaxBatchItems {
+		return errBatchTooManyItems
+	}
+	for i := uint32(0); i < n; i++ {
+		e := &batchAddEntry {
+            ad: h.bs.adp.fetch(),
+			item: &BatchAddItem{},
+		}
+		*entries = append(*entries, e)
+		t, err := mr.NextType()
+		if err != nil {
+			return msgpBodyError(err, "fail to decode msgpack")
+		}
+		switch t {
+			case msgp.BinType:
+				err = h.readMsgpBin(e, mr)
+			case msgp.MapType:
+				var vi interface{}
+				vi, err = mr.ReadIntf()
+				if err == nil {
+					vt, _ := vi.(map[string]interface{})
+					err = h.readMsgpMap(e, vt)
+				}
+			default:
+				err = mr.Skip()
+				if err == nil {
+					h.fail(e, errCodeInvalidRequest, "item shall be bin or a map with data")
+				}
+		}
+		if err != nil {
+			return msgpBodyError(err, "fail to decode msgpack")
+		}
+	}
+	return nil
+}
+
+// a body over the max is told apart from a broken one
+func msgpBodyError(err error, msg string) error {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return err
+	}
+	return errors.New(fmt.Sprintf("%s: %s", msg, err.Error()))
+}
+
+func (h *BatchAddHandler) readMsgpBin(e *batchAddEntry, mr *msgp.Reader) error {
+	size, err := mr.ReadBytesHeader()
+	if err != nil {
+		return err
+	}
+	maxSize := h.bs.config.httpServerMaxBodySize
+	if int64(size) > maxSize {
+		h.fail(e, errCodeBodyTooLarge, fmt.Sprintf("blob exceeds the max size of %d bytes", maxSize))
+		_, err = io.CopyN(ioutil.Discard, mr, int64(size))
+		return err
+	}
+	lr := &io.LimitedReader{R: mr, N: int64(size)}
+	err = h.readOne(e, lr)
+	if err != nil {
+		return err
+	}
+	if lr.N > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (h *BatchAddHandler) readMsgpMap(e *batchAddEntry, vt map[string]interface{}) error {
+	data, _ := vt["data"].([]byte)
+	meta := metaFromMap(vt)
+	e.ad.meta.ContentType = meta.ContentType
+	e.ad.meta.Headers = meta.Headers
+	e.ad.meta.setFilename(meta.Filename)
+	e.item.Name = e.ad.meta.Filename
+	md5Sum, _ := vt["md5"].([]byte)
+	sha256Sum, _ := vt["sha256"].([]byte)
+	err := e.ad.want.set(md5Sum, sha256Sum)
+	if err != nil {
+		h.fail(e, errCodeInvalidRequest, err.Error())
+		return nil
+	}
+	if data == nil {
+		h.fail(e, errCodeInvalidRequest, "item shall be bin or a map with data")
+		return nil
+	}
+	err = e.ad.meta.check()
+	if err != nil {
+		h.fail(e, errCodeInvalidRequest, err.Error())
+		return nil
+	}
+	return h.readOne(e, bytes.NewReader(data))
+}
+
+// a blob too large or empty only fails its item, errors returned come from
+// the request body itself
+func (h *BatchAddHandler) readOne(e *batchAddEntry, r io.Reader) error {
+	maxSize := h.bs.config.httpServerMaxBodySize
+	nr, err := e.ad.readFrom(r, maxSize)
+	if err == errBodyTooLarge {
+		h.fail(e, errCodeBodyTooLarge, fmt.Sprintf("blob exceeds the max size of %d bytes", maxSize))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if nr == 0 {
+		h.fail(e, errCodeInvalidRequest, "empty blob")
+		return nil
+	}
+	// before dedup and id allocation, as addData does
+	err = e.ad.verify()
+	if err != nil {
+		h.fail(e, errCodeChecksumMismatch, err.Error())
+		return nil
+	}
+	e.ad.meta.Ctime = time.Now().Unix()
+	e.ad.Key = ""
+	return nil
+}
+
+func (h *BatchAddHandler) fail(e *batchAddEntry, code string, msg string) {
+	e.item.Code = code
+	e.item.Error = msg
+	if e.ad != nil {
+		h.bs.adp.put(e.ad)
+		e.ad = nil
+	}
+}
+
+// same steps as /add, but one dedup query and one id allocation for the batch,
+// and the blobs are produced concurrently
+func (h *BatchAddHandler) addEntries(ns *Namespace, entries []*batchAddEntry) {
+	var ads []*AddData
+	for _, e := range entries {
+		if e.ad != nil {
+			ads = append(ads, e.ad)
+		}
+	}
+	if len(ads) == 0 {
+		return
+	}
+	err := ns.dd.checkDupMany(ads)
+	if err != nil {
+		logger.Warning("fail to dd.checkDupMany: %s", err.Error())
+		// go on as if all are new, like /add
+	}
+	// the same blob twice in one batch is added once
+	first := make(map[dataSum]*batchAddEntry)
+	same := make(map[*batchAddEntry]*batchAddEntry)
+	var news []*batchAddEntry
+	for _, e := range entries {
+		if e.ad == nil || len(e.ad.Key) > 0 {
+			continue
+		}
+		if f, ok := first[e.ad.dataSum]; ok {
+			same[e] = f
+			continue
+		}
+		first[e.ad.dataSum] = e
+		news = append(news, e)
+	}
+	ids, err := ns.km.getNewIds(len(news))
+	if err != nil {
+		logger.Warning("fail to getNewIds: %s", err.Error())
+		for _, e := range news {
+			e.item.Code = errCodeIdAllocFailed
+			e.item.Error = "fail to allocate id"
+		}
+		news = nil
+	}
+	wg := &sync.WaitGroup{}
+	sem := make(chan bool, gBatchAddConcurrency)
+	for i, e := range news {
+		wg.Add(1)
+		sem <- true
+		go func(id uint64, e *batchAddEntry) {
+			defer wg.Done()
+			h.addNew(ns, id, e)
+			<-sem
+		}(ids[i], e)
+	}
+	wg.Wait()
+	for _, e := range entries {
+		if e.ad == nil {
+			continue
+		}
+		if f, ok := same[e]; ok {
+			e.item.Key = f.item.Key
+			e.item.Code = f.item.Code
+			e.item.Error = f.item.Error
+			continue
+		}
+		e.item.Key = e.ad.Key
+	}
+}
+
+func (h *BatchAddHandler) addNew(ns *Namespace, id uint64, e *batchAddEntry) {
+	p, o, err := ns.broker.addNewData(id, e.ad)
+	if err != nil {
+		logger.Warning("fail to addNewData: %s", err.Error())
+		e.item.Code = brokerErrorCode(err)
+		e.item.Error = "fail to add data to broker"
+		return
+	}
+	key, err := ns.km.generateKey(id, p, o)
+	if err != nil {
+		logger.Warning("fail to generateKey: %s", err.Error())
+		e.item.Code = errCodeInternal
+		e.item.Error = "fail to generate key"
+		return
+	}
+	e.ad.Key = key
+	err = ns.dd.insertNew(e.ad)
+	if err != nil {
+		logger.Warning("fail to dd.insertNew: %s", err.Error())
+		// only warning here
+	}
+}
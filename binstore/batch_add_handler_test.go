@@ -0,0 +1,147 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/tinylib/msgp/msgp"
+		"encoding/json"
+		"mime/multipart"
+		"net/http"
+		"net/http/httptest"
+		"crypto/md5"
+		"bytes"
+		"testing"
+	   )
+
+func batchAddTest(t *testing.T, bs *BinStore, contentType string, body []byte) (int, *BatchAddResponse) {
+	r := httptest.NewRequest("POST", "/batch_add", bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	bs.server.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	rsp := &BatchAddResponse{}
+	err := json.Unmarshal(w.Body.Bytes(), rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, rsp
+}
+
+func TestBatchAddMultipart(t *testing.T) {
+	bs := newTestBinStore(t)
+	bs.config.httpServerMaxBodySize = 100
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, f := range []struct{ name, data string }{
+		{"a.txt", "aaaa"},
+		{"b.txt", string(bytes.Repeat([]byte("b"), 101))},
+		{"c.txt", "aaaa"},
+		{"d.txt", ""},
+	} {
+		fw, _ := mw.CreateFormFile("f", f.name)
+		fw.Write([]byte(f.data))
+	}
+	mw.Close()
+	code, rsp := batchAddTest(t, bs, mw.FormDataContentType(), body.Bytes())
+	if code != http.StatusOK || len(rsp.Items) != 4 {
+		t.Fatalf("%d %+v", code, rsp)
+	}
+	items := rsp.Items
+	// the same blob twice in one batch has one key
+	if len(items[0].Key) == 0 || items[2].Key != items[0].Key || items[0].Name != "f" {
+		t.Fatalf("%+v %+v", items[0], items[2])
+	}
+	if items[1].Code != errCodeBodyTooLarge || items[3].Code != errCodeInvalidRequest {
+		t.Fatalf("%+v %+v", items[1], items[3])
+	}
+	w := getTestBlob(bs, "GET", items[0].Key, nil)
+	if w.Body.String() != "aaaa" || w.Header().Get("Content-Disposition") != `attachment; filename=a.txt` {
+		t.Fatalf("get: %q %v", w.Body, w.Header())
+	}
+}
+
+func TestBatchAddMsgp(t *testing.T) {
+	bs := newTestBinStore(t)
+	bs.config.httpServerMaxBodySize = 100
+	bad := md5.Sum([]byte("other"))
+	items := []interface{}{
+		[]byte("bin"),
+		map[string]interface{}{"data": []byte("mapped"), "content_type": "text/plain", "filename": "dir/m.txt"},
+		bytes.Repeat([]byte("x"), 101),
+		"not a blob",
+		map[string]interface{}{"data": []byte("sum"), "md5": bad[:]},
+		map[string]interface{}{"filename": "no data"},
+		[]byte("after"),
+	}
+	body, err := msgp.AppendIntf(nil, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, rsp := batchAddTest(t, bs, "application/x-msgpack", body)
+	if code != http.StatusOK || len(rsp.Items) != len(items) {
+		t.Fatalf("%d %+v", code, rsp)
+	}
+	codes := []string{"", "", errCodeBodyTooLarge, errCodeInvalidRequest, errCodeChecksumMismatch, errCodeInvalidRequest, ""}
+	for i, item := range rsp.Items {
+		if item.Code != codes[i] || (len(codes[i]) == 0) != (len(item.Key) > 0) {
+			t.Fatalf("item %d: %+v", i, item)
+		}
+	}
+	if rsp.Items[1].Name != "m.txt" {
+		t.Fatalf("name: %+v", rsp.Items[1])
+	}
+	for i, want := range map[int]string{0: "bin", 1: "mapped", 6: "after"} {
+		w := getTestBlob(bs, "GET", rsp.Items[i].Key, nil)
+		if w.Body.String() != want {
+			t.Fatalf("get %d: %q", i, w.Body)
+		}
+	}
+	// cut in the middle of a bin
+	code, _ = batchAddTest(t, bs, "application/x-msgpack", body[:len(body)-2])
+	if code != http.StatusBadRequest {
+		t.Fatalf("truncated: %d", code)
+	}
+	code, _ = batchAddTest(t, bs, "application/x-msgpack", []byte("not msgpack"))
+	if code != http.StatusBadRequest {
+		t.Fatalf("not an array: %d", code)
+	}
+	bs.config.httpServerMaxBatchItems = 3
+	code, _ = batchAddTest(t, bs, "application/x-msgpack", body)
+	if code != http.StatusBadRequest {
+		t.Fatalf("too many items: %d", code)
+	}
+	// the body is decoded as it is read, it stops at the max
+	bs.config.httpServerMaxBatchItems = 1000
+	bs.config.httpServerMaxBatchBodySize = int64(len(body) - 10)
+	r := httptest.NewRequest("POST", "/batch_add", bytes.NewReader(body))
+	r.ContentLength = -1
+	r.Header.Set("Content-Type", "application/x-msgpack")
+	w := httptest.NewRecorder()
+	bs.server.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("body over the max: %d %s", w.Code, w.Body)
+	}
+}
@@ -23,6 +23,10 @@
 */
 package binstore
 
+// binstore/pb for the grpc server, here as go generate skips files behind
+// build tags it is not given
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative pb/binstore.proto
+
 import (
 		"github.com/dzch/go-utils/logger"
 		"github.com/Shopify/sarama"
@@ -40,12 +44,17 @@ type BinStore struct {
 	config *Config
 	fatalErrorChan chan error
 	server *http.Server
-	dd *DeDup
+	// nil if built without grpc or grpc_server.port is 0
+	grpcServer *grpcServer
+	// nil if s3_server.port is 0
+	s3Server *http.Server
 	adp *AddDataPool
-	km *KeyManager
-	broker *Broker
-	zk *ZK
-	store *Store
+	imgt *ImageTransformer
+	idAlloc IdAllocator
+	// nil if encryption.keyring_file is not set
+	kr *Keyring
+	// the default namespace first
+	namespaces []*Namespace
 }
 
 func NewBinStore(confFile string) (*BinStore, error) {
@@ -60,9 +69,16 @@ func NewBinStore(confFile string) (*BinStore, error) {
 }
 
 func (bs *BinStore) Run() {
-	go bs.broker.run()
-	go bs.zk.run()
+	for _, ns := range bs.namespaces {
+		ns.run()
+	}
 	go bs.runHttpServer()
+	if bs.grpcServer != nil {
+		go bs.runGrpcServer()
+	}
+	if bs.s3Server != nil {
+		go bs.runS3Server()
+	}
 	err := <-bs.fatalErrorChan
 	logger.Fatal("Fail: %s", err.Error())
 	return
@@ -85,29 +101,33 @@ func (bs *BinStore) init() error {
 	if err != nil {
 		return errors.New(fmt.Sprintf("http_server: %s", err.Error()))
 	}
-	err = bs.initDeDup()
+	err = bs.initGrpcServer()
+	if err != nil {
+		return errors.New(fmt.Sprintf("grpc_server: %s", err.Error()))
+	}
+	err = bs.initS3Server()
 	if err != nil {
-		return errors.New(fmt.Sprintf("dedup: %s", err.Error()))
+		return errors.New(fmt.Sprintf("s3_server: %s", err.Error()))
 	}
 	err = bs.initADP()
 	if err != nil {
 		return err
 	}
-	err = bs.initKeyManager()
+	err = bs.initImageTransformer()
 	if err != nil {
-		return errors.New(fmt.Sprintf("km: %s", err.Error()))
+		return err
 	}
-	err = bs.initBroker()
+	err = bs.initIdAllocator()
 	if err != nil {
-		return errors.New(fmt.Sprintf("broker: %s", err.Error()))
+		return errors.New(fmt.Sprintf("km: %s", err.Error()))
 	}
-	err = bs.initZK()
+	err = bs.initKeyring()
 	if err != nil {
-		return errors.New(fmt.Sprintf("zk: %s", err.Error()))
+		return errors.New(fmt.Sprintf("keyring: %s", err.Error()))
 	}
-	err = bs.initStore()
+	err = bs.initNamespaces()
 	if err != nil {
-		return errors.New(fmt.Sprintf("store: %s", err.Error()))
+		return err
 	}
 	return nil
 }
@@ -131,13 +151,18 @@ func (bs *BinStore) initChans() error {
 
 func (bs *BinStore) initHttpServer() error {
     mux := http.NewServeMux()
-	mux.Handle("/add", newAddHandler(bs))
-	mux.Handle("/get", newGetHandler(bs))
+	mux.Handle("/add", withRequestId(newAddHandler(bs)))
+	mux.Handle("/batch_add", withRequestId(newBatchAddHandler(bs)))
+	mux.Handle("/get", withRequestId(newGetHandler(bs)))
+	mux.Handle("/mget", withRequestId(newMGetHandler(bs)))
+	mux.Handle("/stat", withRequestId(newStatHandler(bs)))
+	mux.Handle("/delete", withRequestId(newDeleteHandler(bs)))
+	mux.Handle("/sign", withRequestId(newSignHandler(bs)))
 	h, err := newStoreHandler(bs)
 	if err != nil {
 		return err
 	}
-	mux.Handle("/store", h)
+	mux.Handle("/store", withRequestId(h))
     bs.server = &http.Server {
         Addr: fmt.Sprintf(":%d", bs.config.httpServerListenPort),
 		Handler: mux,
@@ -147,39 +172,40 @@ func (bs *BinStore) initHttpServer() error {
 	return nil
 }
 
-func (bs *BinStore) initDeDup() error {
-	var err error
-	bs.dd, err = newDeDup(bs)
-	return err
-}
-
 func (bs *BinStore) initADP() error {
 	bs.adp = newAddDataPool()
 	return nil
 }
 
-func (bs *BinStore) initKeyManager() error {
-	var err error
-	bs.km, err = newKeyManager(bs)
-	return err
+func (bs *BinStore) initImageTransformer() error {
+	bs.imgt = newImageTransformer(bs.config)
+	return nil
 }
 
-func (bs *BinStore) initBroker() error {
+func (bs *BinStore) initIdAllocator() error {
 	var err error
-	bs.broker, err = newBroker(bs)
+	bs.idAlloc, err = newIdAllocator(bs.config)
 	return err
 }
 
-func (bs *BinStore) initZK() error {
+func (bs *BinStore) initKeyring() error {
+	if len(bs.config.encryptionKeyringFile) == 0 {
+		return nil
+	}
 	var err error
-	bs.zk, err = newZK(bs)
+	bs.kr, err = newKeyring(bs.config.encryptionKeyringFile)
 	return err
 }
 
-func (bs *BinStore) initStore() error {
-	var err error
-	bs.store, err = newStore(bs)
-	return err
+func (bs *BinStore) initNamespaces() error {
+	for _, nc := range bs.config.namespaces {
+		ns, err := newNamespace(nc, bs.idAlloc, bs.kr)
+		if err != nil {
+			return errors.New(fmt.Sprintf("namespace %s: %s", nc.nsName, err.Error()))
+		}
+		bs.namespaces = append(bs.namespaces, ns)
+	}
+	return nil
 }
 
 func (bs *BinStore) runHttpServer() {
@@ -0,0 +1,72 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"errors"
+		"fmt"
+	   )
+
+var (
+		ErrBlobNotFound = errors.New("blob not found")
+		ErrBlobDeleted = errors.New("blob deleted")
+		ErrBlobExpired = errors.New("blob expired")
+	)
+
+// BlobBackend is where archived blobs live once they have left the broker.
+// implementations must be concurrent safe. meta may be nil on Put, and Get
+// returns nil meta for blobs stored without one.
+// Delete leaves a tombstone, even for an id never put: Get returns ErrBlobDeleted
+// after it and a later Put of the id is dropped, the archiver may still be
+// behind the delete.
+type BlobBackend interface {
+	Put(id uint64, data []byte, meta *ObjectMeta) error
+	Get(id uint64) ([]byte, *ObjectMeta, error)
+	// datas[i], metas[i] and errs[i] are for ids[i]
+	GetMany(ids []uint64) ([][]byte, []*ObjectMeta, []error)
+	Delete(id uint64) error
+	// deleted[i] is for ids[i]
+	Deleted(ids []uint64) ([]bool, error)
+	// at most limit ids whose meta expired at or before now (unix time)
+	Expired(now int64, limit int) ([]uint64, error)
+	// removes the blob without a tombstone
+	Purge(id uint64) error
+}
+
+// backends that do not give space back by themselves, the sweeper calls
+// Compact after each round. it returns the bytes given back, 0 if there was
+// nothing worth compacting.
+type blobCompacter interface {
+	Compact() (int64, error)
+}
+
+func newBlobBackend(config *Config) (BlobBackend, error) {
+	switch config.storeBackend {
+		case "mongo":
+			return newMgoBackend(config)
+		case "pack":
+			return newPackBackend(config)
+	}
+	return nil, errors.New(fmt.Sprintf("unknown store backend: %s", config.storeBackend))
+}
@@ -0,0 +1,220 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		bolt "go.etcd.io/bbolt"
+		"encoding/binary"
+		"bytes"
+		"os"
+		"path/filepath"
+	   )
+
+var (
+		gBoltDeDupBucket = []byte("dedup")
+		// key -> sum, for Delete
+		gBoltDeDupKeyBucket = []byte("dedup_key")
+		// s3 object name -> key
+		gBoltDeDupNameBucket = []byte("dedup_name")
+		// key 0x00 name -> nothing, for Delete
+		gBoltDeDupKeyNameBucket = []byte("dedup_key_name")
+	)
+
+// BoltDeDupIndex keeps the dedup index in a local B+tree file, for single node
+// deployments without mongo. concurrent safe.
+type BoltDeDupIndex struct {
+	config *Config
+	db *bolt.DB
+}
+
+func newBoltDeDupIndex(config *Config) (*BoltDeDupIndex, error) {
+    bi := &BoltDeDupIndex {
+        config: config,
+	}
+	err := bi.init()
+	if err != nil {
+		return nil, err
+	}
+	return bi, nil
+}
+
+func (bi *BoltDeDupIndex) init() error {
+	err := os.MkdirAll(filepath.Dir(bi.config.ddBoltFile), 0755)
+	if err != nil {
+		return err
+	}
+	bi.db, err = bolt.Open(bi.config.ddBoltFile, 0644, &bolt.Options{Timeout: bi.config.ddOperationTimeout})
+	if err != nil {
+		return err
+	}
+	return bi.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(gBoltDeDupBucket)
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{gBoltDeDupKeyBucket, gBoltDeDupNameBucket, gBoltDeDupKeyNameBucket} {
+			_, err = tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bi *BoltDeDupIndex) sumKey(sum *dataSum) []byte {
+	k := make([]byte, 20)
+	binary.BigEndian.PutUint32(k[0:4], sum.fnv1a32)
+	binary.BigEndian.PutUint64(k[4:12], sum.md5a)
+	binary.BigEndian.PutUint64(k[12:20], sum.md5b)
+	return k
+}
+
+func (bi *BoltDeDupIndex) Get(sum *dataSum) (string, error) {
+	var key string
+	err := bi.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(gBoltDeDupBucket).Get(bi.sumKey(sum))
+		// v is only valid inside the tx
+		key = string(v)
+		return nil
+	})
+	return key, err
+}
+
+func (bi *BoltDeDupIndex) GetMany(sums []*dataSum) ([]string, error) {
+	keys := make([]string, len(sums))
+	err := bi.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(gBoltDeDupBucket)
+		for i, sum := range sums {
+			keys[i] = string(b.Get(bi.sumKey(sum)))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (bi *BoltDeDupIndex) Put(sum *dataSum, key string) error {
+	return bi.db.Update(func(tx *bolt.Tx) error {
+		sk := bi.sumKey(sum)
+		err := tx.Bucket(gBoltDeDupBucket).Put(sk, []byte(key))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(gBoltDeDupKeyBucket).Put([]byte(key), sk)
+	})
+}
+
+// only sums and names indexed through dedup_key and dedup_key_name are
+// dropped. an entry is kept if it was re-pointed to another key since.
+func (bi *BoltDeDupIndex) Delete(key string) error {
+	return bi.db.Update(func(tx *bolt.Tx) error {
+		err := bi.deleteKeyNames(tx, key)
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket(gBoltDeDupBucket)
+		kb := tx.Bucket(gBoltDeDupKeyBucket)
+		sk := kb.Get([]byte(key))
+		if sk == nil {
+			return nil
+		}
+		// sk is only valid inside the tx and until the bucket changes
+		sk = append([]byte(nil), sk...)
+		if string(b.Get(sk)) == key {
+			err := b.Delete(sk)
+			if err != nil {
+				return err
+			}
+		}
+		return kb.Delete([]byte(key))
+	})
+}
+
+func (bi *BoltDeDupIndex) keyNameKey(key string, name string) []byte {
+	k := make([]byte, 0, len(key) + 1 + len(name))
+	k = append(k, key...)
+	k = append(k, 0)
+	return append(k, name...)
+}
+
+func (bi *BoltDeDupIndex) deleteKeyNames(tx *bolt.Tx, key string) error {
+	nb := tx.Bucket(gBoltDeDupNameBucket)
+	knb := tx.Bucket(gBoltDeDupKeyNameBucket)
+	prefix := bi.keyNameKey(key, "")
+	var kns [][]byte
+	c := knb.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		kns = append(kns, append([]byte(nil), k...))
+	}
+	for _, kn := range kns {
+		name := kn[len(prefix):]
+		if string(nb.Get(name)) == key {
+			err := nb.Delete(name)
+			if err != nil {
+				return err
+			}
+		}
+		err := knb.Delete(kn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bi *BoltDeDupIndex) GetName(name string) (string, error) {
+	var key string
+	err := bi.db.View(func(tx *bolt.Tx) error {
+		key = string(tx.Bucket(gBoltDeDupNameBucket).Get([]byte(name)))
+		return nil
+	})
+	return key, err
+}
+
+// the dedup_key_name entry of the key name pointed at before is left, Delete
+// of that key skips it
+func (bi *BoltDeDupIndex) PutName(name string, key string) error {
+	return bi.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(gBoltDeDupNameBucket).Put([]byte(name), []byte(key))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(gBoltDeDupKeyNameBucket).Put(bi.keyNameKey(key, name), []byte{})
+	})
+}
+
+func (bi *BoltDeDupIndex) DeleteName(name string) error {
+	return bi.db.Update(func(tx *bolt.Tx) error {
+		nb := tx.Bucket(gBoltDeDupNameBucket)
+		key := nb.Get([]byte(name))
+		if key == nil {
+			return nil
+		}
+		err := tx.Bucket(gBoltDeDupKeyNameBucket).Delete(bi.keyNameKey(string(key), name))
+		if err != nil {
+			return err
+		}
+		return nb.Delete([]byte(name))
+	})
+}
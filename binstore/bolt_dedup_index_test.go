@@ -0,0 +1,154 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"path/filepath"
+		"testing"
+		"time"
+	   )
+
+func newTestBoltDeDupIndex(t *testing.T, file string) *BoltDeDupIndex {
+	bi, err := newBoltDeDupIndex(&Config{ddBoltFile: file, ddOperationTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bi
+}
+
+func checkBoltKey(t *testing.T, bi *BoltDeDupIndex, sum *dataSum, want string) {
+	key, err := bi.Get(sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != want {
+		t.Fatalf("sum %v: %q, want %q", *sum, key, want)
+	}
+}
+
+func TestBoltDeDupIndexRoundTrip(t *testing.T) {
+	// the directory is made if missing
+	file := filepath.Join(t.TempDir(), "data", "dedup.db")
+	bi := newTestBoltDeDupIndex(t, file)
+	a, b := &dataSum{1, 2, 3}, &dataSum{1, 2, 4}
+	checkBoltKey(t, bi, a, "")
+	err := bi.Put(a, "key-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBoltKey(t, bi, a, "key-a")
+	checkBoltKey(t, bi, b, "")
+	err = bi.Put(b, "key-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := bi.GetMany([]*dataSum{b, {9, 9, 9}, a})
+	if err != nil || keys[0] != "key-b" || keys[1] != "" || keys[2] != "key-a" {
+		t.Fatalf("get many: %v %v", keys, err)
+	}
+	// kept across a restart
+	bi.db.Close()
+	bi = newTestBoltDeDupIndex(t, file)
+	checkBoltKey(t, bi, a, "key-a")
+	checkBoltKey(t, bi, b, "key-b")
+}
+
+func TestBoltDeDupIndexDelete(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dedup.db")
+	bi := newTestBoltDeDupIndex(t, file)
+	a, b := &dataSum{1, 2, 3}, &dataSum{4, 5, 6}
+	bi.Put(a, "key-a")
+	bi.Put(b, "key-b")
+	err := bi.Delete("key-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBoltKey(t, bi, a, "")
+	checkBoltKey(t, bi, b, "key-b")
+	// unknown keys and keys deleted twice are no error
+	err = bi.Delete("key-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bi.Delete("never-put")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sum was re-pointed to a newer key, deleting the old one keeps it
+	bi.Put(a, "key-a1")
+	bi.Put(a, "key-a2")
+	err = bi.Delete("key-a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBoltKey(t, bi, a, "key-a2")
+	bi.db.Close()
+	bi = newTestBoltDeDupIndex(t, file)
+	checkBoltKey(t, bi, a, "key-a2")
+	err = bi.Delete("key-a2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBoltKey(t, bi, a, "")
+}
+
+func TestBoltDeDupIndexNames(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dedup.db")
+	bi := newTestBoltDeDupIndex(t, file)
+	checkName := func(name string, want string) {
+		key, err := bi.GetName(name)
+		if err != nil || key != want {
+			t.Fatalf("name %s: %q %v, want %q", name, key, err, want)
+		}
+	}
+	checkName("a.jpg", "")
+	bi.PutName("a.jpg", "key-a")
+	bi.PutName("b.jpg", "key-a")
+	bi.PutName("c.jpg", "key-c")
+	checkName("a.jpg", "key-a")
+	// re-pointed, Delete of the old key keeps it
+	bi.PutName("b.jpg", "key-b")
+	err := bi.Delete("key-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkName("a.jpg", "")
+	checkName("b.jpg", "key-b")
+	checkName("c.jpg", "key-c")
+	err = bi.DeleteName("c.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkName("c.jpg", "")
+	err = bi.DeleteName("never-put")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a key that is a prefix of another keeps the names of the longer one
+	bi.PutName("d.jpg", "key-d")
+	bi.PutName("e.jpg", "key-d1")
+	bi.Delete("key-d")
+	checkName("d.jpg", "")
+	checkName("e.jpg", "key-d1")
+}
@@ -24,7 +24,6 @@
 package binstore
 
 import (
-		"github.com/Shopify/sarama"
 		"github.com/tinylib/msgp/msgp"
 		"errors"
 		"fmt"
@@ -33,26 +32,39 @@ import (
 		"bytes"
 	   )
 
+/*
+   a blob larger than chunk_size is written as chunk messages followed by a manifest
+   in the same partition, its key points to the manifest:
+     chunk    := {id, method: binstore_chunk, seq, data}
+     manifest := {id, method: binstore_manifest, size, partitions, offsets, meta}
+   a blob message is {id, method: binstore, data, meta}.
+   data is compressed with broker.compression, meta.encoding tells the codec,
+   then encrypted if the namespace has encrypt, meta.key_id and
+   meta.data_key tell how.
+*/
 var (
 		gBrokerTopic = "binstore"
 		gBrokerMethod = "binstore"
+		gBrokerMethodChunk = "binstore_chunk"
+		gBrokerMethodManifest = "binstore_manifest"
+		errNoWritablePartition = errors.New("no writable partitions in broker")
 	)
 
 type Broker struct {
 	config *Config
-	ap sarama.AsyncProducer
-	brokerConfig *sarama.Config
-	bc sarama.Client
+	// nil if blobs are not encrypted
+	kr *Keyring
+	log MessageLog
 	writeDisabledPartitions []int
 	nWriteDisabledPartitions int
-	produceChan chan *sarama.ProducerMessage
 }
 
-func newBroker(bs *BinStore) (*Broker, error) {
+func newBroker(config *Config, kr *Keyring) (*Broker, error) {
     b := &Broker {
-        config: bs.config,
-		writeDisabledPartitions: bs.config.brokerWDisabledPartitions,
-		nWriteDisabledPartitions: len(bs.config.brokerWDisabledPartitions),
+        config: config,
+		kr: kr,
+		writeDisabledPartitions: config.brokerWDisabledPartitions,
+		nWriteDisabledPartitions: len(config.brokerWDisabledPartitions),
 	}
 	err := b.init()
 	if err != nil {
@@ -62,131 +74,145 @@ func newBroker(bs *BinStore) (*Broker, error) {
 }
 
 func (b *Broker) init() error {
-    err := b.initBrokerConfig()
-	if err != nil {
-		return err
-	}
-    err = b.initAP()
-	if err != nil {
-		return err
-	}
-    err = b.initBC()
+    err := b.initLog()
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (b *Broker) initBrokerConfig() error {
-    pconfig := sarama.NewConfig()
-	pconfig.Net.MaxOpenRequests = 10240
-	pconfig.Net.DialTimeout = b.config.brokerConnTimeout
-	pconfig.Net.ReadTimeout = b.config.brokerReadTimeout
-	pconfig.Net.WriteTimeout = b.config.brokerWriteTimeout
-	pconfig.Metadata.RefreshFrequency = b.config.brokerMetadataRefreshInterval
-	pconfig.Producer.MaxMessageBytes = b.config.brokerMaxMessageSize
-	pconfig.Producer.RequiredAcks = sarama.WaitForAll
-	pconfig.Producer.Return.Successes = true
-	pconfig.Producer.Return.Errors = true
-	pconfig.Producer.Partitioner = sarama.NewManualPartitioner
-	b.brokerConfig = pconfig
-	return nil
+func (b *Broker) initLog() error {
+	var err error
+	b.log, err = newMessageLog(b.config)
+	return err
 }
 
-func (b *Broker) initAP() error {
-	var err error
-	b.ap, err = sarama.NewAsyncProducer(b.config.brokerServerList, b.brokerConfig)
+func (b *Broker) addNewData(id uint64, ad *AddData) (int32, int64, error) {
+	partition, err := b.getOneWritablePartition()
 	if err != nil {
-		return err
+		if err == errNoWritablePartition {
+			return 0, 0, err
+		}
+		return 0, 0, errors.New(fmt.Sprintf("fail to get one writable partition: %s", err.Error()))
 	}
-	b.produceChan = make(chan *sarama.ProducerMessage, 64)
-	return nil
-}
-
-func (b *Broker) initBC() error {
-	var err error
-	b.bc, err = sarama.NewClient(b.config.brokerServerList, b.brokerConfig)
+	data, err := b.encode(id, ad)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
-	return nil
-}
-
-func (b *Broker) run() {
-	for {
-		select {
-			case pm := <-b.produceChan:
-				b.produce(pm)
-			case perr := <-b.ap.Errors():
-				b.processProduceError(perr)
-			case pm := <-b.ap.Successes():
-				b.processProduceSuccess(pm)
+	chunkSize := b.config.brokerChunkSize
+	if len(data) <= chunkSize {
+        msg := map[string]interface{} {
+            "id": id,
+			"data": data,
+			"method": gBrokerMethod,
+			"meta": ad.meta.toMap(),
+		}
+		err = b.packMessage(ad, msg)
+		if err != nil {
+			return 0, 0, err
+		}
+		// with its meta and framing it may not fit, the manifest carries the meta then
+		if ad.msgpBuffer.Len() <= b.config.brokerMaxMessageSize {
+			return b.produce(ad, partition)
 		}
 	}
-}
-
-func (b *Broker) produce(pm *sarama.ProducerMessage) {
-	for {
-		select {
-			case b.ap.Input() <- pm:
-				return
-			case perr := <-b.ap.Errors():
-				b.processProduceError(perr)
-			case pm := <-b.ap.Successes():
-				b.processProduceSuccess(pm)
+	var partitions []int64
+	var offsets []int64
+	for seq, start := 0, 0; start < len(data); seq, start = seq+1, start+chunkSize {
+		end := start + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+        msg := map[string]interface{} {
+            "id": id,
+			"data": data[start:end],
+			"method": gBrokerMethodChunk,
+			"seq": seq,
+		}
+		p, o, err := b.appendMessage(ad, partition, msg)
+		if err != nil {
+			return 0, 0, errors.New(fmt.Sprintf("chunk %d: %s", seq, err.Error()))
 		}
+		partitions = append(partitions, int64(p))
+		offsets = append(offsets, o)
+	}
+    msg := map[string]interface{} {
+        "id": id,
+		"method": gBrokerMethodManifest,
+		"size": int64(len(data)),
+		"partitions": partitions,
+		"offsets": offsets,
+		"meta": ad.meta.toMap(),
 	}
+	return b.appendMessage(ad, partition, msg)
 }
 
-func (b *Broker) processProduceError(perr *sarama.ProducerError) {
-    pm := perr.Msg
-	ad := pm.Metadata.(*AddData)
-	ad.brokerErr = perr.Err
-	ad.pmsg = pm
-	ad.brokerDoneChan <- 1
+// the data of ad as it is produced, compressed then encrypted. meta is set
+// to match.
+func (b *Broker) encode(id uint64, ad *AddData) ([]byte, error) {
+	data := ad.buffer.Bytes()
+	ad.meta.Md5 = ad.md5Sum()
+	ad.meta.Encoding = ""
+	ad.meta.KeyId = ""
+	ad.meta.DataKey = nil
+	if b.config.brokerCompression != gCodecNone && len(data) >= b.config.brokerCompressionMinSize && isCompressible(ad.meta.ContentType) {
+		var codec string
+		var err error
+		data, codec, err = encodeBlob(b.config.brokerCompression, data, ad.encBuffer)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("fail to compress: %s", err.Error()))
+		}
+		ad.meta.Encoding = codec
+	}
+	if b.kr == nil {
+		return data, nil
+	}
+	data, err := b.kr.seal(id, data, &ad.meta, ad.sealBuffer)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("fail to encrypt: %s", err.Error()))
+	}
+	return data, nil
 }
 
-func (b *Broker) processProduceSuccess(pm *sarama.ProducerMessage) {
-    ad := pm.Metadata.(*AddData)
-	ad.brokerErr = nil
-	ad.pmsg = pm
-	ad.brokerDoneChan <- 1
+func (b *Broker) appendMessage(ad *AddData, partition int32, msg map[string]interface{}) (int32, int64, error) {
+	err := b.packMessage(ad, msg)
+	if err != nil {
+		return 0, 0, err
+	}
+	return b.produce(ad, partition)
 }
 
-func (b *Broker) addNewData(id uint64, ad *AddData) (int32, int64, error) {
-    data := map[string]interface{} {
-        "id": id,
-		"data": ad.buffer.Bytes(),
-		"method": gBrokerMethod,
-	}
+// msg encoded into ad.msgpBuffer
+func (b *Broker) packMessage(ad *AddData, msg map[string]interface{}) error {
+	ad.msgpBuffer.Reset()
 	wr := ad.msgpWriter
-	err := wr.WriteIntf(data)
+	err := wr.WriteIntf(msg)
 	if err != nil {
-		return 0, 0, errors.New(fmt.Sprintf("fail to msgp.WriteIntf: %s", err.Error()))
+		return errors.New(fmt.Sprintf("fail to msgp.WriteIntf: %s", err.Error()))
 	}
-	wr.Flush()
-	ad.pmsg.Value = sarama.ByteEncoder(ad.msgpBuffer.Bytes())
-	ad.pmsg.Metadata = ad
-	ad.pmsg.Partition, err = b.getOneWritablePartition()
-	if err != nil {
-		return 0, 0, errors.New(fmt.Sprintf("fail to get one writable partition: %s", err.Error()))
+	return wr.Flush()
+}
+
+// produces the message packed in ad.msgpBuffer
+func (b *Broker) produce(ad *AddData, partition int32) (int32, int64, error) {
+	if ad.msgpBuffer.Len() > b.config.brokerMaxMessageSize {
+		return 0, 0, errors.New(fmt.Sprintf("message of %d bytes exceeds max_message_size %d", ad.msgpBuffer.Len(), b.config.brokerMaxMessageSize))
 	}
-	b.produceChan <-ad.pmsg
-	<-ad.brokerDoneChan
-	if ad.brokerErr != nil {
-		return 0, 0, errors.New(fmt.Sprintf("fail to produce: %s", ad.brokerErr.Error()))
+	partition, offset, err := b.log.Append(partition, ad.msgpBuffer.Bytes())
+	if err != nil {
+		return 0, 0, errors.New(fmt.Sprintf("fail to produce: %s", err.Error()))
 	}
-	return ad.pmsg.Partition, ad.pmsg.Offset, nil
+	return partition, offset, nil
 }
 
 func (b *Broker) getOneWritablePartition() (int32, error) {
-	wp, err := b.bc.WritablePartitions(gBrokerTopic)
+	wp, err := b.log.WritablePartitions()
 	if err != nil {
 		return 0, err
 	}
     wplen := len(wp)
 	if wplen == 0 {
-		return 0, errors.New("no writable partitions in broker")
+		return 0, errNoWritablePartition
 	}
 	i,j := rand.Int()%wplen, 0
 	for ; j < wplen; j++ {
@@ -197,9 +223,9 @@ func (b *Broker) getOneWritablePartition() (int32, error) {
 		break
 	}
 	if j == wplen {
-		return 0, errors.New("no writable partitions in broker")
+		return 0, errNoWritablePartition
 	}
-	return wp[i], nil
+	return wp[i%wplen], nil
 }
 
 func (b *Broker) isPartitionBlocked(partition int) bool {
@@ -207,39 +233,122 @@ func (b *Broker) isPartitionBlocked(partition int) bool {
 		return false
 	}
     idx := sort.SearchInts(b.writeDisabledPartitions, partition)
-	if b.writeDisabledPartitions[idx] == partition {
+	if idx < b.nWriteDisabledPartitions && b.writeDisabledPartitions[idx] == partition {
 		return true
 	}
 	return false
 }
 
-func (b *Broker) getData(partition int32, offset int64) ([]byte, error) {
-	// TODO: using pool ?
-	bb, err := b.bc.Leader(gBrokerTopic, partition)
+func (b *Broker) getData(id uint64, partition int32, offset int64) ([]byte, *ObjectMeta, error) {
+	msg, err := b.getMessage(partition, offset)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	bbb := sarama.NewBroker(bb.Addr())
-	defer bbb.Close()
-	err = bbb.Open(b.brokerConfig)
-	if err != nil {
-		return nil, err
+	return b.messageData(id, msg)
+}
+
+// ids[i] is the id expected at locs[i]
+func (b *Broker) getDataMany(ids []uint64, locs []logLocation) ([][]byte, []*ObjectMeta, []error) {
+	datas := make([][]byte, len(locs))
+	metas := make([]*ObjectMeta, len(locs))
+	values, errs := b.log.FetchMany(locs)
+	for i, value := range values {
+		if errs[i] != nil {
+			continue
+		}
+		msg, err := decodeMessage(value)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		datas[i], metas[i], errs[i] = b.messageData(ids[i], msg)
 	}
-    freq := &sarama.FetchRequest {}
-	freq.AddBlock(gBrokerTopic, partition, offset, int32(b.config.brokerMaxMessageSize))
-	fres, err := bbb.Fetch(freq)
+	return datas, metas, errs
+}
+
+func (b *Broker) getMessage(partition int32, offset int64) (map[string]interface{}, error) {
+	value, err := b.log.Fetch(partition, offset)
 	if err != nil {
 		return nil, err
 	}
-    fresb := fres.GetBlock(gBrokerTopic, partition)
-	msgs := fresb.MsgSet.Messages
-	if len(msgs) == 0 {
-		return nil, errors.New("no msg found in broker")
+	return decodeMessage(value)
+}
+
+// data and meta of the blob a message stands for, chunks of a manifest are fetched and joined.
+// an offset reused by another blob, e.g. after a torn tail was cut, is not found.
+func (b *Broker) messageData(id uint64, msg map[string]interface{}) ([]byte, *ObjectMeta, error) {
+	mid, ok := msgpInt64(msg["id"])
+	if !ok || uint64(mid) != id {
+		return nil, nil, ErrBlobNotFound
+	}
+	method, _ := msg["method"].(string)
+	switch method {
+		case gBrokerMethodManifest:
+			data, err := b.assemble(msg)
+			if err != nil {
+				return nil, nil, err
+			}
+			return data, metaFromMap(msg["meta"]), nil
+		case gBrokerMethodChunk:
+			return nil, nil, errors.New("invalid data from broker: a chunk, not a blob")
+	}
+	datai, ok := msg["data"]
+	if !ok {
+        return nil, nil, errors.New(fmt.Sprintf("invalid data from broker: data not exist"))
 	}
+	data, ok := datai.([]byte)
+	if !ok {
+        return nil, nil, errors.New(fmt.Sprintf("invalid data from broker: data is not bytes"))
+	}
+	return data, metaFromMap(msg["meta"]), nil
+}
+
+func (b *Broker) assemble(manifest map[string]interface{}) ([]byte, error) {
+	id, ok := msgpInt64(manifest["id"])
+	if !ok {
+		return nil, errors.New("invalid manifest: id not exist")
+	}
+	size, ok := msgpInt64(manifest["size"])
+	if !ok || size < 0 {
+		return nil, errors.New("invalid manifest: size not exist")
+	}
+	partitions, ok := manifest["partitions"].([]interface{})
+	if !ok {
+		return nil, errors.New("invalid manifest: partitions not exist")
+	}
+	offsets, ok := manifest["offsets"].([]interface{})
+	if !ok || len(offsets) != len(partitions) {
+		return nil, errors.New("invalid manifest: offsets not match partitions")
+	}
+	data := make([]byte, 0, size)
+	for i := range partitions {
+		p, ok1 := msgpInt64(partitions[i])
+		o, ok2 := msgpInt64(offsets[i])
+		if !ok1 || !ok2 {
+			return nil, errors.New(fmt.Sprintf("invalid manifest: bad location of chunk %d", i))
+		}
+		chunk, err := b.getMessage(int32(p), o)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("fail to get chunk %d: %s", i, err.Error()))
+		}
+		cid, _ := msgpInt64(chunk["id"])
+		seq, _ := msgpInt64(chunk["seq"])
+		method, _ := chunk["method"].(string)
+		cdata, _ := chunk["data"].([]byte)
+		if method != gBrokerMethodChunk || cid != id || seq != int64(i) {
+			return nil, errors.New(fmt.Sprintf("chunk %d at %d:%d does not belong to id %d", i, p, o, id))
+		}
+		data = append(data, cdata...)
+	}
+	if int64(len(data)) != size {
+		return nil, errors.New(fmt.Sprintf("assembled size %d, manifest says %d", len(data), size))
+	}
+	return data, nil
+}
+
+func decodeMessage(value []byte) (map[string]interface{}, error) {
 	/* unpack */
-	buf := bytes.NewReader(msgs[0].Msg.Value)
-	buf.Seek(0, 0)
-	msgr := msgp.NewReader(buf)
+	msgr := msgp.NewReader(bytes.NewReader(value))
 	resi, err := msgr.ReadIntf()
 	if err != nil {
         return nil, errors.New(fmt.Sprintf("fail to decode data from broker: %s", err.Error()))
@@ -248,9 +357,16 @@ func (b *Broker) getData(partition int32, offset int64) ([]byte, error) {
 	if !ok {
         return nil, errors.New(fmt.Sprintf("invalid data from broker: data need be map"))
 	}
-	datai, ok := res["data"]
-	if !ok {
-        return nil, errors.New(fmt.Sprintf("invalid data from broker: data not exist"))
+	return res, nil
+}
+
+// msgp decodes integers as int64 or uint64 depending on how they were packed
+func msgpInt64(v interface{}) (int64, bool) {
+	switch i := v.(type) {
+		case int64:
+			return i, true
+		case uint64:
+			return int64(i), true
 	}
-	return datai.([]byte), nil
+	return 0, false
 }
@@ -0,0 +1,127 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"bytes"
+		"testing"
+	   )
+
+func newTestBroker(t *testing.T) *Broker {
+	c := testSegmentConfig(t, false)
+	c.brokerSegmentMaxSize = 1 << 20
+	c.brokerMaxMessageSize = 4096
+	c.brokerChunkSize = 100
+	c.brokerLog = "segment"
+	c.brokerTopic = "binstore"
+	c.brokerCompression = gCodecNone
+	b, err := newBroker(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// data added to b under id, with a content type to check the meta by
+func addTestData(t *testing.T, b *Broker, id uint64, data []byte) (int32, int64) {
+	ad := newAddData().(*AddData)
+	_, err := ad.readFrom(bytes.NewReader(data), 1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad.meta.ContentType = "text/plain"
+	p, o, err := b.addNewData(id, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, o
+}
+
+func TestBrokerChunks(t *testing.T) {
+	b := newTestBroker(t)
+	for i, size := range []int{1, 100, 101, 1000} {
+		id := uint64(i+1)
+		data := bytes.Repeat([]byte{byte('a'+i)}, size)
+		p, o := addTestData(t, b, id, data)
+		msg, err := b.getMessage(p, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		method, _ := msg["method"].(string)
+		want := gBrokerMethod
+		if size > 100 {
+			want = gBrokerMethodManifest
+		}
+		if method != want {
+			t.Fatalf("%d bytes: %s, want %s", size, method, want)
+		}
+		got, meta, err := b.getData(id, p, o)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, data) || meta.ContentType != "text/plain" {
+			t.Fatalf("%d bytes: %d bytes back, %+v", size, len(got), meta)
+		}
+		// the key of another blob does not read it
+		_, _, err = b.getData(id+100, p, o)
+		if err != ErrBlobNotFound {
+			t.Fatalf("%d bytes, other id: %v", size, err)
+		}
+	}
+}
+
+func TestBrokerManifestChecked(t *testing.T) {
+	b := newTestBroker(t)
+	p1, o1 := addTestData(t, b, 1, bytes.Repeat([]byte("x"), 250))
+	p2, o2 := addTestData(t, b, 2, bytes.Repeat([]byte("y"), 250))
+	m1, err := b.getMessage(p1, o1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := b.getMessage(p2, o2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// chunks of blob 2 under the manifest of blob 1
+	m1["offsets"], m1["partitions"] = m2["offsets"], m2["partitions"]
+	_, err = b.assemble(m1)
+	if err == nil {
+		t.Fatal("chunks of another blob assembled")
+	}
+	// a chunk is not a blob of its own
+	offsets := m2["offsets"].([]interface{})
+	partitions := m2["partitions"].([]interface{})
+	p, _ := msgpInt64(partitions[0])
+	o, _ := msgpInt64(offsets[0])
+	_, _, err = b.getData(2, int32(p), o)
+	if err == nil {
+		t.Fatal("a chunk read as a blob")
+	}
+	// a size not matching the chunks
+	m2["size"] = int64(249)
+	_, err = b.assemble(m2)
+	if err == nil {
+		t.Fatal("size mismatch assembled")
+	}
+}
@@ -0,0 +1,103 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"net/http"
+		"encoding/base64"
+		"encoding/hex"
+		"crypto/md5"
+		"crypto/sha256"
+		"errors"
+		"fmt"
+	   )
+
+var (
+		gSha256Header = "X-Binstore-Sha256"
+		errChecksumMismatch = errors.New("checksum mismatch")
+	)
+
+// checksums the client sent along with the body, empty if not given
+type clientSums struct {
+	md5 []byte
+	sha256 []byte
+}
+
+func (cs *clientSums) reset() {
+	cs.md5 = nil
+	cs.sha256 = nil
+}
+
+// Content-MD5 is base64 as in rfc 1864, hex is taken as well.
+// X-Binstore-Sha256 is hex or base64.
+func (cs *clientSums) parseHeader(header http.Header) error {
+	var err error
+	cs.md5, err = decodeSum(header.Get("Content-MD5"), md5.Size)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid Content-MD5: %s", err.Error()))
+	}
+	cs.sha256, err = decodeSum(header.Get(gSha256Header), sha256.Size)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid %s: %s", gSha256Header, err.Error()))
+	}
+	return nil
+}
+
+func decodeSum(v string, size int) ([]byte, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+	var sum []byte
+	var err error
+	if len(v) == 2*size {
+		sum, err = hex.DecodeString(v)
+	} else {
+		sum, err = base64.StdEncoding.DecodeString(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(sum) != size {
+		return nil, errors.New(fmt.Sprintf("need %d bytes, got %d", size, len(sum)))
+	}
+	return sum, nil
+}
+
+// raw sums as other protocols carry them, nil for not given
+func (cs *clientSums) set(md5Sum []byte, sha256Sum []byte) error {
+	if len(md5Sum) > 0 && len(md5Sum) != md5.Size {
+		return errors.New(fmt.Sprintf("invalid md5: need %d bytes, got %d", md5.Size, len(md5Sum)))
+	}
+	if len(sha256Sum) > 0 && len(sha256Sum) != sha256.Size {
+		return errors.New(fmt.Sprintf("invalid sha256: need %d bytes, got %d", sha256.Size, len(sha256Sum)))
+	}
+	cs.md5, cs.sha256 = nil, nil
+	if len(md5Sum) > 0 {
+		cs.md5 = md5Sum
+	}
+	if len(sha256Sum) > 0 {
+		cs.sha256 = sha256Sum
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"net/http"
+		"net/http/httptest"
+		"encoding/base64"
+		"encoding/hex"
+		"crypto/md5"
+		"crypto/sha256"
+		"strings"
+		"testing"
+	   )
+
+func TestDecodeSum(t *testing.T) {
+	sum := md5.Sum([]byte("abc"))
+	for _, v := range []string{hex.EncodeToString(sum[:]), base64.StdEncoding.EncodeToString(sum[:])} {
+		got, err := decodeSum(v, md5.Size)
+		if err != nil || string(got) != string(sum[:]) {
+			t.Fatalf("%s: %x %v", v, got, err)
+		}
+	}
+	got, err := decodeSum("", md5.Size)
+	if got != nil || err != nil {
+		t.Fatalf("empty: %x %v", got, err)
+	}
+	for _, v := range []string{"zz", hex.EncodeToString(sum[:8]), "!!!!" + hex.EncodeToString(sum[2:])} {
+		_, err = decodeSum(v, md5.Size)
+		if err == nil {
+			t.Fatalf("%s accepted", v)
+		}
+	}
+	cs := &clientSums{}
+	if cs.set(sum[:8], nil) == nil {
+		t.Fatal("short md5 accepted")
+	}
+}
+
+func TestAddChecksum(t *testing.T) {
+	bs := newTestBinStore(t)
+	data := "checked on the way"
+	md5Sum := md5.Sum([]byte(data))
+	sha256Sum := sha256.Sum256([]byte(data))
+	other := sha256.Sum256([]byte("other"))
+	cases := []struct {
+		name string
+		header map[string]string
+		code int
+	}{
+		{"md5", map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(md5Sum[:])}, http.StatusOK},
+		{"sha256", map[string]string{gSha256Header: hex.EncodeToString(sha256Sum[:])}, http.StatusOK},
+		{"both", map[string]string{"Content-MD5": hex.EncodeToString(md5Sum[:]), gSha256Header: hex.EncodeToString(sha256Sum[:])}, http.StatusOK},
+		{"md5 mismatch", map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(other[:16])}, http.StatusBadRequest},
+		{"sha256 mismatch", map[string]string{gSha256Header: hex.EncodeToString(other[:])}, http.StatusBadRequest},
+		{"invalid", map[string]string{"Content-MD5": "nope"}, http.StatusBadRequest},
+	}
+	first := ""
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/add", strings.NewReader(data))
+		for k, v := range c.header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		bs.server.Handler.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Fatalf("%s: %d %s", c.name, w.Code, w.Body)
+		}
+		if len(first) == 0 {
+			first = w.Body.String()
+		}
+		if strings.HasSuffix(c.name, "mismatch") && !strings.Contains(w.Body.String(), errCodeChecksumMismatch) {
+			t.Fatalf("%s: %s", c.name, w.Body)
+		}
+	}
+	// a mismatch never became an object, nor took the content's dedup entry
+	w := serveTest(bs, "POST", "/add", strings.NewReader("unseen"), 6)
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Code)
+	}
+	km := bs.namespaces[0].km
+	id1, _, _, _ := km.parseKey(first)
+	id2, _, _, _ := km.parseKey(w.Body.String())
+	if id2 != id1+1 {
+		t.Fatalf("ids taken by refused bodies: %d after %d", id2, id1)
+	}
+}
@@ -0,0 +1,466 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package client
+
+import (
+		"encoding/base64"
+		"bytes"
+		"encoding/hex"
+		"encoding/json"
+		"crypto/md5"
+		"crypto/sha256"
+		"io/ioutil"
+		"math/rand"
+		"net/http"
+		"net/url"
+		"strconv"
+		"strings"
+		"sync/atomic"
+		"time"
+		"mime"
+		"hash"
+		"io"
+		"os"
+	   )
+
+var (
+		gNamespaceHeader = "X-Binstore-Namespace"
+		gMetaHeaderPrefix = "X-Binstore-Meta-"
+		gSha256Header = "X-Binstore-Sha256"
+		gAdminTokenHeader = "X-Binstore-Token"
+		gRequestIdHeader = "X-Request-Id"
+		gDefaultTimeout = 30*time.Second
+		gDefaultMaxRetries = 3
+		gDefaultRetryBackoff = 100*time.Millisecond
+		gDefaultMaxBackoff = 2*time.Second
+		// error bodies are small, do not read more of a broken one
+		gErrorBodyMaxLen = int64(64*1024)
+	)
+
+/*
+   Client talks to a set of binstore servers, each request goes to the next
+   endpoint in turn and a retry goes to the one after it.
+   calls are retried on network failures and retryable errors, after a backoff
+   doubling from RetryBackoff up to MaxBackoff:
+     Get, Open, Stat, Delete: always, they are idempotent
+     Add: only when the body is an io.ReadSeeker, it is rewound for the retry.
+          the same content is deduplicated to the same key, expiring blobs
+          are not and a retry may leave a copy which expires the same.
+   a Client is safe for concurrent use, set the fields before the first call.
+*/
+type Client struct {
+	endpoints []string
+	next uint32
+	HttpClient *http.Client
+	// retries after the first try, 0 for none
+	MaxRetries int
+	RetryBackoff time.Duration
+	MaxBackoff time.Duration
+	// sent on Add, "" for the default namespace
+	Namespace string
+	// needed by Delete
+	AdminToken string
+}
+
+// AddOptions are optional, the zero value adds a blob with nothing but its data
+type AddOptions struct {
+	ContentType string
+	Filename string
+	// sent as X-Binstore-Meta-<name>
+	Headers map[string]string
+	// only one of TTL and Expire
+	TTL time.Duration
+	Expire time.Time
+	// checksums of the body binstore verifies, AddBytes and AddFile fill them
+	Md5 []byte
+	Sha256 []byte
+}
+
+// Object is a blob with the meta binstore keeps for it
+type Object struct {
+	Data []byte
+	ObjectInfo
+}
+
+type ObjectInfo struct {
+	Size int64
+	ContentType string
+	Filename string
+	// X-Binstore-Meta-* with the prefix stripped
+	Headers map[string]string
+	ModTime time.Time
+	ETag string
+}
+
+// the json of /stat
+type StatResult struct {
+	Key string `json:"key"`
+	Namespace string `json:"namespace"`
+	Id uint64 `json:"id"`
+	Partition int32 `json:"partition"`
+	Offset int64 `json:"offset"`
+	Location string `json:"location"`
+	Size int `json:"size"`
+	Md5 string `json:"md5"`
+	Fnv1a32 uint32 `json:"fnv1a32"`
+	ContentType string `json:"content_type,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Ctime int64 `json:"ctime,omitempty"`
+	Expire int64 `json:"expire,omitempty"`
+	Expired bool `json:"expired,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	StoredSize int `json:"stored_size,omitempty"`
+	KeyId string `json:"key_id,omitempty"`
+}
+
+// endpoints are like http://10.10.1.2:8080, a missing scheme is taken as http
+func NewClient(endpoints []string) (*Client, error) {
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+    c := &Client {
+        HttpClient: &http.Client{Timeout: gDefaultTimeout},
+		MaxRetries: gDefaultMaxRetries,
+		RetryBackoff: gDefaultRetryBackoff,
+		MaxBackoff: gDefaultMaxBackoff,
+	}
+	for _, ep := range endpoints {
+		if !strings.HasPrefix(ep, "http://") && !strings.HasPrefix(ep, "https://") {
+			ep = "http://" + ep
+		}
+		c.endpoints = append(c.endpoints, strings.TrimRight(ep, "/"))
+	}
+	return c, nil
+}
+
+// a request of one try, body is nil or rewound by the caller
+type request struct {
+	method string
+	path string
+	query url.Values
+	header http.Header
+	body io.Reader
+	// -1 if unknown, the body is sent chunked
+	contentLength int64
+}
+
+// do tries req on the endpoints in turn, the response returned is 2xx or 304
+// and its body is for the caller to close. rewind is called before each retry,
+// nil if req can not be retried.
+func (c *Client) do(req *request, rewind func() error) (*http.Response, error) {
+	var err error
+	for i := 0; ; i++ {
+		if i > 0 {
+			if rewind == nil || i > c.MaxRetries || !IsRetryable(err) {
+				return nil, err
+			}
+			c.sleep(i)
+			if e := rewind(); e != nil {
+				return nil, err
+			}
+		}
+		var rsp *http.Response
+		rsp, err = c.doOnce(c.endpoint(), req)
+		if err == nil {
+			return rsp, nil
+		}
+	}
+}
+
+func (c *Client) doOnce(endpoint string, req *request) (*http.Response, error) {
+	u := endpoint + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+	var body io.Reader
+	if req.body != nil {
+		// the transport closes a body it is given, a file would not rewind
+		body = ioutil.NopCloser(req.body)
+	}
+	hreq, err := http.NewRequest(req.method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range req.header {
+		hreq.Header[k] = vs
+	}
+	if req.body != nil {
+		hreq.ContentLength = req.contentLength
+	}
+	rsp, err := c.HttpClient.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode / 100 == 2 || rsp.StatusCode == http.StatusNotModified {
+		return rsp, nil
+	}
+	defer rsp.Body.Close()
+	ebody, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, gErrorBodyMaxLen))
+	return nil, newError(endpoint, rsp, ebody)
+}
+
+func (c *Client) endpoint() string {
+	n := atomic.AddUint32(&c.next, 1)
+	return c.endpoints[int(n - 1) % len(c.endpoints)]
+}
+
+// RetryBackoff << (try-1) capped by MaxBackoff, half of it random
+func (c *Client) sleep(try int) {
+	d := c.RetryBackoff
+	for i := 1; i < try && d < c.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	if d <= 0 {
+		return
+	}
+	time.Sleep(d/2 + time.Duration(rand.Int63n(int64(d/2) + 1)))
+}
+
+// Add streams body to /add and returns the key. size is -1 if unknown.
+func (c *Client) Add(body io.Reader, size int64, opts *AddOptions) (string, error) {
+	if opts == nil {
+		opts = &AddOptions{}
+	}
+	req := &request {
+        method: "POST",
+		path: "/add",
+		query: url.Values{},
+		header: http.Header{},
+		body: body,
+		contentLength: size,
+	}
+	if len(c.Namespace) > 0 {
+		req.header.Set(gNamespaceHeader, c.Namespace)
+	}
+	opts.setRequest(req)
+	var rewind func() error
+	if rs, ok := body.(io.ReadSeeker); ok {
+		start, err := rs.Seek(0, os.SEEK_CUR)
+		if err == nil {
+			rewind = func() error {
+				_, err := rs.Seek(start, os.SEEK_SET)
+				return err
+			}
+		}
+	}
+	rsp, err := c.do(req, rewind)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	key, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+// AddBytes adds data with its checksums, so a body broken on the way is refused
+func (c *Client) AddBytes(data []byte, opts *AddOptions) (string, error) {
+	o := AddOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Md5 == nil {
+		sum := md5.Sum(data)
+		o.Md5 = sum[:]
+	}
+	return c.Add(bytes.NewReader(data), int64(len(data)), &o)
+}
+
+// AddFile streams the file at path after reading it once for its sha256, the
+// filename is the base name of path unless opts has one
+func (c *Client) AddFile(path string, opts *AddOptions) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	o := AddOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if len(o.Filename) == 0 {
+		o.Filename = fi.Name()
+	}
+	if o.Sha256 == nil {
+		o.Sha256, err = sumOf(f, sha256.New())
+		if err != nil {
+			return "", err
+		}
+	}
+	return c.Add(f, fi.Size(), &o)
+}
+
+// the reader is rewound to where it was
+func sumOf(rs io.ReadSeeker, h hash.Hash) ([]byte, error) {
+	start, err := rs.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(h, rs)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rs.Seek(start, os.SEEK_SET)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (opts *AddOptions) setRequest(req *request) {
+	if len(opts.ContentType) > 0 {
+		req.header.Set("Content-Type", opts.ContentType)
+	}
+	if len(opts.Filename) > 0 {
+		req.header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": opts.Filename}))
+	}
+	for k, v := range opts.Headers {
+		req.header.Set(gMetaHeaderPrefix + k, v)
+	}
+	if opts.TTL > 0 {
+		req.query.Set("ttl", strconv.FormatInt(int64(opts.TTL/time.Second), 10))
+	} else if !opts.Expire.IsZero() {
+		req.query.Set("expire", strconv.FormatInt(opts.Expire.Unix(), 10))
+	}
+	if opts.Md5 != nil {
+		req.header.Set("Content-MD5", base64.StdEncoding.EncodeToString(opts.Md5))
+	}
+	if opts.Sha256 != nil {
+		req.header.Set(gSha256Header, hex.EncodeToString(opts.Sha256))
+	}
+}
+
+// Open streams the blob of key, the reader is for the caller to close.
+// a failure while reading it is not retried.
+func (c *Client) Open(key string) (io.ReadCloser, *ObjectInfo, error) {
+	err := ValidateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	req := &request {
+        method: "GET",
+		path: "/get",
+		query: url.Values{"key": {key}},
+	}
+	rsp, err := c.do(req, noRewind)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rsp.Body, infoOf(rsp), nil
+}
+
+// Get reads the whole blob of key
+func (c *Client) Get(key string) (*Object, error) {
+	rc, info, err := c.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	info.Size = int64(len(data))
+	return &Object{Data: data, ObjectInfo: *info}, nil
+}
+
+func (c *Client) Stat(key string) (*StatResult, error) {
+	err := ValidateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	req := &request {
+        method: "GET",
+		path: "/stat",
+		query: url.Values{"key": {key}},
+	}
+	rsp, err := c.do(req, noRewind)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	res := &StatResult{}
+	err = json.NewDecoder(rsp.Body).Decode(res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Delete needs AdminToken, deleting a key twice is fine
+func (c *Client) Delete(key string) error {
+	err := ValidateKey(key)
+	if err != nil {
+		return err
+	}
+	req := &request {
+        method: "POST",
+		path: "/delete",
+		query: url.Values{"key": {key}},
+		header: http.Header{gAdminTokenHeader: {c.AdminToken}},
+	}
+	rsp, err := c.do(req, noRewind)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	return nil
+}
+
+// requests with no body have nothing to rewind
+func noRewind() error {
+	return nil
+}
+
+func infoOf(rsp *http.Response) *ObjectInfo {
+	info := &ObjectInfo {
+        Size: rsp.ContentLength,
+		ContentType: rsp.Header.Get("Content-Type"),
+		ETag: strings.Trim(rsp.Header.Get("ETag"), "\""),
+	}
+	_, params, err := mime.ParseMediaType(rsp.Header.Get("Content-Disposition"))
+	if err == nil {
+		info.Filename = params["filename"]
+	}
+	info.ModTime, _ = http.ParseTime(rsp.Header.Get("Last-Modified"))
+	for k, vs := range rsp.Header {
+		if strings.HasPrefix(k, gMetaHeaderPrefix) && len(vs) > 0 {
+			if info.Headers == nil {
+				info.Headers = make(map[string]string)
+			}
+			info.Headers[strings.TrimPrefix(k, gMetaHeaderPrefix)] = vs[0]
+		}
+	}
+	return info
+}
@@ -0,0 +1,118 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package client
+
+import (
+		"encoding/json"
+		"net/http"
+		"errors"
+		"fmt"
+	   )
+
+var (
+		ErrNoEndpoints = errors.New("binstore client: no endpoints")
+		ErrInvalidKey = errors.New("binstore client: invalid key")
+	)
+
+// codes of the json error bodies of binstore, see binstore/http_error.go
+var (
+		CodeInvalidRequest = "invalid_request"
+		CodeInvalidKey = "invalid_key"
+		CodeUnknownNamespace = "unknown_namespace"
+		CodeBodyTooLarge = "body_too_large"
+		CodeChecksumMismatch = "checksum_mismatch"
+		CodeForbidden = "forbidden"
+		CodeNotFound = "not_found"
+		CodeDeleted = "deleted"
+		CodeExpired = "expired"
+		CodeDedupUnavailable = "dedup_unavailable"
+		CodeIdAllocFailed = "id_alloc_failed"
+		CodeNoWritablePartition = "no_writable_partition"
+		CodeBrokerUnavailable = "broker_unavailable"
+		CodeStoreUnavailable = "store_unavailable"
+		CodeInternal = "internal_error"
+	)
+
+// Error is a failure answered by binstore. Code is empty if the body was not
+// the json of binstore, from a proxy in between for example.
+type Error struct {
+	StatusCode int `json:"-"`
+	Code string `json:"code"`
+	Message string `json:"message"`
+	RequestId string `json:"request_id"`
+	Retryable bool `json:"retryable"`
+	Endpoint string `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if len(e.Code) == 0 {
+		return fmt.Sprintf("binstore %s: http status %d", e.Endpoint, e.StatusCode)
+	}
+	return fmt.Sprintf("binstore %s: %d %s: %s, request_id=%s", e.Endpoint, e.StatusCode, e.Code, e.Message, e.RequestId)
+}
+
+func newError(endpoint string, rsp *http.Response, body []byte) *Error {
+	e := &Error{}
+	if json.Unmarshal(body, e) != nil {
+		e = &Error {
+            Retryable: rsp.StatusCode >= 500,
+		}
+	}
+	e.StatusCode = rsp.StatusCode
+	e.Endpoint = endpoint
+	if len(e.RequestId) == 0 {
+		e.RequestId = rsp.Header.Get(gRequestIdHeader)
+	}
+	return e
+}
+
+func errorCode(err error) string {
+	e, ok := err.(*Error)
+	if !ok {
+		return ""
+	}
+	return e.Code
+}
+
+func IsNotFound(err error) bool {
+	return errorCode(err) == CodeNotFound
+}
+
+// deleted or expired
+func IsGone(err error) bool {
+	code := errorCode(err)
+	return code == CodeDeleted || code == CodeExpired
+}
+
+// failures of the network and 5xx of binstore may go away on their own
+func IsRetryable(err error) bool {
+	if err == nil || err == ErrNoEndpoints || err == ErrInvalidKey {
+		return false
+	}
+	e, ok := err.(*Error)
+	if !ok {
+		return true
+	}
+	return e.Retryable
+}
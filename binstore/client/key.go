@@ -0,0 +1,70 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package client
+
+import (
+		"strings"
+	   )
+
+var (
+		// fcrypt gives 16 bytes in hex for the id and the partition/offset
+		gKeyHexLen = 32
+	)
+
+// ValidateKey tells, with no request, whether key is in the format binstore
+// generates: a key tag followed by the fcrypt hex string. with tags given the
+// key must carry one of them, without them any tag is taken. it can not tell
+// whether the key was ever generated, that needs the fcrypt key.
+func ValidateKey(key string, tags ...string) error {
+	if len(key) < gKeyHexLen {
+		return ErrInvalidKey
+	}
+	tagLen := len(key) - gKeyHexLen
+	if len(tags) > 0 {
+		found := false
+		for _, tag := range tags {
+			if len(tag) == tagLen && strings.HasPrefix(key, tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ErrInvalidKey
+		}
+	}
+	for _, c := range key[tagLen:] {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
+
+// KeyTag is the tag of a key in the format binstore generates, "" if it is not
+func KeyTag(key string) string {
+	if ValidateKey(key) != nil {
+		return ""
+	}
+	return key[:len(key) - gKeyHexLen]
+}
@@ -0,0 +1,96 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package client
+
+import (
+		"crypto/hmac"
+		"crypto/sha256"
+		"encoding/hex"
+		"encoding/json"
+		"net/http"
+		"net/url"
+		"strconv"
+		"strings"
+		"time"
+	   )
+
+type signResponse struct {
+	Key string `json:"key"`
+	Expires int64 `json:"expires"`
+	Url string `json:"url"`
+}
+
+// Sign needs AdminToken, it asks /sign for a /get url of key that works for
+// ttl, 0 for the default of the server. ip binds it to one client, "" for any.
+func (c *Client) Sign(key string, ttl time.Duration, ip string) (string, error) {
+	err := ValidateKey(key)
+	if err != nil {
+		return "", err
+	}
+	qv := url.Values{"key": {key}}
+	if ttl > 0 {
+		qv.Set("ttl", strconv.FormatInt(int64((ttl + time.Second - 1)/time.Second), 10))
+	}
+	if len(ip) > 0 {
+		qv.Set("ip", ip)
+	}
+	req := &request {
+        method: "GET",
+		path: "/sign",
+		query: qv,
+		header: http.Header{gAdminTokenHeader: {c.AdminToken}},
+	}
+	rsp, err := c.do(req, noRewind)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	res := &signResponse{}
+	err = json.NewDecoder(rsp.Body).Decode(res)
+	if err != nil {
+		return "", err
+	}
+	// the endpoint that answered, with any path prefix it has
+	u := rsp.Request.URL
+	return u.Scheme + "://" + u.Host + strings.TrimSuffix(u.Path, "/sign") + res.Url, nil
+}
+
+// SignURL makes the same url as /sign without asking the server, for those
+// who hold url_signing.secret. endpoint is like http://10.10.1.2:8080.
+func SignURL(endpoint string, secret string, key string, expires time.Time, ip string) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(key + "\n" + exp + "\n" + ip))
+	qv := url.Values{}
+	qv.Set("key", key)
+	qv.Set("expires", exp)
+	if len(ip) > 0 {
+		qv.Set("ip", ip)
+	}
+	qv.Set("sig", hex.EncodeToString(mac.Sum(nil)))
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		endpoint = "http://" + endpoint
+	}
+	return strings.TrimRight(endpoint, "/") + "/get?" + qv.Encode()
+}
@@ -0,0 +1,308 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/dzch/binstore/binstore/client"
+		"net/http"
+		"net/http/httptest"
+		"io/ioutil"
+		"path/filepath"
+		"strings"
+		"bytes"
+		"sync/atomic"
+		"testing"
+		"fmt"
+	   )
+
+// a binstore of local files only: segment log, bolt dedup and pack store
+var gTestConf = `
+common:
+ log_dir: %[1]s/log
+ log_level: 16
+http_server:
+ port: 0
+ read_timeout_ms: 5000
+ write_timeout_ms: 5000
+ max_body_size: 1048576
+ admin_token: secret
+dedup:
+ backend: bolt
+ bolt_file: %[1]s/dedup.db
+ operation_timeout_ms: 1000
+km:
+ fcrypt_key: 123aaccs2d
+ key_tag: ff5837
+ id_allocator: lease
+ lease_file: %[1]s/idlease
+ lease_min_id: 0
+ node_id: 1
+broker:
+ log: segment
+ topic: binstore
+ segment_dir: %[1]s/log
+ segment_partitions: 2
+ max_message_size: 65536
+store:
+ backend: pack
+ pack_dir: %[1]s/store
+archive:
+ source: store_watermark
+ watermark_file: %[1]s/watermark
+`
+
+func newTestBinStore(t *testing.T) *BinStore {
+	dir := t.TempDir()
+	confFile := filepath.Join(dir, "binstore.yaml")
+	err := ioutil.WriteFile(confFile, []byte(fmt.Sprintf(gTestConf, dir)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := NewBinStore(confFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+// what the archiver does: the message at partition/offset goes to /store,
+// then the watermark is loaded as ArchivedOffsets.run would
+func archiveKey(t *testing.T, bs *BinStore, endpoint string, key string) {
+	ns, _, partition, offset, err := bs.parseKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ns.broker.log.Fetch(partition, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := http.Post(fmt.Sprintf("%s/store?ns=%s&partition=%d&offset=%d", endpoint, ns.name, partition, offset), "application/x-msgpack", bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("store: %d", rsp.StatusCode)
+	}
+	err = ns.ao.updateOffsets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inBroker, _ := ns.ao.dataInBroker(partition, offset)
+	if inBroker {
+		t.Fatal("still in broker after /store")
+	}
+}
+
+func TestClientAddGetStatDelete(t *testing.T) {
+	bs := newTestBinStore(t)
+	srv := httptest.NewServer(bs.server.Handler)
+	defer srv.Close()
+	c, err := client.NewClient([]string{srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AdminToken = "secret"
+	data := []byte("hello binstore")
+	opts := &client.AddOptions{ContentType: "text/plain", Filename: "hello.txt", Headers: map[string]string{"Owner": "t"}}
+	key, err := c.AddBytes(data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.ValidateKey(key, "ff5837"); err != nil {
+		t.Fatal(err)
+	}
+	// the same content is deduplicated to the same key
+	key2, err := c.AddBytes(data, opts)
+	if err != nil || key2 != key {
+		t.Fatalf("dedup: %s != %s, %v", key2, key, err)
+	}
+	check := func(where string) {
+		obj, err := c.Get(key)
+		if err != nil {
+			t.Fatalf("%s: %v", where, err)
+		}
+		if !bytes.Equal(obj.Data, data) || obj.ContentType != "text/plain" || obj.Filename != "hello.txt" || obj.Headers["Owner"] != "t" {
+			t.Fatalf("%s: %q %+v", where, obj.Data, obj.ObjectInfo)
+		}
+		st, err := c.Stat(key)
+		if err != nil {
+			t.Fatalf("%s: %v", where, err)
+		}
+		if st.Key != key || st.Size != len(data) || st.Location != where {
+			t.Fatalf("%s: %+v", where, st)
+		}
+	}
+	check("broker")
+	archiveKey(t, bs, srv.URL, key)
+	check("store")
+	// a file is streamed and rewound after its sha256 is taken
+	path := filepath.Join(t.TempDir(), "big.bin")
+	big := bytes.Repeat([]byte("0123456789"), 20000)
+	err = ioutil.WriteFile(path, big, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fkey, err := c.AddFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := c.Get(fkey)
+	if err != nil || !bytes.Equal(obj.Data, big) || obj.Filename != "big.bin" {
+		t.Fatalf("file: %v", err)
+	}
+	// a body broken on the way is refused
+	_, err = c.AddBytes([]byte("other"), &client.AddOptions{Md5: make([]byte, 16)})
+	if err == nil || client.IsRetryable(err) {
+		t.Fatalf("checksum: %v", err)
+	}
+	err = c.Delete(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Get(key)
+	if !client.IsGone(err) {
+		t.Fatalf("deleted: %v", err)
+	}
+	// a key of this node never written
+	ns := bs.namespaces[0]
+	missing, err := ns.km.generateKey(1<<20, 1, 99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Get(missing)
+	if !client.IsNotFound(err) {
+		t.Fatalf("missing: %v", err)
+	}
+	c.AdminToken = ""
+	err = c.Delete(fkey)
+	if err == nil || client.IsRetryable(err) {
+		t.Fatalf("delete without token: %v", err)
+	}
+}
+
+func TestClientFailover(t *testing.T) {
+	bs := newTestBinStore(t)
+	srv := httptest.NewServer(bs.server.Handler)
+	defer srv.Close()
+	// nothing listens there any more
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	var down int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&down, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+	c, err := client.NewClient([]string{dead.URL, proxy.URL, srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RetryBackoff = 1
+	c.AdminToken = "secret"
+	for i := 0; i < 6; i++ {
+		data := []byte(fmt.Sprintf("failover %d", i))
+		key, err := c.AddBytes(data, nil)
+		if err != nil {
+			t.Fatalf("add %d: %v", i, err)
+		}
+		obj, err := c.Get(key)
+		if err != nil || !bytes.Equal(obj.Data, data) {
+			t.Fatalf("get %d: %v", i, err)
+		}
+		_, err = c.Stat(key)
+		if err != nil {
+			t.Fatalf("stat %d: %v", i, err)
+		}
+		err = c.Delete(key)
+		if err != nil {
+			t.Fatalf("delete %d: %v", i, err)
+		}
+	}
+	if atomic.LoadInt32(&down) == 0 {
+		t.Fatal("the failing endpoint was never tried")
+	}
+	// with every endpoint down the last error is returned
+	c, _ = client.NewClient([]string{dead.URL, proxy.URL})
+	c.RetryBackoff = 1
+	_, err = c.AddBytes([]byte("nowhere"), nil)
+	if err == nil || !client.IsRetryable(err) {
+		t.Fatalf("all down: %v", err)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	bs := newTestBinStore(t)
+	// the first try of each request fails after the body is read, as a
+	// server dying mid request would
+	var tries, fails int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&tries, 1) % 2 == 1 {
+			ioutil.ReadAll(r.Body)
+			atomic.AddInt32(&fails, 1)
+			writeError(w, http.StatusServiceUnavailable, errCodeBrokerUnavailable, "try again")
+			return
+		}
+		bs.server.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	c, err := client.NewClient([]string{srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RetryBackoff = 1
+	data := []byte("retried until it sticks")
+	// rewound for the retry, the checksum would refuse a short body
+	key, err := c.AddBytes(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := c.Get(key)
+	if err != nil || !bytes.Equal(obj.Data, data) {
+		t.Fatalf("get: %v", err)
+	}
+	if atomic.LoadInt32(&fails) != 2 {
+		t.Fatalf("fails: %d", fails)
+	}
+	// a body that can not be rewound is tried once
+	_, err = c.Add(ioutil.NopCloser(strings.NewReader("stream")), -1, nil)
+	if err == nil || !client.IsRetryable(err) {
+		t.Fatalf("stream: %v", err)
+	}
+	// MaxRetries bounds the tries
+	atomic.StoreInt32(&tries, 0)
+	c.MaxRetries = 0
+	_, err = c.Get(key)
+	if err == nil || atomic.LoadInt32(&tries) != 1 {
+		t.Fatalf("no retries: %v, tries=%d", err, tries)
+	}
+	// not found is an answer, not a failure
+	c.MaxRetries = 3
+	atomic.StoreInt32(&tries, 1)
+	missing, _ := bs.namespaces[0].km.generateKey(1<<20, 0, 99)
+	_, err = c.Get(missing)
+	if !client.IsNotFound(err) || atomic.LoadInt32(&tries) != 2 {
+		t.Fatalf("missing: %v, tries=%d", err, tries)
+	}
+}
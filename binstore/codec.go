@@ -0,0 +1,134 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/klauspost/compress/zstd"
+		"compress/gzip"
+		"io/ioutil"
+		"strings"
+		"errors"
+		"bytes"
+		"fmt"
+	   )
+
+/*
+   blobs may be compressed before they are produced, the codec is kept as
+   meta.Encoding and goes with the blob into the store. the md5 and the dedup
+   index are of the data as added, so the same data is the same key whatever
+   the codec was at the time.
+*/
+var (
+		gCodecNone = "none"
+		gCodecGzip = "gzip"
+		gCodecZstd = "zstd"
+		// compressing these again gains nothing
+		gCompressedTypePrefixes = []string{"image/", "video/", "audio/", "application/zip", "application/gzip", "application/x-gzip", "application/zstd", "application/x-bzip2", "application/x-xz", "application/x-7z-compressed", "application/x-rar-compressed", "application/pdf"}
+		gCompressibleImageTypes = []string{"image/svg+xml", "image/bmp", "image/x-ms-bmp"}
+		gZstdEncoder *zstd.Encoder
+		gZstdDecoder *zstd.Decoder
+	)
+
+func init() {
+	// both are safe for concurrent EncodeAll and DecodeAll
+	gZstdEncoder, _ = zstd.NewWriter(nil)
+	gZstdDecoder, _ = zstd.NewReader(nil)
+}
+
+func checkCodec(codec string) error {
+	switch codec {
+		case gCodecNone, gCodecGzip, gCodecZstd:
+			return nil
+	}
+	return errors.New(fmt.Sprintf("compression should be none, gzip or zstd, not %s", codec))
+}
+
+// an empty type is compressed, the smaller result is kept anyway
+func isCompressible(contentType string) bool {
+	ct := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	for _, t := range gCompressibleImageTypes {
+		if ct == t {
+			return true
+		}
+	}
+	for _, p := range gCompressedTypePrefixes {
+		if strings.HasPrefix(ct, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// data compressed into buf with codec, or data itself and "" if that is not
+// smaller
+func encodeBlob(codec string, data []byte, buf *bytes.Buffer) ([]byte, string, error) {
+	buf.Reset()
+	switch codec {
+		case gCodecGzip:
+			zw := gzip.NewWriter(buf)
+			_, err := zw.Write(data)
+			if err == nil {
+				err = zw.Close()
+			}
+			if err != nil {
+				return nil, "", err
+			}
+		case gCodecZstd:
+			buf.Write(gZstdEncoder.EncodeAll(data, buf.Bytes()[:0]))
+		default:
+			return data, "", nil
+	}
+	if buf.Len() >= len(data) {
+		return data, "", nil
+	}
+	return buf.Bytes(), codec, nil
+}
+
+// the data as added and its meta without the encoding. meta is not changed,
+// it may be nil for blobs added before meta was kept.
+func decodeBlob(data []byte, meta *ObjectMeta) ([]byte, *ObjectMeta, error) {
+	if meta == nil || len(meta.Encoding) == 0 {
+		return data, meta, nil
+	}
+	var err error
+	var out []byte
+	switch meta.Encoding {
+		case gCodecGzip:
+			var zr *gzip.Reader
+			zr, err = gzip.NewReader(bytes.NewReader(data))
+			if err == nil {
+				out, err = ioutil.ReadAll(zr)
+			}
+		case gCodecZstd:
+			out, err = gZstdDecoder.DecodeAll(data, nil)
+		default:
+			err = errors.New("unknown encoding")
+	}
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("fail to decode %s blob: %s", meta.Encoding, err.Error()))
+	}
+	dmeta := *meta
+	dmeta.Encoding = ""
+	return out, &dmeta, nil
+}
@@ -0,0 +1,217 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"compress/gzip"
+		"crypto/rand"
+		"net/http"
+		"net/http/httptest"
+		"io/ioutil"
+		"strings"
+		"testing"
+		"bytes"
+	   )
+
+var gTestCodecConf = `
+namespaces:
+ gz:
+  key_tag: c1
+  fcrypt_key: 51a0c3be77
+  compression: gzip
+ zs:
+  key_tag: c2
+  fcrypt_key: 8d02ee6b14
+  compression: zstd
+`
+
+func TestCodecRoundTrip(t *testing.T) {
+	text := []byte(strings.Repeat(`{"level":"info","msg":"compress me"}`, 200))
+	random := make([]byte, 4096)
+	rand.Read(random)
+	buf := &bytes.Buffer{}
+	for _, codec := range []string{gCodecGzip, gCodecZstd} {
+		out, enc, err := encodeBlob(codec, text, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enc != codec || len(out) >= len(text)/5 {
+			t.Fatalf("%s: %q, %d of %d", codec, enc, len(out), len(text))
+		}
+		meta := &ObjectMeta{ContentType: "application/json", Encoding: enc}
+		data, dmeta, err := decodeBlob(append([]byte(nil), out...), meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, text) || dmeta.Encoding != "" || dmeta.ContentType != "application/json" || meta.Encoding != codec {
+			t.Fatalf("%s: decoded %d bytes, meta %+v, was %+v", codec, len(data), dmeta, meta)
+		}
+		// what does not get smaller is kept as it is
+		out, enc, err = encodeBlob(codec, random, buf)
+		if err != nil || enc != "" || !bytes.Equal(out, random) {
+			t.Fatalf("%s random: %q %v", codec, enc, err)
+		}
+		_, _, err = decodeBlob([]byte("not compressed"), &ObjectMeta{Encoding: codec})
+		if err == nil {
+			t.Fatalf("%s: garbage decoded", codec)
+		}
+	}
+	out, enc, err := encodeBlob(gCodecNone, text, buf)
+	if err != nil || enc != "" || !bytes.Equal(out, text) {
+		t.Fatalf("none: %q %v", enc, err)
+	}
+	// blobs added before meta was kept, and unknown codecs
+	data, meta, err := decodeBlob(text, nil)
+	if err != nil || meta != nil || !bytes.Equal(data, text) {
+		t.Fatalf("nil meta: %v", err)
+	}
+	_, _, err = decodeBlob(text, &ObjectMeta{Encoding: "br"})
+	if err == nil {
+		t.Fatal("unknown encoding decoded")
+	}
+	if checkCodec("br") == nil || checkCodec(gCodecZstd) != nil {
+		t.Fatal("checkCodec")
+	}
+}
+
+func TestCodecCompressible(t *testing.T) {
+	cases := map[string]bool {
+		"": true,
+		"text/plain": true,
+		"application/json; charset=utf-8": true,
+		"image/svg+xml": true,
+		"image/bmp": true,
+		"image/png": false,
+		"IMAGE/JPEG": false,
+		"video/mp4": false,
+		"application/zip": false,
+		"application/pdf": false,
+	}
+	for ct, want := range cases {
+		if isCompressible(ct) != want {
+			t.Fatalf("%q: %v", ct, !want)
+		}
+	}
+}
+
+func TestCodecAcceptsEncoding(t *testing.T) {
+	cases := []struct {
+		accept string
+		want bool
+	} {
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"GZIP", true},
+		{"gzip;q=0", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"zstd, br", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/get", nil)
+		if len(c.accept) > 0 {
+			r.Header.Set("Accept-Encoding", c.accept)
+		}
+		if acceptsEncoding(r, gCodecGzip) != c.want {
+			t.Fatalf("%q: %v", c.accept, !c.want)
+		}
+	}
+}
+
+func addTestBlobTo(t *testing.T, bs *BinStore, ns string, data string, contentType string) string {
+	r := httptest.NewRequest("POST", "/add?ns=" + ns, strings.NewReader(data))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	bs.server.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("add: %d %s", w.Code, w.Body)
+	}
+	return w.Body.String()
+}
+
+// blobs of a namespace with compression, from the broker and from the store
+func TestCodecGet(t *testing.T) {
+	bs, err := newTestBinStoreWith(t, gTestCodecConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(bs.server.Handler)
+	defer srv.Close()
+	text := strings.Repeat("a log line that repeats\n", 500)
+	codecs := map[string]string{"gz": gCodecGzip, "zs": gCodecZstd}
+	for _, ns := range []string{"gz", "zs"} {
+		key := addTestBlobTo(t, bs, ns, text, "text/plain")
+		for _, where := range []string{"broker", "store"} {
+			if where == "store" {
+				archiveKey(t, bs, srv.URL, key)
+			}
+			w := getTestBlob(bs, "GET", key, nil)
+			if w.Code != http.StatusOK || w.Body.String() != text || len(w.Header().Get("Content-Encoding")) > 0 || w.Header().Get("Vary") != "Accept-Encoding" {
+				t.Fatalf("%s %s: %d %d bytes, %v", ns, where, w.Code, w.Body.Len(), w.Header())
+			}
+			plainTag := w.Header().Get("ETag")
+			w = getTestBlob(bs, "GET", key, map[string]string{"Accept-Encoding": "gzip, zstd"})
+			if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != codecs[ns] {
+				t.Fatalf("%s %s encoded: %d %v", ns, where, w.Code, w.Header())
+			}
+			if w.Body.Len() >= len(text)/5 || w.Header().Get("ETag") == plainTag {
+				t.Fatalf("%s %s encoded: %d bytes, etag %s", ns, where, w.Body.Len(), w.Header().Get("ETag"))
+			}
+			if ns == "gz" {
+				zr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := ioutil.ReadAll(zr)
+				if err != nil || string(data) != text {
+					t.Fatalf("gunzip: %d bytes, %v", len(data), err)
+				}
+			}
+			// ranges are of the data as added
+			w = getTestBlob(bs, "GET", key, map[string]string{"Range": "bytes=0-2"})
+			if w.Code != http.StatusPartialContent || w.Body.String() != "a l" {
+				t.Fatalf("%s %s range: %d %q", ns, where, w.Code, w.Body)
+			}
+			checkFrame(t, mgetTest(t, bs, []string{key})[0], http.StatusOK, text)
+			_, res := statTestBlob(t, bs, key)
+			if res == nil || res.Size != len(text) || res.StoredSize == 0 || res.StoredSize >= len(text)/5 {
+				t.Fatalf("%s %s stat: %+v", ns, where, res)
+			}
+		}
+	}
+	// images and blobs below compression_min_size are kept as they are. the
+	// data differs from text, dedup would answer its key
+	for _, ct := range []string{"image/png", "text/plain"} {
+		data := strings.Repeat("not really an image ", 500)
+		if ct == "text/plain" {
+			data = text[:1000]
+		}
+		key := addTestBlobTo(t, bs, "gz", data, ct)
+		w := getTestBlob(bs, "GET", key, map[string]string{"Accept-Encoding": "gzip"})
+		if w.Code != http.StatusOK || len(w.Header().Get("Content-Encoding")) > 0 || w.Body.String() != data {
+			t.Fatalf("%s: %d %v", ct, w.Code, w.Header())
+		}
+	}
+}
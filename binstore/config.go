@@ -32,6 +32,8 @@ import (
 		"strings"
 		"strconv"
 		"sort"
+		"path/filepath"
+		"runtime"
 	   )
 
 type Config struct {
@@ -44,7 +46,27 @@ type Config struct {
 	httpServerListenPort uint16
 	httpServerReadTimeout time.Duration
 	httpServerWriteTimeout time.Duration
+	httpServerMaxBodySize int64
+	httpServerCacheControl string
+	httpServerMaxBatchBodySize int64
+	httpServerMaxBatchItems int
+	httpServerAdminToken string
+	// grpc server, off if port is 0
+	grpcServerListenPort uint16
+	grpcServerChunkSize int
+	grpcServerMaxRecvMsgSize int
+	// s3 server, off if port is 0
+	s3ServerListenPort uint16
+	s3Region string
+	s3Credentials map[string]*s3Credential
+	// image transforms on /get, off if no presets
+	imagePresets map[string]*imageSpec
+	imageCacheSize int64
+	imageMaxPixels int
+	imageMaxConcurrency int
 	// dedup
+	ddBackend string
+	ddBoltFile string
 	ddServerList []string
 	ddConnTimeout time.Duration
 	ddSocketTimeout time.Duration
@@ -53,6 +75,7 @@ type Config struct {
 	ddDbName string
 	ddCollName string
 	// key manager
+	kmIdAllocator string
 	kmOddRedisAddr string
 	kmEvenRedisAddr string
 	kmFCryptKey string
@@ -63,15 +86,43 @@ type Config struct {
 	kmRedisMaxConnEach int
 	kmRedisPoolIdleTimeout time.Duration
 	kmKeyTag string
+	kmLeaseFile string
+	kmLeaseBlockSize uint64
+	kmLeaseMinId uint64
+	kmLeaseMinIdSet bool
+	kmLeaseNode int64
+	kmSnowflakeNode int64
+	kmSnowflakeEpoch int64
+	kmSnowflakeFile string
 	// broker
+	brokerLog string
+	brokerTopic string
 	brokerServerList []string
 	brokerWDisabledPartitions []int
 	brokerConnTimeout time.Duration
 	brokerReadTimeout time.Duration
 	brokerWriteTimeout time.Duration
 	brokerMaxMessageSize int
+	brokerChunkSize int
+	// none, gzip or zstd
+	brokerCompression string
+	brokerCompressionMinSize int
+	// encryption, blobs of the namespace are encrypted if encrypt
+	encryptionKeyringFile string
+	encrypt bool
+	// signed /get, required if signRequired
+	signSecret string
+	signRequired bool
+	signDefaultTTL int64
+	signMaxTTL int64
+	signProxyHops int
 	brokerMetadataRefreshInterval time.Duration
+	brokerSegmentDir string
+	brokerSegmentPartitions int
+	brokerSegmentMaxSize int64
+	brokerSegmentSync bool
 	// store
+	storeBackend string
 	storeServerList []string
 	storeConnTimeout time.Duration
 	storeSocketTimeout time.Duration
@@ -80,15 +131,40 @@ type Config struct {
 	storeDbName string
 	storeCollName string
 	storeWriteConcern int
+	storePackDir string
+	storePackMaxSize int64
+	storePackSync bool
+	// percent, 0 for no compaction
+	storePackCompactRatio int
+	storeSweepInterval time.Duration
+	storeSweepBatch int
+	// archive
+	archiveSource string
+	archiveUpdateInterval time.Duration
+	archiveFailRetryInterval time.Duration
+	archiveGroup string
+	archiveWatermarkFile string
 	// zk
 	zkHosts []string
 	zkSessionTimeout time.Duration
 	zkChroot string
-	zkUpdateInterval time.Duration
-	zkFailRetryInterval time.Duration
+	// namespace, "default" for the top level config
+	nsName string
+	// one derived config for each namespace
+	namespaces []*Config
 }
 
 func newConfig(confFile string) (*Config, error) {
+	c, err := loadConfig(confFile)
+	if err != nil {
+		return nil, err
+	}
+	c.dump()
+	return c, nil
+}
+
+// quietly, for tools reading the config of a server
+func loadConfig(confFile string) (*Config, error) {
     c := &Config {
 		confFile: confFile,
 	   }
@@ -112,6 +188,26 @@ func (c *Config) init() error {
 	if err != nil {
 		return err
 	}
+	err = c.initGrpcServerConfig()
+	if err != nil {
+		return err
+	}
+	err = c.initS3ServerConfig()
+	if err != nil {
+		return err
+	}
+	err = c.initImageConfig()
+	if err != nil {
+		return err
+	}
+	err = c.initEncryptionConfig()
+	if err != nil {
+		return err
+	}
+	err = c.initUrlSigningConfig()
+	if err != nil {
+		return err
+	}
 	err = c.initDeDupConfig()
 	if err != nil {
 		return err
@@ -128,11 +224,14 @@ func (c *Config) init() error {
 	if err != nil {
 		return err
 	}
-	err = c.initZK()
+	err = c.initArchiveConfig()
+	if err != nil {
+		return err
+	}
+	err = c.initNamespacesConfig()
 	if err != nil {
 		return err
 	}
-	c.dump()
 	return nil
 }
 
@@ -195,6 +294,284 @@ func (c *Config) initHttpServerConfig() error {
 		return errors.New("write_timeout_ms not found in conf file")
 	}
 	c.httpServerWriteTimeout = time.Duration(wtimeo.(int))*time.Millisecond
+	maxSize, ok := m["max_body_size"]
+	if !ok {
+		c.httpServerMaxBodySize = 10*1024*1024
+	} else {
+		c.httpServerMaxBodySize = int64(maxSize.(int))
+	}
+	if c.httpServerMaxBodySize <= 0 {
+		return errors.New("max_body_size should be > 0")
+	}
+	cc, ok := m["cache_control"]
+	if !ok {
+		c.httpServerCacheControl = "public, max-age=31536000, immutable"
+	} else {
+		c.httpServerCacheControl = cc.(string)
+	}
+	maxBatchSize, ok := m["max_batch_body_size"]
+	if !ok {
+		c.httpServerMaxBatchBodySize = 10*c.httpServerMaxBodySize
+	} else {
+		c.httpServerMaxBatchBodySize = int64(maxBatchSize.(int))
+	}
+	if c.httpServerMaxBatchBodySize <= 0 {
+		return errors.New("max_batch_body_size should be > 0")
+	}
+	maxItems, ok := m["max_batch_items"]
+	if !ok {
+		c.httpServerMaxBatchItems = 1000
+	} else {
+		c.httpServerMaxBatchItems = maxItems.(int)
+	}
+	if c.httpServerMaxBatchItems <= 0 {
+		return errors.New("max_batch_items should be > 0")
+	}
+	// admin endpoints are refused without it
+	token, ok := m["admin_token"]
+	if ok {
+		c.httpServerAdminToken = token.(string)
+	}
+	return nil
+}
+
+// the section is optional, no grpc server without it
+func (c *Config) initGrpcServerConfig() error {
+	mi, ok := c.confParsed["grpc_server"]
+	if !ok {
+		return nil
+	}
+    m, ok := mi.(map[interface{}]interface{})
+	if !ok {
+		return errors.New("grpc_server config is not map")
+	}
+	port, ok := m["port"]
+	if ok {
+		c.grpcServerListenPort = uint16(port.(int))
+	}
+	chunkSize, ok := m["chunk_size"]
+	if !ok {
+		c.grpcServerChunkSize = 64*1024
+	} else {
+		c.grpcServerChunkSize = chunkSize.(int)
+	}
+	if c.grpcServerChunkSize <= 0 {
+		return errors.New("grpc_server chunk_size should be > 0")
+	}
+	maxRecv, ok := m["max_recv_msg_size"]
+	if !ok {
+		c.grpcServerMaxRecvMsgSize = 4*1024*1024
+	} else {
+		c.grpcServerMaxRecvMsgSize = maxRecv.(int)
+	}
+	if c.grpcServerMaxRecvMsgSize <= 0 {
+		return errors.New("grpc_server max_recv_msg_size should be > 0")
+	}
+	return nil
+}
+
+// the section is optional, no s3 server without it
+func (c *Config) initS3ServerConfig() error {
+	mi, ok := c.confParsed["s3_server"]
+	if !ok {
+		return nil
+	}
+    m, ok := mi.(map[interface{}]interface{})
+	if !ok {
+		return errors.New("s3_server config is not map")
+	}
+	port, ok := m["port"]
+	if ok {
+		c.s3ServerListenPort = uint16(port.(int))
+	}
+	region, ok := m["region"]
+	if !ok {
+		c.s3Region = "us-east-1"
+	} else {
+		c.s3Region = region.(string)
+	}
+	c.s3Credentials = make(map[string]*s3Credential)
+	credsi, ok := m["credentials"]
+	if !ok {
+		if c.s3ServerListenPort != 0 {
+			return errors.New("s3_server credentials not found")
+		}
+		return nil
+	}
+	creds, ok := credsi.([]interface{})
+	if !ok {
+		return errors.New("s3_server credentials is not list")
+	}
+	for i, credi := range creds {
+		cm, ok := credi.(map[interface{}]interface{})
+		if !ok {
+			return errors.New(fmt.Sprintf("s3_server credentials[%d] is not map", i))
+		}
+		accessKey, ok := cm["access_key"]
+		if !ok {
+			return errors.New(fmt.Sprintf("s3_server credentials[%d] access_key not found", i))
+		}
+		secretKey, ok := cm["secret_key"]
+		if !ok {
+			return errors.New(fmt.Sprintf("s3_server credentials[%d] secret_key not found", i))
+		}
+        cred := &s3Credential {
+            accessKey: accessKey.(string),
+			secretKey: secretKey.(string),
+		}
+		readOnly, ok := cm["read_only"]
+		if ok {
+			cred.readOnly = readOnly.(bool)
+		}
+		if len(cred.accessKey) == 0 || len(cred.secretKey) == 0 {
+			return errors.New(fmt.Sprintf("s3_server credentials[%d] access_key and secret_key should not be empty", i))
+		}
+		if _, ok := c.s3Credentials[cred.accessKey]; ok {
+			return errors.New(fmt.Sprintf("s3_server access_key %s is duplicated", cred.accessKey))
+		}
+		c.s3Credentials[cred.accessKey] = cred
+	}
+	return nil
+}
+
+// the section is optional, /get refuses transforms without it
+func (c *Config) initImageConfig() error {
+	c.imagePresets = make(map[string]*imageSpec)
+	c.imageCacheSize = 64*1024*1024
+	c.imageMaxPixels = 25*1000*1000
+	c.imageMaxConcurrency = runtime.NumCPU()
+	mi, ok := c.confParsed["image"]
+	if !ok {
+		return nil
+	}
+    m, ok := mi.(map[interface{}]interface{})
+	if !ok {
+		return errors.New("image config is not map")
+	}
+	presetsi, ok := m["presets"]
+	if !ok {
+		return errors.New("image presets not found")
+	}
+	presets, ok := presetsi.(map[interface{}]interface{})
+	if !ok {
+		return errors.New("image presets is not map")
+	}
+	for namei, pi := range presets {
+		name := fmt.Sprint(namei)
+		pm, ok := pi.(map[interface{}]interface{})
+		if !ok {
+			return errors.New(fmt.Sprintf("image preset %s is not map", name))
+		}
+		var ints [3]int
+		for i, k := range []string{"w", "h", "q"} {
+			v, ok := pm[k]
+			if ok {
+				ints[i] = v.(int)
+			}
+		}
+		var fit, format string
+		if v, ok := pm["fit"]; ok {
+			fit = v.(string)
+		}
+		if v, ok := pm["fmt"]; ok {
+			format = v.(string)
+		}
+		spec, err := newImageSpec(ints[0], ints[1], fit, ints[2], format)
+		if err != nil {
+			return errors.New(fmt.Sprintf("image preset %s: %s", name, err.Error()))
+		}
+		c.imagePresets[name] = spec
+	}
+	cacheSize, ok := m["cache_size"]
+	if ok {
+		c.imageCacheSize = int64(cacheSize.(int))
+	}
+	if c.imageCacheSize < 0 {
+		return errors.New("image cache_size should be >= 0")
+	}
+	maxPixels, ok := m["max_pixels"]
+	if ok {
+		c.imageMaxPixels = maxPixels.(int)
+	}
+	if c.imageMaxPixels <= 0 {
+		return errors.New("image max_pixels should be > 0")
+	}
+	maxConcurrency, ok := m["max_concurrency"]
+	if ok {
+		c.imageMaxConcurrency = maxConcurrency.(int)
+	}
+	if c.imageMaxConcurrency <= 0 {
+		return errors.New("image max_concurrency should be > 0")
+	}
+	return nil
+}
+
+// the section is optional, nothing is encrypted without it. the keyring file
+// is kept even if encrypt is false, blobs encrypted before are still read.
+func (c *Config) initEncryptionConfig() error {
+	mi, ok := c.confParsed["encryption"]
+	if !ok {
+		return nil
+	}
+    m, ok := mi.(map[interface{}]interface{})
+	if !ok {
+		return errors.New("encryption config is not map")
+	}
+	file, ok := m["keyring_file"]
+	if !ok {
+		return errors.New("encryption keyring_file not found")
+	}
+	c.encryptionKeyringFile = file.(string)
+	encrypt, ok := m["encrypt"]
+	if ok {
+		c.encrypt = encrypt.(bool)
+	}
+	return nil
+}
+
+// the section is optional, /sign is off and no /get needs a signature
+// without it
+func (c *Config) initUrlSigningConfig() error {
+	c.signDefaultTTL = 300
+	c.signMaxTTL = 7*24*3600
+	mi, ok := c.confParsed["url_signing"]
+	if !ok {
+		return nil
+	}
+    m, ok := mi.(map[interface{}]interface{})
+	if !ok {
+		return errors.New("url_signing config is not map")
+	}
+	secret, ok := m["secret"]
+	if !ok {
+		return errors.New("url_signing secret not found")
+	}
+	c.signSecret = secret.(string)
+	if len(c.signSecret) < 16 {
+		return errors.New("url_signing secret should be at least 16 bytes")
+	}
+	required, ok := m["required"]
+	if ok {
+		c.signRequired = required.(bool)
+	}
+	defaultTTL, ok := m["default_ttl"]
+	if ok {
+		c.signDefaultTTL = int64(defaultTTL.(int))
+	}
+	maxTTL, ok := m["max_ttl"]
+	if ok {
+		c.signMaxTTL = int64(maxTTL.(int))
+	}
+	if c.signDefaultTTL <= 0 || c.signMaxTTL < c.signDefaultTTL {
+		return errors.New("url_signing default_ttl should be > 0 and <= max_ttl")
+	}
+	hops, ok := m["proxy_hops"]
+	if ok {
+		c.signProxyHops = hops.(int)
+	}
+	if c.signProxyHops < 0 {
+		return errors.New("url_signing proxy_hops should be >= 0")
+	}
 	return nil
 }
 
@@ -207,6 +584,22 @@ func (c *Config) initDeDupConfig() error {
 	if !ok {
 		return errors.New("dedup config is not map")
 	}
+	backend, ok := m["backend"]
+	if !ok {
+		c.ddBackend = "mongo"
+	} else {
+		c.ddBackend = backend.(string)
+	}
+	switch c.ddBackend {
+		case "mongo":
+			return c.initDeDupMgoConfig(m)
+		case "bolt":
+			return c.initDeDupBoltConfig(m)
+	}
+	return errors.New(fmt.Sprintf("dedup backend should be mongo or bolt, not %s", c.ddBackend))
+}
+
+func (c *Config) initDeDupMgoConfig(m map[interface{}]interface{}) error {
 	deduphosts, ok := m["dedup_hosts"]
 	if !ok {
 		return errors.New("dedup_hosts not found in conf file")
@@ -251,6 +644,20 @@ func (c *Config) initDeDupConfig() error {
 	return nil
 }
 
+func (c *Config) initDeDupBoltConfig(m map[interface{}]interface{}) error {
+	file, ok := m["bolt_file"]
+	if !ok {
+		return errors.New("dedup bolt_file not found in conf file")
+	}
+	c.ddBoltFile = file.(string)
+	timeo, ok := m["operation_timeout_ms"]
+	if !ok {
+		return errors.New("dedup operation_timeout_ms not found in conf file")
+	}
+	c.ddOperationTimeout = time.Duration(timeo.(int))*time.Millisecond
+	return nil
+}
+
 func (c *Config) initKeyManager() error {
 	mi, ok := c.confParsed["km"]
 	if !ok {
@@ -270,6 +677,24 @@ func (c *Config) initKeyManager() error {
 		return errors.New("km key_tag not found in conf file")
 	}
 	c.kmKeyTag = keyt.(string)
+	alloc, ok := m["id_allocator"]
+	if !ok {
+		c.kmIdAllocator = "redis"
+	} else {
+		c.kmIdAllocator = alloc.(string)
+	}
+	switch c.kmIdAllocator {
+		case "redis":
+			return c.initKeyManagerRedis(m)
+		case "lease":
+			return c.initKeyManagerLease(m)
+		case "snowflake":
+			return c.initKeyManagerSnowflake(m)
+	}
+	return errors.New(fmt.Sprintf("km id_allocator should be redis, lease or snowflake, not %s", c.kmIdAllocator))
+}
+
+func (c *Config) initKeyManagerRedis(m map[interface{}]interface{}) error {
 	oaddr, ok := m["odd_id_redis_addr"]
 	if !ok {
 		return errors.New("km odd_id_redis_addr not found in conf file")
@@ -313,6 +738,58 @@ func (c *Config) initKeyManager() error {
     return nil
 }
 
+func (c *Config) initKeyManagerLease(m map[interface{}]interface{}) error {
+	file, ok := m["lease_file"]
+	if !ok {
+		return errors.New("km lease_file not found in conf file")
+	}
+	c.kmLeaseFile = file.(string)
+	bsize, ok := m["lease_block_size"]
+	if !ok {
+		c.kmLeaseBlockSize = 1000
+	} else {
+		if bsize.(int) <= 0 {
+			return errors.New("km lease_block_size should be > 0")
+		}
+		c.kmLeaseBlockSize = uint64(bsize.(int))
+	}
+	minId, ok := m["lease_min_id"]
+	if ok {
+		if minId.(int) < 0 {
+			return errors.New("km lease_min_id should be >= 0")
+		}
+		c.kmLeaseMinId = uint64(minId.(int))
+		c.kmLeaseMinIdSet = true
+	}
+	node, ok := m["node_id"]
+	if !ok {
+		return errors.New("km node_id not found in conf file")
+	}
+	c.kmLeaseNode = int64(node.(int))
+	return nil
+}
+
+func (c *Config) initKeyManagerSnowflake(m map[interface{}]interface{}) error {
+	node, ok := m["node_id"]
+	if !ok {
+		return errors.New("km node_id not found in conf file")
+	}
+	c.kmSnowflakeNode = int64(node.(int))
+	file, ok := m["snowflake_file"]
+	if !ok {
+		return errors.New("km snowflake_file not found in conf file")
+	}
+	c.kmSnowflakeFile = file.(string)
+	epoch, ok := m["epoch_ms"]
+	if !ok {
+		// 2015-01-01 00:00:00 UTC
+		c.kmSnowflakeEpoch = 1420070400000
+	} else {
+		c.kmSnowflakeEpoch = int64(epoch.(int))
+	}
+	return nil
+}
+
 func (c *Config) initBrokerConfig() error {
 	mi, ok := c.confParsed["broker"]
 	if !ok {
@@ -322,16 +799,17 @@ func (c *Config) initBrokerConfig() error {
 	if !ok {
 		return errors.New("broker config is not map")
 	}
-	brokerhosts, ok := m["broker_hosts"]
+	log, ok := m["log"]
 	if !ok {
-		return errors.New("broker: broker_hosts not found in conf file")
+		c.brokerLog = "kafka"
+	} else {
+		c.brokerLog = log.(string)
 	}
-    brokerHosts := brokerhosts.([]interface{})
-	if len(brokerHosts) <= 0 {
-		return errors.New("broker: num of brokerHosts is zero")
-	}
-	for _, brokerhost := range brokerHosts {
-		c.brokerServerList = append(c.brokerServerList, brokerhost.(string))
+	topic, ok := m["topic"]
+	if !ok {
+		c.brokerTopic = gBrokerTopic
+	} else {
+		c.brokerTopic = topic.(string)
 	}
 	ep, ok := m ["write_disabled_partitions"]
 	if ok {
@@ -374,6 +852,70 @@ func (c *Config) initBrokerConfig() error {
 	        c.brokerWDisabledPartitions = append(c.brokerWDisabledPartitions, last)
 	    }
 	}
+	ms, ok := m["max_message_size"]
+	if !ok {
+		return errors.New("broker: max_message_size not found in conf file")
+	}
+	c.brokerMaxMessageSize = ms.(int)
+	// a manifest carries up to gMetaMaxSize of meta
+	if c.brokerMaxMessageSize < gMetaMaxSize + 2048 {
+		return errors.New(fmt.Sprintf("broker: max_message_size should be >= %d", gMetaMaxSize + 2048))
+	}
+	// room for the msgpack framing around a chunk
+	cs, ok := m["chunk_size"]
+	if !ok {
+		c.brokerChunkSize = c.brokerMaxMessageSize - 1024
+	} else {
+		c.brokerChunkSize = cs.(int)
+	}
+	if c.brokerChunkSize <= 0 || c.brokerChunkSize > c.brokerMaxMessageSize - 1024 {
+		return errors.New("broker: chunk_size should be > 0 and <= max_message_size - 1024")
+	}
+	compression, ok := m["compression"]
+	if !ok {
+		c.brokerCompression = gCodecNone
+	} else {
+		c.brokerCompression = compression.(string)
+	}
+	err := checkCodec(c.brokerCompression)
+	if err != nil {
+		return errors.New(fmt.Sprintf("broker: %s", err.Error()))
+	}
+	minSize, ok := m["compression_min_size"]
+	if !ok {
+		c.brokerCompressionMinSize = 1024
+	} else {
+		c.brokerCompressionMinSize = minSize.(int)
+	}
+	//reqPoolSize, ok := m["req_pool_size"]
+	//if !ok {
+	//	c.cmDataPoolSize = 10240
+	//	c.producerMsgPoolSize = 10240
+	//} else {
+	//	c.cmDataPoolSize = reqPoolSize.(int)
+	//	c.producerMsgPoolSize = reqPoolSize.(int)
+	//}
+	switch c.brokerLog {
+		case "kafka":
+			return c.initBrokerKafkaConfig(m)
+		case "segment":
+			return c.initBrokerSegmentConfig(m)
+	}
+	return errors.New(fmt.Sprintf("broker: log should be kafka or segment, not %s", c.brokerLog))
+}
+
+func (c *Config) initBrokerKafkaConfig(m map[interface{}]interface{}) error {
+	brokerhosts, ok := m["broker_hosts"]
+	if !ok {
+		return errors.New("broker: broker_hosts not found in conf file")
+	}
+    brokerHosts := brokerhosts.([]interface{})
+	if len(brokerHosts) <= 0 {
+		return errors.New("broker: num of brokerHosts is zero")
+	}
+	for _, brokerhost := range brokerHosts {
+		c.brokerServerList = append(c.brokerServerList, brokerhost.(string))
+	}
 	ctimeo, ok := m["conn_timeout_ms"]
 	if !ok {
 		return errors.New("broker: conn_timeout_ms not found in conf file")
@@ -389,24 +931,45 @@ func (c *Config) initBrokerConfig() error {
 		return errors.New("broker: write_timeout_ms not found in conf file")
 	}
 	c.brokerWriteTimeout = time.Duration(wtimeo.(int))*time.Millisecond
-	ms, ok := m["max_message_size"]
-	if !ok {
-		return errors.New("broker: max_message_size not found in conf file")
-	}
-	c.brokerMaxMessageSize = ms.(int)
 	mrtime, ok := m["metadata_refresh_interval_ms"]
 	if !ok {
 		return errors.New("broker: metadata_refresh_interval_ms not found in conf file")
 	}
 	c.brokerMetadataRefreshInterval = time.Duration(mrtime.(int))*time.Millisecond
-	//reqPoolSize, ok := m["req_pool_size"]
-	//if !ok {
-	//	c.cmDataPoolSize = 10240
-	//	c.producerMsgPoolSize = 10240
-	//} else {
-	//	c.cmDataPoolSize = reqPoolSize.(int)
-	//	c.producerMsgPoolSize = reqPoolSize.(int)
-	//}
+	return nil
+}
+
+func (c *Config) initBrokerSegmentConfig(m map[interface{}]interface{}) error {
+	dir, ok := m["segment_dir"]
+	if !ok {
+		return errors.New("broker: segment_dir not found in conf file")
+	}
+	c.brokerSegmentDir = dir.(string)
+	num, ok := m["segment_partitions"]
+	if !ok {
+		c.brokerSegmentPartitions = 8
+	} else {
+		c.brokerSegmentPartitions = num.(int)
+	}
+	maxSize, ok := m["segment_max_size_mb"]
+	if !ok {
+		c.brokerSegmentMaxSize = 1024*1024*1024
+	} else {
+		c.brokerSegmentMaxSize = int64(maxSize.(int))*1024*1024
+	}
+	if c.brokerSegmentMaxSize <= 0 {
+		return errors.New("broker: segment_max_size_mb should be > 0")
+	}
+	// nothing archives the segment log yet, a dropped segment would take its
+	// blobs with it while their keys still point at it
+	retention, ok := m["segment_retention_hours"]
+	if ok && retention.(int) > 0 {
+		return errors.New("broker: segment_retention_hours is not supported, segments are kept until they are archived and nothing archives them yet")
+	}
+	sync, ok := m["segment_sync"]
+	if ok {
+		c.brokerSegmentSync = sync.(bool)
+	}
 	return nil
 }
 
@@ -419,6 +982,48 @@ func (c *Config) initStoreConfig() error {
 	if !ok {
 		return errors.New("store config is not map")
 	}
+	backend, ok := m["backend"]
+	if !ok {
+		c.storeBackend = "mongo"
+	} else {
+		c.storeBackend = backend.(string)
+	}
+	err := c.initStoreSweepConfig(m)
+	if err != nil {
+		return err
+	}
+	switch c.storeBackend {
+		case "mongo":
+			return c.initStoreMgoConfig(m)
+		case "pack":
+			return c.initStorePackConfig(m)
+	}
+	return errors.New(fmt.Sprintf("store backend should be mongo or pack, not %s", c.storeBackend))
+}
+
+func (c *Config) initStoreSweepConfig(m map[interface{}]interface{}) error {
+	interval, ok := m["sweep_interval_ms"]
+	if !ok {
+		c.storeSweepInterval = 10*time.Minute
+	} else {
+		c.storeSweepInterval = time.Duration(interval.(int))*time.Millisecond
+	}
+	if c.storeSweepInterval < 0 {
+		return errors.New("store sweep_interval_ms should be >= 0")
+	}
+	batch, ok := m["sweep_batch"]
+	if !ok {
+		c.storeSweepBatch = 1000
+	} else {
+		c.storeSweepBatch = batch.(int)
+	}
+	if c.storeSweepBatch <= 0 {
+		return errors.New("store sweep_batch should be > 0")
+	}
+	return nil
+}
+
+func (c *Config) initStoreMgoConfig(m map[interface{}]interface{}) error {
 	storehosts, ok := m["store_hosts"]
 	if !ok {
 		return errors.New("store_hosts not found in conf file")
@@ -468,6 +1073,94 @@ func (c *Config) initStoreConfig() error {
 	return nil
 }
 
+func (c *Config) initStorePackConfig(m map[interface{}]interface{}) error {
+	dir, ok := m["pack_dir"]
+	if !ok {
+		return errors.New("store pack_dir not found in conf file")
+	}
+	c.storePackDir = dir.(string)
+	maxSize, ok := m["pack_max_size_mb"]
+	if !ok {
+		c.storePackMaxSize = 1024*1024*1024
+	} else {
+		c.storePackMaxSize = int64(maxSize.(int))*1024*1024
+	}
+	if c.storePackMaxSize <= 0 {
+		return errors.New("store pack_max_size_mb should be > 0")
+	}
+	sync, ok := m["pack_sync"]
+	if ok {
+		c.storePackSync = sync.(bool)
+	}
+	c.storePackCompactRatio = 50
+	ratio, ok := m["pack_compact_ratio"]
+	if ok {
+		c.storePackCompactRatio = ratio.(int)
+	}
+	if c.storePackCompactRatio < 0 || c.storePackCompactRatio > 100 {
+		return errors.New("store pack_compact_ratio should be in [0, 100]")
+	}
+	return nil
+}
+
+func (c *Config) initArchiveConfig() error {
+	c.archiveSource = "zk"
+	c.archiveUpdateInterval = 60*time.Second
+	c.archiveFailRetryInterval = time.Second
+	var m map[interface{}]interface{}
+	mi, ok := c.confParsed["archive"]
+	if ok {
+		m, ok = mi.(map[interface{}]interface{})
+		if !ok {
+			return errors.New("archive config is not map")
+		}
+		source, ok := m["source"]
+		if ok {
+			c.archiveSource = source.(string)
+		}
+	}
+	switch c.archiveSource {
+		case "zk":
+			err := c.initZK()
+			if err != nil {
+				return err
+			}
+		case "kafka_group":
+			if c.brokerLog != "kafka" {
+				return errors.New("archive: kafka_group source needs broker log kafka")
+			}
+			group, ok := m["group"]
+			if !ok {
+				return errors.New("archive: group not found in conf file")
+			}
+			c.archiveGroup = group.(string)
+		case "store_watermark":
+			// kept by the node /store is called on, as the segment log is
+			if c.brokerLog != "segment" {
+				return errors.New("archive: store_watermark source needs broker log segment, use zk or kafka_group with kafka")
+			}
+			file, ok := m["watermark_file"]
+			if !ok {
+				return errors.New("archive: watermark_file not found in conf file")
+			}
+			c.archiveWatermarkFile = file.(string)
+		default:
+			return errors.New(fmt.Sprintf("archive: source should be zk, kafka_group or store_watermark, not %s", c.archiveSource))
+	}
+	if m == nil {
+		return nil
+	}
+	timeo, ok := m["update_interval_ms"]
+	if ok {
+		c.archiveUpdateInterval = time.Duration(timeo.(int))*time.Millisecond
+	}
+	timeo, ok = m["fail_retry_interval_ms"]
+	if ok {
+		c.archiveFailRetryInterval = time.Duration(timeo.(int))*time.Millisecond
+	}
+	return nil
+}
+
 func (c *Config) initZK() error {
 	mi, ok := c.confParsed["zk"]
 	if !ok {
@@ -501,19 +1194,120 @@ func (c *Config) initZK() error {
 		return errors.New("zk: zk_chroot not found in conf file")
 	}
 	c.zkChroot = chroot.(string)
+	// used to be here before the archive section
 	stimeo, ok = m["update_interval_ms"]
-	if !ok {
-		return errors.New("zk: update_interval_ms not found in conf file")
+	if ok {
+		c.archiveUpdateInterval = time.Duration(stimeo.(int))*time.Millisecond
 	}
-	c.zkUpdateInterval = time.Duration(stimeo.(int))*time.Millisecond
 	stimeo, ok = m["fail_retry_interval_ms"]
+	if ok {
+		c.archiveFailRetryInterval = time.Duration(stimeo.(int))*time.Millisecond
+	}
+	return nil
+}
+
+// the top level config is namespace "default", each entry of namespaces is a
+// copy of it with its own key tag, fcrypt key, topic, dedup and store. what is
+// not given is derived from the default one and the namespace name.
+func (c *Config) initNamespacesConfig() error {
+	c.nsName = gDefaultNamespace
+	c.namespaces = []*Config{c}
+	mi, ok := c.confParsed["namespaces"]
 	if !ok {
-		return errors.New("zk: fail_retry_interval_ms not found in conf file")
+		return nil
+	}
+    m, ok := mi.(map[interface{}]interface{})
+	if !ok {
+		return errors.New("namespaces config is not map")
+	}
+	var names []string
+	for namei := range m {
+		name, ok := namei.(string)
+		if !ok || len(name) == 0 || name == gDefaultNamespace {
+			return errors.New(fmt.Sprintf("invalid namespace name: %v", namei))
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		nm, ok := m[name].(map[interface{}]interface{})
+		if !ok {
+			return errors.New(fmt.Sprintf("namespace %s config is not map", name))
+		}
+		nc, err := c.deriveNamespace(name, nm)
+		if err != nil {
+			return errors.New(fmt.Sprintf("namespace %s: %s", name, err.Error()))
+		}
+		c.namespaces = append(c.namespaces, nc)
+	}
+	// a key is routed by its tag, no tag may start another
+	for _, a := range c.namespaces {
+		for _, b := range c.namespaces {
+			if a != b && strings.HasPrefix(a.kmKeyTag, b.kmKeyTag) {
+				return errors.New(fmt.Sprintf("key_tag of namespace %s starts with key_tag of %s", a.nsName, b.nsName))
+			}
+			if a != b && a.brokerTopic == b.brokerTopic {
+				return errors.New(fmt.Sprintf("namespaces %s and %s share topic %s", a.nsName, b.nsName, a.brokerTopic))
+			}
+		}
 	}
-	c.zkFailRetryInterval = time.Duration(stimeo.(int))*time.Millisecond
 	return nil
 }
 
+func (c *Config) deriveNamespace(name string, m map[interface{}]interface{}) (*Config, error) {
+	nc := *c
+	nc.nsName = name
+	nc.namespaces = nil
+	tag, ok := m["key_tag"]
+	if !ok {
+		return nil, errors.New("key_tag not found in conf file")
+	}
+	nc.kmKeyTag = tag.(string)
+	if len(nc.kmKeyTag) == 0 {
+		return nil, errors.New("key_tag should not be empty")
+	}
+	fkey, ok := m["fcrypt_key"]
+	if !ok {
+		return nil, errors.New("fcrypt_key not found in conf file")
+	}
+	nc.kmFCryptKey = fkey.(string)
+	nc.brokerTopic = nsString(m, "topic", c.brokerTopic + "_" + name)
+	nc.ddCollName = nsString(m, "dedup_collection", c.ddCollName + "_" + name)
+	nc.ddBoltFile = nsString(m, "dedup_bolt_file", c.ddBoltFile + "." + name)
+	nc.brokerCompression = nsString(m, "compression", c.brokerCompression)
+	err := checkCodec(nc.brokerCompression)
+	if err != nil {
+		return nil, err
+	}
+	encrypt, ok := m["encrypt"]
+	if ok {
+		nc.encrypt = encrypt.(bool)
+	}
+	if nc.encrypt && len(nc.encryptionKeyringFile) == 0 {
+		return nil, errors.New("encrypt needs encryption.keyring_file")
+	}
+	signed, ok := m["signed_get"]
+	if ok {
+		nc.signRequired = signed.(bool)
+	}
+	if nc.signRequired && len(nc.signSecret) == 0 {
+		return nil, errors.New("signed_get needs url_signing.secret")
+	}
+	nc.storeCollName = nsString(m, "store_collection", c.storeCollName + "_" + name)
+	nc.storePackDir = nsString(m, "store_pack_dir", filepath.Join(c.storePackDir, name))
+	nc.archiveGroup = nsString(m, "archive_group", c.archiveGroup)
+	nc.archiveWatermarkFile = nsString(m, "watermark_file", c.archiveWatermarkFile + "." + name)
+	return &nc, nil
+}
+
+func nsString(m map[interface{}]interface{}, key string, def string) string {
+	v, ok := m[key]
+	if !ok {
+		return def
+	}
+	return v.(string)
+}
+
 func (c *Config) dump() {
 	fmt.Println("confFile:", c.confFile)
 	fmt.Println("logDir:", c.logDir)
@@ -521,6 +1315,15 @@ func (c *Config) dump() {
 	fmt.Println("httpServerListenPort:", c.httpServerListenPort)
 	fmt.Println("httpServerReadTimeout:", c.httpServerReadTimeout)
 	fmt.Println("httpServerWriteTimeout:", c.httpServerWriteTimeout)
+	fmt.Println("httpServerMaxBodySize:", c.httpServerMaxBodySize)
+	fmt.Println("httpServerMaxBatchBodySize:", c.httpServerMaxBatchBodySize)
+	fmt.Println("httpServerMaxBatchItems:", c.httpServerMaxBatchItems)
+	fmt.Println("grpcServerListenPort:", c.grpcServerListenPort)
+	fmt.Println("imagePresets:", len(c.imagePresets), "imageCacheSize:", c.imageCacheSize)
+	fmt.Println("s3ServerListenPort:", c.s3ServerListenPort, "s3Region:", c.s3Region, "s3Credentials:", len(c.s3Credentials))
+	for _, nc := range c.namespaces {
+		fmt.Println("namespace:", nc.nsName, "keyTag:", nc.kmKeyTag, "topic:", nc.brokerTopic, "compression:", nc.brokerCompression, "encrypt:", nc.encrypt, "signedGet:", nc.signRequired)
+	}
 }
 
 
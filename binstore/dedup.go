@@ -24,24 +24,42 @@
 package binstore
 
 import (
-		"gopkg.in/mgo.v2"
-		"gopkg.in/mgo.v2/bson"
-		"strings"
+		"errors"
+		"fmt"
 	   )
 
+// checksums of one blob, identical blobs share one key
+type dataSum struct {
+	fnv1a32 uint32
+	md5a uint64
+	md5b uint64
+}
+
+// DeDupIndex maps the checksums of a blob to the key it was first added as.
+// Get returns "" if the blob was never seen, GetMany does the same for many sums
+// in one round trip. Delete drops every sum and name mapped to key.
+// it also keeps the object names of s3 PutObject: PutName points name at key,
+// replacing what it pointed at, GetName returns "" for unknown names.
+// implementations must be concurrent safe.
+type DeDupIndex interface {
+	Get(sum *dataSum) (string, error)
+	GetMany(sums []*dataSum) ([]string, error)
+	Put(sum *dataSum, key string) error
+	Delete(key string) error
+	GetName(name string) (string, error)
+	PutName(name string, key string) error
+	DeleteName(name string) error
+}
+
 // concurrent safe
 type DeDup struct {
 	config *Config
-	dialSession *mgo.Session
+	index DeDupIndex
 }
 
-type DeDupResponse struct {
-	Key string "key"
-}
-
-func newDeDup(bs *BinStore) (*DeDup, error) {
+func newDeDup(config *Config) (*DeDup, error) {
     dd := &DeDup{
-        config: bs.config,
+        config: config,
 	}
 	err := dd.init()
 	if err != nil {
@@ -51,49 +69,89 @@ func newDeDup(bs *BinStore) (*DeDup, error) {
 }
 
 func (dd *DeDup) init() error {
-    err := dd.initSession()
+    err := dd.initIndex()
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (dd *DeDup) initSession() error {
-    servers := strings.Join(dd.config.ddServerList, ",")
-    url := "mongodb://" + servers
-    s, err := mgo.DialWithTimeout(url, dd.config.ddConnTimeout)
+func (dd *DeDup) initIndex() error {
+	var err error
+	switch dd.config.ddBackend {
+		case "mongo":
+			dd.index, err = newMgoDeDupIndex(dd.config)
+		case "bolt":
+			dd.index, err = newBoltDeDupIndex(dd.config)
+		default:
+			err = errors.New(fmt.Sprintf("unknown dedup backend: %s", dd.config.ddBackend))
+	}
+	return err
+}
+
+// blobs that expire are kept out of the index both ways: they must not be
+// given a key that outlives them, and a blob added to stay must not be given
+// a key that is about to go.
+func (dd *DeDup) checkDup(ad *AddData) error {
+	ad.Key = ""
+	if ad.meta.Expire > 0 {
+		return nil
+	}
+	key, err := dd.index.Get(&ad.dataSum)
 	if err != nil {
 		return err
 	}
-	s.SetSyncTimeout(dd.config.ddOperationTimeout)
-	s.SetSocketTimeout(dd.config.ddSocketTimeout)
-	s.SetSafe(&mgo.Safe{W: 1})
-	s.SetMode(mgo.Strong, false)
-	s.SetPoolLimit(dd.config.ddMgoPoolSize)
-	dd.dialSession = s
+	ad.Key = key
 	return nil
 }
 
-func (dd *DeDup) checkDup(ad *AddData) error {
-	var rsp DeDupResponse
-    dds := dd.dialSession.Copy()
-	defer dds.Close()
-	c := dds.DB(dd.config.ddDbName).C(dd.config.ddCollName)
-	err := c.Find(bson.M{"fnv1a": ad.fnv1a32, "md5a": ad.md5a, "md5b": ad.md5b}).Select(bson.M{"key": 1, "_id": 0}).One(&rsp)
-	if err == mgo.ErrNotFound {
+func (dd *DeDup) checkDupMany(ads []*AddData) error {
+	var sums []*dataSum
+	var checked []*AddData
+	for _, ad := range ads {
 		ad.Key = ""
+		if ad.meta.Expire > 0 {
+			continue
+		}
+		sums = append(sums, &ad.dataSum)
+		checked = append(checked, ad)
+	}
+	if len(sums) == 0 {
 		return nil
 	}
+	keys, err := dd.index.GetMany(sums)
 	if err != nil {
 		return err
 	}
-	ad.Key = rsp.Key
+	for i, ad := range checked {
+		ad.Key = keys[i]
+	}
 	return nil
 }
 
 func (dd *DeDup) insertNew(ad *AddData) error {
-    dds := dd.dialSession.Copy()
-	defer dds.Close()
-	c := dds.DB(dd.config.ddDbName).C(dd.config.ddCollName)
-	return c.Insert(bson.M{"fnv1a": ad.fnv1a32, "md5a": ad.md5a, "md5b": ad.md5b, "key": ad.Key})
+	if ad.meta.Expire > 0 {
+		return nil
+	}
+	return dd.index.Put(&ad.dataSum, ad.Key)
+}
+
+// the same content added again gets a new key
+func (dd *DeDup) deleteKey(key string) error {
+	return dd.index.Delete(key)
+}
+
+// names are kept for expiring blobs too, a name of a gone blob reads as
+// missing like its key does
+func (dd *DeDup) nameKey(name string) (string, error) {
+	return dd.index.GetName(name)
+}
+
+func (dd *DeDup) setName(name string, key string) error {
+	return dd.index.PutName(name, key)
+}
+
+// the blob stays, other names or clients of /add may share it
+func (dd *DeDup) deleteName(name string) error {
+	return dd.index.DeleteName(name)
 }
@@ -0,0 +1,98 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/dzch/go-utils/logger"
+		"crypto/subtle"
+		"net/http"
+		"time"
+	   )
+
+var (
+		gAdminTokenHeader = "X-Binstore-Token"
+	)
+
+type DeleteHandler struct {
+	bs *BinStore
+}
+
+func newDeleteHandler(bs *BinStore) *DeleteHandler {
+	return &DeleteHandler {bs: bs}
+}
+
+// the tombstone goes first, /get answers 410 from then on wherever the data is.
+// the dedup entry is dropped so the same content added again gets a new key.
+func (h *DeleteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    startTime := time.Now()
+	bs := h.bs
+	if r.Method != "POST" && r.Method != "DELETE" {
+		w.Header().Set("Allow", "POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "need POST or DELETE")
+		return
+	}
+	if !checkAdminToken(bs.config, r) {
+		logger.Warning("invalid query, not authorized: %s, %s", r.URL.String(), r.RemoteAddr)
+		writeError(w, http.StatusForbidden, errCodeForbidden, "bad or no admin token")
+		return
+	}
+	id, ae := bs.deleteKey(r.URL.Query().Get("key"))
+	if ae != nil {
+		logger.Warning("fail to delete: %s, %s", r.URL.String(), ae.Error())
+		writeApiError(w, ae)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+    endTime := time.Now()
+	costTimeUS := endTime.Sub(startTime)/time.Microsecond
+	logger.Notice("success process delete: %s, cost_us=%d, id=%d, remote=%s", r.URL.String(), costTimeUS, id, r.RemoteAddr)
+	return
+}
+
+// shared by /delete and the s3 DeleteObject
+func (bs *BinStore) deleteKey(key string) (uint64, *apiError) {
+	ns, id, _, _, err := bs.parseKey(key)
+	if err != nil {
+		return 0, newApiError(http.StatusBadRequest, errCodeInvalidKey, err.Error())
+	}
+	err = ns.store.deleteData(id)
+	if err != nil {
+		logger.Warning("fail to deleteData: key=%s, %s", key, err.Error())
+		return 0, newApiError(http.StatusServiceUnavailable, errCodeStoreUnavailable, "fail to delete from store")
+	}
+	err = ns.dd.deleteKey(key)
+	if err != nil {
+		logger.Warning("fail to dd.deleteKey: key=%s, %s", key, err.Error())
+		return 0, newApiError(http.StatusServiceUnavailable, errCodeDedupUnavailable, "fail to delete from dedup")
+	}
+	return id, nil
+}
+
+func checkAdminToken(config *Config, r *http.Request) bool {
+	if len(config.httpServerAdminToken) == 0 {
+		return false
+	}
+	token := r.Header.Get(gAdminTokenHeader)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(config.httpServerAdminToken)) == 1
+}
@@ -0,0 +1,97 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"net/http"
+		"net/http/httptest"
+		"testing"
+	   )
+
+func deleteTest(bs *BinStore, method string, key string, token string) int {
+	r := httptest.NewRequest(method, "/delete?key=" + key, nil)
+	if len(token) > 0 {
+		r.Header.Set(gAdminTokenHeader, token)
+	}
+	w := httptest.NewRecorder()
+	bs.server.Handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestDeleteHandler(t *testing.T) {
+	bs := newTestBinStore(t)
+	srv := httptest.NewServer(bs.server.Handler)
+	defer srv.Close()
+	inStore := addTestBlob(t, bs, "in store", "text/plain")
+	archiveKey(t, bs, srv.URL, inStore)
+	inBroker := addTestBlob(t, bs, "in broker", "text/plain")
+	cases := []struct {
+		method string
+		token string
+		code int
+	}{
+		{"GET", "secret", http.StatusMethodNotAllowed},
+		{"POST", "", http.StatusForbidden},
+		{"POST", "wrong", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		code := deleteTest(bs, c.method, inBroker, c.token)
+		if code != c.code {
+			t.Fatalf("%s %q: %d, want %d", c.method, c.token, code, c.code)
+		}
+	}
+	if code := deleteTest(bs, "POST", "ff5837garbage", "secret"); code != http.StatusBadRequest {
+		t.Fatalf("invalid key: %d", code)
+	}
+	for _, key := range []string{inStore, inBroker} {
+		if code := deleteTest(bs, "DELETE", key, "secret"); code != http.StatusOK {
+			t.Fatalf("delete: %d", code)
+		}
+		// the tombstone is honored wherever the data is
+		if w := getTestBlob(bs, "GET", key, nil); w.Code != http.StatusGone {
+			t.Fatalf("get: %d", w.Code)
+		}
+		if w := serveTest(bs, "GET", "/stat?key=" + key, nil, 0); w.Code != http.StatusGone {
+			t.Fatalf("stat: %d", w.Code)
+		}
+		checkFrame(t, mgetTest(t, bs, []string{key})[0], http.StatusGone, "")
+		// deleting again is fine
+		if code := deleteTest(bs, "POST", key, "secret"); code != http.StatusOK {
+			t.Fatalf("delete again: %d", code)
+		}
+	}
+	// the dedup entry went with it, the same content gets a new key
+	again := addTestBlob(t, bs, "in broker", "text/plain")
+	if again == inBroker {
+		t.Fatal("deleted key handed out again")
+	}
+	if w := getTestBlob(bs, "GET", again, nil); w.Code != http.StatusOK {
+		t.Fatalf("added again: %d", w.Code)
+	}
+	// with no admin_token configured nothing can be deleted
+	bs.config.httpServerAdminToken = ""
+	if code := deleteTest(bs, "POST", again, ""); code != http.StatusForbidden {
+		t.Fatalf("no admin_token: %d", code)
+	}
+}
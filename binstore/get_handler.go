@@ -25,9 +25,14 @@ package binstore
 
 import (
 		"github.com/dzch/go-utils/logger"
-		"errors"
+		"fmt"
 		"net/http"
 		"time"
+		"bytes"
+		"strings"
+		"strconv"
+		"net/url"
+		"encoding/hex"
 	   )
 
 type GetHandler struct {
@@ -41,43 +46,222 @@ func newGetHandler(bs *BinStore) *GetHandler {
 	return gh
 }
 
+// GET or HEAD, HEAD sends the same headers with no body. images are
+// transformed first when asked, see image_transform.go
 func (h *GetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     startTime := time.Now()
     qv := r.URL.Query()
-	id, partition, offset, err := h.bs.km.parseKey(qv.Get("key"))
-	if err != nil {
-		logger.Warning("fail to parseKey: %s, %s", r.URL.String(), err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	key := qv.Get("key")
+	signedExpires := int64(0)
+	ns, err := h.bs.namespaceOfKey(key)
+	if err == nil && ns.config.signRequired {
+		var ae *apiError
+		signedExpires, ae = checkSignedGet(h.bs.config, r, key, time.Now())
+		if ae != nil {
+			logger.Warning("invalid query, not signed: %s, %s, %s", r.URL.String(), r.RemoteAddr, ae.Error())
+			writeApiError(w, ae)
+			return
+		}
 	}
-	val, err := h.getData(id, partition, offset)
-	if err != nil {
-		logger.Warning("fail to getData: %s, %s", r.URL.String(), err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	var val []byte
+	var meta *ObjectMeta
+	var etag string
+	var ae *apiError
+	if isImageQuery(qv) {
+		val, meta, etag, ae = h.getImage(key, qv)
+	} else {
+		val, meta, etag, ae = h.getBlob(w, r, key)
 	}
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write(val)
-	if err != nil {
-		logger.Warning("fail to write response: %s, %s", r.URL.String(), err.Error())
-	    w.WriteHeader(http.StatusInternalServerError)
+	if ae != nil {
+		logger.Warning("fail to get: %s, %s", r.URL.String(), ae.Error())
+		writeApiError(w, ae)
 		return
 	}
+	if signedExpires > 0 {
+		// the link stops working, so must any copy of it
+		if meta != nil && meta.Expire > 0 && meta.Expire < signedExpires {
+			signedExpires = meta.Expire
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", signedExpires - time.Now().Unix()))
+	}
+	h.serveData(w, r, val, meta, etag)
     endTime := time.Now()
 	costTimeUS := endTime.Sub(startTime)/time.Microsecond
-	logger.Notice("success process get: %s, cost_us=%d, datalen=%d", r.URL.String(), costTimeUS, len(val))
+	logger.Notice("success process get: %s, method=%s, cost_us=%d, datalen=%d", r.URL.String(), r.Method, costTimeUS, len(val))
 	return
 }
 
-func (h *GetHandler) getData(id uint64, partition int32, offset int64) ([]byte, error) {
-	inBroker, err := h.bs.zk.dataInBroker(partition, offset)
+// the blob as kept, compressed if the client takes the encoding
+func (h *GetHandler) getBlob(w http.ResponseWriter, r *http.Request, key string) ([]byte, *ObjectMeta, string, *apiError) {
+	val, meta, ae := h.bs.getStoredByKey(key)
+	if ae != nil {
+		return nil, nil, "", ae
+	}
+	if meta == nil || len(meta.Encoding) == 0 {
+		return val, meta, blobETag(key, meta, ""), nil
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	// with no type, ServeContent would sniff the compressed bytes
+	if len(meta.ContentType) > 0 && acceptsEncoding(r, meta.Encoding) {
+		return val, meta, blobETag(key, meta, meta.Encoding), nil
+	}
+	val, meta, ae = decodeStored(val, meta)
+	if ae != nil {
+		return nil, nil, "", ae
+	}
+	return val, meta, blobETag(key, meta, ""), nil
+}
+
+// a cached image is answered once the tombstone is checked, the blob is only
+// fetched, decrypted and decompressed on a miss
+func (h *GetHandler) getImage(key string, qv url.Values) ([]byte, *ObjectMeta, string, *apiError) {
+	it := h.bs.imgt
+	spec, err := it.specOf(qv)
 	if err != nil {
-		return nil, err
+		return nil, nil, "", newApiError(http.StatusBadRequest, errCodeInvalidRequest, err.Error())
 	}
-	if inBroker {
-		return h.bs.broker.getData(partition, offset)
-	} else {
-		return h.bs.store.getData(id)
+	ae := h.bs.checkNotDeleted(key)
+	if ae != nil {
+		return nil, nil, "", ae
+	}
+	out, tmeta, etag, ok := it.cached(key, spec)
+	if ok {
+		if tmeta.expired(time.Now()) {
+			status, code := dataErrorStatus(ErrBlobExpired, false)
+			return nil, nil, "", newApiError(status, code, ErrBlobExpired.Error())
+		}
+		return out, tmeta, etag, nil
+	}
+	val, meta, ae := h.bs.getByKey(key)
+	if ae != nil {
+		return nil, nil, "", ae
+	}
+	return it.transform(key, spec, val, meta)
+}
+
+// a tombstone is looked up alone, without fetching the blob
+func (bs *BinStore) checkNotDeleted(key string) *apiError {
+	ns, id, _, _, err := bs.parseKey(key)
+	if err != nil {
+		return newApiError(http.StatusBadRequest, errCodeInvalidKey, err.Error())
+	}
+	deleted, err := ns.store.isDeleted(id)
+	if err == nil && deleted {
+		err = ErrBlobDeleted
+	}
+	if err != nil {
+		status, code := dataErrorStatus(err, false)
+		return newApiError(status, code, err.Error())
+	}
+	return nil
+}
+
+// blobs never change once keyed, so the md5 kept in meta is a strong etag, the
+// key is for blobs added before it was kept. variant tells apart the encoded
+// or transformed forms of one blob.
+func blobETag(key string, meta *ObjectMeta, variant string) string {
+	tag := key
+	if meta != nil && len(meta.Md5) > 0 {
+		tag = hex.EncodeToString(meta.Md5)
+	}
+	if len(variant) > 0 {
+		tag += "-" + variant
+	}
+	return "\"" + tag + "\""
+}
+
+// the blob of key as /get and grpc Get answer it, an expired one is refused
+func (bs *BinStore) getByKey(key string) ([]byte, *ObjectMeta, *apiError) {
+	val, meta, ae := bs.getStoredByKey(key)
+	if ae != nil {
+		return nil, nil, ae
+	}
+	return decodeStored(val, meta)
+}
+
+// as getByKey, but the data is left compressed if it was kept so
+func (bs *BinStore) getStoredByKey(key string) ([]byte, *ObjectMeta, *apiError) {
+	ns, id, partition, offset, err := bs.parseKey(key)
+	if err != nil {
+		return nil, nil, newApiError(http.StatusBadRequest, errCodeInvalidKey, err.Error())
+	}
+	val, meta, inBroker, err := ns.getData(id, partition, offset)
+	if err == nil && meta != nil && meta.expired(time.Now()) {
+		err = ErrBlobExpired
+	}
+	if err != nil {
+		status, code := dataErrorStatus(err, inBroker)
+		if status == http.StatusServiceUnavailable {
+			logger.Warning("fail to getData: key=%s, %s", key, err.Error())
+		}
+		return nil, nil, newApiError(status, code, err.Error())
+	}
+	return val, meta, nil
+}
+
+func decodeStored(val []byte, meta *ObjectMeta) ([]byte, *ObjectMeta, *apiError) {
+	val, meta, err := decodeBlob(val, meta)
+	if err != nil {
+		logger.Warning("fail to decodeBlob: %s", err.Error())
+		return nil, nil, newApiError(http.StatusInternalServerError, errCodeInternal, err.Error())
+	}
+	return val, meta, nil
+}
+
+// whether Accept-Encoding of r allows encoding, q=0 refuses it
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, v := range r.Header["Accept-Encoding"] {
+		for _, part := range strings.Split(v, ",") {
+			fields := strings.Split(part, ";")
+			name := strings.ToLower(strings.TrimSpace(fields[0]))
+			if name != encoding && name != "*" {
+				continue
+			}
+			for _, f := range fields[1:] {
+				f = strings.TrimSpace(f)
+				if strings.HasPrefix(f, "q=") {
+					q, err := strconv.ParseFloat(f[len("q="):], 64)
+					return err == nil && q > 0
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// any cached copy is still fresh, blobs never change once keyed.
+// ServeContent answers Range (206, multipart/byteranges), If-None-Match,
+// If-Range and HEAD. meta is nil for blobs added before meta was kept, those
+// have no Last-Modified and get their type sniffed. only raster images are
+// sent inline, browsers are told not to sniff.
+func (h *GetHandler) serveData(w http.ResponseWriter, r *http.Request, val []byte, meta *ObjectMeta, etag string) {
+	header := w.Header()
+	modtime := time.Time{}
+	filename := ""
+	if meta != nil {
+		meta.writeHeader(header)
+		if meta.Ctime > 0 {
+			modtime = time.Unix(meta.Ctime, 0)
+		}
+		filename = meta.Filename
+	}
+	// sniffed here rather than by ServeContent, the disposition goes by it
+	if len(header.Get("Content-Type")) == 0 {
+		header.Set("Content-Type", http.DetectContentType(val))
+	}
+	header.Set("Content-Disposition", contentDisposition(header.Get("Content-Type"), filename))
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("ETag", etag)
+	// a signed /get set its own
+	if len(header.Get("Cache-Control")) == 0 {
+		if meta != nil && meta.Expire > 0 {
+			// must not be cached past its expiry
+			header.Set("Cache-Control", fmt.Sprintf("max-age=%d", meta.Expire - time.Now().Unix()))
+		} else if len(h.bs.config.httpServerCacheControl) > 0 {
+			header.Set("Cache-Control", h.bs.config.httpServerCacheControl)
+		}
 	}
-	return nil, errors.New("fatal Error for getData !")
+	// with a zero modtime ServeContent sends no Last-Modified and ignores If-Modified-Since
+	http.ServeContent(w, r, "", modtime, bytes.NewReader(val))
 }
@@ -0,0 +1,111 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"net/http"
+		"net/http/httptest"
+		"strings"
+		"testing"
+		"time"
+	   )
+
+// a blob added through /add, its key
+func addTestBlob(t *testing.T, bs *BinStore, data string, contentType string) string {
+	r := httptest.NewRequest("POST", "/add", strings.NewReader(data))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	bs.server.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("add: %d %s", w.Code, w.Body)
+	}
+	return w.Body.String()
+}
+
+func getTestBlob(bs *BinStore, method string, key string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/get?key=" + key, nil)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	bs.server.Handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestGetHandlerRange(t *testing.T) {
+	bs := newTestBinStore(t)
+	key := addTestBlob(t, bs, "0123456789", "text/plain")
+	w := getTestBlob(bs, "GET", key, map[string]string{"Range": "bytes=2-5"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" || w.Header().Get("Content-Range") != "bytes 2-5/10" {
+		t.Fatalf("range: %d %q %v", w.Code, w.Body, w.Header())
+	}
+	w = getTestBlob(bs, "GET", key, map[string]string{"Range": "bytes=-3"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "789" {
+		t.Fatalf("suffix range: %d %q", w.Code, w.Body)
+	}
+	w = getTestBlob(bs, "GET", key, map[string]string{"Range": "bytes=0-0,8-9"})
+	if w.Code != http.StatusPartialContent || !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges") {
+		t.Fatalf("ranges: %d %v", w.Code, w.Header())
+	}
+	w = getTestBlob(bs, "GET", key, map[string]string{"Range": "bytes=20-30"})
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("past the end: %d", w.Code)
+	}
+	w = getTestBlob(bs, "HEAD", key, nil)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "10" {
+		t.Fatalf("head: %d %q %v", w.Code, w.Body, w.Header())
+	}
+}
+
+func TestGetHandlerConditional(t *testing.T) {
+	bs := newTestBinStore(t)
+	key := addTestBlob(t, bs, "0123456789", "text/plain")
+	w := getTestBlob(bs, "GET", key, nil)
+	etag := w.Header().Get("ETag")
+	lastModified := w.Header().Get("Last-Modified")
+	if w.Code != http.StatusOK || len(etag) == 0 || len(lastModified) == 0 {
+		t.Fatalf("get: %d %v", w.Code, w.Header())
+	}
+	w = getTestBlob(bs, "GET", key, map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("if-none-match: %d", w.Code)
+	}
+	w = getTestBlob(bs, "GET", key, map[string]string{"If-None-Match": "\"other\""})
+	if w.Code != http.StatusOK {
+		t.Fatalf("if-none-match other: %d", w.Code)
+	}
+	w = getTestBlob(bs, "GET", key, map[string]string{"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)})
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("if-modified-since: %d", w.Code)
+	}
+	// a range of another version is answered in full
+	w = getTestBlob(bs, "GET", key, map[string]string{"Range": "bytes=0-1", "If-Range": "\"other\""})
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Fatalf("if-range other: %d %q", w.Code, w.Body)
+	}
+	w = getTestBlob(bs, "GET", key, map[string]string{"Range": "bytes=0-1", "If-Range": etag})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "01" {
+		t.Fatalf("if-range: %d %q", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,319 @@
+//go:build grpc
+// +build grpc
+
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/dzch/go-utils/logger"
+		"github.com/dzch/binstore/binstore/pb"
+		"google.golang.org/grpc"
+		"google.golang.org/grpc/codes"
+		"google.golang.org/grpc/status"
+		"net/http"
+		"net/url"
+		"strconv"
+		"context"
+		"errors"
+		"time"
+		"net"
+		"fmt"
+		"io"
+	   )
+
+/*
+   the grpc service of pb/binstore.proto, built with -tags grpc.
+   it runs the same steps as the http handlers, see addData, getByKey, statKey
+   and MGetHandler.getEntries. deadlines of clients cancel the stream, a Get
+   or BatchGet past it stops at the next Send.
+*/
+type grpcServer struct {
+	pb.UnimplementedBinStoreServer
+	bs *BinStore
+	server *grpc.Server
+}
+
+func (bs *BinStore) initGrpcServer() error {
+	if bs.config.grpcServerListenPort == 0 {
+		return nil
+	}
+    gs := &grpcServer {
+        bs: bs,
+	}
+	gs.server = grpc.NewServer(grpc.MaxRecvMsgSize(bs.config.grpcServerMaxRecvMsgSize))
+	pb.RegisterBinStoreServer(gs.server, gs)
+	bs.grpcServer = gs
+	return nil
+}
+
+func (bs *BinStore) runGrpcServer() {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", bs.config.grpcServerListenPort))
+	if err == nil {
+		err = bs.grpcServer.server.Serve(l)
+	}
+	if err != nil {
+		logger.Fatal("fail to start grpc server: %s", err.Error())
+		bs.fatalErrorChan <- err
+		return
+	}
+	err = errors.New("grpc server done")
+	bs.fatalErrorChan <- err
+}
+
+// the message of the status starts with the code of the http json body
+func grpcError(e *apiError) error {
+	c := codes.Internal
+	switch e.status {
+		case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+			c = codes.InvalidArgument
+		case http.StatusForbidden:
+			c = codes.PermissionDenied
+		case http.StatusNotFound, http.StatusGone:
+			c = codes.NotFound
+		case http.StatusServiceUnavailable:
+			c = codes.Unavailable
+	}
+	return status.Error(c, e.Error())
+}
+
+func (gs *grpcServer) Add(stream pb.BinStore_AddServer) error {
+    startTime := time.Now()
+	bs := gs.bs
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return grpcError(newApiError(http.StatusBadRequest, errCodeInvalidRequest, "need data"))
+	}
+	if err != nil {
+		return err
+	}
+	ns, err := bs.namespaceNamed(first.GetNamespace())
+	if err != nil {
+		logger.Warning("invalid grpc add, unknown namespace: %s", first.GetNamespace())
+		return grpcError(newApiError(http.StatusBadRequest, errCodeUnknownNamespace, err.Error()))
+	}
+	ad := bs.adp.fetch()
+	defer bs.adp.put(ad)
+	err = gs.parseAddRequest(ad, first)
+	if err != nil {
+		logger.Warning("invalid grpc add, bad request: ns=%s, %s", ns.name, err.Error())
+		return grpcError(newApiError(http.StatusBadRequest, errCodeInvalidRequest, err.Error()))
+	}
+	ad.meta.Ctime = time.Now().Unix()
+	maxSize := bs.config.httpServerMaxBodySize
+	nr, err := ad.readFrom(&grpcAddReader{stream: stream, data: first.GetData()}, maxSize)
+	if err == errBodyTooLarge {
+		logger.Warning("invalid grpc add, body too large: ns=%s, more than %d", ns.name, maxSize)
+		return grpcError(newApiError(http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, fmt.Sprintf("body exceeds the max size of %d bytes", maxSize)))
+	}
+	if err != nil {
+		logger.Warning("fail to read grpc add stream: ns=%s, %s", ns.name, err.Error())
+		return err
+	}
+	if nr == 0 {
+		return grpcError(newApiError(http.StatusBadRequest, errCodeInvalidRequest, "need data"))
+	}
+	id, ae := bs.addData(ns, ad)
+	if ae != nil {
+		logger.Warning("fail to grpc add: ns=%s, %s", ns.name, ae.Error())
+		return grpcError(ae)
+	}
+	err = stream.SendAndClose(&pb.AddResponse{Key: ad.Key})
+	if err != nil {
+		logger.Warning("fail to send grpc add response: ns=%s, key=%s, %s", ns.name, ad.Key, err.Error())
+		return err
+	}
+    endTime := time.Now()
+	costTimeUS := endTime.Sub(startTime)/time.Microsecond
+	logger.Notice("success process grpc add: ns=%s, cost_us=%d, datalen=%d, id=%d, md5a=%d, md5b=%d, fnv1a32=%d, key=%s", ns.name, costTimeUS, nr, id, ad.md5a, ad.md5b, ad.fnv1a32, ad.Key)
+	return nil
+}
+
+// options go through the checks /add makes of headers and query
+func (gs *grpcServer) parseAddRequest(ad *AddData, m *pb.AddRequest) error {
+	header := http.Header{}
+	meta := m.GetMeta()
+	if len(meta.GetContentType()) > 0 {
+		header.Set("Content-Type", meta.GetContentType())
+	}
+	for k, v := range meta.GetHeaders() {
+		header.Set(gMetaHeaderPrefix + k, v)
+	}
+	err := ad.meta.parseHeader(header, meta.GetFilename())
+	if err != nil {
+		return err
+	}
+	qv := url.Values{}
+	if m.GetTtl() != 0 {
+		qv.Set("ttl", strconv.FormatInt(m.GetTtl(), 10))
+	}
+	if m.GetExpire() != 0 {
+		qv.Set("expire", strconv.FormatInt(m.GetExpire(), 10))
+	}
+	err = ad.meta.parseExpire(qv, time.Now())
+	if err != nil {
+		return err
+	}
+	return ad.want.set(m.GetMd5(), m.GetSha256())
+}
+
+// data of the Add stream as one body, io.EOF after the last message
+type grpcAddReader struct {
+	stream pb.BinStore_AddServer
+	data []byte
+}
+
+func (r *grpcAddReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		m, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.data = m.GetData()
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (gs *grpcServer) Get(req *pb.GetRequest, stream pb.BinStore_GetServer) error {
+    startTime := time.Now()
+	ns, err := gs.bs.namespaceOfKey(req.GetKey())
+	if err == nil && ns.config.signRequired {
+		return grpcError(newApiError(http.StatusForbidden, errCodeForbidden, "namespace needs signed urls"))
+	}
+	val, meta, ae := gs.bs.getByKey(req.GetKey())
+	if ae != nil {
+		logger.Warning("fail to grpc get: key=%s, %s", req.GetKey(), ae.Error())
+		return grpcError(ae)
+	}
+	chunkSize := gs.bs.config.grpcServerChunkSize
+    rsp := &pb.GetResponse {
+        Meta: metaToPb(meta),
+		Size: int64(len(val)),
+	}
+	for start := 0; ; start += chunkSize {
+		end := start + chunkSize
+		if end > len(val) {
+			end = len(val)
+		}
+		rsp.Data = val[start:end]
+		err := stream.Send(rsp)
+		if err != nil {
+			logger.Warning("fail to send grpc get response: key=%s, %s", req.GetKey(), err.Error())
+			return err
+		}
+		if end == len(val) {
+			break
+		}
+		rsp = &pb.GetResponse{}
+	}
+    endTime := time.Now()
+	costTimeUS := endTime.Sub(startTime)/time.Microsecond
+	logger.Notice("success process grpc get: key=%s, cost_us=%d, datalen=%d", req.GetKey(), costTimeUS, len(val))
+	return nil
+}
+
+func (gs *grpcServer) Stat(ctx context.Context, req *pb.StatRequest) (*pb.StatResponse, error) {
+	ns, err := gs.bs.namespaceOfKey(req.GetKey())
+	if err == nil && ns.config.signRequired {
+		return nil, grpcError(newApiError(http.StatusForbidden, errCodeForbidden, "namespace needs signed urls"))
+	}
+	res, ae := gs.bs.statKey(req.GetKey())
+	if ae != nil {
+		logger.Warning("fail to grpc stat: key=%s, %s", req.GetKey(), ae.Error())
+		return nil, grpcError(ae)
+	}
+    rsp := &pb.StatResponse {
+        Key: res.Key,
+		Namespace: res.Namespace,
+		Id: res.Id,
+		Partition: res.Partition,
+		Offset: res.Offset,
+		Location: res.Location,
+		Size: int64(res.Size),
+		Md5: res.Md5,
+		Fnv1A32: res.Fnv1a32,
+		Expired: res.Expired,
+		Meta: &pb.Meta {
+            ContentType: res.ContentType,
+			Filename: res.Filename,
+			Headers: res.Headers,
+			Ctime: res.Ctime,
+			Expire: res.Expire,
+		},
+	}
+	return rsp, nil
+}
+
+func (gs *grpcServer) BatchGet(req *pb.BatchGetRequest, stream pb.BinStore_BatchGetServer) error {
+    startTime := time.Now()
+	keys := req.GetKeys()
+	maxItems := gs.bs.config.httpServerMaxBatchItems
+	if len(keys) == 0 || len(keys) > maxItems {
+		return grpcError(newApiError(http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("need 1 to %d keys", maxItems)))
+	}
+	entries := make([]*mgetEntry, len(keys))
+	for i, key := range keys {
+		entries[i] = &mgetEntry{key: key}
+	}
+	newMGetHandler(gs.bs).getEntries(entries, false)
+	nok := 0
+	for _, e := range entries {
+        item := &pb.BatchGetItem {
+            Key: e.key,
+		}
+		if e.status == http.StatusOK {
+			item.Data = e.data
+			item.Meta = metaToPb(e.meta)
+			nok ++
+		} else {
+			item.Code = e.code
+			item.Message = e.err
+		}
+		err := stream.Send(item)
+		if err != nil {
+			logger.Warning("fail to send grpc batch get response: %s", err.Error())
+			return err
+		}
+	}
+    endTime := time.Now()
+	costTimeUS := endTime.Sub(startTime)/time.Microsecond
+	logger.Notice("success process grpc batch get: cost_us=%d, keys=%d, ok=%d", costTimeUS, len(entries), nok)
+	return nil
+}
+
+func metaToPb(meta *ObjectMeta) *pb.Meta {
+	if meta == nil {
+		return nil
+	}
+    m := &pb.Meta {
+        ContentType: meta.ContentType,
+		Filename: meta.Filename,
+		Headers: meta.Headers,
+		Ctime: meta.Ctime,
+		Expire: meta.Expire,
+	}
+	return m
+}
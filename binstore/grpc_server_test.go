@@ -0,0 +1,206 @@
+//go:build grpc
+// +build grpc
+
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/dzch/binstore/binstore/pb"
+		"google.golang.org/grpc"
+		"google.golang.org/grpc/codes"
+		"google.golang.org/grpc/credentials/insecure"
+		"google.golang.org/grpc/status"
+		"google.golang.org/grpc/test/bufconn"
+		"context"
+		"testing"
+		"net"
+		"io"
+	   )
+
+// the grpc service of bs over an in memory listener
+func newTestGrpcClient(t *testing.T, bs *BinStore) pb.BinStoreClient {
+	l := bufconn.Listen(1 << 20)
+    gs := &grpcServer {
+        bs: bs,
+	}
+	gs.server = grpc.NewServer(grpc.MaxRecvMsgSize(bs.config.grpcServerMaxRecvMsgSize))
+	pb.RegisterBinStoreServer(gs.server, gs)
+	go gs.server.Serve(l)
+	t.Cleanup(gs.server.Stop)
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		return l.DialContext(ctx)
+	}
+	conn, err := grpc.NewClient("passthrough:///bufnet", grpc.WithContextDialer(dial), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewBinStoreClient(conn)
+}
+
+func grpcTestAdd(t *testing.T, c pb.BinStoreClient, first *pb.AddRequest, chunks ...string) (string, error) {
+	stream, err := c.Add(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stream.Send(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range chunks {
+		err = stream.Send(&pb.AddRequest{Data: []byte(chunk)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rsp, err := stream.CloseAndRecv()
+	if err != nil {
+		return "", err
+	}
+	return rsp.GetKey(), nil
+}
+
+func TestGrpcServer(t *testing.T) {
+	// no port, the test serves it over bufconn
+	bs, err := newTestBinStoreWith(t, "grpc_server:\n  chunk_size: 4\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestGrpcClient(t, bs)
+	ctx := context.Background()
+	// the blob comes in over three messages
+	first := &pb.AddRequest {
+        Meta: &pb.Meta{ContentType: "text/plain", Filename: "a.txt"},
+		Data: []byte("hello "),
+	}
+	key, err := grpcTestAdd(t, c, first, "grpc ", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = grpcTestAdd(t, c, &pb.AddRequest{Namespace: "nope", Data: []byte("x")})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("unknown namespace: %v", err)
+	}
+	_, err = grpcTestAdd(t, c, &pb.AddRequest{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("no data: %v", err)
+	}
+	// 17 bytes in chunks of 4, meta and size only in the first message
+	gs, err := c.Get(ctx, &pb.GetRequest{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte{}
+	n := 0
+	for ; ; n ++ {
+		rsp, err := gs.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 && (rsp.GetSize() != 17 || rsp.GetMeta().GetContentType() != "text/plain" || rsp.GetMeta().GetFilename() != "a.txt") {
+			t.Fatalf("first: %+v", rsp)
+		}
+		if n > 0 && (rsp.GetMeta() != nil || rsp.GetSize() != 0) {
+			t.Fatalf("chunk %d: %+v", n, rsp)
+		}
+		data = append(data, rsp.GetData()...)
+	}
+	if string(data) != "hello grpc stream" || n != 5 {
+		t.Fatalf("get: %d %q", n, data)
+	}
+	missing, _ := bs.namespaces[0].km.generateKey(1<<20, 0, 99)
+	gs, err = c.Get(ctx, &pb.GetRequest{Key: missing})
+	if err == nil {
+		_, err = gs.Recv()
+	}
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("get missing: %v", err)
+	}
+	// stat
+	st, err := c.Stat(ctx, &pb.StatRequest{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.GetKey() != key || st.GetNamespace() != "default" || st.GetSize() != 17 || st.GetLocation() != gStatLocationBroker ||
+		len(st.GetMd5()) != 32 || st.GetFnv1A32() == 0 || st.GetMeta().GetFilename() != "a.txt" {
+		t.Fatalf("stat: %+v", st)
+	}
+	_, err = c.Stat(ctx, &pb.StatRequest{Key: "ff5837garbage"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("stat invalid key: %v", err)
+	}
+	// batch get, items in the order of keys
+	bg, err := c.BatchGet(ctx, &pb.BatchGetRequest{Keys: []string{missing, key}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := []*pb.BatchGetItem{}
+	for {
+		item, err := bg.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+	if len(items) != 2 || items[0].GetKey() != missing || items[0].GetCode() != errCodeNotFound || len(items[0].GetData()) != 0 ||
+		items[1].GetKey() != key || string(items[1].GetData()) != "hello grpc stream" || items[1].GetMeta().GetContentType() != "text/plain" {
+		t.Fatalf("batch get: %+v", items)
+	}
+	bg, err = c.BatchGet(ctx, &pb.BatchGetRequest{})
+	if err == nil {
+		_, err = bg.Recv()
+	}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("batch get without keys: %v", err)
+	}
+}
+
+// no signature can be passed over grpc, keys of such namespaces are refused
+func TestGrpcServerSignRequired(t *testing.T) {
+	bs, err := newTestBinStoreWith(t, gTestSignConf + "grpc_server:\n  chunk_size: 4\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := addTestBlob(t, bs, "private", "text/plain")
+	c := newTestGrpcClient(t, bs)
+	ctx := context.Background()
+	_, err = c.Stat(ctx, &pb.StatRequest{Key: key})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("stat: %v", err)
+	}
+	gs, err := c.Get(ctx, &pb.GetRequest{Key: key})
+	if err == nil {
+		_, err = gs.Recv()
+	}
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("get: %v", err)
+	}
+}
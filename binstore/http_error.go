@@ -0,0 +1,157 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"encoding/json"
+		"encoding/hex"
+		"crypto/rand"
+		"net/http"
+		"sync/atomic"
+		"strconv"
+	   )
+
+/*
+   failures are answered with a json body, code never changes for the same
+   kind of failure and is what clients shall match on:
+     {"code": "not_found", "message": "blob not found", "request_id": "...", "retryable": false}
+   retryable is true for 5xx, the same request may succeed later.
+   the request id is the X-Request-Id of the client, or one made up here, and
+   is sent back in X-Request-Id either way.
+*/
+var (
+		gRequestIdHeader = "X-Request-Id"
+		gRequestIdMaxLen = 128
+
+		errCodeInvalidRequest = "invalid_request"
+		errCodeInvalidKey = "invalid_key"
+		errCodeUnknownNamespace = "unknown_namespace"
+		errCodeBodyTooLarge = "body_too_large"
+		errCodeUnsupportedMediaType = "unsupported_media_type"
+		errCodeChecksumMismatch = "checksum_mismatch"
+		errCodeMethodNotAllowed = "method_not_allowed"
+		errCodeForbidden = "forbidden"
+		errCodeNotFound = "not_found"
+		errCodeDeleted = "deleted"
+		errCodeExpired = "expired"
+		errCodeDedupUnavailable = "dedup_unavailable"
+		errCodeIdAllocFailed = "id_alloc_failed"
+		errCodeNoWritablePartition = "no_writable_partition"
+		errCodeBrokerUnavailable = "broker_unavailable"
+		errCodeStoreUnavailable = "store_unavailable"
+		errCodeInternal = "internal_error"
+
+		gRequestIdPrefix = newRequestIdPrefix()
+		gRequestIdSeq = uint64(0)
+	)
+
+type ErrorResponse struct {
+	Code string `json:"code"`
+	Message string `json:"message"`
+	RequestId string `json:"request_id"`
+	Retryable bool `json:"retryable"`
+}
+
+// a failure as the http and grpc servers both answer it
+type apiError struct {
+	status int
+	code string
+	msg string
+}
+
+func newApiError(status int, code string, msg string) *apiError {
+	return &apiError{status: status, code: code, msg: msg}
+}
+
+func (e *apiError) Error() string {
+	return e.code + ": " + e.msg
+}
+
+type requestIdHandler struct {
+	h http.Handler
+}
+
+// every request gets an id before the handler sees it
+func withRequestId(h http.Handler) http.Handler {
+	return &requestIdHandler{h: h}
+}
+
+func (rh *requestIdHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(gRequestIdHeader)
+	if len(id) == 0 || len(id) > gRequestIdMaxLen {
+		id = gRequestIdPrefix + strconv.FormatUint(atomic.AddUint64(&gRequestIdSeq, 1), 16)
+	}
+	w.Header().Set(gRequestIdHeader, id)
+	rh.h.ServeHTTP(w, r)
+}
+
+// random per process, so ids of different servers do not collide
+func newRequestIdPrefix() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b) + "-"
+}
+
+func writeError(w http.ResponseWriter, status int, code string, msg string) {
+	rsp := &ErrorResponse {
+        Code: code,
+		Message: msg,
+		RequestId: w.Header().Get(gRequestIdHeader),
+		Retryable: status >= 500,
+	}
+	body, _ := json.Marshal(rsp)
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func writeApiError(w http.ResponseWriter, e *apiError) {
+	writeError(w, e.status, e.code, e.msg)
+}
+
+// status and code for errors of reading a blob, inBroker tells where it was read
+func dataErrorStatus(err error, inBroker bool) (int, string) {
+	switch {
+		case err == ErrBlobNotFound || err == errLogNoMessage:
+			return http.StatusNotFound, errCodeNotFound
+		case err == ErrBlobDeleted:
+			return http.StatusGone, errCodeDeleted
+		case err == ErrBlobExpired:
+			return http.StatusGone, errCodeExpired
+		case err == errDecrypt:
+			return http.StatusInternalServerError, errCodeInternal
+		case inBroker:
+			return http.StatusServiceUnavailable, errCodeBrokerUnavailable
+	}
+	return http.StatusServiceUnavailable, errCodeStoreUnavailable
+}
+
+func brokerErrorCode(err error) string {
+	if err == errNoWritablePartition {
+		return errCodeNoWritablePartition
+	}
+	return errCodeBrokerUnavailable
+}
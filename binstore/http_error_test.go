@@ -0,0 +1,98 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"encoding/json"
+		"net/http"
+		"net/http/httptest"
+		"strings"
+		"errors"
+		"testing"
+	   )
+
+func TestWriteError(t *testing.T) {
+	bs := newTestBinStore(t)
+	r := httptest.NewRequest("GET", "/get?key=ff5837garbage", nil)
+	r.Header.Set(gRequestIdHeader, "client-id-1")
+	w := httptest.NewRecorder()
+	bs.server.Handler.ServeHTTP(w, r)
+	rsp := &ErrorResponse{}
+	err := json.Unmarshal(w.Body.Bytes(), rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusBadRequest || rsp.Code != errCodeInvalidKey || rsp.RequestId != "client-id-1" || rsp.Retryable {
+		t.Fatalf("%d %+v", w.Code, rsp)
+	}
+	if w.Header().Get(gRequestIdHeader) != "client-id-1" || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("%v", w.Header())
+	}
+	// made up when not given or too long, and different each time
+	ids := make(map[string]bool)
+	for _, id := range []string{"", strings.Repeat("x", gRequestIdMaxLen+1), ""} {
+		r = httptest.NewRequest("GET", "/get?key=ff5837garbage", nil)
+		r.Header.Set(gRequestIdHeader, id)
+		w = httptest.NewRecorder()
+		bs.server.Handler.ServeHTTP(w, r)
+		got := w.Header().Get(gRequestIdHeader)
+		if !strings.HasPrefix(got, gRequestIdPrefix) || ids[got] {
+			t.Fatalf("request id: %q", got)
+		}
+		ids[got] = true
+	}
+	w = httptest.NewRecorder()
+	writeError(w, http.StatusServiceUnavailable, errCodeStoreUnavailable, "down")
+	rsp = &ErrorResponse{}
+	json.Unmarshal(w.Body.Bytes(), rsp)
+	if !rsp.Retryable || rsp.Code != errCodeStoreUnavailable || rsp.Message != "down" {
+		t.Fatalf("%+v", rsp)
+	}
+}
+
+func TestDataErrorStatus(t *testing.T) {
+	cases := []struct {
+		err error
+		inBroker bool
+		status int
+		code string
+	}{
+		{ErrBlobNotFound, false, http.StatusNotFound, errCodeNotFound},
+		{errLogNoMessage, true, http.StatusNotFound, errCodeNotFound},
+		{ErrBlobDeleted, true, http.StatusGone, errCodeDeleted},
+		{ErrBlobExpired, false, http.StatusGone, errCodeExpired},
+		{errDecrypt, false, http.StatusInternalServerError, errCodeInternal},
+		{errors.New("timeout"), true, http.StatusServiceUnavailable, errCodeBrokerUnavailable},
+		{errors.New("timeout"), false, http.StatusServiceUnavailable, errCodeStoreUnavailable},
+	}
+	for _, c := range cases {
+		status, code := dataErrorStatus(c.err, c.inBroker)
+		if status != c.status || code != c.code {
+			t.Fatalf("%v %v: %d %s", c.err, c.inBroker, status, code)
+		}
+	}
+	if brokerErrorCode(errNoWritablePartition) != errCodeNoWritablePartition || brokerErrorCode(errors.New("x")) != errCodeBrokerUnavailable {
+		t.Fatal("broker error codes")
+	}
+}
@@ -0,0 +1,80 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"os"
+		"path/filepath"
+		"errors"
+		"fmt"
+	   )
+
+// IdAllocator hands out ids that are never reused, whatever happens to the
+// process. NewIds gives n ids at once, not necessarily contiguous.
+// implementations must be concurrent safe.
+type IdAllocator interface {
+	NewId() (uint64, error)
+	NewIds(n int) ([]uint64, error)
+}
+
+func newIdAllocator(config *Config) (IdAllocator, error) {
+	switch config.kmIdAllocator {
+		case "redis":
+			return newRedisIdAllocator(config)
+		case "lease":
+			return newLeaseIdAllocator(config)
+		case "snowflake":
+			return newSnowflakeIdAllocator(config)
+	}
+	return nil, errors.New(fmt.Sprintf("unknown id allocator: %s", config.kmIdAllocator))
+}
+
+// write to a tmp file, sync it, rename it over file and sync the directory,
+// so after a crash file is either the old content or the new one, never a
+// half written one, and the rename is not lost
+func writeFileSynced(file string, content []byte) error {
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, file)
+	if err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(file))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,90 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"container/list"
+		"sync"
+	   )
+
+// lru of transformed images, bounded by the bytes of the images. blobs never
+// change once keyed, so entries are only dropped for room.
+type imageCache struct {
+	maxSize int64
+	size int64
+	mu sync.Mutex
+	ll *list.List
+	items map[string]*list.Element
+}
+
+type imageCacheEntry struct {
+	key string
+	data []byte
+	// of the image, with the expiry of the blob
+	meta *ObjectMeta
+	etag string
+}
+
+func newImageCache(maxSize int64) *imageCache {
+    c := &imageCache {
+        maxSize: maxSize,
+		ll: list.New(),
+		items: make(map[string]*list.Element),
+	}
+	return c
+}
+
+func (c *imageCache) get(key string) (*imageCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*imageCacheEntry), true
+}
+
+// an image larger than the whole cache is not kept
+func (c *imageCache) add(ent *imageCacheEntry) {
+	key := ent.key
+	size := int64(len(ent.data))
+	if size > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[key]; ok {
+		return
+	}
+	c.items[key] = c.ll.PushFront(ent)
+	c.size += size
+	for c.size > c.maxSize {
+		e := c.ll.Back()
+		ent := e.Value.(*imageCacheEntry)
+		c.ll.Remove(e)
+		delete(c.items, ent.key)
+		c.size -= int64(len(ent.data))
+	}
+}
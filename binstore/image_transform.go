@@ -0,0 +1,320 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/dzch/go-utils/logger"
+		"golang.org/x/image/draw"
+		"image"
+		"image/gif"
+		"image/jpeg"
+		"image/png"
+		"hash/crc32"
+		"net/http"
+		"net/url"
+		"path/filepath"
+		"strconv"
+		"strings"
+		"errors"
+		"bytes"
+		"fmt"
+		"time"
+	   )
+
+/*
+   /get?key=..&w=&h=&fit=&q=&fmt= or /get?key=..&preset=name answers the blob
+   transformed:
+     w, h   pixels, one of them may be left out to keep the aspect ratio
+     fit    contain (default) scales within w x h and never enlarges,
+            cover scales to fill w x h and crops the center,
+            fill scales to w x h and stretches
+     q      jpeg quality, 1 to 100, 85 by default
+     fmt    jpeg, png or gif, the one of the blob by default
+   only the presets of the image section are allowed, w, h, fit, q and fmt
+   must equal one of them. results are cached by key and preset.
+*/
+var (
+		gImageDefaultFit = "contain"
+		gImageDefaultQuality = 85
+		gImageMaxSide = 8192
+		gImageQueryParams = []string{"preset", "w", "h", "fit", "q", "fmt"}
+		errImageTooLarge = errors.New("image has too many pixels to transform")
+		errImageFormat = errors.New("blob is not a jpeg, png or gif image")
+	)
+
+type imageSpec struct {
+	width int
+	height int
+	fit string
+	quality int
+	// empty for the format of the blob
+	format string
+}
+
+type ImageTransformer struct {
+	config *Config
+	cache *imageCache
+	// bounds the decodes running at once, they are cpu and memory heavy
+	sem chan struct{}
+}
+
+func newImageTransformer(config *Config) *ImageTransformer {
+    it := &ImageTransformer {
+        config: config,
+		cache: newImageCache(config.imageCacheSize),
+		sem: make(chan struct{}, config.imageMaxConcurrency),
+	}
+	return it
+}
+
+func newImageSpec(width, height int, fit string, quality int, format string) (*imageSpec, error) {
+	if len(fit) == 0 {
+		fit = gImageDefaultFit
+	}
+	if quality == 0 {
+		quality = gImageDefaultQuality
+	}
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	if width < 0 || height < 0 || width > gImageMaxSide || height > gImageMaxSide {
+		return nil, errors.New(fmt.Sprintf("w and h should be in [1, %d]", gImageMaxSide))
+	}
+	if width == 0 && height == 0 {
+		return nil, errors.New("need w or h")
+	}
+	switch fit {
+		case "contain":
+		case "cover", "fill":
+			if width == 0 || height == 0 {
+				return nil, errors.New(fmt.Sprintf("fit=%s needs both w and h", fit))
+			}
+		default:
+			return nil, errors.New("fit should be contain, cover or fill")
+	}
+	if quality < 1 || quality > 100 {
+		return nil, errors.New("q should be in [1, 100]")
+	}
+	switch format {
+		case "", "jpeg", "png", "gif":
+		default:
+			return nil, errors.New("fmt should be jpeg, png or gif")
+	}
+    spec := &imageSpec {
+        width: width,
+		height: height,
+		fit: fit,
+		quality: quality,
+		format: format,
+	}
+	return spec, nil
+}
+
+// the same for equal specs, presets are matched and results cached by it
+func (spec *imageSpec) String() string {
+	return fmt.Sprintf("w=%d&h=%d&fit=%s&q=%d&fmt=%s", spec.width, spec.height, spec.fit, spec.quality, spec.format)
+}
+
+func isImageQuery(qv url.Values) bool {
+	for _, p := range gImageQueryParams {
+		if _, ok := qv[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// the preset named or the one w, h, fit, q and fmt equal
+func (it *ImageTransformer) specOf(qv url.Values) (*imageSpec, error) {
+	if len(it.config.imagePresets) == 0 {
+		return nil, errors.New("image transforms are not enabled")
+	}
+	name := qv.Get("preset")
+	if len(name) > 0 {
+		spec, ok := it.config.imagePresets[name]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("unknown preset: %s", name))
+		}
+		return spec, nil
+	}
+	var ints [3]int
+	for i, p := range []string{"w", "h", "q"} {
+		v := qv.Get(p)
+		if len(v) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid %s: %s", p, v))
+		}
+		ints[i] = n
+	}
+	spec, err := newImageSpec(ints[0], ints[1], qv.Get("fit"), ints[2], strings.ToLower(qv.Get("fmt")))
+	if err != nil {
+		return nil, err
+	}
+	s := spec.String()
+	for _, preset := range it.config.imagePresets {
+		if preset.String() == s {
+			return preset, nil
+		}
+	}
+	return nil, errors.New("not an allowed preset: " + s)
+}
+
+// the image of key transformed by spec, if cached. its meta keeps the expiry
+// of the blob, the caller checks it.
+func (it *ImageTransformer) cached(key string, spec *imageSpec) ([]byte, *ObjectMeta, string, bool) {
+	ent, ok := it.cache.get(key + "?" + spec.String())
+	if !ok {
+		return nil, nil, "", false
+	}
+	return ent.data, ent.meta, ent.etag, true
+}
+
+// val of key transformed by spec, with meta changed to match and its etag.
+// val and meta were got and checked by getByKey.
+func (it *ImageTransformer) transform(key string, spec *imageSpec, val []byte, meta *ObjectMeta) ([]byte, *ObjectMeta, string, *apiError) {
+	startTime := time.Now()
+	it.sem <- struct{}{}
+	out, format, err := transformImage(val, spec, it.config.imageMaxPixels)
+	<-it.sem
+	if err != nil {
+		return nil, nil, "", newApiError(http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, err.Error())
+	}
+	tmeta := &ObjectMeta{}
+	if meta != nil {
+		*tmeta = *meta
+	}
+	tmeta.ContentType = "image/" + format
+	tmeta.Md5 = nil
+	if len(tmeta.Filename) > 0 {
+		ext := filepath.Ext(tmeta.Filename)
+		tmeta.Filename = tmeta.Filename[:len(tmeta.Filename) - len(ext)] + "." + imageExt(format)
+	}
+	etag := blobETag(key, meta, fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(spec.String()))))
+    ent := &imageCacheEntry {
+        key: key + "?" + spec.String(),
+		data: out,
+		meta: tmeta,
+		etag: etag,
+	}
+	it.cache.add(ent)
+	endTime := time.Now()
+	costTimeUS := endTime.Sub(startTime)/time.Microsecond
+	logger.Notice("success transform image: key=%s, %s, cost_us=%d, from=%d, to=%d", key, spec.String(), costTimeUS, len(val), len(out))
+	return out, tmeta, etag, nil
+}
+
+func imageExt(format string) string {
+	if format == "jpeg" {
+		return "jpg"
+	}
+	return format
+}
+
+// the size is checked before decoding, a small blob can claim a huge image.
+// only the first frame of a gif is kept.
+func transformImage(val []byte, spec *imageSpec, maxPixels int) ([]byte, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(val))
+	if err != nil {
+		return nil, "", errImageFormat
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > maxPixels/cfg.Height {
+		return nil, "", errImageTooLarge
+	}
+	src, _, err := image.Decode(bytes.NewReader(val))
+	if err != nil {
+		return nil, "", errImageFormat
+	}
+	if len(spec.format) > 0 {
+		format = spec.format
+	}
+	sr := src.Bounds()
+	width, height := scaledSize(sr.Dx(), sr.Dy(), spec)
+	if spec.fit == "cover" {
+		sr = coverRect(sr, width, height)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	op := draw.Src
+	if format == "jpeg" {
+		// jpeg has no alpha, transparent pixels turn white and not black
+		draw.Draw(dst, dst.Bounds(), image.White, image.ZP, draw.Src)
+		op = draw.Over
+	}
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, sr, op, nil)
+	buf := &bytes.Buffer{}
+	switch format {
+		case "jpeg":
+			err = jpeg.Encode(buf, dst, &jpeg.Options{Quality: spec.quality})
+		case "png":
+			err = png.Encode(buf, dst)
+		case "gif":
+			err = gif.Encode(buf, dst, nil)
+		default:
+			return nil, "", errImageFormat
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), format, nil
+}
+
+func scaledSize(sw, sh int, spec *imageSpec) (int, int) {
+	w, h := spec.width, spec.height
+	if spec.fit != "contain" {
+		return w, h
+	}
+	if w == 0 || (h > 0 && sw*h < sh*w) {
+		// the height bounds it
+		if h >= sh {
+			return sw, sh
+		}
+		return maxInt(1, sw*h/sh), h
+	}
+	if w >= sw {
+		return sw, sh
+	}
+	return w, maxInt(1, sh*w/sw)
+}
+
+// the center of r with the aspect ratio of w x h
+func coverRect(r image.Rectangle, w, h int) image.Rectangle {
+	sw, sh := r.Dx(), r.Dy()
+	cw, ch := sw, sh
+	if sw*h > sh*w {
+		cw = maxInt(1, sh*w/h)
+	} else {
+		ch = maxInt(1, sw*h/w)
+	}
+	x0, y0 := r.Min.X + (sw - cw)/2, r.Min.Y + (sh - ch)/2
+	return image.Rect(x0, y0, x0 + cw, y0 + ch)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,297 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"image"
+		"image/color"
+		"image/gif"
+		"image/jpeg"
+		"image/png"
+		"net/http"
+		"testing"
+		"bytes"
+	   )
+
+var (
+		gTestImageConf = `
+image:
+ presets:
+  thumb: {w: 100, h: 100, fit: cover}
+  small: {w: 50, q: 70, fmt: png}
+  wide: {w: 80, h: 20, fit: fill, fmt: jpeg}
+ max_pixels: 1000000
+`
+	)
+
+// w x h, red to the right, green to the bottom, the left half transparent if alpha
+func testImage(t *testing.T, format string, w, h int, alpha bool) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			a := uint8(255)
+			if alpha && x < w/2 {
+				a = 0
+			}
+			img.Set(x, y, color.NRGBA{uint8(x*255/w), uint8(y*255/h), 0, a})
+		}
+	}
+	buf := &bytes.Buffer{}
+	var err error
+	switch format {
+		case "png":
+			err = png.Encode(buf, img)
+		case "jpeg":
+			err = jpeg.Encode(buf, img, nil)
+		case "gif":
+			err = gif.Encode(buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeTestImage(t *testing.T, data []byte) (image.Image, string) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img, format
+}
+
+func TestImageSpec(t *testing.T) {
+	spec, err := newImageSpec(100, 0, "", 0, "jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.String() != "w=100&h=0&fit=contain&q=85&fmt=jpeg" {
+		t.Fatal(spec.String())
+	}
+	bad := []struct {
+		w, h int
+		fit string
+		q int
+		format string
+	} {
+		{0, 0, "", 0, ""},
+		{-1, 10, "", 0, ""},
+		{gImageMaxSide + 1, 10, "", 0, ""},
+		{10, 0, "cover", 0, ""},
+		{0, 10, "fill", 0, ""},
+		{10, 10, "stretch", 0, ""},
+		{10, 10, "", 101, ""},
+		{10, 10, "", -1, ""},
+		{10, 10, "", 0, "webp"},
+	}
+	for _, b := range bad {
+		_, err := newImageSpec(b.w, b.h, b.fit, b.q, b.format)
+		if err == nil {
+			t.Fatalf("%+v accepted", b)
+		}
+	}
+}
+
+func TestImageScaledSize(t *testing.T) {
+	cases := []struct {
+		sw, sh int
+		w, h int
+		fit string
+		ww, wh int
+	} {
+		// contain keeps the aspect ratio within w x h
+		{400, 200, 100, 0, "contain", 100, 50},
+		{400, 200, 0, 100, "contain", 200, 100},
+		{400, 200, 100, 100, "contain", 100, 50},
+		{200, 400, 100, 100, "contain", 50, 100},
+		// and never enlarges
+		{40, 20, 100, 100, "contain", 40, 20},
+		// never below a pixel
+		{1000, 1, 10, 0, "contain", 10, 1},
+		{400, 200, 100, 100, "cover", 100, 100},
+		{400, 200, 30, 90, "fill", 30, 90},
+	}
+	for _, c := range cases {
+		spec, err := newImageSpec(c.w, c.h, c.fit, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, h := scaledSize(c.sw, c.sh, spec)
+		if w != c.ww || h != c.wh {
+			t.Fatalf("%+v: %dx%d", c, w, h)
+		}
+	}
+	// cover crops the center
+	r := coverRect(image.Rect(0, 0, 400, 200), 100, 100)
+	if r != image.Rect(100, 0, 300, 200) {
+		t.Fatal(r)
+	}
+	r = coverRect(image.Rect(0, 0, 200, 400), 200, 100)
+	if r != image.Rect(0, 150, 200, 250) {
+		t.Fatal(r)
+	}
+}
+
+func TestTransformImage(t *testing.T) {
+	spec, _ := newImageSpec(100, 100, "cover", 0, "")
+	out, format, err := transformImage(testImage(t, "png", 400, 200, false), spec, 1000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, f := decodeTestImage(t, out)
+	if format != "png" || f != "png" || img.Bounds() != image.Rect(0, 0, 100, 100) {
+		t.Fatalf("cover: %s %s %v", format, f, img.Bounds())
+	}
+	// the center is kept: the left of a 200x200 crop of 400 starts a quarter in
+	r, _, _, _ := img.At(0, 50).RGBA()
+	if r>>8 < 50 || r>>8 > 90 {
+		t.Fatalf("not the center: red %d", r>>8)
+	}
+	// to jpeg, transparent pixels turn white
+	src := testImage(t, "png", 400, 200, true)
+	spec, _ = newImageSpec(40, 0, "", 90, "jpeg")
+	out, format, err = transformImage(src, spec, 1000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, f = decodeTestImage(t, out)
+	if format != "jpeg" || f != "jpeg" || img.Bounds() != image.Rect(0, 0, 40, 20) {
+		t.Fatalf("jpeg: %s %s %v", format, f, img.Bounds())
+	}
+	r, g, b, _ := img.At(2, 10).RGBA()
+	if r>>8 < 240 || g>>8 < 240 || b>>8 < 240 {
+		t.Fatalf("transparent not white: %d %d %d", r>>8, g>>8, b>>8)
+	}
+	// gif in, first frame, gif out
+	spec, _ = newImageSpec(20, 0, "", 0, "")
+	out, format, err = transformImage(testImage(t, "gif", 40, 40, false), spec, 1000000)
+	if err != nil || format != "gif" {
+		t.Fatalf("gif: %s %v", format, err)
+	}
+	img, _ = decodeTestImage(t, out)
+	if img.Bounds() != image.Rect(0, 0, 20, 20) {
+		t.Fatalf("gif: %v", img.Bounds())
+	}
+	// 80000 pixels, refused before decoding
+	_, _, err = transformImage(src, spec, 79999)
+	if err != errImageTooLarge {
+		t.Fatalf("too large: %v", err)
+	}
+	_, _, err = transformImage([]byte("not an image"), spec, 1000000)
+	if err != errImageFormat {
+		t.Fatalf("not an image: %v", err)
+	}
+}
+
+func TestImageCache(t *testing.T) {
+	c := newImageCache(10)
+	c.add(&imageCacheEntry{key: "a", data: []byte("aaaa")})
+	c.add(&imageCacheEntry{key: "b", data: []byte("bbbb")})
+	// a is used, so b is the least recent when c needs room
+	_, ok := c.get("a")
+	if !ok {
+		t.Fatal("a missing")
+	}
+	c.add(&imageCacheEntry{key: "c", data: []byte("cccc")})
+	_, okA := c.get("a")
+	_, okB := c.get("b")
+	_, okC := c.get("c")
+	if !okA || okB || !okC || c.size != 8 {
+		t.Fatalf("a %v, b %v, c %v, size %d", okA, okB, okC, c.size)
+	}
+	// larger than the whole cache
+	c.add(&imageCacheEntry{key: "d", data: make([]byte, 11)})
+	_, ok = c.get("d")
+	if ok || c.size != 8 {
+		t.Fatalf("d kept, size %d", c.size)
+	}
+}
+
+func TestGetHandlerImage(t *testing.T) {
+	bs, err := newTestBinStoreWith(t, gTestImageConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := addTestBlob(t, bs, string(testImage(t, "png", 400, 200, false)), "image/png")
+	w := getTestBlob(bs, "GET", key + "&preset=thumb", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("preset: %d %s", w.Code, w.Body)
+	}
+	img, _ := decodeTestImage(t, w.Body.Bytes())
+	if img.Bounds() != image.Rect(0, 0, 100, 100) {
+		t.Fatalf("preset: %v", img.Bounds())
+	}
+	etag := w.Header().Get("ETag")
+	// the same preset spelled out, answered from the cache
+	if _, _, _, ok := bs.imgt.cached(key, bs.config.imagePresets["thumb"]); !ok {
+		t.Fatal("not cached")
+	}
+	w = getTestBlob(bs, "GET", key + "&w=100&h=100&fit=cover", nil)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != etag {
+		t.Fatalf("spelled out: %d %s", w.Code, w.Header().Get("ETag"))
+	}
+	w = getTestBlob(bs, "GET", key + "&w=50&q=70&fmt=png", nil)
+	img, _ = decodeTestImage(t, w.Body.Bytes())
+	if w.Code != http.StatusOK || img.Bounds() != image.Rect(0, 0, 50, 25) || w.Header().Get("ETag") == etag {
+		t.Fatalf("small: %d %v %s", w.Code, img.Bounds(), w.Header().Get("ETag"))
+	}
+	w = getTestBlob(bs, "GET", key + "&preset=wide", nil)
+	img, format := decodeTestImage(t, w.Body.Bytes())
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" || format != "jpeg" || img.Bounds() != image.Rect(0, 0, 80, 20) {
+		t.Fatalf("wide: %d %s %v", w.Code, format, img.Bounds())
+	}
+	// the original is untouched
+	w = getTestBlob(bs, "GET", key, nil)
+	img, _ = decodeTestImage(t, w.Body.Bytes())
+	if w.Code != http.StatusOK || img.Bounds() != image.Rect(0, 0, 400, 200) || w.Header().Get("ETag") == etag {
+		t.Fatalf("original: %d %v", w.Code, img.Bounds())
+	}
+	// only presets are allowed
+	for _, q := range []string{"&w=101&h=100&fit=cover", "&preset=huge", "&w=abc", "&w=100&fit=cover"} {
+		w = getTestBlob(bs, "GET", key + q, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: %d", q, w.Code)
+		}
+	}
+	text := addTestBlob(t, bs, "not an image", "text/plain")
+	w = getTestBlob(bs, "GET", text + "&preset=thumb", nil)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("not an image: %d", w.Code)
+	}
+	// 1200x1000 is past max_pixels
+	large := addTestBlob(t, bs, string(testImage(t, "png", 1200, 1000, false)), "image/png")
+	w = getTestBlob(bs, "GET", large + "&preset=thumb", nil)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("too large: %d", w.Code)
+	}
+}
+
+func TestGetHandlerImageDisabled(t *testing.T) {
+	bs := newTestBinStore(t)
+	key := addTestBlob(t, bs, string(testImage(t, "png", 40, 20, false)), "image/png")
+	w := getTestBlob(bs, "GET", key + "&w=10", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("disabled: %d", w.Code)
+	}
+}
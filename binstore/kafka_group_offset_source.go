@@ -0,0 +1,108 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/Shopify/sarama"
+		"errors"
+		"fmt"
+	   )
+
+// offsets committed to kafka by the archiver's consumer group, read with OffsetFetch
+type KafkaGroupOffsetSource struct {
+	config *Config
+	topic string
+	group string
+	bc sarama.Client
+}
+
+func newKafkaGroupOffsetSource(config *Config) (*KafkaGroupOffsetSource, error) {
+    ks := &KafkaGroupOffsetSource {
+        config: config,
+		topic: config.brokerTopic,
+		group: config.archiveGroup,
+	}
+	err := ks.init()
+	if err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func (ks *KafkaGroupOffsetSource) init() error {
+	if len(ks.config.brokerServerList) == 0 {
+		return errors.New("kafka_group source needs broker_hosts")
+	}
+    kconfig := sarama.NewConfig()
+	kconfig.Net.DialTimeout = ks.config.brokerConnTimeout
+	kconfig.Net.ReadTimeout = ks.config.brokerReadTimeout
+	kconfig.Net.WriteTimeout = ks.config.brokerWriteTimeout
+	kconfig.Metadata.RefreshFrequency = ks.config.brokerMetadataRefreshInterval
+	var err error
+	ks.bc, err = sarama.NewClient(ks.config.brokerServerList, kconfig)
+	return err
+}
+
+func (ks *KafkaGroupOffsetSource) Load(offsets []int64) error {
+	partitions, err := ks.bc.Partitions(ks.topic)
+	if err != nil {
+		return err
+	}
+	coordinator, err := ks.bc.Coordinator(ks.group)
+	if err != nil {
+		return err
+	}
+    req := &sarama.OffsetFetchRequest {
+        ConsumerGroup: ks.group,
+		Version: 1,    // v1 reads offsets stored in kafka, v0 reads zk
+	}
+	for _, partition := range partitions {
+		req.AddPartition(ks.topic, partition)
+	}
+	res, err := coordinator.FetchOffset(req)
+	if err != nil {
+		// the coordinator may have moved
+		ks.bc.RefreshCoordinator(ks.group)
+		return err
+	}
+	for _, partition := range partitions {
+		block := res.GetBlock(ks.topic, partition)
+		if block == nil {
+			return errors.New(fmt.Sprintf("no offset of partition %d in response", partition))
+		}
+		if block.Err != sarama.ErrNoError {
+			return errors.New(fmt.Sprintf("fail to fetch offset of partition %d: %s", partition, block.Err.Error()))
+		}
+		if int(partition) >= len(offsets) {
+			return errors.New(fmt.Sprintf("partition %d out of range", partition))
+		}
+		// -1 means nothing committed yet
+		if block.Offset < 0 {
+			offsets[partition] = 0
+		} else {
+			offsets[partition] = block.Offset
+		}
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/Shopify/sarama"
+		"errors"
+		"sync"
+	   )
+
+var (
+		// how many messages one block of a FetchMany is sized for
+		gKafkaFetchManyMaxMessages = 16
+	)
+
+type KafkaLog struct {
+	config *Config
+	topic string
+	ap sarama.AsyncProducer
+	brokerConfig *sarama.Config
+	bc sarama.Client
+	produceChan chan *sarama.ProducerMessage
+	reqPool *sync.Pool
+}
+
+type kafkaProduceReq struct {
+	pmsg *sarama.ProducerMessage
+	err error
+	doneChan chan int
+}
+
+func newKafkaLog(config *Config, topic string) (*KafkaLog, error) {
+    kl := &KafkaLog {
+        config: config,
+		topic: topic,
+	}
+	err := kl.init()
+	if err != nil {
+		return nil, err
+	}
+	return kl, nil
+}
+
+func (kl *KafkaLog) init() error {
+    err := kl.initBrokerConfig()
+	if err != nil {
+		return err
+	}
+    err = kl.initAP()
+	if err != nil {
+		return err
+	}
+    err = kl.initBC()
+	if err != nil {
+		return err
+	}
+	kl.initReqPool()
+	go kl.run()
+	return nil
+}
+
+func (kl *KafkaLog) initBrokerConfig() error {
+    pconfig := sarama.NewConfig()
+	pconfig.Net.MaxOpenRequests = 10240
+	pconfig.Net.DialTimeout = kl.config.brokerConnTimeout
+	pconfig.Net.ReadTimeout = kl.config.brokerReadTimeout
+	pconfig.Net.WriteTimeout = kl.config.brokerWriteTimeout
+	pconfig.Metadata.RefreshFrequency = kl.config.brokerMetadataRefreshInterval
+	pconfig.Producer.MaxMessageBytes = kl.config.brokerMaxMessageSize
+	pconfig.Producer.RequiredAcks = sarama.WaitForAll
+	pconfig.Producer.Return.Successes = true
+	pconfig.Producer.Return.Errors = true
+	pconfig.Producer.Partitioner = sarama.NewManualPartitioner
+	kl.brokerConfig = pconfig
+	return nil
+}
+
+func (kl *KafkaLog) initAP() error {
+	var err error
+	kl.ap, err = sarama.NewAsyncProducer(kl.config.brokerServerList, kl.brokerConfig)
+	if err != nil {
+		return err
+	}
+	kl.produceChan = make(chan *sarama.ProducerMessage, 64)
+	return nil
+}
+
+func (kl *KafkaLog) initBC() error {
+	var err error
+	kl.bc, err = sarama.NewClient(kl.config.brokerServerList, kl.brokerConfig)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (kl *KafkaLog) initReqPool() {
+	kl.reqPool = &sync.Pool {
+        New: kl.newProduceReq,
+	}
+}
+
+func (kl *KafkaLog) newProduceReq() interface{} {
+    req := &kafkaProduceReq {
+        pmsg: &sarama.ProducerMessage{Topic: kl.topic},
+		doneChan: make(chan int, 1),
+	}
+	req.pmsg.Metadata = req
+	return req
+}
+
+func (kl *KafkaLog) run() {
+	for {
+		select {
+			case pm := <-kl.produceChan:
+				kl.produce(pm)
+			case perr := <-kl.ap.Errors():
+				kl.processProduceError(perr)
+			case pm := <-kl.ap.Successes():
+				kl.processProduceSuccess(pm)
+		}
+	}
+}
+
+func (kl *KafkaLog) produce(pm *sarama.ProducerMessage) {
+	for {
+		select {
+			case kl.ap.Input() <- pm:
+				return
+			case perr := <-kl.ap.Errors():
+				kl.processProduceError(perr)
+			case pm := <-kl.ap.Successes():
+				kl.processProduceSuccess(pm)
+		}
+	}
+}
+
+func (kl *KafkaLog) processProduceError(perr *sarama.ProducerError) {
+	req := perr.Msg.Metadata.(*kafkaProduceReq)
+	req.err = perr.Err
+	req.doneChan <- 1
+}
+
+func (kl *KafkaLog) processProduceSuccess(pm *sarama.ProducerMessage) {
+	req := pm.Metadata.(*kafkaProduceReq)
+	req.err = nil
+	req.doneChan <- 1
+}
+
+func (kl *KafkaLog) Append(partition int32, value []byte) (int32, int64, error) {
+	req := kl.reqPool.Get().(*kafkaProduceReq)
+	defer kl.reqPool.Put(req)
+	req.pmsg.Value = sarama.ByteEncoder(value)
+	req.pmsg.Partition = partition
+	kl.produceChan <- req.pmsg
+	<-req.doneChan
+	req.pmsg.Value = nil
+	if req.err != nil {
+		return 0, 0, req.err
+	}
+	return req.pmsg.Partition, req.pmsg.Offset, nil
+}
+
+func (kl *KafkaLog) Fetch(partition int32, offset int64) ([]byte, error) {
+	// TODO: using pool ?
+	bb, err := kl.bc.Leader(kl.topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	bbb := sarama.NewBroker(bb.Addr())
+	defer bbb.Close()
+	err = bbb.Open(kl.brokerConfig)
+	if err != nil {
+		return nil, err
+	}
+    freq := &sarama.FetchRequest {}
+	freq.AddBlock(kl.topic, partition, offset, int32(kl.config.brokerMaxMessageSize))
+	fres, err := bbb.Fetch(freq)
+	if err != nil {
+		return nil, err
+	}
+    fresb := fres.GetBlock(kl.topic, partition)
+	if fresb == nil {
+		return nil, errors.New("no block in fetch response")
+	}
+	if fresb.Err == sarama.ErrOffsetOutOfRange {
+		return nil, errLogNoMessage
+	}
+	if fresb.Err != sarama.ErrNoError {
+		return nil, fresb.Err
+	}
+	// a compressed message set may start before offset
+	for _, msg := range fresb.MsgSet.Messages {
+		if msg.Offset == offset {
+			return msg.Msg.Value, nil
+		}
+	}
+	return nil, errLogNoMessage
+}
+
+// state of one FetchMany
+type kafkaFetchMany struct {
+	values [][]byte
+	errs []error
+	// partition -> offset -> indexes in locs
+	pending map[int32]map[int64][]int
+}
+
+func (fm *kafkaFetchMany) fail(partition int32, offset int64, err error) {
+	for _, i := range fm.pending[partition][offset] {
+		fm.errs[i] = err
+	}
+	delete(fm.pending[partition], offset)
+}
+
+func (fm *kafkaFetchMany) failPartition(partition int32, err error) {
+	for offset := range fm.pending[partition] {
+		fm.fail(partition, offset, err)
+	}
+	delete(fm.pending, partition)
+}
+
+// one FetchRequest per leader each round, with a block for every partition
+// starting at its smallest wanted offset. offsets not in the returned message
+// sets are fetched in the next round.
+func (kl *KafkaLog) FetchMany(locs []logLocation) ([][]byte, []error) {
+	fm := &kafkaFetchMany {
+        values: make([][]byte, len(locs)),
+		errs: make([]error, len(locs)),
+		pending: make(map[int32]map[int64][]int),
+	}
+	for i, loc := range locs {
+		po, ok := fm.pending[loc.partition]
+		if !ok {
+			po = make(map[int64][]int)
+			fm.pending[loc.partition] = po
+		}
+		po[loc.offset] = append(po[loc.offset], i)
+	}
+	for len(fm.pending) > 0 {
+		byLeader := make(map[string][]int32)
+		for partition := range fm.pending {
+			leader, err := kl.bc.Leader(kl.topic, partition)
+			if err != nil {
+				fm.failPartition(partition, err)
+				continue
+			}
+			byLeader[leader.Addr()] = append(byLeader[leader.Addr()], partition)
+		}
+		for addr, partitions := range byLeader {
+			kl.fetchRound(fm, addr, partitions)
+		}
+	}
+	return fm.values, fm.errs
+}
+
+func (kl *KafkaLog) fetchRound(fm *kafkaFetchMany, addr string, partitions []int32) {
+	starts := make(map[int32]int64)
+    freq := &sarama.FetchRequest {}
+	for _, partition := range partitions {
+		start := int64(-1)
+		for offset := range fm.pending[partition] {
+			if start < 0 || offset < start {
+				start = offset
+			}
+		}
+		starts[partition] = start
+		n := len(fm.pending[partition])
+		if n > gKafkaFetchManyMaxMessages {
+			n = gKafkaFetchManyMaxMessages
+		}
+		freq.AddBlock(kl.topic, partition, start, int32(kl.config.brokerMaxMessageSize*n))
+	}
+	bbb := sarama.NewBroker(addr)
+	defer bbb.Close()
+	err := bbb.Open(kl.brokerConfig)
+	var fres *sarama.FetchResponse
+	if err == nil {
+		fres, err = bbb.Fetch(freq)
+	}
+	if err != nil {
+		for _, partition := range partitions {
+			fm.failPartition(partition, err)
+		}
+		return
+	}
+	for _, partition := range partitions {
+		fresb := fres.GetBlock(kl.topic, partition)
+		if fresb == nil {
+			fm.failPartition(partition, errors.New("no block in fetch response"))
+			continue
+		}
+		if fresb.Err != sarama.ErrNoError {
+			fm.failPartition(partition, fresb.Err)
+			continue
+		}
+		po := fm.pending[partition]
+		for _, msg := range fresb.MsgSet.Messages {
+			idxs, ok := po[msg.Offset]
+			if !ok {
+				continue
+			}
+			for _, i := range idxs {
+				fm.values[i] = msg.Msg.Value
+			}
+			delete(po, msg.Offset)
+		}
+		// every round settles the first offset, so FetchMany ends
+		if _, ok := po[starts[partition]]; ok {
+			fm.fail(partition, starts[partition], errLogNoMessage)
+		}
+		if len(po) == 0 {
+			delete(fm.pending, partition)
+		}
+	}
+}
+
+func (kl *KafkaLog) WritablePartitions() ([]int32, error) {
+	return kl.bc.WritablePartitions(kl.topic)
+}
+
+func (kl *KafkaLog) Watermarks(partition int32) (int64, int64, error) {
+	low, err := kl.bc.GetOffset(kl.topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, 0, err
+	}
+	high, err := kl.bc.GetOffset(kl.topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, 0, err
+	}
+	return low, high, nil
+}
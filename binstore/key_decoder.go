@@ -0,0 +1,99 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"errors"
+		"fmt"
+	   )
+
+// KeyDecoder tells what a key points to with no running binstore, from the
+// key tags and fcrypt keys of its config.
+type KeyDecoder struct {
+	config *Config
+	kms []*KeyManager
+}
+
+type KeyInfo struct {
+	Namespace string `json:"namespace"`
+	Id uint64 `json:"id"`
+	Partition int32 `json:"partition"`
+	Offset int64 `json:"offset"`
+}
+
+func NewKeyDecoder(confFile string) (*KeyDecoder, error) {
+	config, err := loadConfig(confFile)
+	if err != nil {
+		return nil, err
+	}
+    kd := &KeyDecoder {
+        config: config,
+	}
+	err = kd.init()
+	if err != nil {
+		return nil, err
+	}
+	return kd, nil
+}
+
+func (kd *KeyDecoder) init() error {
+	for _, nc := range kd.config.namespaces {
+		// no id is ever allocated
+		km, err := newKeyManager(nc, nil)
+		if err != nil {
+			return errors.New(fmt.Sprintf("km of namespace %s: %s", nc.nsName, err.Error()))
+		}
+		kd.kms = append(kd.kms, km)
+	}
+	return nil
+}
+
+// a key not generated with the fcrypt key of its namespace is refused, fcrypt
+// turns any hex into some id so the key is generated again and compared
+func (kd *KeyDecoder) Decode(key string) (*KeyInfo, error) {
+	for i, km := range kd.kms {
+		if len(key) < km.keyTagLen || key[:km.keyTagLen] != km.keyTag {
+			continue
+		}
+		id, partition, offset, err := km.parseKey(key)
+		if err != nil {
+			return nil, err
+		}
+		regen, err := km.generateKey(id, partition, offset)
+		if err != nil {
+			return nil, err
+		}
+		if regen != key {
+			return nil, errors.New("key not generated with the fcrypt key of its namespace")
+		}
+		info := &KeyInfo {
+            Namespace: kd.config.namespaces[i].nsName,
+			Id: id,
+			Partition: partition,
+			Offset: offset,
+		}
+		return info, nil
+	}
+	return nil, errUnknownKeyTag
+}
@@ -0,0 +1,66 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"io/ioutil"
+		"path/filepath"
+		"testing"
+		"fmt"
+	   )
+
+func TestKeyDecoder(t *testing.T) {
+	bs, err := newTestBinStoreWith(t, gTestNamespacesConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	confFile := filepath.Join(t.TempDir(), "binstore.yaml")
+	err = ioutil.WriteFile(confFile, []byte(fmt.Sprintf(gTestConf, t.TempDir()) + gTestNamespacesConf), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kd, err := NewKeyDecoder(confFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ns := range bs.namespaces {
+		key, _ := ns.km.generateKey(12345, 1, 678)
+		info, err := kd.Decode(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Namespace != ns.name || info.Id != 12345 || info.Partition != 1 || info.Offset != 678 {
+			t.Fatalf("%s: %+v", ns.name, info)
+		}
+	}
+	other, _ := bs.namespaces[0].km.generateKey(12345, 1, 678)
+	_, err = kd.Decode("zz" + other[len("ff5837"):])
+	if err != errUnknownKeyTag {
+		t.Fatalf("unknown tag: %v", err)
+	}
+	_, err = kd.Decode("a1" + "not hex")
+	if err == nil {
+		t.Fatal("broken key decoded")
+	}
+}
@@ -24,10 +24,7 @@
 package binstore
 
 import (
-		"github.com/garyburd/redigo/redis"
 		"github.com/dzch/fcrypt"
-		"math/rand"
-		"time"
 		"fmt"
 		"errors"
 		"strings"
@@ -42,31 +39,16 @@ var (
 type KeyManager struct {
 	config *Config
 	fc *fcrypt.FCrypt
-	idRedis [2]*redis.Pool
-	idKey string    // ${keyTag}_idalloc
+	idAlloc IdAllocator
 	keyTag string
 	keyTagLen int
 }
 
-type IdRedisDialer struct {
-	addr string
-	connTimeout time.Duration
-	readTimeout time.Duration
-	writeTimeout time.Duration
-}
-
-func (rd *IdRedisDialer) dial() (redis.Conn, error) {
-	return redis.DialTimeout("tcp", rd.addr, rd.connTimeout, rd.readTimeout, rd.writeTimeout)
-}
-
-func (rd *IdRedisDialer) testOnBorrow(c redis.Conn, t time.Time) error {
-	_, err := c.Do("PING")
-	return err
-}
-
-func newKeyManager(bs *BinStore) (*KeyManager, error) {
+// idAlloc is shared by all namespaces
+func newKeyManager(config *Config, idAlloc IdAllocator) (*KeyManager, error) {
     km := &KeyManager{
-        config: bs.config,
+        config: config,
+		idAlloc: idAlloc,
 	}
 	err := km.init()
 	if err != nil {
@@ -77,10 +59,6 @@ func newKeyManager(bs *BinStore) (*KeyManager, error) {
 
 func (km *KeyManager) init() error {
     err := km.initFCrypt()
-	if err != nil {
-		return err
-	}
-	err = km.initIdRedis()
 	if err != nil {
 		return err
 	}
@@ -94,51 +72,12 @@ func (km *KeyManager) initFCrypt() error {
 	return nil
 }
 
-func (km *KeyManager) initIdRedis() error {
-	km.idRedis[0] = km.initIdRedisOne(km.config.kmEvenRedisAddr)
-	km.idRedis[1] = km.initIdRedisOne(km.config.kmOddRedisAddr)
-	km.idKey = fmt.Sprintf("%s_idalloc", km.config.kmKeyTag)
-	return nil
-}
-
-func (km *KeyManager) initIdRedisOne(addr string) *redis.Pool {
-    ord := &IdRedisDialer {
-        addr: addr,
-		connTimeout: km.config.kmRedisConnTimeout,
-		readTimeout: km.config.kmRedisReadTimeout,
-		writeTimeout: km.config.kmRedisWriteTimeout,
-	}
-    kmRedis := &redis.Pool {
-        MaxIdle: km.config.kmRedisMinConnEach,
-		MaxActive: km.config.kmRedisMaxConnEach,
-		IdleTimeout: km.config.kmRedisPoolIdleTimeout,
-		Dial: ord.dial,
-		TestOnBorrow: ord.testOnBorrow,
-	}
-	return kmRedis
-}
-
 func (km *KeyManager) getNewId() (uint64, error) {
-    i := rand.Int()%2
-	id, err := km.getNewIdIdx(i)
-	if err == nil {
-		return id, nil
-	}
-	return km.getNewIdIdx((i+1)%2)
+	return km.idAlloc.NewId()
 }
 
-func (km *KeyManager) getNewIdIdx(idx int) (uint64, error) {
-	conn := km.idRedis[idx].Get()
-	defer conn.Close()
-	r, err := conn.Do("INCR", km.idKey)
-	if err != nil {
-		return 0, err
-	}
-	id, err := redis.Uint64(r, err)
-	if err != nil {
-		return 0, err
-	}
-	return id*2+uint64(idx), nil
+func (km *KeyManager) getNewIds(n int) ([]uint64, error) {
+	return km.idAlloc.NewIds(n)
 }
 
 func (km *KeyManager) generateKey(id uint64, partition int32, offset int64) (string, error) {
@@ -151,7 +90,7 @@ func (km *KeyManager) generateKey(id uint64, partition int32, offset int64) (str
 	if offset > gOffsetMaxValue {
 		return "", errors.New(fmt.Sprintf("max offset shall be %d, partition %d has exceeded it", gOffsetMaxValue, partition))
 	}
-    id2 := uint64(partition << 54) + uint64(offset)
+    id2 := uint64(partition) << 54 + uint64(offset)
 	key, err := km.fc.Id64ToHstr(id, id2)
 	if err != nil {
 		return "", errors.New(fmt.Sprintf("fail to fcrypt.Id64ToHstr: %s", err.Error()))
@@ -169,6 +108,6 @@ func (km *KeyManager) parseKey(key string) (uint64, int32, int64, error) {
 		return 0,0,0,err
 	}
 	offset := int64(id2 & 0x3fffffffffffff)
-	partition := int32(id2 >> 64)
+	partition := int32(id2 >> 54)
 	return id1, partition, offset, nil
 }
@@ -0,0 +1,74 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"testing"
+	   )
+
+func newTestKeyManager(t *testing.T) *KeyManager {
+	c := &Config {
+		kmFCryptKey: "123aaccs2d",
+		kmKeyTag: "ff5837",
+	}
+	km, err := newKeyManager(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return km
+}
+
+func TestKeyManagerRoundTrip(t *testing.T) {
+	km := newTestKeyManager(t)
+	cases := []struct {
+		id uint64
+		partition int32
+		offset int64
+	}{
+		{1, 0, 0},
+		{1<<40 + 7, 1, 12345},
+		{gIdMaxValue, gPartitionMaxValue, gOffsetMaxValue},
+	}
+	for _, c := range cases {
+		key, err := km.generateKey(c.id, c.partition, c.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, partition, offset, err := km.parseKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != c.id || partition != c.partition || offset != c.offset {
+			t.Fatalf("%+v: got %d/%d/%d", c, id, partition, offset)
+		}
+	}
+	_, err := km.generateKey(1, gPartitionMaxValue+1, 0)
+	if err == nil {
+		t.Fatal("partition over the max accepted")
+	}
+	_, _, _, err = km.parseKey("000000" + "abc")
+	if err == nil {
+		t.Fatal("key without the tag accepted")
+	}
+}
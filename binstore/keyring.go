@@ -0,0 +1,220 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/go-yaml/yaml"
+		"github.com/dzch/go-utils/logger"
+		"crypto/aes"
+		"crypto/cipher"
+		"crypto/rand"
+		"encoding/base64"
+		"encoding/binary"
+		"io/ioutil"
+		"errors"
+		"bytes"
+		"fmt"
+		"io"
+	   )
+
+/*
+   envelope encryption of blobs: each blob gets a random aes-256 data key,
+   the data is sealed with it by aes-gcm and the data key is sealed by the
+   master key. meta keeps the master key id and the sealed data key, so the
+   blob goes into the broker and the store as
+     data     := nonce | gcm(data key, data, id)
+     data_key := nonce | gcm(master key, data key, key id)
+   the keyring file is yaml:
+     active: 2016-01
+     keys:
+       2015-06: <base64 of 16, 24 or 32 bytes>
+       2016-01: <base64 of 16, 24 or 32 bytes>
+   new blobs use the active key. to rotate, add a key and make it active,
+   old keys stay in the file as long as blobs sealed by them are kept.
+   only the data is sealed. meta, with the md5 of the data, and the sums of
+   the dedup index are kept plain, they find and check blobs without a key.
+*/
+var (
+		gDataKeySize = 32
+		errDecrypt = errors.New("fail to decrypt blob")
+	)
+
+type Keyring struct {
+	file string
+	active string
+	keys map[string]cipher.AEAD
+}
+
+func newKeyring(file string) (*Keyring, error) {
+    kr := &Keyring {
+        file: file,
+		keys: make(map[string]cipher.AEAD),
+	}
+	err := kr.init()
+	if err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+func (kr *Keyring) init() error {
+	content, err := ioutil.ReadFile(kr.file)
+	if err != nil {
+		return err
+	}
+	m := make(map[interface{}]interface{})
+	err = yaml.Unmarshal(content, &m)
+	if err != nil {
+		return err
+	}
+	active, ok := m["active"]
+	if !ok {
+		return errors.New("active not found in keyring file")
+	}
+	kr.active = fmt.Sprint(active)
+	keysi, ok := m["keys"]
+	if !ok {
+		return errors.New("keys not found in keyring file")
+	}
+	keys, ok := keysi.(map[interface{}]interface{})
+	if !ok {
+		return errors.New("keys is not map")
+	}
+	for idi, vi := range keys {
+		id := fmt.Sprint(idi)
+		v, ok := vi.(string)
+		if !ok {
+			return errors.New(fmt.Sprintf("key %s is not string", id))
+		}
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return errors.New(fmt.Sprintf("key %s is not base64: %s", id, err.Error()))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return errors.New(fmt.Sprintf("key %s: %s", id, err.Error()))
+		}
+		kr.keys[id] = aead
+	}
+	if _, ok := kr.keys[kr.active]; !ok {
+		return errors.New(fmt.Sprintf("active key %s not in keys", kr.active))
+	}
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// data of blob id sealed into buf, meta gets the key id and the sealed data key
+func (kr *Keyring) seal(id uint64, data []byte, meta *ObjectMeta, buf *bytes.Buffer) ([]byte, error) {
+	dataKey := make([]byte, gDataKeySize)
+	_, err := io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	master := kr.keys[kr.active]
+	sealedKey, err := sealWith(master, dataKey, []byte(kr.active), nil)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	buf.Reset()
+	sealed, err := sealWith(aead, data, blobAD(id), buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	meta.KeyId = kr.active
+	meta.DataKey = sealedKey
+	return sealed, nil
+}
+
+// the data of blob id as sealed, and meta without the data key, the key id
+// is left for /stat. meta is not changed. a blob that was not sealed is
+// returned as it is.
+func (kr *Keyring) open(id uint64, data []byte, meta *ObjectMeta) ([]byte, *ObjectMeta, error) {
+	if meta == nil || len(meta.DataKey) == 0 {
+		return data, meta, nil
+	}
+	if kr == nil {
+		logger.Warning("fail to decrypt: id=%d, no keyring for key %s", id, meta.KeyId)
+		return nil, nil, errDecrypt
+	}
+	master, ok := kr.keys[meta.KeyId]
+	if !ok {
+		logger.Warning("fail to decrypt: id=%d, key %s not in keyring", id, meta.KeyId)
+		return nil, nil, errDecrypt
+	}
+	dataKey, err := openWith(master, meta.DataKey, []byte(meta.KeyId))
+	if err != nil {
+		logger.Warning("fail to decrypt data key: id=%d, key=%s, %s", id, meta.KeyId, err.Error())
+		return nil, nil, errDecrypt
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, nil, errDecrypt
+	}
+	out, err := openWith(aead, data, blobAD(id))
+	if err != nil {
+		logger.Warning("fail to decrypt data: id=%d, key=%s, %s", id, meta.KeyId, err.Error())
+		return nil, nil, errDecrypt
+	}
+	ometa := *meta
+	ometa.DataKey = nil
+	return out, &ometa, nil
+}
+
+// nonce | sealed, appended to dst
+func sealWith(aead cipher.AEAD, plain []byte, ad []byte, dst []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+	return aead.Seal(dst, nonce, plain, ad), nil
+}
+
+func openWith(aead cipher.AEAD, sealed []byte, ad []byte) ([]byte, error) {
+	ns := aead.NonceSize()
+	if len(sealed) < ns {
+		return nil, errors.New("sealed data too short")
+	}
+	return aead.Open(nil, sealed[:ns], sealed[ns:], ad)
+}
+
+// the blob id is authenticated with the data, a sealed blob copied under
+// another id does not open
+func blobAD(id uint64) []byte {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, id)
+	return ad
+}
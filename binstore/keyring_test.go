@@ -0,0 +1,250 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"encoding/base64"
+		"net/http"
+		"net/http/httptest"
+		"path/filepath"
+		"io/ioutil"
+		"strings"
+		"os"
+		"testing"
+		"bytes"
+		"fmt"
+	   )
+
+// a keyring file of keys named by ids, each key the id repeated to 32 bytes
+func writeTestKeyring(t *testing.T, file string, active string, ids ...string) {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "active: %s\nkeys:\n", active)
+	for _, id := range ids {
+		key := bytes.Repeat([]byte(id), 32)[:32]
+		fmt.Fprintf(b, "  %s: %s\n", id, base64.StdEncoding.EncodeToString(key))
+	}
+	err := ioutil.WriteFile(file, b.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestKeyring(t *testing.T, file string) *Keyring {
+	kr, err := newKeyring(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+func TestKeyringSealOpen(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keyring.yaml")
+	writeTestKeyring(t, file, "k1", "k1")
+	kr := newTestKeyring(t, file)
+	plain := []byte("a private document")
+	meta := &ObjectMeta{ContentType: "text/plain"}
+	sealed, err := kr.seal(7, plain, meta, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, plain) || meta.KeyId != "k1" || len(meta.DataKey) == 0 {
+		t.Fatalf("sealed: %q, meta %+v", sealed, meta)
+	}
+	// a data key of its own for each blob
+	meta2 := &ObjectMeta{}
+	sealed2, _ := kr.seal(7, plain, meta2, &bytes.Buffer{})
+	if bytes.Equal(sealed, sealed2) || bytes.Equal(meta.DataKey, meta2.DataKey) {
+		t.Fatal("data key reused")
+	}
+	out, ometa, err := kr.open(7, sealed, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, plain) || ometa.DataKey != nil || ometa.KeyId != "k1" || len(meta.DataKey) == 0 {
+		t.Fatalf("open: %q, meta %+v", out, ometa)
+	}
+	// the id is authenticated, so is every byte of data and data key
+	_, _, err = kr.open(8, sealed, meta)
+	if err != errDecrypt {
+		t.Fatalf("other id: %v", err)
+	}
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered) - 1] ^= 1
+	_, _, err = kr.open(7, tampered, meta)
+	if err != errDecrypt {
+		t.Fatalf("tampered data: %v", err)
+	}
+	tmeta := *meta
+	tmeta.DataKey = append([]byte(nil), meta.DataKey...)
+	tmeta.DataKey[0] ^= 1
+	_, _, err = kr.open(7, sealed, &tmeta)
+	if err != errDecrypt {
+		t.Fatalf("tampered data key: %v", err)
+	}
+	_, _, err = kr.open(7, sealed[:4], meta)
+	if err != errDecrypt {
+		t.Fatalf("short data: %v", err)
+	}
+	// blobs that were not sealed are read as they are, sealed ones need a keyring
+	out, _, err = kr.open(7, plain, &ObjectMeta{})
+	if err != nil || !bytes.Equal(out, plain) {
+		t.Fatalf("not sealed: %q %v", out, err)
+	}
+	var none *Keyring
+	_, _, err = none.open(7, sealed, meta)
+	if err != errDecrypt {
+		t.Fatalf("no keyring: %v", err)
+	}
+}
+
+func TestKeyringRotate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keyring.yaml")
+	writeTestKeyring(t, file, "2015-06", "2015-06")
+	plain := []byte("sealed before the rotation")
+	old := &ObjectMeta{}
+	sealedOld, err := newTestKeyring(t, file).seal(1, plain, old, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a new active key, the old one is kept for what it sealed
+	writeTestKeyring(t, file, "2016-01", "2015-06", "2016-01")
+	kr := newTestKeyring(t, file)
+	out, _, err := kr.open(1, sealedOld, old)
+	if err != nil || !bytes.Equal(out, plain) {
+		t.Fatalf("old blob: %q %v", out, err)
+	}
+	meta := &ObjectMeta{}
+	sealed, err := kr.seal(2, plain, meta, &bytes.Buffer{})
+	if err != nil || meta.KeyId != "2016-01" {
+		t.Fatalf("new blob: %+v %v", meta, err)
+	}
+	// once the old key is dropped its blobs are lost, the new ones are not
+	writeTestKeyring(t, file, "2016-01", "2016-01")
+	kr = newTestKeyring(t, file)
+	_, _, err = kr.open(1, sealedOld, old)
+	if err != errDecrypt {
+		t.Fatalf("dropped key: %v", err)
+	}
+	out, _, err = kr.open(2, sealed, meta)
+	if err != nil || !bytes.Equal(out, plain) {
+		t.Fatalf("new blob: %q %v", out, err)
+	}
+	// the same id under another key does not open with the wrong one
+	fake := *old
+	fake.KeyId = "2016-01"
+	_, _, err = kr.open(1, sealedOld, &fake)
+	if err != errDecrypt {
+		t.Fatalf("wrong key: %v", err)
+	}
+}
+
+func TestKeyringFile(t *testing.T) {
+	dir := t.TempDir()
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	bad := []string {
+		"keys:\n  k1: " + key + "\n",
+		"active: k1\n",
+		"active: k2\nkeys:\n  k1: " + key + "\n",
+		"active: k1\nkeys:\n  k1: not base64!\n",
+		"active: k1\nkeys:\n  k1: " + base64.StdEncoding.EncodeToString([]byte("short")) + "\n",
+		"active: k1\nkeys: [k1]\n",
+	}
+	for i, content := range bad {
+		file := filepath.Join(dir, fmt.Sprintf("keyring%d.yaml", i))
+		ioutil.WriteFile(file, []byte(content), 0600)
+		_, err := newKeyring(file)
+		if err == nil {
+			t.Fatalf("accepted: %q", content)
+		}
+	}
+	_, err := newKeyring(filepath.Join(dir, "missing.yaml"))
+	if err == nil {
+		t.Fatal("missing file accepted")
+	}
+	// 16 and 24 byte keys are aes-128 and aes-192, ids may be numbers
+	file := filepath.Join(dir, "keyring.yaml")
+	ioutil.WriteFile(file, []byte("active: 2\nkeys:\n  1: " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16)) + "\n  2: " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 24)) + "\n"), 0600)
+	kr := newTestKeyring(t, file)
+	if kr.active != "2" || len(kr.keys) != 2 {
+		t.Fatalf("%+v", kr)
+	}
+}
+
+func checkNotInFiles(t *testing.T, dir string, plain string) {
+	n := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(content, []byte(plain)) {
+			t.Fatalf("plain data in %s", path)
+		}
+		n ++
+		return nil
+	})
+	if err != nil || n == 0 {
+		t.Fatalf("%d files in %s, %v", n, dir, err)
+	}
+}
+
+// blobs of a namespace with encrypt, read back from the broker and the store
+func TestKeyringBinStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keyring.yaml")
+	writeTestKeyring(t, file, "k1", "k1")
+	bs, err := newTestBinStoreWith(t, fmt.Sprintf("encryption:\n keyring_file: %s\n encrypt: true\n", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(bs.server.Handler)
+	defer srv.Close()
+	plain := strings.Repeat("a private document ", 10)
+	key := addTestBlob(t, bs, plain, "text/plain")
+	ns, _, partition, offset, err := bs.parseKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ns.broker.log.Fetch(partition, offset)
+	if err != nil || bytes.Contains(msg, []byte("a private document")) {
+		t.Fatalf("plain data in the broker: %v", err)
+	}
+	for _, where := range []string{"broker", "store"} {
+		if where == "store" {
+			archiveKey(t, bs, srv.URL, key)
+			checkNotInFiles(t, ns.config.storePackDir, "a private document")
+		}
+		w := getTestBlob(bs, "GET", key, nil)
+		if w.Code != http.StatusOK || w.Body.String() != plain {
+			t.Fatalf("%s: %d %q", where, w.Code, w.Body)
+		}
+		checkFrame(t, mgetTest(t, bs, []string{key})[0], http.StatusOK, plain)
+		_, res := statTestBlob(t, bs, key)
+		if res == nil || res.KeyId != "k1" || res.Size != len(plain) {
+			t.Fatalf("%s stat: %+v", where, res)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"io/ioutil"
+		"os"
+		"path/filepath"
+		"strconv"
+		"strings"
+		"sync"
+		"errors"
+		"fmt"
+	   )
+
+/*
+   lease id layout:
+     node(10) | leased counter(54)
+   the lease file is local, so every node sharing a store has its own node id.
+*/
+var (
+		gLeaseCounterBits = uint(54)
+		gLeaseNodeMax = int64(1<<10 - 1)
+		gLeaseCounterMax = uint64(1<<54 - 1)
+	)
+
+// LeaseIdAllocator leases blocks of ids by writing the end of the block to a
+// local file before handing any of them out. after a restart allocation goes on
+// from the end of the last lease, the rest of that block is skipped.
+type LeaseIdAllocator struct {
+	config *Config
+	file string
+	blockSize uint64
+	node uint64
+	last uint64
+	limit uint64
+	lock *sync.Mutex
+}
+
+func newLeaseIdAllocator(config *Config) (*LeaseIdAllocator, error) {
+    la := &LeaseIdAllocator {
+        config: config,
+		file: config.kmLeaseFile,
+		blockSize: config.kmLeaseBlockSize,
+		lock: &sync.Mutex{},
+	}
+	if config.kmLeaseNode < 0 || config.kmLeaseNode > gLeaseNodeMax {
+		return nil, errors.New(fmt.Sprintf("lease node id shall be in [0, %d], now is %d", gLeaseNodeMax, config.kmLeaseNode))
+	}
+	if config.kmLeaseMinId > gLeaseCounterMax {
+		return nil, errors.New(fmt.Sprintf("lease min id shall be <= %d, now is %d", gLeaseCounterMax, config.kmLeaseMinId))
+	}
+	la.node = uint64(config.kmLeaseNode) << gLeaseCounterBits
+	err := la.init()
+	if err != nil {
+		return nil, err
+	}
+	return la, nil
+}
+
+func (la *LeaseIdAllocator) init() error {
+	err := os.MkdirAll(filepath.Dir(la.file), 0755)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(la.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		la.limit, err = strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid lease file %s: %s", la.file, err.Error()))
+		}
+	} else if !la.config.kmLeaseMinIdSet {
+		// the first start, ids may have come from redis before
+		return errors.New(fmt.Sprintf("lease file %s does not exist, km lease_min_id must be set on the first start: above the last id redis gave out, or 0 for a new deployment", la.file))
+	}
+	if la.limit < la.config.kmLeaseMinId {
+		la.limit = la.config.kmLeaseMinId
+	}
+	la.last = la.limit
+	return nil
+}
+
+// a lease lost in a crash would hand its ids out again
+func (la *LeaseIdAllocator) persistLimit(limit uint64) error {
+	return writeFileSynced(la.file, []byte(strconv.FormatUint(limit, 10)))
+}
+
+func (la *LeaseIdAllocator) NewId() (uint64, error) {
+	la.lock.Lock()
+	defer la.lock.Unlock()
+	err := la.lease(1)
+	if err != nil {
+		return 0, err
+	}
+	la.last ++
+	return la.node | la.last, nil
+}
+
+func (la *LeaseIdAllocator) NewIds(n int) ([]uint64, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	la.lock.Lock()
+	defer la.lock.Unlock()
+	err := la.lease(uint64(n))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint64, n)
+	for i := range ids {
+		la.last ++
+		ids[i] = la.node | la.last
+	}
+	return ids, nil
+}
+
+// make sure n more ids are leased, with one write of the lease file.
+// must hold la.lock
+func (la *LeaseIdAllocator) lease(n uint64) error {
+	if la.limit - la.last >= n {
+		return nil
+	}
+	blocks := (n - (la.limit - la.last) + la.blockSize - 1)/la.blockSize
+	if (gLeaseCounterMax - la.limit)/la.blockSize < blocks {
+		return errors.New("ids are exhausted")
+	}
+	limit := la.limit + blocks*la.blockSize
+	err := la.persistLimit(limit)
+	if err != nil {
+		return errors.New(fmt.Sprintf("fail to lease ids: %s", err.Error()))
+	}
+	la.limit = limit
+	return nil
+}
@@ -0,0 +1,130 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"io/ioutil"
+		"path/filepath"
+		"testing"
+	   )
+
+func testLeaseConfig(t *testing.T) *Config {
+	return &Config {
+        kmLeaseFile: filepath.Join(t.TempDir(), "data", "idlease"),
+		kmLeaseBlockSize: 3,
+		kmLeaseMinId: 10,
+		kmLeaseMinIdSet: true,
+	}
+}
+
+func newTestLeaseIdAllocator(t *testing.T, config *Config) *LeaseIdAllocator {
+	la, err := newLeaseIdAllocator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return la
+}
+
+func TestLeaseIdAllocatorRestart(t *testing.T) {
+	c := testLeaseConfig(t)
+	la := newTestLeaseIdAllocator(t, c)
+	for want := uint64(11); want <= 14; want++ {
+		id, err := la.NewId()
+		if err != nil || id != want {
+			t.Fatalf("id: %d %v, want %d", id, err, want)
+		}
+	}
+	// the lease of 15 and 16 is lost with the restart, not reused
+	content, _ := ioutil.ReadFile(c.kmLeaseFile)
+	if string(content) != "16" {
+		t.Fatalf("lease file: %q", content)
+	}
+	la = newTestLeaseIdAllocator(t, c)
+	id, _ := la.NewId()
+	if id != 17 {
+		t.Fatalf("after restart: %d", id)
+	}
+	// one write for all of them
+	ids, err := la.NewIds(10)
+	if err != nil || len(ids) != 10 || ids[0] != 18 || ids[9] != 27 {
+		t.Fatalf("ids: %v %v", ids, err)
+	}
+	content, _ = ioutil.ReadFile(c.kmLeaseFile)
+	if string(content) != "28" {
+		t.Fatalf("lease file: %q", content)
+	}
+	// a min id above the lease wins
+	c.kmLeaseMinId = 100
+	la = newTestLeaseIdAllocator(t, c)
+	id, _ = la.NewId()
+	if id != 101 {
+		t.Fatalf("min id: %d", id)
+	}
+}
+
+func TestLeaseIdAllocatorFirstStart(t *testing.T) {
+	c := testLeaseConfig(t)
+	// ids redis gave out before would come again
+	c.kmLeaseMinIdSet = false
+	_, err := newLeaseIdAllocator(c)
+	if err == nil {
+		t.Fatal("first start without lease_min_id")
+	}
+	c.kmLeaseMinIdSet = true
+	la := newTestLeaseIdAllocator(t, c)
+	la.NewId()
+	// once leased, the file is what counts
+	c.kmLeaseMinIdSet = false
+	la = newTestLeaseIdAllocator(t, c)
+	id, _ := la.NewId()
+	if id != 14 {
+		t.Fatalf("id: %d", id)
+	}
+}
+
+func TestLeaseIdAllocatorNode(t *testing.T) {
+	c := testLeaseConfig(t)
+	c.kmLeaseNode = 3
+	la := newTestLeaseIdAllocator(t, c)
+	id, _ := la.NewId()
+	if id != 3<<gLeaseCounterBits | 11 {
+		t.Fatalf("id: %x", id)
+	}
+	c.kmLeaseNode = gLeaseNodeMax + 1
+	_, err := newLeaseIdAllocator(c)
+	if err == nil {
+		t.Fatal("node id out of range")
+	}
+	c = testLeaseConfig(t)
+	c.kmLeaseMinId = gLeaseCounterMax - 4
+	la = newTestLeaseIdAllocator(t, c)
+	_, err = la.NewIds(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = la.NewIds(3)
+	if err == nil {
+		t.Fatal("ids past the counter bits")
+	}
+}
@@ -0,0 +1,64 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"errors"
+		"fmt"
+	   )
+
+var (
+		errLogNoMessage = errors.New("no message at the offset")
+	)
+
+// MessageLog is the partitioned log new blobs are written to first. keys are
+// generated from the partition and offset Append returns, so an offset must
+// never be reused. implementations must be concurrent safe.
+type MessageLog interface {
+	// append value to the given partition, returns where it is written
+	Append(partition int32, value []byte) (int32, int64, error)
+	// errLogNoMessage if there is none at offset, never written or dropped
+	Fetch(partition int32, offset int64) ([]byte, error)
+	// values[i] or errs[i] is set for locs[i]
+	FetchMany(locs []logLocation) ([][]byte, []error)
+	WritablePartitions() ([]int32, error)
+	// low is the oldest offset still kept, high is the offset of the next append
+	Watermarks(partition int32) (int64, int64, error)
+}
+
+// where a message is in the log
+type logLocation struct {
+	partition int32
+	offset int64
+}
+
+func newMessageLog(config *Config) (MessageLog, error) {
+	switch config.brokerLog {
+		case "kafka":
+			return newKafkaLog(config, config.brokerTopic)
+		case "segment":
+			return newSegmentLog(config, config.brokerTopic)
+	}
+	return nil, errors.New(fmt.Sprintf("unknown broker log: %s", config.brokerLog))
+}
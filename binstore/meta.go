@@ -0,0 +1,267 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"net/http"
+		"net/url"
+		"strconv"
+		"time"
+		"mime"
+		"path/filepath"
+		"strings"
+		"errors"
+		"fmt"
+	   )
+
+var (
+		gMetaHeaderPrefix = "X-Binstore-Meta-"
+		gMetaMaxSize = 8*1024
+		// raster images are shown by browsers without running anything, any
+		// other type is sent as an attachment so it is never rendered on our origin
+		gInlineContentTypes = map[string]bool {
+			"image/png": true,
+			"image/jpeg": true,
+			"image/gif": true,
+			"image/webp": true,
+			"image/bmp": true,
+		}
+	)
+
+// ObjectMeta is given on /add and kept with the blob in the broker message and
+// in the store, /get sends it back as response headers.
+type ObjectMeta struct {
+	ContentType string `bson:"content_type,omitempty"`
+	Filename string `bson:"filename,omitempty"`
+	// X-Binstore-Meta-* headers, without the prefix
+	Headers map[string]string `bson:"headers,omitempty"`
+	// unix time of the /add
+	Ctime int64 `bson:"ctime,omitempty"`
+	// unix time after which it is gone, 0 for never
+	Expire int64 `bson:"expire,omitempty"`
+	// codec of the data as kept, empty for none, see codec.go
+	Encoding string `bson:"encoding,omitempty"`
+	// master key and sealed data key of an encrypted blob, see keyring.go
+	KeyId string `bson:"key_id,omitempty"`
+	DataKey []byte `bson:"data_key,omitempty"`
+	// of the data as added, before compression and encryption
+	Md5 []byte `bson:"md5,omitempty"`
+}
+
+func (meta *ObjectMeta) reset() {
+	meta.ContentType = ""
+	meta.Filename = ""
+	meta.Headers = nil
+	meta.Ctime = 0
+	meta.Expire = 0
+	meta.Encoding = ""
+	meta.KeyId = ""
+	meta.DataKey = nil
+	meta.Md5 = nil
+}
+
+func (meta *ObjectMeta) parseRequest(r *http.Request) error {
+	err := meta.parseHeader(r.Header, r.URL.Query().Get("filename"))
+	if err != nil {
+		return err
+	}
+	return meta.parseExpire(r.URL.Query(), time.Now())
+}
+
+// header of a request or of a multipart part, name is used if there is no
+// filename in Content-Disposition
+func (meta *ObjectMeta) parseHeader(header http.Header, name string) error {
+	meta.reset()
+	ct := header.Get("Content-Type")
+	if len(ct) > 0 {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid Content-Type: %s", ct))
+		}
+		// what curl -d sends when told nothing, not a real type
+		if mt != "application/x-www-form-urlencoded" {
+			meta.ContentType = ct
+		}
+	}
+	if cd := header.Get("Content-Disposition"); len(cd) > 0 {
+		_, params, err := mime.ParseMediaType(cd)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid Content-Disposition: %s", cd))
+		}
+		if len(params["filename"]) > 0 {
+			name = params["filename"]
+		}
+	}
+	meta.setFilename(name)
+	for k, v := range header {
+		if !strings.HasPrefix(k, gMetaHeaderPrefix) || len(k) == len(gMetaHeaderPrefix) || len(v) == 0 {
+			continue
+		}
+		if meta.Headers == nil {
+			meta.Headers = make(map[string]string)
+		}
+		meta.Headers[k[len(gMetaHeaderPrefix):]] = v[0]
+	}
+	return meta.check()
+}
+
+func (meta *ObjectMeta) setFilename(name string) {
+	meta.Filename = ""
+	if len(name) == 0 {
+		return
+	}
+	// only the base name, clients send full paths
+	name = filepath.Base(strings.Replace(name, "\\", "/", -1))
+	if name != "." && name != "/" {
+		meta.Filename = name
+	}
+}
+
+func (meta *ObjectMeta) check() error {
+	size := len(meta.ContentType) + len(meta.Filename)
+	for k, v := range meta.Headers {
+		size += len(k) + len(v)
+	}
+	if size > gMetaMaxSize {
+		return errors.New(fmt.Sprintf("meta exceeds %d bytes", gMetaMaxSize))
+	}
+	return nil
+}
+
+// ?ttl= in seconds or ?expire= as unix time, at most one of them
+func (meta *ObjectMeta) parseExpire(qv url.Values, now time.Time) error {
+	ttl, expire := qv.Get("ttl"), qv.Get("expire")
+	if len(ttl) > 0 && len(expire) > 0 {
+		return errors.New("ttl and expire are exclusive")
+	}
+	if len(ttl) > 0 {
+		secs, err := strconv.ParseInt(ttl, 10, 64)
+		if err != nil || secs <= 0 {
+			return errors.New(fmt.Sprintf("invalid ttl: %s", ttl))
+		}
+		meta.Expire = now.Unix() + secs
+	}
+	if len(expire) > 0 {
+		at, err := strconv.ParseInt(expire, 10, 64)
+		if err != nil || at <= now.Unix() {
+			return errors.New(fmt.Sprintf("invalid expire: %s", expire))
+		}
+		meta.Expire = at
+	}
+	return nil
+}
+
+func (meta *ObjectMeta) expired(now time.Time) bool {
+	return meta.Expire > 0 && now.Unix() >= meta.Expire
+}
+
+func (meta *ObjectMeta) writeHeader(header http.Header) {
+	if len(meta.ContentType) > 0 {
+		header.Set("Content-Type", meta.ContentType)
+	}
+	for k, v := range meta.Headers {
+		header.Set(gMetaHeaderPrefix + k, v)
+	}
+	if len(meta.Encoding) > 0 {
+		header.Set("Content-Encoding", meta.Encoding)
+	}
+	if meta.Expire > 0 {
+		header.Set("Expires", time.Unix(meta.Expire, 0).UTC().Format(http.TimeFormat))
+	}
+}
+
+// Content-Disposition for a blob of contentType, inline only for the types in
+// gInlineContentTypes. filename may be empty.
+func contentDisposition(contentType string, filename string) string {
+	disposition := "attachment"
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err == nil && gInlineContentTypes[mt] {
+		disposition = "inline"
+	}
+	if len(filename) == 0 {
+		return disposition
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": filename})
+}
+
+// as packed in msgp
+func (meta *ObjectMeta) toMap() map[string]interface{} {
+	m := make(map[string]interface{})
+	if len(meta.ContentType) > 0 {
+		m["content_type"] = meta.ContentType
+	}
+	if len(meta.Filename) > 0 {
+		m["filename"] = meta.Filename
+	}
+	if len(meta.Headers) > 0 {
+		m["headers"] = meta.Headers
+	}
+	if meta.Ctime > 0 {
+		m["ctime"] = meta.Ctime
+	}
+	if meta.Expire > 0 {
+		m["expire"] = meta.Expire
+	}
+	if len(meta.Encoding) > 0 {
+		m["encoding"] = meta.Encoding
+	}
+	if len(meta.KeyId) > 0 {
+		m["key_id"] = meta.KeyId
+	}
+	if len(meta.DataKey) > 0 {
+		m["data_key"] = meta.DataKey
+	}
+	if len(meta.Md5) > 0 {
+		m["md5"] = meta.Md5
+	}
+	return m
+}
+
+// mi is what msgp decoded, nil if the message has no meta
+func metaFromMap(mi interface{}) *ObjectMeta {
+	m, ok := mi.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	meta := &ObjectMeta{}
+	meta.ContentType, _ = m["content_type"].(string)
+	meta.Filename, _ = m["filename"].(string)
+	meta.Ctime, _ = msgpInt64(m["ctime"])
+	meta.Expire, _ = msgpInt64(m["expire"])
+	meta.Encoding, _ = m["encoding"].(string)
+	meta.KeyId, _ = m["key_id"].(string)
+	meta.DataKey, _ = m["data_key"].([]byte)
+	meta.Md5, _ = m["md5"].([]byte)
+	headers, ok := m["headers"].(map[string]interface{})
+	if ok && len(headers) > 0 {
+		meta.Headers = make(map[string]string)
+		for k, v := range headers {
+			s, ok := v.(string)
+			if ok {
+				meta.Headers[k] = s
+			}
+		}
+	}
+	return meta
+}
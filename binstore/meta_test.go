@@ -0,0 +1,133 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/tinylib/msgp/msgp"
+		"net/http"
+		"reflect"
+		"bytes"
+		"testing"
+	   )
+
+// m through msgp and back, as it goes in a broker message
+func decodeTestMap(t *testing.T, m map[string]interface{}) interface{} {
+	var buf bytes.Buffer
+	wr := msgp.NewWriter(&buf)
+	err := wr.WriteIntf(map[string]interface{}{"meta": m})
+	if err == nil {
+		err = wr.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := decodeMessage(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg["meta"]
+}
+
+func TestMetaParseHeader(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Disposition", `attachment; filename="report.txt"`)
+	header.Set("X-Binstore-Meta-Owner", "alice")
+	meta := &ObjectMeta{}
+	err := meta.parseHeader(header, `C:\tmp\ignored.txt`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.ContentType != "text/plain; charset=utf-8" || meta.Filename != "report.txt" || meta.Headers["Owner"] != "alice" {
+		t.Fatalf("%+v", meta)
+	}
+	// the name given aside, as a base name
+	header.Del("Content-Disposition")
+	meta.parseHeader(header, `C:\tmp\upload.txt`)
+	if meta.Filename != "upload.txt" {
+		t.Fatalf("filename: %q", meta.Filename)
+	}
+	header.Set("Content-Type", "application/x-www-form-urlencoded")
+	meta.parseHeader(header, "")
+	if len(meta.ContentType) != 0 {
+		t.Fatalf("curl default type kept: %q", meta.ContentType)
+	}
+	header.Set("Content-Type", "not a type;;")
+	err = meta.parseHeader(header, "")
+	if err == nil {
+		t.Fatal("invalid Content-Type accepted")
+	}
+	header = http.Header{}
+	header.Set("X-Binstore-Meta-Big", string(make([]byte, gMetaMaxSize+1)))
+	err = meta.parseHeader(header, "")
+	if err == nil {
+		t.Fatal("meta over the max accepted")
+	}
+}
+
+func TestMetaMap(t *testing.T) {
+	meta := &ObjectMeta {
+		ContentType: "image/png",
+		Filename: "a.png",
+		Headers: map[string]string{"Owner": "alice"},
+		Ctime: 1000,
+		Expire: 2000,
+		Encoding: "gzip",
+		KeyId: "k1",
+		DataKey: []byte{1, 2},
+		Md5: []byte{3, 4},
+	}
+	back := metaFromMap(decodeTestMap(t, meta.toMap()))
+	if !reflect.DeepEqual(back, meta) {
+		t.Fatalf("%+v != %+v", back, meta)
+	}
+	if metaFromMap(nil) != nil {
+		t.Fatal("meta of a message without one")
+	}
+}
+
+func TestMetaDisposition(t *testing.T) {
+	bs := newTestBinStore(t)
+	cases := []struct {
+		data string
+		contentType string
+		want string
+	}{
+		{"<script>alert(1)</script>", "text/html", "attachment"},
+		{"<svg onload=alert(1)>", "image/svg+xml", "attachment"},
+		{"\x89PNG\r\n\x1a\n0000", "image/png", "inline"},
+		// sniffed as text/html, still not rendered
+		{"<html><script>alert(1)</script>", "", "attachment"},
+	}
+	for _, c := range cases {
+		key := addTestBlob(t, bs, c.data, c.contentType)
+		w := getTestBlob(bs, "GET", key, nil)
+		if w.Header().Get("Content-Disposition") != c.want || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Fatalf("%q: %v", c.contentType, w.Header())
+		}
+	}
+	if contentDisposition("image/jpeg", "a b.jpg") != `inline; filename="a b.jpg"` {
+		t.Fatal(contentDisposition("image/jpeg", "a b.jpg"))
+	}
+}
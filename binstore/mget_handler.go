@@ -0,0 +1,355 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/dzch/go-utils/logger"
+		"github.com/tinylib/msgp/msgp"
+		"net/http"
+		"bufio"
+		"fmt"
+		"strings"
+		"sync"
+		"time"
+	   )
+
+/*
+   /mget?key=k1&key=k2 or a POST body of keys, one per line. the response is
+   application/x-msgpack, one frame per key in the order asked:
+     frame := {key, status, data, meta} or {key, status, code, error}
+   status and code are what /get would answer for that key alone. blobs past
+   max_batch_body_size in total are answered 413 body_too_large.
+   room for max_body_size per blob is reserved before it is fetched, so what
+   is held is max_batch_body_size, plus one blob once less than that is left.
+*/
+type MGetHandler struct {
+	bs *BinStore
+}
+
+type mgetEntry struct {
+	key string
+	id uint64
+	partition int32
+	offset int64
+	status int
+	code string
+	err string
+	data []byte
+	meta *ObjectMeta
+}
+
+func newMGetHandler(bs *BinStore) *MGetHandler {
+	return &MGetHandler {bs: bs}
+}
+
+func (h *MGetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    startTime := time.Now()
+	keys, err := h.readKeys(w, r)
+	if err != nil {
+		logger.Warning("invalid query, fail to read keys: %s, %s", r.URL.String(), err.Error())
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if len(keys) == 0 || len(keys) > h.bs.config.httpServerMaxBatchItems {
+		logger.Warning("invalid query, need 1 to %d keys: %s, %d", h.bs.config.httpServerMaxBatchItems, r.URL.String(), len(keys))
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("need 1 to %d keys", h.bs.config.httpServerMaxBatchItems))
+		return
+	}
+	entries := make([]*mgetEntry, len(keys))
+	for i, key := range keys {
+		entries[i] = &mgetEntry{key: key}
+	}
+	h.getEntries(entries, checkAdminToken(h.bs.config, r))
+	w.Header().Set("Content-Type", "application/x-msgpack")
+	w.WriteHeader(http.StatusOK)
+	wr := msgp.NewWriter(w)
+	nok := 0
+	for _, e := range entries {
+		err = wr.WriteIntf(e.frame())
+		e.data = nil
+		if err != nil {
+			logger.Warning("fail to write response: %s, %s", r.URL.String(), err.Error())
+			return
+		}
+		if e.status == http.StatusOK {
+			nok ++
+		}
+	}
+	err = wr.Flush()
+	if err != nil {
+		logger.Warning("fail to write response: %s, %s", r.URL.String(), err.Error())
+		return
+	}
+    endTime := time.Now()
+	costTimeUS := endTime.Sub(startTime)/time.Microsecond
+	logger.Notice("success process mget: %s, cost_us=%d, keys=%d, ok=%d", r.URL.String(), costTimeUS, len(entries), nok)
+	return
+}
+
+func (h *MGetHandler) readKeys(w http.ResponseWriter, r *http.Request) ([]string, error) {
+	keys := r.URL.Query()["key"]
+	if r.Method != "POST" {
+		return keys, nil
+	}
+	sc := bufio.NewScanner(http.MaxBytesReader(w, r.Body, h.bs.config.httpServerMaxBodySize))
+	for sc.Scan() {
+		key := strings.TrimSpace(sc.Text())
+		if len(key) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys, sc.Err()
+}
+
+// keys of one namespace
+type mgetGroup struct {
+	ns *Namespace
+	inBroker []*mgetEntry
+	inStore []*mgetEntry
+	// shared by all groups
+	budget *mgetBudget
+}
+
+// bytes of the response still allowed
+type mgetBudget struct {
+	lock *sync.Mutex
+	left int64
+	// the most one blob can be
+	per int64
+}
+
+// room for up to n blobs, returns how many may be fetched and the bytes
+// taken for them. with less than one blob of room left, one is fetched
+// against what is left.
+func (b *mgetBudget) reserve(n int) (int, int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.left <= 0 {
+		return 0, 0
+	}
+	k := b.left / b.per
+	if k == 0 {
+		taken := b.left
+		b.left = 0
+		return 1, taken
+	}
+	if k > int64(n) {
+		k = int64(n)
+	}
+	b.left -= k*b.per
+	return int(k), k*b.per
+}
+
+func (b *mgetBudget) refund(n int64) {
+	b.lock.Lock()
+	b.left += n
+	b.lock.Unlock()
+}
+
+// per namespace, keys still in the broker go in FetchMany and the rest in
+// store GetMany, as many at a time as the budget has room for.
+// keys of namespaces with signed_get are refused unless admin
+func (h *MGetHandler) getEntries(entries []*mgetEntry, admin bool) {
+	bs := h.bs
+	groups := make(map[*Namespace]*mgetGroup)
+	budget := &mgetBudget {
+        lock: &sync.Mutex{},
+		left: bs.config.httpServerMaxBatchBodySize,
+		per: bs.config.httpServerMaxBodySize,
+	}
+	for _, e := range entries {
+		ns, id, partition, offset, err := bs.parseKey(e.key)
+		if err != nil {
+			e.status = http.StatusBadRequest
+			e.code = errCodeInvalidKey
+			e.err = err.Error()
+			continue
+		}
+		if ns.config.signRequired && !admin {
+			e.status = http.StatusForbidden
+			e.code = errCodeForbidden
+			e.err = "namespace needs signed urls"
+			continue
+		}
+		e.id, e.partition, e.offset = id, partition, offset
+		ok, err := ns.ao.dataInBroker(e.partition, e.offset)
+		if err != nil {
+			e.setResult(nil, nil, false, err)
+			continue
+		}
+		g, found := groups[ns]
+		if !found {
+			g = &mgetGroup{ns: ns, budget: budget}
+			groups[ns] = g
+		}
+		if ok {
+			g.inBroker = append(g.inBroker, e)
+		} else {
+			g.inStore = append(g.inStore, e)
+		}
+	}
+	wg := &sync.WaitGroup{}
+	for _, g := range groups {
+		g.inBroker = g.dropDeleted(g.inBroker)
+		if len(g.inBroker) > 0 {
+			wg.Add(1)
+			go g.fetchAll(g.inBroker, g.fetchBroker, wg)
+		}
+		if len(g.inStore) > 0 {
+			wg.Add(1)
+			go g.fetchAll(g.inStore, g.fetchStore, wg)
+		}
+	}
+	wg.Wait()
+}
+
+func (g *mgetGroup) fetchAll(entries []*mgetEntry, fetch func([]*mgetEntry), wg *sync.WaitGroup) {
+	defer wg.Done()
+	for len(entries) > 0 {
+		n, reserved := g.budget.reserve(len(entries))
+		if n == 0 {
+			for _, e := range entries {
+				e.setTooLarge()
+			}
+			return
+		}
+		fetch(entries[:n])
+		used := int64(0)
+		for _, e := range entries[:n] {
+			used += e.charge(reserved - used)
+		}
+		g.budget.refund(reserved - used)
+		entries = entries[n:]
+	}
+}
+
+func (g *mgetGroup) fetchBroker(entries []*mgetEntry) {
+	ids := make([]uint64, len(entries))
+	locs := make([]logLocation, len(entries))
+	for i, e := range entries {
+		ids[i] = e.id
+		locs[i] = logLocation{partition: e.partition, offset: e.offset}
+	}
+	datas, metas, errs := g.ns.broker.getDataMany(ids, locs)
+	for i, e := range entries {
+		data, meta, err := g.ns.openData(e.id, datas[i], metas[i], errs[i])
+		e.setResult(data, meta, true, err)
+	}
+}
+
+func (g *mgetGroup) fetchStore(entries []*mgetEntry) {
+	ids := make([]uint64, len(entries))
+	for i, e := range entries {
+		ids[i] = e.id
+	}
+	datas, metas, errs := g.ns.store.getDataMany(ids)
+	for i, e := range entries {
+		data, meta, err := g.ns.openData(e.id, datas[i], metas[i], errs[i])
+		e.setResult(data, meta, false, err)
+	}
+}
+
+// the bytes of e out of room, its data is dropped if it does not fit
+func (e *mgetEntry) charge(room int64) int64 {
+	if e.status != http.StatusOK {
+		return 0
+	}
+	if int64(len(e.data)) <= room {
+		return int64(len(e.data))
+	}
+	e.setTooLarge()
+	return 0
+}
+
+func (e *mgetEntry) setTooLarge() {
+	e.status, e.code = http.StatusRequestEntityTooLarge, errCodeBodyTooLarge
+	e.err = "mget response exceeds max_batch_body_size"
+	e.data = nil
+	e.meta = nil
+}
+
+// tombstones of keys still in the broker are checked in one go
+func (g *mgetGroup) dropDeleted(entries []*mgetEntry) []*mgetEntry {
+	if len(entries) == 0 {
+		return entries
+	}
+	ids := make([]uint64, len(entries))
+	for i, e := range entries {
+		ids[i] = e.id
+	}
+	deleted, err := g.ns.store.areDeleted(ids)
+	var left []*mgetEntry
+	for i, e := range entries {
+		if err != nil {
+			e.setResult(nil, nil, false, err)
+			continue
+		}
+		if deleted[i] {
+			e.setResult(nil, nil, true, ErrBlobDeleted)
+			continue
+		}
+		left = append(left, e)
+	}
+	return left
+}
+
+func (e *mgetEntry) setResult(data []byte, meta *ObjectMeta, inBroker bool, err error) {
+	if err == nil && meta != nil && meta.expired(time.Now()) {
+		err = ErrBlobExpired
+	}
+	if err == nil {
+		data, meta, err = decodeBlob(data, meta)
+		if err != nil {
+			logger.Warning("fail to decodeBlob %s: %s", e.key, err.Error())
+			e.status, e.code, e.err = http.StatusInternalServerError, errCodeInternal, err.Error()
+			return
+		}
+		e.status = http.StatusOK
+		e.data = data
+		e.meta = meta
+		return
+	}
+	e.status, e.code = dataErrorStatus(err, inBroker)
+	if e.status == http.StatusServiceUnavailable {
+		logger.Warning("fail to get %s: %s", e.key, err.Error())
+	}
+	e.err = err.Error()
+}
+
+func (e *mgetEntry) frame() map[string]interface{} {
+	f := map[string]interface{} {
+        "key": e.key,
+		"status": e.status,
+	}
+	if e.status != http.StatusOK {
+		f["code"] = e.code
+		f["error"] = e.err
+		return f
+	}
+	f["data"] = e.data
+	if e.meta != nil {
+		f["meta"] = e.meta.toMap()
+	}
+	return f
+}
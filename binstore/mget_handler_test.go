@@ -0,0 +1,139 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/tinylib/msgp/msgp"
+		"net/http"
+		"net/http/httptest"
+		"strings"
+		"bytes"
+		"io"
+		"sync"
+		"testing"
+	   )
+
+// the frames of an /mget of keys, in order
+func mgetTest(t *testing.T, bs *BinStore, keys []string) []map[string]interface{} {
+	w := serveTest(bs, "GET", "/mget?key=" + strings.Join(keys, "&key="), nil, 0)
+	if w.Code != http.StatusOK {
+		t.Fatalf("mget: %d %s", w.Code, w.Body)
+	}
+	var frames []map[string]interface{}
+	mr := msgp.NewReader(bytes.NewReader(w.Body.Bytes()))
+	for {
+		fi, err := mr.ReadIntf()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, fi.(map[string]interface{}))
+	}
+	if len(frames) != len(keys) {
+		t.Fatalf("%d frames for %d keys", len(frames), len(keys))
+	}
+	return frames
+}
+
+func checkFrame(t *testing.T, f map[string]interface{}, status int, data string) {
+	st, _ := msgpInt64(f["status"])
+	d, _ := f["data"].([]byte)
+	if st != int64(status) || string(d) != data {
+		t.Fatalf("%s: %d %q, want %d %q, %v", f["key"], st, d, status, data, f["error"])
+	}
+}
+
+func TestMGetHandler(t *testing.T) {
+	bs := newTestBinStore(t)
+	srv := httptest.NewServer(bs.server.Handler)
+	defer srv.Close()
+	// the first of its partition, the watermark moves over it alone
+	inStore := addTestBlob(t, bs, "in store", "text/plain")
+	archiveKey(t, bs, srv.URL, inStore)
+	inBroker := addTestBlob(t, bs, "in broker", "text/plain")
+	deleted := addTestBlob(t, bs, "deleted", "text/plain")
+	_, ae := bs.deleteKey(deleted)
+	if ae != nil {
+		t.Fatal(ae)
+	}
+	missing, _ := bs.namespaces[0].km.generateKey(1<<20, 0, 99)
+	frames := mgetTest(t, bs, []string{inStore, "ff5837garbage", inBroker, deleted, missing, inBroker})
+	// keys as a POST body, one per line
+	w := serveTest(bs, "POST", "/mget", strings.NewReader(inBroker + "\n\n" + inStore + "\n"), -1)
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte("in broker")) || !bytes.Contains(w.Body.Bytes(), []byte("in store")) {
+		t.Fatalf("post: %d %q", w.Code, w.Body)
+	}
+	checkFrame(t, frames[0], http.StatusOK, "in store")
+	checkFrame(t, frames[1], http.StatusBadRequest, "")
+	checkFrame(t, frames[2], http.StatusOK, "in broker")
+	checkFrame(t, frames[3], http.StatusGone, "")
+	checkFrame(t, frames[4], http.StatusNotFound, "")
+	checkFrame(t, frames[5], http.StatusOK, "in broker")
+	meta := metaFromMap(frames[0]["meta"])
+	if meta == nil || meta.ContentType != "text/plain" {
+		t.Fatalf("meta: %+v", meta)
+	}
+}
+
+func TestMGetHandlerBudget(t *testing.T) {
+	bs := newTestBinStore(t)
+	bs.config.httpServerMaxBodySize = 10
+	bs.config.httpServerMaxBatchBodySize = 25
+	ten1 := addTestBlob(t, bs, "0123456789", "text/plain")
+	ten2 := addTestBlob(t, bs, "abcdefghij", "text/plain")
+	ten3 := addTestBlob(t, bs, "ABCDEFGHIJ", "text/plain")
+	small := addTestBlob(t, bs, "xyz", "text/plain")
+	// two fit in room reserved up front, with 5 left a blob is tried alone
+	frames := mgetTest(t, bs, []string{ten1, ten2, ten3, small, small})
+	checkFrame(t, frames[0], http.StatusOK, "0123456789")
+	checkFrame(t, frames[1], http.StatusOK, "abcdefghij")
+	checkFrame(t, frames[2], http.StatusRequestEntityTooLarge, "")
+	checkFrame(t, frames[3], http.StatusOK, "xyz")
+	// 2 left, not fetched
+	checkFrame(t, frames[4], http.StatusRequestEntityTooLarge, "")
+}
+
+func TestMGetBudgetReserve(t *testing.T) {
+	b := &mgetBudget{lock: &sync.Mutex{}, left: 35, per: 10}
+	n, taken := b.reserve(5)
+	if n != 3 || taken != 30 {
+		t.Fatalf("%d %d", n, taken)
+	}
+	b.refund(30 - 12)
+	n, taken = b.reserve(1)
+	if n != 1 || taken != 10 || b.left != 13 {
+		t.Fatalf("%d %d, left %d", n, taken, b.left)
+	}
+	b.left = 4
+	n, taken = b.reserve(3)
+	if n != 1 || taken != 4 {
+		t.Fatalf("%d %d", n, taken)
+	}
+	n, _ = b.reserve(3)
+	if n != 0 {
+		t.Fatalf("nothing left: %d", n)
+	}
+}
@@ -0,0 +1,291 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"gopkg.in/mgo.v2"
+		"gopkg.in/mgo.v2/bson"
+		"strings"
+		"strconv"
+		"io/ioutil"
+	   )
+
+var (
+		// documents are limited to 16MB, larger blobs go to gridfs
+		gMgoInlineMaxSize = 15*1024*1024
+	)
+
+type MgoBackend struct {
+	config *Config
+	dialSession *mgo.Session
+}
+
+type QueryResponse struct {
+	Id uint64 "id"
+	Data []byte "data"
+	GridFS bool "gridfs"
+	Deleted bool "deleted"
+	Meta *ObjectMeta "meta"
+}
+
+func newMgoBackend(config *Config) (*MgoBackend, error) {
+    mb := &MgoBackend {
+        config: config,
+	}
+	err := mb.init()
+	if err != nil {
+		return nil, err
+	}
+	return mb, nil
+}
+
+func (mb *MgoBackend) init() error {
+    err := mb.initDialSession()
+	if err != nil {
+		return err
+	}
+	return mb.initIndex()
+}
+
+// Put relies on the unique id to never bring a tombstone back, Expired scans
+// meta.expire, sparse as most blobs never expire
+func (mb *MgoBackend) initIndex() error {
+    s := mb.dialSession.Copy()
+	defer s.Close()
+	c := s.DB(mb.config.storeDbName).C(mb.config.storeCollName)
+	err := c.EnsureIndex(mgo.Index{
+		Key: []string{"id"},
+		Unique: true,
+	})
+	if err != nil {
+		return err
+	}
+	return c.EnsureIndex(mgo.Index{
+		Key: []string{"meta.expire"},
+		Sparse: true,
+	})
+}
+
+func (mb *MgoBackend) initDialSession() error {
+    servers := strings.Join(mb.config.storeServerList, ",")
+    url := "mongodb://" + servers
+    s, err := mgo.DialWithTimeout(url, mb.config.storeConnTimeout)
+	if err != nil {
+		return err
+	}
+	s.SetSyncTimeout(mb.config.storeOperationTimeout)
+	s.SetSocketTimeout(mb.config.storeSocketTimeout)
+	s.SetSafe(&mgo.Safe{W: mb.config.storeWriteConcern})
+	s.SetMode(mgo.Eventual, false)
+	s.SetPoolLimit(mb.config.storeMgoPoolSize)
+	mb.dialSession = s
+	return nil
+}
+
+func (mb *MgoBackend) Put(id uint64, data []byte, meta *ObjectMeta) error {
+	// can do many times repeateadly for one id
+    s := mb.dialSession.Copy()
+	defer s.Close()
+	db := s.DB(mb.config.storeDbName)
+	c := db.C(mb.config.storeCollName)
+	// never bring a deleted blob back: a tombstone does not match the selector,
+	// so the upsert tries to insert and hits the unique id
+	sel := bson.M{"id": id, "deleted": bson.M{"$ne": true}}
+	doc := bson.M{"id": id}
+	if meta != nil {
+		doc["meta"] = meta
+	}
+	if len(data) <= gMgoInlineMaxSize {
+		doc["data"] = data
+		_, err := c.Upsert(sel, doc)
+		if mgo.IsDup(err) {
+			return nil
+		}
+		return err
+	}
+	gfs := db.GridFS(mb.config.storeCollName)
+	err := mb.putGridFS(gfs, id, data)
+	if err != nil {
+		return err
+	}
+	doc["gridfs"] = true
+	_, err = c.Upsert(sel, doc)
+	if mgo.IsDup(err) {
+		return gfs.Remove(strconv.FormatUint(id, 10))
+	}
+	return err
+}
+
+func (mb *MgoBackend) putGridFS(gfs *mgo.GridFS, id uint64, data []byte) error {
+	name := strconv.FormatUint(id, 10)
+	err := gfs.Remove(name)
+	if err != nil {
+		return err
+	}
+	f, err := gfs.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Abort()
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (mb *MgoBackend) Get(id uint64) ([]byte, *ObjectMeta, error) {
+    s := mb.dialSession.Copy()
+	defer s.Close()
+	res := &QueryResponse{}
+	db := s.DB(mb.config.storeDbName)
+	c := db.C(mb.config.storeCollName)
+	err := c.Find(bson.M{"id": id}).One(res)
+	if err == mgo.ErrNotFound {
+		return nil, nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.Deleted {
+		return nil, nil, ErrBlobDeleted
+	}
+	data, err := mb.resData(db, res)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, res.Meta, nil
+}
+
+// one $in for all, blobs in gridfs are still read one by one
+func (mb *MgoBackend) GetMany(ids []uint64) ([][]byte, []*ObjectMeta, []error) {
+	datas := make([][]byte, len(ids))
+	metas := make([]*ObjectMeta, len(ids))
+	errs := make([]error, len(ids))
+    s := mb.dialSession.Copy()
+	defer s.Close()
+	db := s.DB(mb.config.storeDbName)
+	c := db.C(mb.config.storeCollName)
+	var ress []*QueryResponse
+	err := c.Find(bson.M{"id": bson.M{"$in": ids}}).All(&ress)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return datas, metas, errs
+	}
+	found := make(map[uint64]*QueryResponse, len(ress))
+	for _, res := range ress {
+		found[res.Id] = res
+	}
+	for i, id := range ids {
+		res, ok := found[id]
+		if !ok {
+			errs[i] = ErrBlobNotFound
+			continue
+		}
+		if res.Deleted {
+			errs[i] = ErrBlobDeleted
+			continue
+		}
+		datas[i], errs[i] = mb.resData(db, res)
+		metas[i] = res.Meta
+	}
+	return datas, metas, errs
+}
+
+func (mb *MgoBackend) resData(db *mgo.Database, res *QueryResponse) ([]byte, error) {
+	if !res.GridFS {
+		return res.Data, nil
+	}
+	f, err := db.GridFS(mb.config.storeCollName).Open(strconv.FormatUint(res.Id, 10))
+	if err == mgo.ErrNotFound {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// the document is replaced by the tombstone {id, deleted: true}
+func (mb *MgoBackend) Delete(id uint64) error {
+    s := mb.dialSession.Copy()
+	defer s.Close()
+	db := s.DB(mb.config.storeDbName)
+	_, err := db.C(mb.config.storeCollName).Upsert(bson.M{"id": id}, bson.M{"id": id, "deleted": true})
+	if err != nil {
+		return err
+	}
+	return db.GridFS(mb.config.storeCollName).Remove(strconv.FormatUint(id, 10))
+}
+
+func (mb *MgoBackend) Deleted(ids []uint64) ([]bool, error) {
+	deleted := make([]bool, len(ids))
+    s := mb.dialSession.Copy()
+	defer s.Close()
+	c := s.DB(mb.config.storeDbName).C(mb.config.storeCollName)
+	var ress []*QueryResponse
+	err := c.Find(bson.M{"id": bson.M{"$in": ids}, "deleted": true}).Select(bson.M{"id": 1, "_id": 0}).All(&ress)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[uint64]bool, len(ress))
+	for _, res := range ress {
+		found[res.Id] = true
+	}
+	for i, id := range ids {
+		deleted[i] = found[id]
+	}
+	return deleted, nil
+}
+
+func (mb *MgoBackend) Expired(now int64, limit int) ([]uint64, error) {
+    s := mb.dialSession.Copy()
+	defer s.Close()
+	c := s.DB(mb.config.storeDbName).C(mb.config.storeCollName)
+	var ress []*QueryResponse
+	err := c.Find(bson.M{"meta.expire": bson.M{"$gt": 0, "$lte": now}}).Select(bson.M{"id": 1, "_id": 0}).Limit(limit).All(&ress)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint64, len(ress))
+	for i, res := range ress {
+		ids[i] = res.Id
+	}
+	return ids, nil
+}
+
+func (mb *MgoBackend) Purge(id uint64) error {
+    s := mb.dialSession.Copy()
+	defer s.Close()
+	db := s.DB(mb.config.storeDbName)
+	_, err := db.C(mb.config.storeCollName).RemoveAll(bson.M{"id": id, "deleted": bson.M{"$ne": true}})
+	if err != nil {
+		return err
+	}
+	return db.GridFS(mb.config.storeCollName).Remove(strconv.FormatUint(id, 10))
+}
@@ -0,0 +1,188 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"gopkg.in/mgo.v2"
+		"gopkg.in/mgo.v2/bson"
+		"strings"
+	   )
+
+type MgoDeDupIndex struct {
+	config *Config
+	dialSession *mgo.Session
+}
+
+type DeDupResponse struct {
+	Key string "key"
+	Fnv1a uint32 "fnv1a"
+	Md5a uint64 "md5a"
+	Md5b uint64 "md5b"
+}
+
+func newMgoDeDupIndex(config *Config) (*MgoDeDupIndex, error) {
+    mi := &MgoDeDupIndex{
+        config: config,
+	}
+	err := mi.init()
+	if err != nil {
+		return nil, err
+	}
+	return mi, nil
+}
+
+func (mi *MgoDeDupIndex) init() error {
+    err := mi.initSession()
+	if err != nil {
+		return err
+	}
+	return mi.initIndex()
+}
+
+// Delete finds the entries of a key by it, not by their sum. names of s3
+// objects are entries of their own, {name, key}, without a sum
+func (mi *MgoDeDupIndex) initIndex() error {
+    s := mi.dialSession.Copy()
+	defer s.Close()
+	c := s.DB(mi.config.ddDbName).C(mi.config.ddCollName)
+	err := c.EnsureIndex(mgo.Index{
+		Key: []string{"key"},
+	})
+	if err != nil {
+		return err
+	}
+	return c.EnsureIndex(mgo.Index{
+		Key: []string{"name"},
+		Unique: true,
+		Sparse: true,
+	})
+}
+
+func (mi *MgoDeDupIndex) initSession() error {
+    servers := strings.Join(mi.config.ddServerList, ",")
+    url := "mongodb://" + servers
+    s, err := mgo.DialWithTimeout(url, mi.config.ddConnTimeout)
+	if err != nil {
+		return err
+	}
+	s.SetSyncTimeout(mi.config.ddOperationTimeout)
+	s.SetSocketTimeout(mi.config.ddSocketTimeout)
+	s.SetSafe(&mgo.Safe{W: 1})
+	s.SetMode(mgo.Strong, false)
+	s.SetPoolLimit(mi.config.ddMgoPoolSize)
+	mi.dialSession = s
+	return nil
+}
+
+func (mi *MgoDeDupIndex) Get(sum *dataSum) (string, error) {
+	var rsp DeDupResponse
+    s := mi.dialSession.Copy()
+	defer s.Close()
+	c := s.DB(mi.config.ddDbName).C(mi.config.ddCollName)
+	err := c.Find(bson.M{"fnv1a": sum.fnv1a32, "md5a": sum.md5a, "md5b": sum.md5b}).Select(bson.M{"key": 1, "_id": 0}).One(&rsp)
+	if err == mgo.ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return rsp.Key, nil
+}
+
+// one $in on md5a, the rest of the sum is matched here
+func (mi *MgoDeDupIndex) GetMany(sums []*dataSum) ([]string, error) {
+	keys := make([]string, len(sums))
+	if len(sums) == 0 {
+		return keys, nil
+	}
+	md5as := make([]uint64, len(sums))
+	for i, sum := range sums {
+		md5as[i] = sum.md5a
+	}
+    s := mi.dialSession.Copy()
+	defer s.Close()
+	c := s.DB(mi.config.ddDbName).C(mi.config.ddCollName)
+	var rsps []DeDupResponse
+	err := c.Find(bson.M{"md5a": bson.M{"$in": md5as}}).Select(bson.M{"key": 1, "fnv1a": 1, "md5a": 1, "md5b": 1, "_id": 0}).All(&rsps)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[dataSum]string, len(rsps))
+	for _, rsp := range rsps {
+		found[dataSum{fnv1a32: rsp.Fnv1a, md5a: rsp.Md5a, md5b: rsp.Md5b}] = rsp.Key
+	}
+	for i, sum := range sums {
+		keys[i] = found[*sum]
+	}
+	return keys, nil
+}
+
+func (mi *MgoDeDupIndex) Put(sum *dataSum, key string) error {
+    s := mi.dialSession.Copy()
+	defer s.Close()
+	c := s.DB(mi.config.ddDbName).C(mi.config.ddCollName)
+	return c.Insert(bson.M{"fnv1a": sum.fnv1a32, "md5a": sum.md5a, "md5b": sum.md5b, "key": key})
+}
+
+func (mi *MgoDeDupIndex) Delete(key string) error {
+    s := mi.dialSession.Copy()
+	defer s.Close()
+	c := s.DB(mi.config.ddDbName).C(mi.config.ddCollName)
+	_, err := c.RemoveAll(bson.M{"key": key})
+	return err
+}
+
+func (mi *MgoDeDupIndex) GetName(name string) (string, error) {
+	var rsp DeDupResponse
+    s := mi.dialSession.Copy()
+	defer s.Close()
+	c := s.DB(mi.config.ddDbName).C(mi.config.ddCollName)
+	err := c.Find(bson.M{"name": name}).Select(bson.M{"key": 1, "_id": 0}).One(&rsp)
+	if err == mgo.ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return rsp.Key, nil
+}
+
+func (mi *MgoDeDupIndex) PutName(name string, key string) error {
+    s := mi.dialSession.Copy()
+	defer s.Close()
+	c := s.DB(mi.config.ddDbName).C(mi.config.ddCollName)
+	_, err := c.Upsert(bson.M{"name": name}, bson.M{"name": name, "key": key})
+	return err
+}
+
+func (mi *MgoDeDupIndex) DeleteName(name string) error {
+    s := mi.dialSession.Copy()
+	defer s.Close()
+	c := s.DB(mi.config.ddDbName).C(mi.config.ddCollName)
+	err := c.Remove(bson.M{"name": name})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
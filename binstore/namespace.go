@@ -0,0 +1,184 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"net/http"
+		"strings"
+		"errors"
+		"fmt"
+	   )
+
+var (
+		gDefaultNamespace = "default"
+		gNamespaceHeader = "X-Binstore-Namespace"
+		errNoNamespace = errors.New("no namespace")
+		errUnknownKeyTag = errors.New("key tag of no namespace")
+	)
+
+// Namespace is a keyspace of its own: key tag and fcrypt key, topic, dedup
+// index and store. ids come from one allocator shared by all of them.
+type Namespace struct {
+	name string
+	config *Config
+	dd *DeDup
+	km *KeyManager
+	broker *Broker
+	ao *ArchivedOffsets
+	store *Store
+	// to decrypt, nil if there is no keyring. blobs are encrypted only if
+	// config.encrypt
+	kr *Keyring
+}
+
+func newNamespace(config *Config, idAlloc IdAllocator, kr *Keyring) (*Namespace, error) {
+    ns := &Namespace {
+        name: config.nsName,
+		config: config,
+		kr: kr,
+	}
+	err := ns.init(idAlloc)
+	if err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+func (ns *Namespace) init(idAlloc IdAllocator) error {
+	var err error
+	ns.dd, err = newDeDup(ns.config)
+	if err != nil {
+		return errors.New(fmt.Sprintf("dedup: %s", err.Error()))
+	}
+	ns.km, err = newKeyManager(ns.config, idAlloc)
+	if err != nil {
+		return errors.New(fmt.Sprintf("km: %s", err.Error()))
+	}
+	var bkr *Keyring
+	if ns.config.encrypt {
+		bkr = ns.kr
+	}
+	ns.broker, err = newBroker(ns.config, bkr)
+	if err != nil {
+		return errors.New(fmt.Sprintf("broker: %s", err.Error()))
+	}
+	ns.ao, err = newArchivedOffsets(ns.config, ns.broker.log)
+	if err != nil {
+		return errors.New(fmt.Sprintf("archive: %s", err.Error()))
+	}
+	ns.store, err = newStore(ns.config)
+	if err != nil {
+		return errors.New(fmt.Sprintf("store: %s", err.Error()))
+	}
+	return nil
+}
+
+func (ns *Namespace) run() {
+	go ns.ao.run()
+	if ns.config.storeSweepInterval > 0 {
+		go ns.store.runSweeper()
+	}
+}
+
+// ?ns= or the X-Binstore-Namespace header, the default namespace if neither
+func (bs *BinStore) namespaceOf(r *http.Request) (*Namespace, error) {
+	name := r.URL.Query().Get("ns")
+	if len(name) == 0 {
+		name = r.Header.Get(gNamespaceHeader)
+	}
+	return bs.namespaceNamed(name)
+}
+
+// the default namespace if name is empty
+func (bs *BinStore) namespaceNamed(name string) (*Namespace, error) {
+	if len(name) == 0 {
+		return bs.namespaces[0], nil
+	}
+	for _, ns := range bs.namespaces {
+		if ns.name == name {
+			return ns, nil
+		}
+	}
+	return nil, errNoNamespace
+}
+
+// keys carry the key tag of their namespace, no tag starts another
+func (bs *BinStore) namespaceOfKey(key string) (*Namespace, error) {
+	for _, ns := range bs.namespaces {
+		if strings.HasPrefix(key, ns.km.keyTag) {
+			return ns, nil
+		}
+	}
+	return nil, errUnknownKeyTag
+}
+
+// the namespace is told by the key tag
+func (bs *BinStore) parseKey(key string) (*Namespace, uint64, int32, int64, error) {
+	ns, err := bs.namespaceOfKey(key)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	id, partition, offset, err := ns.km.parseKey(key)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	return ns, id, partition, offset, nil
+}
+
+// from the broker until it is archived, then from the store, decrypted.
+// inBroker tells where it was read.
+func (ns *Namespace) getData(id uint64, partition int32, offset int64) ([]byte, *ObjectMeta, bool, error) {
+	data, meta, inBroker, err := ns.getSealedData(id, partition, offset)
+	data, meta, err = ns.openData(id, data, meta, err)
+	return data, meta, inBroker, err
+}
+
+// blobs read by id are decrypted with it, it was sealed with the id
+func (ns *Namespace) openData(id uint64, data []byte, meta *ObjectMeta, err error) ([]byte, *ObjectMeta, error) {
+	if err != nil {
+		return nil, nil, err
+	}
+	return ns.kr.open(id, data, meta)
+}
+
+func (ns *Namespace) getSealedData(id uint64, partition int32, offset int64) ([]byte, *ObjectMeta, bool, error) {
+	inBroker, err := ns.ao.dataInBroker(partition, offset)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if !inBroker {
+		data, meta, err := ns.store.getData(id)
+		return data, meta, false, err
+	}
+	// a delete only leaves a tombstone in the store
+	deleted, err := ns.store.isDeleted(id)
+	if err != nil {
+		return nil, nil, true, err
+	}
+	if deleted {
+		return nil, nil, true, ErrBlobDeleted
+	}
+	data, meta, err := ns.broker.getData(id, partition, offset)
+	return data, meta, true, err
+}
@@ -0,0 +1,114 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"net/http"
+		"net/http/httptest"
+		"io/ioutil"
+		"path/filepath"
+		"strings"
+		"testing"
+		"fmt"
+	   )
+
+var gTestNamespacesConf = `
+namespaces:
+ avatar:
+  key_tag: a1
+  fcrypt_key: 9fe2aa01c3
+`
+
+func newTestBinStoreWith(t *testing.T, extra string) (*BinStore, error) {
+	dir := t.TempDir()
+	confFile := filepath.Join(dir, "binstore.yaml")
+	err := ioutil.WriteFile(confFile, []byte(fmt.Sprintf(gTestConf, dir) + extra), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewBinStore(confFile)
+}
+
+func TestNamespaces(t *testing.T) {
+	bs, err := newTestBinStoreWith(t, gTestNamespacesConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs.namespaces) != 2 || bs.namespaces[1].config.brokerTopic != "binstore_avatar" {
+		t.Fatalf("%d namespaces", len(bs.namespaces))
+	}
+	defKey := addTestBlob(t, bs, "same bytes", "text/plain")
+	w := serveTest(bs, "POST", "/add?ns=avatar", strings.NewReader("same bytes"), 10)
+	if w.Code != http.StatusOK {
+		t.Fatalf("add: %d %s", w.Code, w.Body)
+	}
+	avatarKey := w.Body.String()
+	// dedup is per namespace
+	if !strings.HasPrefix(avatarKey, "a1") || avatarKey == defKey {
+		t.Fatalf("%s, %s", avatarKey, defKey)
+	}
+	// the header does as ?ns=
+	req := httptest.NewRequest("POST", "/add", strings.NewReader("by header"))
+	req.Header.Set(gNamespaceHeader, "avatar")
+	w = httptest.NewRecorder()
+	bs.server.Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "a1") {
+		t.Fatalf("header: %d %s", w.Code, w.Body)
+	}
+	// reads are routed by the key tag
+	for _, key := range []string{defKey, avatarKey} {
+		w = getTestBlob(bs, "GET", key, nil)
+		if w.Code != http.StatusOK || w.Body.String() != "same bytes" {
+			t.Fatalf("get %s: %d", key, w.Code)
+		}
+	}
+	w = serveTest(bs, "GET", "/stat?key=" + avatarKey, nil, 0)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"namespace":"avatar"`) {
+		t.Fatalf("stat: %d %s", w.Code, w.Body)
+	}
+	w = serveTest(bs, "POST", "/add?ns=nobody", strings.NewReader("x"), 1)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), errCodeUnknownNamespace) {
+		t.Fatalf("unknown namespace: %d %s", w.Code, w.Body)
+	}
+	w = getTestBlob(bs, "GET", "zz" + avatarKey[2:], nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown tag: %d", w.Code)
+	}
+}
+
+func TestNamespacesConfig(t *testing.T) {
+	for _, extra := range []string{
+		// starts with the default tag ff5837
+		"namespaces:\n avatar:\n  key_tag: ff58370\n  fcrypt_key: 9fe2aa01c3\n",
+		"namespaces:\n avatar:\n  key_tag: a1\n  fcrypt_key: 9fe2aa01c3\n  topic: binstore\n",
+		"namespaces:\n default:\n  key_tag: a1\n  fcrypt_key: 9fe2aa01c3\n",
+		"namespaces:\n avatar:\n  fcrypt_key: 9fe2aa01c3\n",
+		"namespaces:\n avatar:\n  key_tag: a1\n  fcrypt_key: 9fe2aa01c3\n  signed_get: true\n",
+	} {
+		_, err := newTestBinStoreWith(t, extra)
+		if err == nil {
+			t.Fatalf("accepted: %s", extra)
+		}
+	}
+}
@@ -0,0 +1,553 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"os"
+		"io"
+		"bufio"
+		"sync"
+		"sort"
+		"strings"
+		"strconv"
+		"fmt"
+		"errors"
+		"path/filepath"
+		"hash/crc32"
+		"encoding/binary"
+		"github.com/tinylib/msgp/msgp"
+		"github.com/dzch/go-utils/logger"
+	   )
+
+/*
+   pack file layout, append only:
+     record := type(1) | id(8) | len(4) | crc32(4) | data(len)
+   a delete record carries no data and is kept as a tombstone, a purge record
+   carries no data either and leaves nothing behind. a put with meta carries
+     data := metalen(4) | meta(msgp, metalen) | blob
+   the index of live blobs is rebuilt by scanning all packs in order on start.
+   space is given back by Compact: once less than pack_compact_ratio of the
+   oldest pack is live, its live records and tombstones are copied to the
+   active pack and the file is removed. only the oldest one, a purge in it
+   can not cancel a put in an older pack.
+*/
+var (
+		gPackRecordPut = byte(1)
+		gPackRecordDelete = byte(2)
+		gPackRecordPutMeta = byte(3)
+		gPackRecordPurge = byte(4)
+		gPackHeaderLen = 17
+		gPackFileSuffix = ".pack"
+	)
+
+type packLoc struct {
+	pack int
+	offset int64
+	length uint32
+}
+
+// concurrent safe
+type PackBackend struct {
+	config *Config
+	dir string
+	maxSize int64
+	packs map[int]*os.File
+	index map[uint64]*packLoc
+	tombstones map[uint64]bool
+	// expire of the blobs that have one
+	expires map[uint64]int64
+	// bytes of the records index points to, by pack
+	live map[int]int64
+	active *os.File
+	activeNum int
+	activeSize int64
+	// set once a failed write could not be cut off, no record is appended
+	// after it until a restart cuts it
+	readOnly error
+	lock *sync.RWMutex
+}
+
+func newPackBackend(config *Config) (*PackBackend, error) {
+    pb := &PackBackend {
+        config: config,
+		dir: config.storePackDir,
+		maxSize: config.storePackMaxSize,
+		packs: make(map[int]*os.File),
+		index: make(map[uint64]*packLoc),
+		tombstones: make(map[uint64]bool),
+		expires: make(map[uint64]int64),
+		live: make(map[int]int64),
+		lock: &sync.RWMutex{},
+	}
+	err := pb.init()
+	if err != nil {
+		return nil, err
+	}
+	return pb, nil
+}
+
+func (pb *PackBackend) init() error {
+	err := os.MkdirAll(pb.dir, 0755)
+	if err != nil {
+		return err
+	}
+	nums, err := pb.listPacks()
+	if err != nil {
+		return err
+	}
+	for i, num := range nums {
+		err = pb.loadPack(num, i == len(nums)-1)
+		if err != nil {
+			return errors.New(fmt.Sprintf("fail to load pack %d: %s", num, err.Error()))
+		}
+	}
+	for _, loc := range pb.index {
+		pb.live[loc.pack] += loc.size()
+	}
+	if len(nums) == 0 {
+		return pb.openActive(1)
+	}
+	return pb.openActive(nums[len(nums)-1])
+}
+
+func (pb *PackBackend) listPacks() ([]int, error) {
+	names, err := filepath.Glob(filepath.Join(pb.dir, "*" + gPackFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var nums []int
+	for _, name := range names {
+		num, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), gPackFileSuffix))
+		if err != nil {
+			continue
+		}
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	return nums, nil
+}
+
+func (loc *packLoc) size() int64 {
+	return int64(gPackHeaderLen) + int64(loc.length)
+}
+
+// must hold pb.lock
+func (pb *PackBackend) setLoc(id uint64, loc *packLoc) {
+	pb.dropLoc(id)
+	pb.index[id] = loc
+	pb.live[loc.pack] += loc.size()
+}
+
+// must hold pb.lock
+func (pb *PackBackend) dropLoc(id uint64) {
+	old, ok := pb.index[id]
+	if !ok {
+		return
+	}
+	pb.live[old.pack] -= old.size()
+	delete(pb.index, id)
+}
+
+func (pb *PackBackend) packPath(num int) string {
+	return filepath.Join(pb.dir, fmt.Sprintf("%08d%s", num, gPackFileSuffix))
+}
+
+// a torn record at the tail of the last pack is left by a crash in the middle of
+// Put, it is cut off. a record is torn only if it is incomplete or its crc does
+// not match and it ends the file, any other broken record means the pack is
+// broken and the store does not start.
+func (pb *PackBackend) loadPack(num int, last bool) error {
+	f, err := os.OpenFile(pb.packPath(num), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	pb.packs[num] = f
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	r := bufio.NewReader(f)
+	header := make([]byte, gPackHeaderLen)
+	offset := int64(0)
+	var torn error
+	for {
+		_, err = io.ReadFull(r, header)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			torn = errors.New("incomplete header")
+			break
+		}
+		if err != nil {
+			return err
+		}
+		typ := header[0]
+		id := binary.LittleEndian.Uint64(header[1:9])
+		length := binary.LittleEndian.Uint32(header[9:13])
+		sum := binary.LittleEndian.Uint32(header[13:17])
+		end := offset + int64(gPackHeaderLen) + int64(length)
+		// checked before the length read from disk is trusted
+		if end > size {
+			torn = errors.New("incomplete data")
+			break
+		}
+		data := make([]byte, length)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return err
+		}
+		if crc32.ChecksumIEEE(data) != sum {
+			if end == size {
+				torn = errors.New("crc32 mismatch")
+				break
+			}
+			return errors.New(fmt.Sprintf("crc32 mismatch of record at %d", offset))
+		}
+		switch typ {
+			case gPackRecordPut:
+				pb.index[id] = &packLoc{pack: num, offset: offset, length: length}
+			case gPackRecordPutMeta:
+				pb.index[id] = &packLoc{pack: num, offset: offset, length: length}
+				_, meta, merr := splitPackMeta(data)
+				if merr == nil && meta != nil && meta.Expire > 0 {
+					pb.expires[id] = meta.Expire
+				}
+			case gPackRecordDelete:
+				delete(pb.index, id)
+				delete(pb.expires, id)
+				pb.tombstones[id] = true
+			case gPackRecordPurge:
+				delete(pb.index, id)
+				delete(pb.expires, id)
+			default:
+				return errors.New(fmt.Sprintf("unknown record type %d at %d", typ, offset))
+		}
+		offset = end
+	}
+	if !last {
+		return errors.New(fmt.Sprintf("broken record at %d: %s", offset, torn.Error()))
+	}
+	logger.Warning("cut torn record off pack %d at %d: %s", num, offset, torn.Error())
+	return f.Truncate(offset)
+}
+
+func (pb *PackBackend) openActive(num int) error {
+	f, ok := pb.packs[num]
+	if !ok {
+		var err error
+		f, err = os.OpenFile(pb.packPath(num), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		pb.packs[num] = f
+	}
+	size, err := f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	pb.active = f
+	pb.activeNum = num
+	pb.activeSize = size
+	return nil
+}
+
+// must hold pb.lock
+func (pb *PackBackend) appendRecord(typ byte, id uint64, data []byte) (*packLoc, error) {
+	if pb.readOnly != nil {
+		return nil, pb.readOnly
+	}
+	need := int64(gPackHeaderLen) + int64(len(data))
+	if pb.activeSize > 0 && pb.activeSize + need > pb.maxSize {
+		err := pb.openActive(pb.activeNum+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	buf := make([]byte, need)
+	buf[0] = typ
+	binary.LittleEndian.PutUint64(buf[1:9], id)
+	binary.LittleEndian.PutUint32(buf[9:13], uint32(len(data)))
+	binary.LittleEndian.PutUint32(buf[13:17], crc32.ChecksumIEEE(data))
+	copy(buf[gPackHeaderLen:], data)
+	_, err := pb.active.Write(buf)
+	if err != nil {
+		// drop the torn tail, or the next record lands after it
+		terr := pb.active.Truncate(pb.activeSize)
+		if terr == nil {
+			_, terr = pb.active.Seek(pb.activeSize, os.SEEK_SET)
+		}
+		if terr != nil {
+			pb.readOnly = errors.New(fmt.Sprintf("pack %d is read only, fail to cut a failed write at %d: %s", pb.activeNum, pb.activeSize, terr.Error()))
+			logger.Warning("%s", pb.readOnly.Error())
+		}
+		return nil, err
+	}
+	if pb.config.storePackSync {
+		err = pb.active.Sync()
+		if err != nil {
+			return nil, err
+		}
+	}
+	loc := &packLoc {
+        pack: pb.activeNum,
+		offset: pb.activeSize,
+		length: uint32(len(data)),
+	}
+	pb.activeSize += need
+	return loc, nil
+}
+
+func (pb *PackBackend) Put(id uint64, data []byte, meta *ObjectMeta) error {
+	typ := gPackRecordPut
+	if meta != nil {
+		mb, err := msgp.AppendIntf(nil, meta.toMap())
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, 4, 4 + len(mb) + len(data))
+		binary.LittleEndian.PutUint32(buf, uint32(len(mb)))
+		buf = append(buf, mb...)
+		data = append(buf, data...)
+		typ = gPackRecordPutMeta
+	}
+	if uint64(len(data)) > uint64(^uint32(0)) {
+		return errors.New(fmt.Sprintf("blob too large for pack: %d", len(data)))
+	}
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	if pb.tombstones[id] {
+		return nil
+	}
+	loc, err := pb.appendRecord(typ, id, data)
+	if err != nil {
+		return err
+	}
+	pb.setLoc(id, loc)
+	if meta != nil && meta.Expire > 0 {
+		pb.expires[id] = meta.Expire
+	}
+	return nil
+}
+
+func (pb *PackBackend) Get(id uint64) ([]byte, *ObjectMeta, error) {
+	// held while reading, Compact closes the packs it removes
+	pb.lock.RLock()
+	loc, ok := pb.index[id]
+	if pb.tombstones[id] {
+		pb.lock.RUnlock()
+		return nil, nil, ErrBlobDeleted
+	}
+	if !ok {
+		pb.lock.RUnlock()
+		return nil, nil, ErrBlobNotFound
+	}
+	buf := make([]byte, loc.size())
+	_, err := pb.packs[loc.pack].ReadAt(buf, loc.offset)
+	pb.lock.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	data := buf[gPackHeaderLen:]
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(buf[13:17]) {
+		return nil, nil, errors.New(fmt.Sprintf("crc32 mismatch in pack %d at %d", loc.pack, loc.offset))
+	}
+	if buf[0] != gPackRecordPutMeta {
+		return data, nil, nil
+	}
+	blob, meta, err := splitPackMeta(data)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("broken meta in pack %d at %d: %s", loc.pack, loc.offset, err.Error()))
+	}
+	return blob, meta, nil
+}
+
+// data of a put with meta record
+func splitPackMeta(data []byte) ([]byte, *ObjectMeta, error) {
+	if len(data) < 4 || uint64(binary.LittleEndian.Uint32(data)) > uint64(len(data)-4) {
+		return nil, nil, errors.New("bad meta length")
+	}
+	ml := binary.LittleEndian.Uint32(data)
+	mi, _, err := msgp.ReadIntfBytes(data[4:4+ml])
+	if err != nil {
+		return nil, nil, err
+	}
+	return data[4+ml:], metaFromMap(mi), nil
+}
+
+func (pb *PackBackend) GetMany(ids []uint64) ([][]byte, []*ObjectMeta, []error) {
+	datas := make([][]byte, len(ids))
+	metas := make([]*ObjectMeta, len(ids))
+	errs := make([]error, len(ids))
+	for i, id := range ids {
+		datas[i], metas[i], errs[i] = pb.Get(id)
+	}
+	return datas, metas, errs
+}
+
+func (pb *PackBackend) Delete(id uint64) error {
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	if pb.tombstones[id] {
+		return nil
+	}
+	_, err := pb.appendRecord(gPackRecordDelete, id, nil)
+	if err != nil {
+		return err
+	}
+	pb.dropLoc(id)
+	delete(pb.expires, id)
+	pb.tombstones[id] = true
+	return nil
+}
+
+func (pb *PackBackend) Deleted(ids []uint64) ([]bool, error) {
+	deleted := make([]bool, len(ids))
+	pb.lock.RLock()
+	defer pb.lock.RUnlock()
+	for i, id := range ids {
+		deleted[i] = pb.tombstones[id]
+	}
+	return deleted, nil
+}
+
+func (pb *PackBackend) Expired(now int64, limit int) ([]uint64, error) {
+	var ids []uint64
+	pb.lock.RLock()
+	defer pb.lock.RUnlock()
+	for id, expire := range pb.expires {
+		if len(ids) >= limit {
+			break
+		}
+		if expire <= now {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// the space is given back once the pack is compacted
+func (pb *PackBackend) Purge(id uint64) error {
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	if _, ok := pb.index[id]; !ok {
+		return nil
+	}
+	_, err := pb.appendRecord(gPackRecordPurge, id, nil)
+	if err != nil {
+		return err
+	}
+	pb.dropLoc(id)
+	delete(pb.expires, id)
+	return nil
+}
+
+// Compact rewrites the oldest pack if little of it is live, returns the bytes
+// given back. records are copied one by one under the lock, a blob put or
+// dropped meanwhile is not copied. a crash in the middle leaves copies of
+// records in both packs, the later one wins on load.
+func (pb *PackBackend) Compact() (int64, error) {
+	if pb.config.storePackCompactRatio <= 0 {
+		return 0, nil
+	}
+	pb.lock.RLock()
+	active := pb.activeNum
+	num := active
+	for n := range pb.packs {
+		if n < num {
+			num = n
+		}
+	}
+	f := pb.packs[num]
+	live := pb.live[num]
+	pb.lock.RUnlock()
+	if num == active {
+		return 0, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	if live*100 >= size*int64(pb.config.storePackCompactRatio) {
+		return 0, nil
+	}
+	// sealed, nothing is appended to it any more
+	r := bufio.NewReader(io.NewSectionReader(f, 0, size))
+	header := make([]byte, gPackHeaderLen)
+	offset := int64(0)
+	for offset < size {
+		_, err = io.ReadFull(r, header)
+		if err != nil {
+			return 0, err
+		}
+		typ := header[0]
+		id := binary.LittleEndian.Uint64(header[1:9])
+		data := make([]byte, binary.LittleEndian.Uint32(header[9:13]))
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return 0, err
+		}
+		err = pb.copyRecord(num, offset, typ, id, data)
+		if err != nil {
+			return 0, err
+		}
+		offset += int64(gPackHeaderLen) + int64(len(data))
+	}
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	delete(pb.packs, num)
+	delete(pb.live, num)
+	f.Close()
+	err = os.Remove(pb.packPath(num))
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// the record at offset of pack num goes to the active pack if it still counts
+func (pb *PackBackend) copyRecord(num int, offset int64, typ byte, id uint64, data []byte) error {
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	switch typ {
+		case gPackRecordPut, gPackRecordPutMeta:
+			loc, ok := pb.index[id]
+			if !ok || loc.pack != num || loc.offset != offset {
+				return nil
+			}
+			loc, err := pb.appendRecord(typ, id, data)
+			if err != nil {
+				return err
+			}
+			pb.setLoc(id, loc)
+		case gPackRecordDelete:
+			// tombstones are kept for good
+			_, err := pb.appendRecord(typ, id, nil)
+			return err
+	}
+	// a purge only cancels puts in this pack or before it, there are none left
+	return nil
+}
@@ -0,0 +1,327 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"bytes"
+		"io/ioutil"
+		"testing"
+	   )
+
+func newTestPackBackend(t *testing.T, dir string) *PackBackend {
+	pb, err := newPackBackend(&Config{storePackDir: dir, storePackMaxSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pb
+}
+
+func checkPackBlob(t *testing.T, pb *PackBackend, id uint64, want []byte) {
+	data, _, err := pb.Get(id)
+	if err != nil {
+		t.Fatalf("get %d: %v", id, err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("get %d: %q, want %q", id, data, want)
+	}
+}
+
+func TestPackBackendRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	pb := newTestPackBackend(t, dir)
+	// 100 bytes each, the packs roll over every two
+	for id := uint64(1); id <= 10; id++ {
+		err := pb.Put(id, bytes.Repeat([]byte{byte(id)}, 100), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta := &ObjectMeta{ContentType: "image/png", Filename: "a.png", Expire: 100, Md5: []byte{1, 2}}
+	err := pb.Put(11, []byte("with meta"), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pb.packs) < 5 {
+		t.Fatalf("packs: %d", len(pb.packs))
+	}
+	// the index is rebuilt from the packs
+	for _, b := range []*PackBackend{pb, newTestPackBackend(t, dir)} {
+		for id := uint64(1); id <= 10; id++ {
+			checkPackBlob(t, b, id, bytes.Repeat([]byte{byte(id)}, 100))
+		}
+		data, m, err := b.Get(11)
+		if err != nil || string(data) != "with meta" || m == nil || m.Filename != "a.png" || m.ContentType != "image/png" || !bytes.Equal(m.Md5, []byte{1, 2}) {
+			t.Fatalf("meta: %v %q %+v", err, data, m)
+		}
+		ids, _ := b.Expired(100, 10)
+		if len(ids) != 1 || ids[0] != 11 {
+			t.Fatalf("expired: %v", ids)
+		}
+		_, _, err = b.Get(12)
+		if err != ErrBlobNotFound {
+			t.Fatalf("missing: %v", err)
+		}
+	}
+	datas, metas, errs := pb.GetMany([]uint64{2, 12, 11})
+	if !bytes.Equal(datas[0], bytes.Repeat([]byte{2}, 100)) || errs[1] != ErrBlobNotFound || metas[2] == nil {
+		t.Fatalf("get many: %v", errs)
+	}
+}
+
+func TestPackBackendDelete(t *testing.T) {
+	dir := t.TempDir()
+	pb := newTestPackBackend(t, dir)
+	for id := uint64(1); id <= 3; id++ {
+		err := pb.Put(id, []byte{byte(id)}, &ObjectMeta{Expire: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := pb.Delete(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a tombstone of an id never put, the archiver is behind the delete
+	err = pb.Delete(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pb.Put(4, []byte("late"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pb.Purge(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*PackBackend{pb, newTestPackBackend(t, dir)} {
+		for _, id := range []uint64{1, 4} {
+			_, _, err = b.Get(id)
+			if err != ErrBlobDeleted {
+				t.Fatalf("deleted %d: %v", id, err)
+			}
+		}
+		// a purge leaves nothing behind
+		_, _, err = b.Get(2)
+		if err != ErrBlobNotFound {
+			t.Fatalf("purged: %v", err)
+		}
+		checkPackBlob(t, b, 3, []byte{3})
+		deleted, _ := b.Deleted([]uint64{1, 2, 3, 4})
+		if !deleted[0] || deleted[1] || deleted[2] || !deleted[3] {
+			t.Fatalf("deleted: %v", deleted)
+		}
+		ids, _ := b.Expired(10, 10)
+		if len(ids) != 1 || ids[0] != 3 {
+			t.Fatalf("expired: %v", ids)
+		}
+	}
+}
+
+func TestPackBackendTornTail(t *testing.T) {
+	tails := map[string]func([]byte) []byte {
+		"header": func(rec []byte) []byte { return rec[:gPackHeaderLen-5] },
+		"data": func(rec []byte) []byte { return rec[:len(rec)-3] },
+		"crc32": func(rec []byte) []byte {
+			rec[len(rec)-1] ^= 0xff
+			return rec
+		},
+	}
+	for name, tear := range tails {
+		dir := t.TempDir()
+		pb := newTestPackBackend(t, dir)
+		err := pb.Put(1, []byte("kept"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := pb.activeSize
+		err = pb.Put(2, []byte("torn by a crash"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := pb.packPath(pb.activeNum)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := tear(append([]byte(nil), content[size:]...))
+		err = ioutil.WriteFile(path, append(content[:size], rec...), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pb = newTestPackBackend(t, dir)
+		checkPackBlob(t, pb, 1, []byte("kept"))
+		_, _, err = pb.Get(2)
+		if err != ErrBlobNotFound {
+			t.Fatalf("%s: torn record: %v", name, err)
+		}
+		if pb.activeSize != size {
+			t.Fatalf("%s: not cut off: %d != %d", name, pb.activeSize, size)
+		}
+		// new records go where the torn one was
+		err = pb.Put(3, []byte("after"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pb = newTestPackBackend(t, dir)
+		checkPackBlob(t, pb, 1, []byte("kept"))
+		checkPackBlob(t, pb, 3, []byte("after"))
+	}
+}
+
+func TestPackBackendBrokenRecord(t *testing.T) {
+	dir := t.TempDir()
+	pb := newTestPackBackend(t, dir)
+	for id := uint64(1); id <= 3; id++ {
+		err := pb.Put(id, []byte("record"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a crc32 mismatch before the end of the pack is not a crash
+	path := pb.packPath(pb.activeNum)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[gPackHeaderLen] ^= 0xff
+	err = ioutil.WriteFile(path, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newPackBackend(&Config{storePackDir: dir, storePackMaxSize: 256})
+	if err == nil {
+		t.Fatal("broken pack loaded")
+	}
+	// nor is a torn record ending a pack that is not the last
+	dir = t.TempDir()
+	pb = newTestPackBackend(t, dir)
+	for id := uint64(1); id <= 3; id++ {
+		err = pb.Put(id, bytes.Repeat([]byte{byte(id)}, 200), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := pb.packPath(1)
+	content, err = ioutil.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(first, content[:len(content)-1], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newPackBackend(&Config{storePackDir: dir, storePackMaxSize: 256})
+	if err == nil {
+		t.Fatal("torn pack in the middle loaded")
+	}
+}
+
+func TestPackBackendCompact(t *testing.T) {
+	dir := t.TempDir()
+	pb, err := newPackBackend(&Config{storePackDir: dir, storePackMaxSize: 256, storePackCompactRatio: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two 117 byte records a pack
+	for id := uint64(1); id <= 6; id++ {
+		err = pb.Put(id, bytes.Repeat([]byte{byte(id)}, 100), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = pb.Delete(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// all of pack 1 is live
+	freed, err := pb.Compact()
+	if err != nil || freed != 0 {
+		t.Fatalf("compact: %d %v", freed, err)
+	}
+	err = pb.Purge(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	freed, err = pb.Compact()
+	if err != nil || freed != 234 {
+		t.Fatalf("compact: %d %v", freed, err)
+	}
+	_, err = ioutil.ReadFile(pb.packPath(1))
+	if err == nil {
+		t.Fatal("pack 1 kept")
+	}
+	// pack 2 is all live now
+	freed, err = pb.Compact()
+	if err != nil || freed != 0 {
+		t.Fatalf("compact: %d %v", freed, err)
+	}
+	for _, b := range []*PackBackend{pb, newTestPackBackend(t, dir)} {
+		_, _, err = b.Get(1)
+		if err != ErrBlobNotFound {
+			t.Fatalf("purged: %v", err)
+		}
+		for id := uint64(2); id <= 6; id++ {
+			checkPackBlob(t, b, id, bytes.Repeat([]byte{byte(id)}, 100))
+		}
+		_, _, err = b.Get(100)
+		if err != ErrBlobDeleted {
+			t.Fatalf("tombstone: %v", err)
+		}
+	}
+	// nothing to do without a ratio or with only the active pack
+	pb = newTestPackBackend(t, t.TempDir())
+	pb.config.storePackCompactRatio = 50
+	pb.Put(1, []byte("x"), nil)
+	pb.Purge(1)
+	freed, err = pb.Compact()
+	if err != nil || freed != 0 {
+		t.Fatalf("compact active: %d %v", freed, err)
+	}
+}
+
+func TestPackBackendReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	pb := newTestPackBackend(t, dir)
+	err := pb.Put(1, []byte("kept"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// neither the write nor cutting it off works on a closed file
+	pb.active.Close()
+	err = pb.Put(2, []byte("lost"), nil)
+	if err == nil || pb.readOnly == nil {
+		t.Fatalf("put: %v, read only: %v", err, pb.readOnly)
+	}
+	err = pb.Delete(1)
+	if err != pb.readOnly {
+		t.Fatalf("delete: %v", err)
+	}
+	pb = newTestPackBackend(t, dir)
+	checkPackBlob(t, pb, 1, []byte("kept"))
+	err = pb.Put(2, []byte("after restart"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,286 @@
+//
+//The MIT License (MIT)
+//
+//Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+//
+//Permission is hereby granted, free of charge, to any person obtaining a copy
+//of this software and associated documentation files (the "Software"), to deal
+//in the Software without restriction, including without limitation the rights
+//to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//copies of the Software, and to permit persons to whom the Software is
+//furnished to do so, subject to the following conditions:
+//
+//The above copyright notice and this permission notice shall be included in all
+//copies or substantial portions of the Software.
+//
+//THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//SOFTWARE.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v3.21.12
+// source: pb/binstore.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	BinStore_Add_FullMethodName      = "/binstore.BinStore/Add"
+	BinStore_Get_FullMethodName      = "/binstore.BinStore/Get"
+	BinStore_Stat_FullMethodName     = "/binstore.BinStore/Stat"
+	BinStore_BatchGet_FullMethodName = "/binstore.BinStore/BatchGet"
+)
+
+// BinStoreClient is the client API for BinStore service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// the same store as the http api, failures carry a grpc status whose message
+// starts with the error code of the http json body, "not_found: blob not found":
+//
+//	INVALID_ARGUMENT  invalid_request, invalid_key, unknown_namespace,
+//	                  body_too_large, checksum_mismatch
+//	NOT_FOUND         not_found, deleted, expired
+//	UNAVAILABLE       dedup_unavailable, id_alloc_failed, no_writable_partition,
+//	                  broker_unavailable, store_unavailable
+//	INTERNAL          internal_error
+type BinStoreClient interface {
+	// the blob is sent in as many messages as wanted, the first one carries
+	// the options, data may be in any of them
+	Add(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[AddRequest, AddResponse], error)
+	// the first message carries meta and size, the data comes in chunks
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[GetResponse], error)
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error)
+	// one item per key in the order asked, a key failing does not fail the rest
+	BatchGet(ctx context.Context, in *BatchGetRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BatchGetItem], error)
+}
+
+type binStoreClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBinStoreClient(cc grpc.ClientConnInterface) BinStoreClient {
+	return &binStoreClient{cc}
+}
+
+func (c *binStoreClient) Add(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[AddRequest, AddResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &BinStore_ServiceDesc.Streams[0], BinStore_Add_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[AddRequest, AddResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type BinStore_AddClient = grpc.ClientStreamingClient[AddRequest, AddResponse]
+
+func (c *binStoreClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[GetResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &BinStore_ServiceDesc.Streams[1], BinStore_Get_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[GetRequest, GetResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type BinStore_GetClient = grpc.ServerStreamingClient[GetResponse]
+
+func (c *binStoreClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StatResponse)
+	err := c.cc.Invoke(ctx, BinStore_Stat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *binStoreClient) BatchGet(ctx context.Context, in *BatchGetRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BatchGetItem], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &BinStore_ServiceDesc.Streams[2], BinStore_BatchGet_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[BatchGetRequest, BatchGetItem]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type BinStore_BatchGetClient = grpc.ServerStreamingClient[BatchGetItem]
+
+// BinStoreServer is the server API for BinStore service.
+// All implementations must embed UnimplementedBinStoreServer
+// for forward compatibility.
+//
+// the same store as the http api, failures carry a grpc status whose message
+// starts with the error code of the http json body, "not_found: blob not found":
+//
+//	INVALID_ARGUMENT  invalid_request, invalid_key, unknown_namespace,
+//	                  body_too_large, checksum_mismatch
+//	NOT_FOUND         not_found, deleted, expired
+//	UNAVAILABLE       dedup_unavailable, id_alloc_failed, no_writable_partition,
+//	                  broker_unavailable, store_unavailable
+//	INTERNAL          internal_error
+type BinStoreServer interface {
+	// the blob is sent in as many messages as wanted, the first one carries
+	// the options, data may be in any of them
+	Add(grpc.ClientStreamingServer[AddRequest, AddResponse]) error
+	// the first message carries meta and size, the data comes in chunks
+	Get(*GetRequest, grpc.ServerStreamingServer[GetResponse]) error
+	Stat(context.Context, *StatRequest) (*StatResponse, error)
+	// one item per key in the order asked, a key failing does not fail the rest
+	BatchGet(*BatchGetRequest, grpc.ServerStreamingServer[BatchGetItem]) error
+	mustEmbedUnimplementedBinStoreServer()
+}
+
+// UnimplementedBinStoreServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedBinStoreServer struct{}
+
+func (UnimplementedBinStoreServer) Add(grpc.ClientStreamingServer[AddRequest, AddResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Add not implemented")
+}
+func (UnimplementedBinStoreServer) Get(*GetRequest, grpc.ServerStreamingServer[GetResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedBinStoreServer) Stat(context.Context, *StatRequest) (*StatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stat not implemented")
+}
+func (UnimplementedBinStoreServer) BatchGet(*BatchGetRequest, grpc.ServerStreamingServer[BatchGetItem]) error {
+	return status.Errorf(codes.Unimplemented, "method BatchGet not implemented")
+}
+func (UnimplementedBinStoreServer) mustEmbedUnimplementedBinStoreServer() {}
+func (UnimplementedBinStoreServer) testEmbeddedByValue()                  {}
+
+// UnsafeBinStoreServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to BinStoreServer will
+// result in compilation errors.
+type UnsafeBinStoreServer interface {
+	mustEmbedUnimplementedBinStoreServer()
+}
+
+func RegisterBinStoreServer(s grpc.ServiceRegistrar, srv BinStoreServer) {
+	// If the following call pancis, it indicates UnimplementedBinStoreServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&BinStore_ServiceDesc, srv)
+}
+
+func _BinStore_Add_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(BinStoreServer).Add(&grpc.GenericServerStream[AddRequest, AddResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type BinStore_AddServer = grpc.ClientStreamingServer[AddRequest, AddResponse]
+
+func _BinStore_Get_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BinStoreServer).Get(m, &grpc.GenericServerStream[GetRequest, GetResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type BinStore_GetServer = grpc.ServerStreamingServer[GetResponse]
+
+func _BinStore_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BinStoreServer).Stat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BinStore_Stat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BinStoreServer).Stat(ctx, req.(*StatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BinStore_BatchGet_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(BatchGetRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BinStoreServer).BatchGet(m, &grpc.GenericServerStream[BatchGetRequest, BatchGetItem]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type BinStore_BatchGetServer = grpc.ServerStreamingServer[BatchGetItem]
+
+// BinStore_ServiceDesc is the grpc.ServiceDesc for BinStore service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var BinStore_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "binstore.BinStore",
+	HandlerType: (*BinStoreServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Stat",
+			Handler:    _BinStore_Stat_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Add",
+			Handler:       _BinStore_Add_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Get",
+			Handler:       _BinStore_Get_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "BatchGet",
+			Handler:       _BinStore_BatchGet_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pb/binstore.proto",
+}
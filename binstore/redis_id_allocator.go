@@ -0,0 +1,144 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/garyburd/redigo/redis"
+		"math/rand"
+		"time"
+		"fmt"
+	   )
+
+// ids are INCR-ed in two redis, one gives the even ids and the other the odd ones,
+// so one of them being down does not stop allocation.
+type RedisIdAllocator struct {
+	config *Config
+	idRedis [2]*redis.Pool
+	idKey string    // ${keyTag}_idalloc
+}
+
+type IdRedisDialer struct {
+	addr string
+	connTimeout time.Duration
+	readTimeout time.Duration
+	writeTimeout time.Duration
+}
+
+func (rd *IdRedisDialer) dial() (redis.Conn, error) {
+	return redis.DialTimeout("tcp", rd.addr, rd.connTimeout, rd.readTimeout, rd.writeTimeout)
+}
+
+func (rd *IdRedisDialer) testOnBorrow(c redis.Conn, t time.Time) error {
+	_, err := c.Do("PING")
+	return err
+}
+
+func newRedisIdAllocator(config *Config) (*RedisIdAllocator, error) {
+    ra := &RedisIdAllocator {
+        config: config,
+	}
+	err := ra.init()
+	if err != nil {
+		return nil, err
+	}
+	return ra, nil
+}
+
+func (ra *RedisIdAllocator) init() error {
+	ra.idRedis[0] = ra.initIdRedisOne(ra.config.kmEvenRedisAddr)
+	ra.idRedis[1] = ra.initIdRedisOne(ra.config.kmOddRedisAddr)
+	ra.idKey = fmt.Sprintf("%s_idalloc", ra.config.kmKeyTag)
+	return nil
+}
+
+func (ra *RedisIdAllocator) initIdRedisOne(addr string) *redis.Pool {
+    ord := &IdRedisDialer {
+        addr: addr,
+		connTimeout: ra.config.kmRedisConnTimeout,
+		readTimeout: ra.config.kmRedisReadTimeout,
+		writeTimeout: ra.config.kmRedisWriteTimeout,
+	}
+    kmRedis := &redis.Pool {
+        MaxIdle: ra.config.kmRedisMinConnEach,
+		MaxActive: ra.config.kmRedisMaxConnEach,
+		IdleTimeout: ra.config.kmRedisPoolIdleTimeout,
+		Dial: ord.dial,
+		TestOnBorrow: ord.testOnBorrow,
+	}
+	return kmRedis
+}
+
+func (ra *RedisIdAllocator) NewId() (uint64, error) {
+    i := rand.Int()%2
+	id, err := ra.getNewIdIdx(i)
+	if err == nil {
+		return id, nil
+	}
+	return ra.getNewIdIdx((i+1)%2)
+}
+
+func (ra *RedisIdAllocator) getNewIdIdx(idx int) (uint64, error) {
+	conn := ra.idRedis[idx].Get()
+	defer conn.Close()
+	r, err := conn.Do("INCR", ra.idKey)
+	if err != nil {
+		return 0, err
+	}
+	id, err := redis.Uint64(r, err)
+	if err != nil {
+		return 0, err
+	}
+	return id*2+uint64(idx), nil
+}
+
+func (ra *RedisIdAllocator) NewIds(n int) ([]uint64, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+    i := rand.Int()%2
+	ids, err := ra.getNewIdsIdx(i, n)
+	if err == nil {
+		return ids, nil
+	}
+	return ra.getNewIdsIdx((i+1)%2, n)
+}
+
+// one INCRBY for the whole block
+func (ra *RedisIdAllocator) getNewIdsIdx(idx int, n int) ([]uint64, error) {
+	conn := ra.idRedis[idx].Get()
+	defer conn.Close()
+	r, err := conn.Do("INCRBY", ra.idKey, n)
+	if err != nil {
+		return nil, err
+	}
+	last, err := redis.Uint64(r, err)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint64, n)
+	for j := 0; j < n; j++ {
+		ids[j] = (last-uint64(n-1-j))*2+uint64(idx)
+	}
+	return ids, nil
+}
@@ -0,0 +1,485 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"crypto/hmac"
+		"crypto/sha1"
+		"crypto/sha256"
+		"encoding/base64"
+		"encoding/hex"
+		"hash"
+		"hash/crc32"
+		"hash/crc64"
+		"net/http"
+		"net/url"
+		"strconv"
+		"strings"
+		"errors"
+		"bufio"
+		"bytes"
+		"sort"
+		"time"
+		"fmt"
+		"io"
+	   )
+
+/*
+   aws signature version 4 as s3 checks it, in the Authorization header or in
+   the query of a presigned url. the payload is one of
+     the hex sha256 of the body: verified when the body is read, like X-Binstore-Sha256
+     UNSIGNED-PAYLOAD: not verified
+     STREAMING-AWS4-HMAC-SHA256-PAYLOAD: aws-chunked, every chunk carries a
+       signature chained from the one of the request
+     STREAMING-UNSIGNED-PAYLOAD-TRAILER: aws-chunked without signatures, ends
+       with the checksum named by x-amz-trailer
+     STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER: signed chunks, then the
+       trailing checksum and a signature of it chained from the last chunk
+*/
+var (
+		gS3Algorithm = "AWS4-HMAC-SHA256"
+		gS3Service = "s3"
+		gS3Terminator = "aws4_request"
+		gS3TimeFormat = "20060102T150405Z"
+		gS3DateFormat = "20060102"
+		gS3MaxTimeSkew = 15*time.Minute
+		// a week, as s3 allows
+		gS3MaxPresignExpires = int64(7*24*3600)
+		gS3UnsignedPayload = "UNSIGNED-PAYLOAD"
+		gS3StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+		gS3UnsignedTrailerPayload = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+		gS3StreamingTrailerPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+		gS3TrailerSignatureName = "x-amz-trailer-signature"
+		// crc64nvme, reversed
+		gS3Crc64NvmeTable = crc64.MakeTable(0x9a6c9329ac4bc9b5)
+		gS3EmptySha256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+		// sdks send 64KB to 1MB
+		gS3MaxChunkSize = 16*1024*1024
+		errS3ChunkSignature = errors.New("chunk signature does not match")
+		errS3TrailerChecksum = errors.New("trailing checksum does not match the body")
+	)
+
+type s3Credential struct {
+	accessKey string
+	secretKey string
+	// GET and HEAD only
+	readOnly bool
+}
+
+// a request that passed authenticate, chunked bodies are checked with it
+type s3Auth struct {
+	cred *s3Credential
+	amzDate string
+	scope string
+	signingKey []byte
+	signature string
+	payloadHash string
+}
+
+// errors carry s3 codes, not the ones of http_error.go
+func s3Err(status int, code string, msg string) *apiError {
+	return newApiError(status, code, msg)
+}
+
+func (h *S3Handler) authenticate(r *http.Request, now time.Time) (*s3Auth, *apiError) {
+	if len(r.URL.Query().Get("X-Amz-Algorithm")) > 0 {
+		return h.authenticatePresigned(r, now)
+	}
+	authz := r.Header.Get("Authorization")
+	if len(authz) == 0 {
+		return nil, s3Err(http.StatusForbidden, "AccessDenied", "anonymous access is not allowed")
+	}
+	if !strings.HasPrefix(authz, gS3Algorithm + " ") {
+		return nil, s3Err(http.StatusBadRequest, "InvalidRequest", "only " + gS3Algorithm + " is supported")
+	}
+	var credential, signedHeaders, signature string
+	for _, part := range strings.Split(authz[len(gS3Algorithm) + 1:], ",") {
+		part = strings.TrimSpace(part)
+		switch {
+			case strings.HasPrefix(part, "Credential="):
+				credential = part[len("Credential="):]
+			case strings.HasPrefix(part, "SignedHeaders="):
+				signedHeaders = part[len("SignedHeaders="):]
+			case strings.HasPrefix(part, "Signature="):
+				signature = part[len("Signature="):]
+		}
+	}
+	if len(credential) == 0 || len(signedHeaders) == 0 || len(signature) == 0 {
+		return nil, s3Err(http.StatusBadRequest, "AuthorizationHeaderMalformed", "need Credential, SignedHeaders and Signature")
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if len(amzDate) == 0 {
+		t, err := http.ParseTime(r.Header.Get("Date"))
+		if err != nil {
+			return nil, s3Err(http.StatusForbidden, "AccessDenied", "need X-Amz-Date or Date")
+		}
+		amzDate = t.UTC().Format(gS3TimeFormat)
+	}
+	t, err := time.Parse(gS3TimeFormat, amzDate)
+	if err != nil {
+		return nil, s3Err(http.StatusForbidden, "AccessDenied", "invalid X-Amz-Date")
+	}
+	if t.Sub(now) > gS3MaxTimeSkew || now.Sub(t) > gS3MaxTimeSkew {
+		return nil, s3Err(http.StatusForbidden, "RequestTimeTooSkewed", "the difference between the request time and the server's time is too large")
+	}
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if len(payloadHash) == 0 {
+		return nil, s3Err(http.StatusBadRequest, "InvalidRequest", "missing required header for this request: x-amz-content-sha256")
+	}
+	if payloadHash != gS3UnsignedPayload && !isS3ChunkedPayload(payloadHash) {
+		if _, err := hex.DecodeString(payloadHash); err != nil || len(payloadHash) != 2*sha256.Size {
+			return nil, s3Err(http.StatusBadRequest, "InvalidArgument", "x-amz-content-sha256 must be UNSIGNED-PAYLOAD, a STREAMING- payload or a valid sha256 value")
+		}
+	}
+	return h.verify(r, credential, amzDate, signedHeaders, signature, payloadHash, "")
+}
+
+func (h *S3Handler) authenticatePresigned(r *http.Request, now time.Time) (*s3Auth, *apiError) {
+	qv := r.URL.Query()
+	if qv.Get("X-Amz-Algorithm") != gS3Algorithm {
+		return nil, s3Err(http.StatusBadRequest, "InvalidRequest", "only " + gS3Algorithm + " is supported")
+	}
+	credential, amzDate := qv.Get("X-Amz-Credential"), qv.Get("X-Amz-Date")
+	signedHeaders, signature := qv.Get("X-Amz-SignedHeaders"), qv.Get("X-Amz-Signature")
+	if len(credential) == 0 || len(amzDate) == 0 || len(signedHeaders) == 0 || len(signature) == 0 {
+		return nil, s3Err(http.StatusBadRequest, "AuthorizationQueryParametersError", "need X-Amz-Credential, X-Amz-Date, X-Amz-SignedHeaders and X-Amz-Signature")
+	}
+	t, err := time.Parse(gS3TimeFormat, amzDate)
+	if err != nil {
+		return nil, s3Err(http.StatusBadRequest, "AuthorizationQueryParametersError", "invalid X-Amz-Date")
+	}
+	expires, err := strconv.ParseInt(qv.Get("X-Amz-Expires"), 10, 64)
+	if err != nil || expires <= 0 || expires > gS3MaxPresignExpires {
+		return nil, s3Err(http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be in [1, 604800]")
+	}
+	if t.Sub(now) > gS3MaxTimeSkew {
+		return nil, s3Err(http.StatusForbidden, "AccessDenied", "request is not valid yet")
+	}
+	if now.After(t.Add(time.Duration(expires)*time.Second)) {
+		return nil, s3Err(http.StatusForbidden, "AccessDenied", "request has expired")
+	}
+	payloadHash := qv.Get("X-Amz-Content-Sha256")
+	if len(payloadHash) == 0 {
+		payloadHash = gS3UnsignedPayload
+	}
+	return h.verify(r, credential, amzDate, signedHeaders, signature, payloadHash, "X-Amz-Signature")
+}
+
+// the signature is computed again from the request and compared
+func (h *S3Handler) verify(r *http.Request, credential, amzDate, signedHeaders, signature, payloadHash, skipQuery string) (*s3Auth, *apiError) {
+	// AKID/20130524/us-east-1/s3/aws4_request
+	cparts := strings.Split(credential, "/")
+	if len(cparts) != 5 || cparts[3] != gS3Service || cparts[4] != gS3Terminator {
+		return nil, s3Err(http.StatusBadRequest, "AuthorizationHeaderMalformed", "invalid credential: " + credential)
+	}
+	cred, ok := h.bs.config.s3Credentials[cparts[0]]
+	if !ok {
+		return nil, s3Err(http.StatusForbidden, "InvalidAccessKeyId", "the access key id you provided does not exist in our records")
+	}
+	if cparts[1] != amzDate[:len(gS3DateFormat)] {
+		return nil, s3Err(http.StatusBadRequest, "AuthorizationHeaderMalformed", "the date of the credential does not match X-Amz-Date")
+	}
+	if cparts[2] != h.bs.config.s3Region {
+		return nil, s3Err(http.StatusBadRequest, "AuthorizationHeaderMalformed", fmt.Sprintf("the region is wrong, expecting '%s'", h.bs.config.s3Region))
+	}
+	headers := strings.Split(signedHeaders, ";")
+	hasHost := false
+	for _, name := range headers {
+		if name == "host" {
+			hasHost = true
+		}
+	}
+	if !hasHost {
+		return nil, s3Err(http.StatusBadRequest, "AuthorizationHeaderMalformed", "host must be signed")
+	}
+	creq := strings.Join([]string {
+        r.Method,
+		s3Encode(r.URL.Path, false),
+		s3CanonicalQuery(r.URL.Query(), skipQuery),
+		s3CanonicalHeaders(r, headers),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join(cparts[1:], "/")
+	sts := strings.Join([]string{gS3Algorithm, amzDate, scope, sha256Hex([]byte(creq))}, "\n")
+	key := hmacSha256([]byte("AWS4" + cred.secretKey), []byte(cparts[1]))
+	for _, s := range cparts[2:] {
+		key = hmacSha256(key, []byte(s))
+	}
+	expected := hex.EncodeToString(hmacSha256(key, []byte(sts)))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, s3Err(http.StatusForbidden, "SignatureDoesNotMatch", "the request signature we calculated does not match the signature you provided")
+	}
+    auth := &s3Auth {
+        cred: cred,
+		amzDate: amzDate,
+		scope: scope,
+		signingKey: key,
+		signature: signature,
+		payloadHash: payloadHash,
+	}
+	return auth, nil
+}
+
+// uri encoding of sigv4: all but A-Za-z0-9-_.~ as %XX, / kept in paths
+func s3Encode(s string, encodeSlash bool) string {
+	b := &bytes.Buffer{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(qv url.Values, skip string) string {
+	encoded := make(map[string][]string, len(qv))
+	var keys []string
+	for k, vs := range qv {
+		if k == skip {
+			continue
+		}
+		ek := s3Encode(k, true)
+		keys = append(keys, ek)
+		for _, v := range vs {
+			encoded[ek] = append(encoded[ek], s3Encode(v, true))
+		}
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, ek := range keys {
+		evs := encoded[ek]
+		sort.Strings(evs)
+		for _, ev := range evs {
+			pairs = append(pairs, ek + "=" + ev)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// each header line ends with \n, so there is an empty line before SignedHeaders
+func s3CanonicalHeaders(r *http.Request, names []string) string {
+	b := &bytes.Buffer{}
+	for _, name := range names {
+		var vs []string
+		switch name {
+			case "host":
+				vs = []string{r.Host}
+			case "content-length":
+				vs = []string{strconv.FormatInt(r.ContentLength, 10)}
+			default:
+				vs = r.Header[http.CanonicalHeaderKey(name)]
+		}
+		trimmed := make([]string, len(vs))
+		for i, v := range vs {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(trimmed, ","))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func isS3ChunkedPayload(payloadHash string) bool {
+	switch payloadHash {
+		case gS3StreamingPayload, gS3UnsignedTrailerPayload, gS3StreamingTrailerPayload:
+			return true
+	}
+	return false
+}
+
+// the hash behind x-amz-checksum-<algorithm>, nil if unknown
+func s3ChecksumHash(name string) hash.Hash {
+	switch name {
+		case "x-amz-checksum-crc32":
+			return crc32.NewIEEE()
+		case "x-amz-checksum-crc32c":
+			return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		case "x-amz-checksum-crc64nvme":
+			return crc64.New(gS3Crc64NvmeTable)
+		case "x-amz-checksum-sha1":
+			return sha1.New()
+		case "x-amz-checksum-sha256":
+			return sha256.New()
+	}
+	return nil
+}
+
+// the data of an aws-chunked body, each chunk is
+//   hex(size);chunk-signature=<sig>\r\n<data>\r\n
+// or hex(size)\r\n<data>\r\n if unsigned, and the last one has size 0.
+// with a trailer the last chunk is followed by
+//   <x-amz-checksum-*>:<base64>\r\n[x-amz-trailer-signature:<sig>\r\n]\r\n
+type s3ChunkedReader struct {
+	r *bufio.Reader
+	auth *s3Auth
+	signed bool
+	// lower case name of the trailing checksum, empty if none
+	trailer string
+	sum hash.Hash
+	prevSignature string
+	data []byte
+	done bool
+}
+
+func newS3ChunkedReader(r io.Reader, auth *s3Auth, trailer string) (*s3ChunkedReader, error) {
+    cr := &s3ChunkedReader {
+        r: bufio.NewReader(r),
+		auth: auth,
+		signed: auth.payloadHash != gS3UnsignedTrailerPayload,
+		prevSignature: auth.signature,
+	}
+	if auth.payloadHash == gS3StreamingPayload {
+		return cr, nil
+	}
+	cr.trailer = strings.ToLower(strings.TrimSpace(trailer))
+	cr.sum = s3ChecksumHash(cr.trailer)
+	if cr.sum == nil {
+		return nil, errors.New(fmt.Sprintf("x-amz-trailer shall be one x-amz-checksum-*, not %q", trailer))
+	}
+	return cr, nil
+}
+
+func (cr *s3ChunkedReader) Read(p []byte) (int, error) {
+	for len(cr.data) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		err := cr.readChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cr.data)
+	cr.data = cr.data[n:]
+	return n, nil
+}
+
+func (cr *s3ChunkedReader) readChunk() error {
+	line, err := cr.r.ReadString('\n')
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	line = strings.TrimRight(line, "\r\n")
+	sizeHex, signature := line, ""
+	if cr.signed {
+		i := strings.Index(line, ";chunk-signature=")
+		if i < 0 {
+			return errors.New("invalid chunk header")
+		}
+		sizeHex, signature = line[:i], line[i + len(";chunk-signature="):]
+	} else if i := strings.Index(line, ";"); i >= 0 {
+		sizeHex = line[:i]
+	}
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > int64(gS3MaxChunkSize) {
+		return errors.New("invalid chunk size")
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(cr.r, data)
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if size > 0 || len(cr.trailer) == 0 {
+		crlf := make([]byte, 2)
+		_, err = io.ReadFull(cr.r, crlf)
+		if err != nil || string(crlf) != "\r\n" {
+			return errors.New("invalid chunk end")
+		}
+	}
+	if cr.signed {
+		sts := strings.Join([]string{gS3Algorithm + "-PAYLOAD", cr.auth.amzDate, cr.auth.scope, cr.prevSignature, gS3EmptySha256, sha256Hex(data)}, "\n")
+		expected := hex.EncodeToString(hmacSha256(cr.auth.signingKey, []byte(sts)))
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			return errS3ChunkSignature
+		}
+		cr.prevSignature = signature
+	}
+	if cr.sum != nil {
+		cr.sum.Write(data)
+	}
+	cr.data = data
+	cr.done = size == 0
+	if cr.done && len(cr.trailer) > 0 {
+		return cr.readTrailer()
+	}
+	return nil
+}
+
+// the trailing checksum is checked against the body read
+func (cr *s3ChunkedReader) readTrailer() error {
+	var canonical bytes.Buffer
+	var value, signature string
+	for {
+		line, err := cr.r.ReadString('\n')
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			break
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return errors.New("invalid trailer")
+		}
+		name, v := strings.ToLower(strings.TrimSpace(line[:i])), strings.TrimSpace(line[i+1:])
+		if name == gS3TrailerSignatureName {
+			signature = v
+			continue
+		}
+		if name == cr.trailer {
+			value = v
+		}
+		canonical.WriteString(name + ":" + v + "\n")
+	}
+	if cr.signed {
+		sts := strings.Join([]string{gS3Algorithm + "-TRAILER", cr.auth.amzDate, cr.auth.scope, cr.prevSignature, sha256Hex(canonical.Bytes())}, "\n")
+		expected := hex.EncodeToString(hmacSha256(cr.auth.signingKey, []byte(sts)))
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			return errS3ChunkSignature
+		}
+	}
+	sum := cr.sum.Sum(nil)
+	if base64.StdEncoding.EncodeToString(sum) != value {
+		return errS3TrailerChecksum
+	}
+	return nil
+}
@@ -0,0 +1,375 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/dzch/go-utils/logger"
+		"encoding/hex"
+		"encoding/xml"
+		"net/http"
+		"strconv"
+		"strings"
+		"errors"
+		"time"
+		"fmt"
+		"io"
+	   )
+
+/*
+   a subset of s3 on its own port, path style only:
+     PUT /<bucket>/<name>     PutObject, goes through the steps of /add. name
+                              is pointed at the binstore key in the dedup
+                              index of the namespace, a second PUT re-points
+                              it. the key is answered in X-Binstore-Key, name
+                              is kept as the filename
+     GET, HEAD /<bucket>/<name> GetObject, HeadObject
+     DELETE /<bucket>/<name>  DeleteObject, drops the name only: through dedup
+                              the blob may be shared by other names and keys
+     HEAD /<bucket>           HeadBucket
+   objects are found by name first, then by key, so what /add stored reads as
+   /<bucket>/<key>, and DELETE of a key deletes the blob like /delete.
+   a bucket is a namespace, "default" for the default one. x-amz-meta-* are
+   kept like X-Binstore-Meta-*. every request is signed with sigv4 by one of
+   the credentials of s3_server. sub-resources such as ?acl are refused, other
+   query params such as ?x-id of the js sdk are ignored.
+*/
+var (
+		gS3KeyHeader = "X-Binstore-Key"
+		gS3MetaHeaderPrefix = "X-Amz-Meta-"
+		gS3SubResources = map[string]bool {
+			"acl": true, "attributes": true, "cors": true, "delete": true,
+			"legal-hold": true, "lifecycle": true, "list-type": true, "location": true,
+			"partNumber": true, "policy": true, "restore": true, "retention": true,
+			"select": true, "tagging": true, "torrent": true, "uploadId": true,
+			"uploads": true, "versionId": true, "versioning": true, "versions": true,
+			"website": true,
+		}
+	)
+
+type S3Handler struct {
+	bs *BinStore
+	gh *GetHandler
+}
+
+type S3ErrorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code string `xml:"Code"`
+	Message string `xml:"Message"`
+	Resource string `xml:"Resource"`
+	RequestId string `xml:"RequestId"`
+}
+
+func newS3Handler(bs *BinStore) *S3Handler {
+    h := &S3Handler {
+        bs: bs,
+		gh: newGetHandler(bs),
+	}
+	return h
+}
+
+func (bs *BinStore) initS3Server() error {
+	if bs.config.s3ServerListenPort == 0 {
+		return nil
+	}
+    bs.s3Server = &http.Server {
+        Addr: fmt.Sprintf(":%d", bs.config.s3ServerListenPort),
+		Handler: withRequestId(newS3Handler(bs)),
+		ReadTimeout: bs.config.httpServerReadTimeout,
+		WriteTimeout: bs.config.httpServerWriteTimeout,
+	}
+	return nil
+}
+
+func (bs *BinStore) runS3Server() {
+    err := bs.s3Server.ListenAndServe()
+	if err != nil {
+		logger.Fatal("fail to start s3 server: %s", err.Error())
+		bs.fatalErrorChan <- err
+		return
+	}
+	err = errors.New("s3 server done")
+	bs.fatalErrorChan <- err
+}
+
+func (h *S3Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Amz-Request-Id", w.Header().Get(gRequestIdHeader))
+	auth, ae := h.authenticate(r, time.Now())
+	if ae != nil {
+		logger.Warning("invalid s3 query, not authorized: %s, %s, %s", r.Method, r.URL.String(), ae.Error())
+		writeS3Error(w, r, ae)
+		return
+	}
+	bucket, name := r.URL.Path, ""
+	bucket = strings.TrimPrefix(bucket, "/")
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, name = bucket[:i], bucket[i+1:]
+	}
+	if len(bucket) == 0 {
+		writeS3Error(w, r, s3Err(http.StatusNotImplemented, "NotImplemented", "ListBuckets is not supported"))
+		return
+	}
+	ns, err := h.bs.namespaceNamed(bucket)
+	if err != nil {
+		writeS3Error(w, r, s3Err(http.StatusNotFound, "NoSuchBucket", "the specified bucket does not exist"))
+		return
+	}
+	for k := range r.URL.Query() {
+		if gS3SubResources[k] {
+			writeS3Error(w, r, s3Err(http.StatusNotImplemented, "NotImplemented", fmt.Sprintf("?%s is not supported", k)))
+			return
+		}
+	}
+	if len(name) == 0 {
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		writeS3Error(w, r, s3Err(http.StatusNotImplemented, "NotImplemented", "only HeadBucket is supported on buckets"))
+		return
+	}
+	if (r.Method == "PUT" || r.Method == "DELETE") && auth.cred.readOnly {
+		writeS3Error(w, r, s3Err(http.StatusForbidden, "AccessDenied", "the access key is read only"))
+		return
+	}
+	switch r.Method {
+		case "PUT":
+			if len(r.Header.Get("X-Amz-Copy-Source")) > 0 {
+				writeS3Error(w, r, s3Err(http.StatusNotImplemented, "NotImplemented", "CopyObject is not supported"))
+				return
+			}
+			h.putObject(w, r, ns, auth, name)
+		case "GET", "HEAD":
+			h.getObject(w, r, ns, name)
+		case "DELETE":
+			h.deleteObject(w, r, ns, name)
+		default:
+			writeS3Error(w, r, s3Err(http.StatusMethodNotAllowed, "MethodNotAllowed", "the specified method is not allowed against this resource"))
+	}
+}
+
+func (h *S3Handler) putObject(w http.ResponseWriter, r *http.Request, ns *Namespace, auth *s3Auth, name string) {
+    startTime := time.Now()
+	bs := h.bs
+	ad := bs.adp.fetch()
+	defer bs.adp.put(ad)
+	err := ad.meta.parseHeader(s3MetaHeader(r.Header), name)
+	if err != nil {
+		logger.Warning("invalid s3 put, bad meta: %s, %s", r.URL.String(), err.Error())
+		writeS3Error(w, r, s3Err(http.StatusBadRequest, "InvalidArgument", err.Error()))
+		return
+	}
+	ad.meta.Ctime = time.Now().Unix()
+	err = ad.want.parseHeader(r.Header)
+	if err == nil && len(auth.payloadHash) == len(gS3EmptySha256) {
+		// the signed payload hash is the sha256 of the body
+		sum, e := hex.DecodeString(auth.payloadHash)
+		if e == nil {
+			err = ad.want.set(ad.want.md5, sum)
+		}
+	}
+	if err != nil {
+		logger.Warning("invalid s3 put, bad checksum header: %s, %s", r.URL.String(), err.Error())
+		writeS3Error(w, r, s3Err(http.StatusBadRequest, "InvalidDigest", err.Error()))
+		return
+	}
+	var body io.Reader = r.Body
+	size := r.ContentLength
+	if isS3ChunkedPayload(auth.payloadHash) {
+		cr, err := newS3ChunkedReader(r.Body, auth, r.Header.Get("X-Amz-Trailer"))
+		if err != nil {
+			writeS3Error(w, r, s3Err(http.StatusBadRequest, "InvalidRequest", err.Error()))
+			return
+		}
+		body = cr
+		size, err = strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil {
+			writeS3Error(w, r, s3Err(http.StatusLengthRequired, "MissingContentLength", "need x-amz-decoded-content-length"))
+			return
+		}
+	}
+	maxSize := bs.config.httpServerMaxBodySize
+	if size > maxSize {
+		logger.Warning("invalid s3 put, body too large: %s, %d", r.URL.String(), size)
+		writeS3Error(w, r, s3Err(http.StatusBadRequest, "EntityTooLarge", fmt.Sprintf("body exceeds the max size of %d bytes", maxSize)))
+		return
+	}
+	nr, err := ad.readFrom(body, maxSize)
+	if err == errBodyTooLarge {
+		logger.Warning("invalid s3 put, body too large: %s, more than %d", r.URL.String(), maxSize)
+		writeS3Error(w, r, s3Err(http.StatusBadRequest, "EntityTooLarge", fmt.Sprintf("body exceeds the max size of %d bytes", maxSize)))
+		return
+	}
+	if err == errS3ChunkSignature {
+		logger.Warning("invalid s3 put, bad chunk signature: %s", r.URL.String())
+		writeS3Error(w, r, s3Err(http.StatusForbidden, "SignatureDoesNotMatch", err.Error()))
+		return
+	}
+	if err == errS3TrailerChecksum {
+		logger.Warning("invalid s3 put, bad trailing checksum: %s", r.URL.String())
+		writeS3Error(w, r, s3Err(http.StatusBadRequest, "BadDigest", err.Error()))
+		return
+	}
+	if err != nil || (size >= 0 && nr != size) {
+		logger.Warning("invalid s3 put, incomplete body: %s, size=%d, read=%d", r.URL.String(), size, nr)
+		writeS3Error(w, r, s3Err(http.StatusBadRequest, "IncompleteBody", "you did not provide the number of bytes specified by the Content-Length HTTP header"))
+		return
+	}
+	id, ae := bs.addData(ns, ad)
+	if ae != nil {
+		logger.Warning("fail to s3 put: %s, %s", r.URL.String(), ae.Error())
+		writeS3Error(w, r, s3ErrorOf(ae))
+		return
+	}
+	err = ns.dd.setName(name, ad.Key)
+	if err != nil {
+		logger.Warning("fail to dd.setName: %s, key=%s, %s", r.URL.String(), ad.Key, err.Error())
+		writeS3Error(w, r, s3Err(http.StatusServiceUnavailable, "ServiceUnavailable", "fail to name the object"))
+		return
+	}
+	w.Header().Set("ETag", "\"" + hex.EncodeToString(ad.md5Sum()) + "\"")
+	w.Header().Set(gS3KeyHeader, ad.Key)
+	w.WriteHeader(http.StatusOK)
+    endTime := time.Now()
+	costTimeUS := endTime.Sub(startTime)/time.Microsecond
+	logger.Notice("success process s3 put: %s, ns=%s, access_key=%s, cost_us=%d, datalen=%d, id=%d, key=%s", r.URL.String(), ns.name, auth.cred.accessKey, costTimeUS, nr, id, ad.Key)
+}
+
+// x-amz-meta-* as X-Binstore-Meta-*, with Content-Type and Content-Disposition
+func s3MetaHeader(header http.Header) http.Header {
+	mh := http.Header{}
+	for k, vs := range header {
+		switch {
+			case k == "Content-Type" || k == "Content-Disposition":
+				mh[k] = vs
+			case strings.HasPrefix(k, gS3MetaHeaderPrefix):
+				mh[gMetaHeaderPrefix + k[len(gS3MetaHeaderPrefix):]] = vs
+		}
+	}
+	return mh
+}
+
+// the key name points at, or name itself if it is a key of ns. "" if neither
+func (h *S3Handler) objectKey(ns *Namespace, name string) (key string, named bool, err error) {
+	key, err = ns.dd.nameKey(name)
+	if err != nil || len(key) > 0 {
+		return key, len(key) > 0, err
+	}
+	if kns, e := h.bs.namespaceOfKey(name); e == nil && kns == ns {
+		return name, false, nil
+	}
+	return "", false, nil
+}
+
+func (h *S3Handler) getObject(w http.ResponseWriter, r *http.Request, ns *Namespace, name string) {
+    startTime := time.Now()
+	key, _, err := h.objectKey(ns, name)
+	if err != nil {
+		logger.Warning("fail to dd.nameKey: %s, %s", r.URL.String(), err.Error())
+		writeS3Error(w, r, s3Err(http.StatusServiceUnavailable, "ServiceUnavailable", "fail to find the object"))
+		return
+	}
+	if len(key) == 0 {
+		writeS3Error(w, r, s3Err(http.StatusNotFound, "NoSuchKey", "the specified key does not exist"))
+		return
+	}
+	val, meta, ae := h.bs.getByKey(key)
+	if ae != nil {
+		logger.Warning("fail to s3 get: %s, %s", r.URL.String(), ae.Error())
+		writeS3Error(w, r, s3ErrorOf(ae))
+		return
+	}
+	if meta != nil {
+		for k, v := range meta.Headers {
+			w.Header().Set(gS3MetaHeaderPrefix + k, v)
+		}
+	}
+	h.gh.serveData(w, r, val, meta, blobETag(key, meta, ""))
+    endTime := time.Now()
+	costTimeUS := endTime.Sub(startTime)/time.Microsecond
+	logger.Notice("success process s3 get: %s, method=%s, key=%s, cost_us=%d, datalen=%d", r.URL.String(), r.Method, key, costTimeUS, len(val))
+}
+
+// like s3, deleting what is not there is fine
+func (h *S3Handler) deleteObject(w http.ResponseWriter, r *http.Request, ns *Namespace, name string) {
+	key, named, err := h.objectKey(ns, name)
+	if err == nil && named {
+		err = ns.dd.deleteName(name)
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			logger.Notice("success process s3 delete: %s, name of key=%s, remote=%s", r.URL.String(), key, r.RemoteAddr)
+			return
+		}
+	}
+	if err != nil {
+		logger.Warning("fail to s3 delete name: %s, %s", r.URL.String(), err.Error())
+		writeS3Error(w, r, s3Err(http.StatusServiceUnavailable, "ServiceUnavailable", "fail to delete the object"))
+		return
+	}
+	if len(key) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	id, ae := h.bs.deleteKey(key)
+	if ae != nil && ae.code != errCodeInvalidKey {
+		logger.Warning("fail to s3 delete: %s, %s", r.URL.String(), ae.Error())
+		writeS3Error(w, r, s3ErrorOf(ae))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	logger.Notice("success process s3 delete: %s, id=%d, remote=%s", r.URL.String(), id, r.RemoteAddr)
+}
+
+// failures of the binstore steps as s3 would answer them
+func s3ErrorOf(ae *apiError) *apiError {
+	switch ae.code {
+		case errCodeNotFound, errCodeDeleted, errCodeExpired, errCodeInvalidKey:
+			return s3Err(http.StatusNotFound, "NoSuchKey", ae.msg)
+		case errCodeUnknownNamespace:
+			return s3Err(http.StatusNotFound, "NoSuchBucket", ae.msg)
+		case errCodeBodyTooLarge:
+			return s3Err(http.StatusBadRequest, "EntityTooLarge", ae.msg)
+		case errCodeChecksumMismatch:
+			return s3Err(http.StatusBadRequest, "BadDigest", ae.msg)
+		case errCodeInvalidRequest:
+			return s3Err(http.StatusBadRequest, "InvalidArgument", ae.msg)
+	}
+	if ae.status == http.StatusServiceUnavailable {
+		return s3Err(http.StatusServiceUnavailable, "ServiceUnavailable", ae.msg)
+	}
+	return s3Err(http.StatusInternalServerError, "InternalError", ae.msg)
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, ae *apiError) {
+	rsp := &S3ErrorResponse {
+        Code: ae.code,
+		Message: ae.msg,
+		Resource: r.URL.Path,
+		RequestId: w.Header().Get(gRequestIdHeader),
+	}
+	body, _ := xml.Marshal(rsp)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(ae.status)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
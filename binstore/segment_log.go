@@ -0,0 +1,432 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"os"
+		"sort"
+		"sync"
+		"strings"
+		"strconv"
+		"fmt"
+		"errors"
+		"path/filepath"
+		"hash/crc32"
+		"encoding/binary"
+	   )
+
+/*
+   embedded message log, one directory per partition: <dir>/<topic>-<partition>/
+   a partition is a list of segments named by the offset of their first record:
+     <base>.log    record := len(4) | crc32(4) | value(len)
+     <base>.index  one uint64 file position per record, entry i is offset base+i
+   the tail of the last segment is checked on start, a torn record is cut off.
+   without segment_sync a crash may lose acked records, so offsets are reserved
+   ahead in <dir>/reserved (synced) and a partition restarts past the last
+   reservation: an offset is never handed out twice, lost ones are not found.
+*/
+var (
+		gSegmentRecordHeaderLen = 8
+		gSegmentIndexEntryLen = 8
+		gSegmentLogSuffix = ".log"
+		gSegmentIndexSuffix = ".index"
+		gSegmentReservedFile = "reserved"
+		gSegmentReserveStep int64 = 4096
+	)
+
+type segment struct {
+	base int64
+	count int64
+	size int64
+	log *os.File
+	index *os.File
+}
+
+type segmentPartition struct {
+	dir string
+	segments []*segment
+	// offsets below it may have been handed out
+	reserved int64
+	reservedFile *os.File
+	lock *sync.RWMutex
+}
+
+// concurrent safe
+type SegmentLog struct {
+	config *Config
+	topic string
+	partitions []*segmentPartition
+	writable []int32
+}
+
+func newSegmentLog(config *Config, topic string) (*SegmentLog, error) {
+    sl := &SegmentLog {
+        config: config,
+		topic: topic,
+	}
+	err := sl.init()
+	if err != nil {
+		return nil, err
+	}
+	return sl, nil
+}
+
+func (sl *SegmentLog) init() error {
+	n := sl.config.brokerSegmentPartitions
+	if n <= 0 || n > int(gPartitionMaxValue)+1 {
+		return errors.New(fmt.Sprintf("segment partitions shall be in [1, %d], now is %d", gPartitionMaxValue+1, n))
+	}
+	for i := 0; i < n; i ++ {
+        sp := &segmentPartition {
+            dir: filepath.Join(sl.config.brokerSegmentDir, fmt.Sprintf("%s-%d", sl.topic, i)),
+			lock: &sync.RWMutex{},
+		}
+		err := sl.loadPartition(sp)
+		if err != nil {
+			return errors.New(fmt.Sprintf("fail to load partition %d: %s", i, err.Error()))
+		}
+		sl.partitions = append(sl.partitions, sp)
+		sl.writable = append(sl.writable, int32(i))
+	}
+	return nil
+}
+
+func (sl *SegmentLog) loadPartition(sp *segmentPartition) error {
+	err := os.MkdirAll(sp.dir, 0755)
+	if err != nil {
+		return err
+	}
+	names, err := filepath.Glob(filepath.Join(sp.dir, "*" + gSegmentLogSuffix))
+	if err != nil {
+		return err
+	}
+	var bases []int64
+	for _, name := range names {
+		base, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), gSegmentLogSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		bases = append(bases, base)
+	}
+	sort.Sort(int64Slice(bases))
+	for i, base := range bases {
+		seg, err := sl.openSegment(sp, base, i == len(bases)-1)
+		if err != nil {
+			return err
+		}
+		sp.segments = append(sp.segments, seg)
+	}
+	if len(sp.segments) == 0 {
+		seg, err := sl.openSegment(sp, 0, true)
+		if err != nil {
+			return err
+		}
+		sp.segments = append(sp.segments, seg)
+	}
+	return sl.loadReserved(sp)
+}
+
+// records acked but lost in a crash leave the next offset below the reservation,
+// writing goes on in a new segment based at it
+func (sl *SegmentLog) loadReserved(sp *segmentPartition) error {
+	f, err := os.OpenFile(filepath.Join(sp.dir, gSegmentReservedFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	sp.reservedFile = f
+	buf := make([]byte, 8)
+	n, err := f.ReadAt(buf, 0)
+	if n == 0 {
+		return nil
+	}
+	if n != len(buf) {
+		return errors.New(fmt.Sprintf("invalid %s in %s: %v", gSegmentReservedFile, sp.dir, err))
+	}
+	sp.reserved = int64(binary.LittleEndian.Uint64(buf))
+	active := sp.segments[len(sp.segments)-1]
+	if active.base + active.count >= sp.reserved {
+		return nil
+	}
+	seg, err := sl.openSegment(sp, sp.reserved, true)
+	if err != nil {
+		return err
+	}
+	sp.segments = append(sp.segments, seg)
+	return nil
+}
+
+// must hold sp.lock
+func (sl *SegmentLog) reserve(sp *segmentPartition, offset int64) error {
+	reserved := offset + gSegmentReserveStep
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(reserved))
+	_, err := sp.reservedFile.WriteAt(buf, 0)
+	if err != nil {
+		return err
+	}
+	err = sp.reservedFile.Sync()
+	if err != nil {
+		return err
+	}
+	sp.reserved = reserved
+	return nil
+}
+
+func (sl *SegmentLog) segmentPath(sp *segmentPartition, base int64, suffix string) string {
+	return filepath.Join(sp.dir, fmt.Sprintf("%020d%s", base, suffix))
+}
+
+func (sl *SegmentLog) openSegment(sp *segmentPartition, base int64, last bool) (*segment, error) {
+	lf, err := os.OpenFile(sl.segmentPath(sp, base, gSegmentLogSuffix), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	xf, err := os.OpenFile(sl.segmentPath(sp, base, gSegmentIndexSuffix), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		lf.Close()
+		return nil, err
+	}
+    seg := &segment {
+        base: base,
+		log: lf,
+		index: xf,
+	}
+	if last {
+		err = sl.recoverSegment(seg)
+	} else {
+		err = sl.statSegment(seg)
+	}
+	if err != nil {
+		lf.Close()
+		xf.Close()
+		return nil, err
+	}
+	return seg, nil
+}
+
+func (sl *SegmentLog) statSegment(seg *segment) error {
+	fi, err := seg.index.Stat()
+	if err != nil {
+		return err
+	}
+	seg.count = fi.Size()/int64(gSegmentIndexEntryLen)
+	fi, err = seg.log.Stat()
+	if err != nil {
+		return err
+	}
+	seg.size = fi.Size()
+	return nil
+}
+
+// rebuild the index of the active segment from its log, so that a crash
+// between writing the log and the index loses nothing that was acked.
+func (sl *SegmentLog) recoverSegment(seg *segment) error {
+	fi, err := seg.log.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	header := make([]byte, gSegmentRecordHeaderLen)
+	entry := make([]byte, gSegmentIndexEntryLen)
+	var pos int64
+	var count int64
+	for {
+		_, err := seg.log.ReadAt(header, pos)
+		if err != nil {
+			break
+		}
+		length := int64(binary.LittleEndian.Uint32(header[0:4]))
+		// a garbage length in a torn header must not be allocated
+		if length > int64(sl.config.brokerMaxMessageSize) || pos + int64(gSegmentRecordHeaderLen) + length > size {
+			break
+		}
+		value := make([]byte, length)
+		_, err = seg.log.ReadAt(value, pos + int64(gSegmentRecordHeaderLen))
+		if err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(value) != binary.LittleEndian.Uint32(header[4:8]) {
+			break
+		}
+		binary.LittleEndian.PutUint64(entry, uint64(pos))
+		_, err = seg.index.WriteAt(entry, count*int64(gSegmentIndexEntryLen))
+		if err != nil {
+			return err
+		}
+		pos += int64(gSegmentRecordHeaderLen) + length
+		count ++
+	}
+	err = seg.log.Truncate(pos)
+	if err != nil {
+		return err
+	}
+	err = seg.index.Truncate(count*int64(gSegmentIndexEntryLen))
+	if err != nil {
+		return err
+	}
+	seg.count = count
+	seg.size = pos
+	return nil
+}
+
+func (sl *SegmentLog) getPartition(partition int32) (*segmentPartition, error) {
+	if partition < 0 || int(partition) >= len(sl.partitions) {
+		return nil, errors.New(fmt.Sprintf("partition %d not exist", partition))
+	}
+	return sl.partitions[partition], nil
+}
+
+// must hold sp.lock
+func (sl *SegmentLog) roll(sp *segmentPartition) error {
+	active := sp.segments[len(sp.segments)-1]
+	seg, err := sl.openSegment(sp, active.base + active.count, true)
+	if err != nil {
+		return err
+	}
+	sp.segments = append(sp.segments, seg)
+	return nil
+}
+
+func (sl *SegmentLog) Append(partition int32, value []byte) (int32, int64, error) {
+	sp, err := sl.getPartition(partition)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(value) > sl.config.brokerMaxMessageSize {
+		return 0, 0, errors.New(fmt.Sprintf("message of %d bytes is larger than max_message_size %d", len(value), sl.config.brokerMaxMessageSize))
+	}
+	need := int64(gSegmentRecordHeaderLen) + int64(len(value))
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	seg := sp.segments[len(sp.segments)-1]
+	if seg.size > 0 && seg.size + need > sl.config.brokerSegmentMaxSize {
+		err = sl.roll(sp)
+		if err != nil {
+			return 0, 0, err
+		}
+		seg = sp.segments[len(sp.segments)-1]
+	}
+	offset := seg.base + seg.count
+	if !sl.config.brokerSegmentSync && offset >= sp.reserved {
+		err = sl.reserve(sp, offset)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	buf := make([]byte, need)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(value)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(value))
+	copy(buf[gSegmentRecordHeaderLen:], value)
+	_, err = seg.log.WriteAt(buf, seg.size)
+	if err != nil {
+		seg.log.Truncate(seg.size)
+		return 0, 0, err
+	}
+	entry := make([]byte, gSegmentIndexEntryLen)
+	binary.LittleEndian.PutUint64(entry, uint64(seg.size))
+	_, err = seg.index.WriteAt(entry, seg.count*int64(gSegmentIndexEntryLen))
+	if err != nil {
+		seg.log.Truncate(seg.size)
+		seg.index.Truncate(seg.count*int64(gSegmentIndexEntryLen))
+		return 0, 0, err
+	}
+	if sl.config.brokerSegmentSync {
+		err = seg.log.Sync()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	seg.size += need
+	seg.count ++
+	return partition, offset, nil
+}
+
+// local reads, nothing to gain from batching
+func (sl *SegmentLog) FetchMany(locs []logLocation) ([][]byte, []error) {
+	values := make([][]byte, len(locs))
+	errs := make([]error, len(locs))
+	for i, loc := range locs {
+		values[i], errs[i] = sl.Fetch(loc.partition, loc.offset)
+	}
+	return values, errs
+}
+
+func (sl *SegmentLog) Fetch(partition int32, offset int64) ([]byte, error) {
+	sp, err := sl.getPartition(partition)
+	if err != nil {
+		return nil, err
+	}
+	// held across the reads, no segment changes under them
+	sp.lock.RLock()
+	defer sp.lock.RUnlock()
+	i := sort.Search(len(sp.segments), func(i int) bool {
+		return sp.segments[i].base + sp.segments[i].count > offset
+	})
+	if i == len(sp.segments) || sp.segments[i].base > offset {
+		return nil, errLogNoMessage
+	}
+	seg := sp.segments[i]
+	entry := make([]byte, gSegmentIndexEntryLen)
+	_, err = seg.index.ReadAt(entry, (offset - seg.base)*int64(gSegmentIndexEntryLen))
+	if err != nil {
+		return nil, err
+	}
+	pos := int64(binary.LittleEndian.Uint64(entry))
+	header := make([]byte, gSegmentRecordHeaderLen)
+	_, err = seg.log.ReadAt(header, pos)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+	_, err = seg.log.ReadAt(value, pos + int64(gSegmentRecordHeaderLen))
+	if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(value) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, errors.New(fmt.Sprintf("crc32 mismatch at offset %d in partition %d", offset, partition))
+	}
+	return value, nil
+}
+
+func (sl *SegmentLog) WritablePartitions() ([]int32, error) {
+	return sl.writable, nil
+}
+
+func (sl *SegmentLog) Watermarks(partition int32) (int64, int64, error) {
+	sp, err := sl.getPartition(partition)
+	if err != nil {
+		return 0, 0, err
+	}
+	sp.lock.RLock()
+	defer sp.lock.RUnlock()
+	first := sp.segments[0]
+	last := sp.segments[len(sp.segments)-1]
+	return first.base, last.base + last.count, nil
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,242 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"io/ioutil"
+		"testing"
+		"fmt"
+	   )
+
+func newTestSegmentLog(t *testing.T, config *Config) *SegmentLog {
+	sl, err := newSegmentLog(config, "binstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sl
+}
+
+func testSegmentConfig(t *testing.T, sync bool) *Config {
+	return &Config {
+        brokerSegmentDir: t.TempDir(),
+		brokerSegmentPartitions: 2,
+		brokerSegmentMaxSize: 64,
+		brokerMaxMessageSize: 1024,
+		brokerSegmentSync: sync,
+	}
+}
+
+func checkSegmentValue(t *testing.T, sl *SegmentLog, partition int32, offset int64, want string) {
+	v, err := sl.Fetch(partition, offset)
+	if err != nil {
+		t.Fatalf("fetch %d/%d: %v", partition, offset, err)
+	}
+	if string(v) != want {
+		t.Fatalf("fetch %d/%d: %q, want %q", partition, offset, v, want)
+	}
+}
+
+// the active segment of partition, to tear its tail
+func activeSegment(sl *SegmentLog, partition int32) *segment {
+	sp := sl.partitions[partition]
+	return sp.segments[len(sp.segments)-1]
+}
+
+func TestSegmentLogRoundTrip(t *testing.T) {
+	c := testSegmentConfig(t, true)
+	sl := newTestSegmentLog(t, c)
+	// 26 bytes a record, segments roll over every two
+	for i := 0; i < 20; i++ {
+		p, o, err := sl.Append(int32(i%2), []byte(fmt.Sprintf("value-%02d-xxxxxxxx", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p != int32(i%2) || o != int64(i/2) {
+			t.Fatalf("append %d: %d/%d", i, p, o)
+		}
+	}
+	if len(sl.partitions[0].segments) != 5 {
+		t.Fatalf("segments: %d", len(sl.partitions[0].segments))
+	}
+	for _, l := range []*SegmentLog{sl, newTestSegmentLog(t, c)} {
+		for i := 0; i < 20; i++ {
+			checkSegmentValue(t, l, int32(i%2), int64(i/2), fmt.Sprintf("value-%02d-xxxxxxxx", i))
+		}
+		lo, hi, err := l.Watermarks(1)
+		if err != nil || lo != 0 || hi != 10 {
+			t.Fatalf("watermarks: %d %d %v", lo, hi, err)
+		}
+		_, err = l.Fetch(0, 10)
+		if err != errLogNoMessage {
+			t.Fatalf("past the end: %v", err)
+		}
+		values, errs := l.FetchMany([]logLocation{{1, 3}, {0, 99}})
+		if string(values[0]) != "value-07-xxxxxxxx" || errs[1] != errLogNoMessage {
+			t.Fatalf("fetch many: %q %v", values[0], errs)
+		}
+	}
+	_, _, err := sl.Append(2, []byte("x"))
+	if err == nil {
+		t.Fatal("append to a partition that does not exist")
+	}
+	_, _, err = sl.Append(0, make([]byte, c.brokerMaxMessageSize+1))
+	if err == nil {
+		t.Fatal("append larger than max_message_size")
+	}
+}
+
+func TestSegmentLogRetentionRefused(t *testing.T) {
+	c := &Config{}
+	m := map[interface{}]interface{}{"segment_dir": t.TempDir(), "segment_retention_hours": 24}
+	err := c.initBrokerSegmentConfig(m)
+	if err == nil {
+		t.Fatal("segment_retention_hours accepted")
+	}
+	m["segment_retention_hours"] = 0
+	err = c.initBrokerSegmentConfig(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSegmentLogConcurrent(t *testing.T) {
+	c := testSegmentConfig(t, false)
+	sl := newTestSegmentLog(t, c)
+	done := make(chan error)
+	for w := 0; w < 4; w++ {
+		go func(w int) {
+			for i := 0; i < 50; i++ {
+				p, o, err := sl.Append(int32(w%2), []byte(fmt.Sprintf("w%d-%02d", w, i)))
+				if err == nil {
+					// rolled over meanwhile or not, it reads back
+					var v []byte
+					v, err = sl.Fetch(p, o)
+					if err == nil && string(v) != fmt.Sprintf("w%d-%02d", w, i) {
+						err = fmt.Errorf("%d/%d: %q", p, o, v)
+					}
+				}
+				if err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}(w)
+	}
+	for w := 0; w < 4; w++ {
+		err := <-done
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, hi, _ := sl.Watermarks(0)
+	if hi != 100 {
+		t.Fatalf("next offset: %d", hi)
+	}
+}
+
+func TestSegmentLogTornTail(t *testing.T) {
+	tails := map[string]func(seg *segment) {
+		"header": func(seg *segment) { seg.log.WriteAt([]byte{9, 0, 0, 0, 1}, seg.size) },
+		"value": func(seg *segment) { seg.log.WriteAt([]byte{9, 0, 0, 0, 1, 2, 3, 4, 'a'}, seg.size) },
+		"crc32": func(seg *segment) { seg.log.WriteAt([]byte{1, 0, 0, 0, 1, 2, 3, 4, 'a'}, seg.size) },
+		// must not be allocated
+		"garbage length": func(seg *segment) { seg.log.WriteAt([]byte{0xff, 0xff, 0xff, 0x7f, 1, 2, 3, 4}, seg.size) },
+		// the log was written, the index was not
+		"index": func(seg *segment) { seg.index.Truncate(0) },
+	}
+	for name, tear := range tails {
+		c := testSegmentConfig(t, true)
+		c.brokerSegmentMaxSize = 1 << 20
+		sl := newTestSegmentLog(t, c)
+		for i := 0; i < 3; i++ {
+			sl.Append(0, []byte(fmt.Sprintf("value-%d", i)))
+		}
+		tear(activeSegment(sl, 0))
+		sl = newTestSegmentLog(t, c)
+		_, hi, _ := sl.Watermarks(0)
+		if hi != 3 {
+			t.Fatalf("%s: next offset %d", name, hi)
+		}
+		for i := 0; i < 3; i++ {
+			checkSegmentValue(t, sl, 0, int64(i), fmt.Sprintf("value-%d", i))
+		}
+		// the torn record is cut off, new ones go where it was
+		_, o, err := sl.Append(0, []byte("after"))
+		if err != nil || o != 3 {
+			t.Fatalf("%s: append %d %v", name, o, err)
+		}
+		sl = newTestSegmentLog(t, c)
+		checkSegmentValue(t, sl, 0, 3, "after")
+	}
+}
+
+func TestSegmentLogReserved(t *testing.T) {
+	c := testSegmentConfig(t, false)
+	c.brokerSegmentMaxSize = 1 << 20
+	sl := newTestSegmentLog(t, c)
+	for i := 0; i < 5; i++ {
+		sl.Append(0, []byte(fmt.Sprintf("value-%d", i)))
+	}
+	// the last acked record is lost in a crash, its offset may be in a key
+	seg := activeSegment(sl, 0)
+	seg.log.Truncate(seg.size - 2)
+	sl = newTestSegmentLog(t, c)
+	_, o, err := sl.Append(0, []byte("after"))
+	if err != nil || o != gSegmentReserveStep {
+		t.Fatalf("append: %d %v", o, err)
+	}
+	_, err = sl.Fetch(0, 4)
+	if err != errLogNoMessage {
+		t.Fatalf("lost: %v", err)
+	}
+	for _, l := range []*SegmentLog{sl, newTestSegmentLog(t, c)} {
+		checkSegmentValue(t, l, 0, 3, "value-3")
+		checkSegmentValue(t, l, 0, gSegmentReserveStep, "after")
+	}
+	// each restart moves past the reservation taken since
+	sl = newTestSegmentLog(t, c)
+	_, o, _ = sl.Append(0, []byte("again"))
+	if o != 2*gSegmentReserveStep {
+		t.Fatalf("append: %d", o)
+	}
+	// partitions keep reservations of their own
+	_, o, _ = sl.Append(1, []byte("other"))
+	if o != 0 {
+		t.Fatalf("append to partition 1: %d", o)
+	}
+	// with segment_sync records are not lost, nothing is reserved
+	c = testSegmentConfig(t, true)
+	sl = newTestSegmentLog(t, c)
+	sl.Append(0, []byte("synced"))
+	sl = newTestSegmentLog(t, c)
+	_, o, _ = sl.Append(0, []byte("next"))
+	if o != 1 {
+		t.Fatalf("synced append: %d", o)
+	}
+	content, _ := ioutil.ReadFile(sl.partitions[0].reservedFile.Name())
+	if len(content) != 0 {
+		t.Fatalf("reserved with segment_sync: %v", content)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/dzch/go-utils/logger"
+		"crypto/hmac"
+		"crypto/sha256"
+		"encoding/hex"
+		"encoding/json"
+		"net/http"
+		"net/url"
+		"strconv"
+		"strings"
+		"net"
+		"time"
+		"fmt"
+	   )
+
+/*
+   a signed /get is /get?key=..&expires=..&sig=.. and, if bound to a client
+   ip, &ip=.., with
+     sig := hex(hmac-sha256(url_signing.secret, key \n expires \n ip))
+   expires is unix time, ip is empty if not bound. namespaces with signed_get
+   refuse /get and /stat without a valid one, /stat takes the admin token
+   too, /mget needs the admin token for them and grpc Get, BatchGet and Stat
+   refuse them.
+   /sign?key=..&ttl=..&ip=.. with the admin token answers such a url.
+*/
+type SignHandler struct {
+	bs *BinStore
+}
+
+type SignResponse struct {
+	Key string `json:"key"`
+	Expires int64 `json:"expires"`
+	// path and query of the /get, to be put after the host
+	Url string `json:"url"`
+}
+
+func newSignHandler(bs *BinStore) *SignHandler {
+	return &SignHandler {bs: bs}
+}
+
+func (h *SignHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    startTime := time.Now()
+	bs := h.bs
+	if len(bs.config.signSecret) == 0 {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "url signing is not enabled")
+		return
+	}
+	if !checkAdminToken(bs.config, r) {
+		logger.Warning("invalid query, not authorized: %s, %s", r.URL.String(), r.RemoteAddr)
+		writeError(w, http.StatusForbidden, errCodeForbidden, "bad or no admin token")
+		return
+	}
+    qv := r.URL.Query()
+	key := qv.Get("key")
+	_, _, _, _, err := bs.parseKey(key)
+	if err != nil {
+		logger.Warning("fail to parseKey: %s, %s", r.URL.String(), err.Error())
+		writeError(w, http.StatusBadRequest, errCodeInvalidKey, err.Error())
+		return
+	}
+	ttl := bs.config.signDefaultTTL
+	if len(qv.Get("ttl")) > 0 {
+		ttl, err = strconv.ParseInt(qv.Get("ttl"), 10, 64)
+		if err != nil || ttl <= 0 || ttl > bs.config.signMaxTTL {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("ttl should be in [1, %d]", bs.config.signMaxTTL))
+			return
+		}
+	}
+	ip := qv.Get("ip")
+	if len(ip) > 0 && net.ParseIP(ip) == nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "invalid ip")
+		return
+	}
+    rsp := &SignResponse {
+        Key: key,
+		Expires: time.Now().Unix() + ttl,
+	}
+	rsp.Url = signedGetUrl(bs.config.signSecret, key, rsp.Expires, ip)
+	body, _ := json.Marshal(rsp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+    endTime := time.Now()
+	costTimeUS := endTime.Sub(startTime)/time.Microsecond
+	logger.Notice("success process sign: %s, cost_us=%d, expires=%d", r.URL.String(), costTimeUS, rsp.Expires)
+}
+
+func signGet(secret string, key string, expires int64, ip string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(key + "\n" + strconv.FormatInt(expires, 10) + "\n" + ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func signedGetUrl(secret string, key string, expires int64, ip string) string {
+	qv := url.Values{}
+	qv.Set("key", key)
+	qv.Set("expires", strconv.FormatInt(expires, 10))
+	if len(ip) > 0 {
+		qv.Set("ip", ip)
+	}
+	qv.Set("sig", signGet(secret, key, expires, ip))
+	return "/get?" + qv.Encode()
+}
+
+// for a namespace with signed_get, the expires of a valid signature of r
+func checkSignedGet(config *Config, r *http.Request, key string, now time.Time) (int64, *apiError) {
+    qv := r.URL.Query()
+	sig := qv.Get("sig")
+	expires, err := strconv.ParseInt(qv.Get("expires"), 10, 64)
+	if len(sig) == 0 || err != nil {
+		return 0, newApiError(http.StatusForbidden, errCodeForbidden, "need expires and sig")
+	}
+	ip := qv.Get("ip")
+	expected := signGet(config.signSecret, key, expires, ip)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(sig))) {
+		return 0, newApiError(http.StatusForbidden, errCodeForbidden, "bad sig")
+	}
+	if now.Unix() >= expires {
+		return 0, newApiError(http.StatusForbidden, errCodeForbidden, "link expired")
+	}
+	if len(ip) > 0 && !net.ParseIP(ip).Equal(net.ParseIP(clientIP(r, config.signProxyHops))) {
+		return 0, newApiError(http.StatusForbidden, errCodeForbidden, "link is bound to another ip")
+	}
+	return expires, nil
+}
+
+// each proxy appends the address it got the request from to X-Forwarded-For,
+// so behind proxyHops proxies the client is that many entries from the right.
+// what is left of it was sent by the client and is not trusted.
+func clientIP(r *http.Request, proxyHops int) string {
+	if proxyHops > 0 {
+		var addrs []string
+		for _, v := range r.Header["X-Forwarded-For"] {
+			for _, addr := range strings.Split(v, ",") {
+				addr = strings.TrimSpace(addr)
+				if len(addr) > 0 {
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+		if len(addrs) > 0 {
+			// fewer entries than proxies, all of them were added by ours
+			i := len(addrs) - proxyHops
+			if i < 0 {
+				i = 0
+			}
+			return addrs[i]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,207 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"encoding/json"
+		"net/http"
+		"net/http/httptest"
+		"strconv"
+		"strings"
+		"testing"
+		"time"
+	   )
+
+var gTestSignConf = `
+url_signing:
+ secret: a-long-enough-test-secret
+ required: true
+ max_ttl: 3600
+`
+
+func signedTestRequest(path string, remoteAddr string, xff ...string) *http.Request {
+	r := httptest.NewRequest("GET", path, nil)
+	r.RemoteAddr = remoteAddr
+	for _, v := range xff {
+		r.Header.Add("X-Forwarded-For", v)
+	}
+	return r
+}
+
+func TestCheckSignedGet(t *testing.T) {
+	config := &Config{signSecret: "a-long-enough-test-secret"}
+	now := time.Unix(1444444444, 0)
+	expires := now.Unix() + 300
+	key := "ff5837abcdef"
+	url := signedGetUrl(config.signSecret, key, expires, "")
+	got, ae := checkSignedGet(config, signedTestRequest(url, "10.0.0.1:1234"), key, now)
+	if ae != nil || got != expires {
+		t.Fatalf("valid: %d %v", got, ae)
+	}
+	// hex of any case
+	sig := signGet(config.signSecret, key, expires, "")
+	upper := strings.Replace(url, sig, strings.ToUpper(sig), 1)
+	_, ae = checkSignedGet(config, signedTestRequest(upper, "10.0.0.1:1234"), key, now)
+	if ae != nil {
+		t.Fatalf("upper case: %v", ae)
+	}
+	bad := map[string]string {
+		"no sig": "/get?key=" + key + "&expires=" + strconv.FormatInt(expires, 10),
+		"no expires": "/get?key=" + key + "&sig=" + sig,
+		"other key": signedGetUrl(config.signSecret, key + "0", expires, ""),
+		"later expires": strings.Replace(url, strconv.FormatInt(expires, 10), strconv.FormatInt(expires + 1, 10), 1),
+		"other secret": signedGetUrl("another-long-test-secret", key, expires, ""),
+		"ip added": url + "&ip=10.0.0.1",
+	}
+	for name, u := range bad {
+		_, ae = checkSignedGet(config, signedTestRequest(u, "10.0.0.1:1234"), key, now)
+		if ae == nil || ae.status != http.StatusForbidden {
+			t.Fatalf("%s: %v", name, ae)
+		}
+	}
+	_, ae = checkSignedGet(config, signedTestRequest(url, "10.0.0.1:1234"), key, time.Unix(expires, 0))
+	if ae == nil || ae.msg != "link expired" {
+		t.Fatalf("expired: %v", ae)
+	}
+	// bound to an ip, of the peer or behind proxies from X-Forwarded-For
+	url = signedGetUrl(config.signSecret, key, expires, "10.0.0.1")
+	_, ae = checkSignedGet(config, signedTestRequest(url, "10.0.0.1:1234"), key, now)
+	if ae != nil {
+		t.Fatalf("bound: %v", ae)
+	}
+	_, ae = checkSignedGet(config, signedTestRequest(url, "10.0.0.2:1234", "10.0.0.1"), key, now)
+	if ae == nil || ae.msg != "link is bound to another ip" {
+		t.Fatalf("no proxy, X-Forwarded-For ignored: %v", ae)
+	}
+	config.signProxyHops = 1
+	_, ae = checkSignedGet(config, signedTestRequest(url, "192.168.0.1:80", "10.0.0.1"), key, now)
+	if ae != nil {
+		t.Fatalf("behind a proxy: %v", ae)
+	}
+	// the client sends the entry the link is bound to, the proxy appends its own
+	_, ae = checkSignedGet(config, signedTestRequest(url, "192.168.0.1:80", "10.0.0.1, 10.0.0.2"), key, now)
+	if ae == nil {
+		t.Fatal("spoofed X-Forwarded-For accepted")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	cases := []struct {
+		hops int
+		remote string
+		xff []string
+		want string
+	} {
+		{0, "10.0.0.1:1234", nil, "10.0.0.1"},
+		{0, "10.0.0.1:1234", []string{"1.1.1.1"}, "10.0.0.1"},
+		{0, "[::1]:1234", nil, "::1"},
+		{1, "10.0.0.1:1234", nil, "10.0.0.1"},
+		{1, "10.0.0.1:1234", []string{"1.1.1.1"}, "1.1.1.1"},
+		{1, "10.0.0.1:1234", []string{"6.6.6.6, 1.1.1.1"}, "1.1.1.1"},
+		// a header per proxy is read in order
+		{1, "10.0.0.1:1234", []string{"6.6.6.6", "1.1.1.1"}, "1.1.1.1"},
+		{2, "10.0.0.1:1234", []string{"6.6.6.6, 1.1.1.1, 192.168.0.1"}, "1.1.1.1"},
+		{2, "10.0.0.1:1234", []string{"1.1.1.1"}, "1.1.1.1"},
+		{1, "10.0.0.1:1234", []string{" , "}, "10.0.0.1"},
+	}
+	for _, c := range cases {
+		r := signedTestRequest("/get", c.remote, c.xff...)
+		ip := clientIP(r, c.hops)
+		if ip != c.want {
+			t.Fatalf("%+v: %s", c, ip)
+		}
+	}
+}
+
+func TestSignHandler(t *testing.T) {
+	bs, err := newTestBinStoreWith(t, gTestSignConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := addTestBlob(t, bs, "private", "text/plain")
+	admin := map[string]string{gAdminTokenHeader: "secret"}
+	serveSign := func(url string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		bs.server.Handler.ServeHTTP(w, r)
+		return w
+	}
+	w := serveSign("/sign?key=" + key, nil)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("sign without token: %d", w.Code)
+	}
+	for _, q := range []string{"&ttl=0", "&ttl=3601", "&ip=nope"} {
+		w = serveSign("/sign?key=" + key + q, admin)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("sign %s: %d", q, w.Code)
+		}
+	}
+	w = serveSign("/sign?key=" + key + "&ttl=60", admin)
+	var rsp SignResponse
+	err = json.Unmarshal(w.Body.Bytes(), &rsp)
+	if w.Code != http.StatusOK || err != nil || rsp.Key != key || rsp.Expires - time.Now().Unix() > 60 {
+		t.Fatalf("sign: %d %s", w.Code, w.Body)
+	}
+	w = serveSign(rsp.Url, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "private" || !strings.HasPrefix(w.Header().Get("Cache-Control"), "private, max-age=") {
+		t.Fatalf("signed get: %d %v", w.Code, w.Header())
+	}
+	w = getTestBlob(bs, "GET", key, nil)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("unsigned get: %d", w.Code)
+	}
+	// /stat takes the signature or the admin token
+	w = serveSign("/stat?key=" + key, nil)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("unsigned stat: %d", w.Code)
+	}
+	for _, c := range []struct {
+		url string
+		header map[string]string
+	} {
+		{"/stat" + rsp.Url[len("/get"):], nil},
+		{"/stat?key=" + key, admin},
+	} {
+		w = serveSign(c.url, c.header)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), key) {
+			t.Fatalf("stat %s: %d %s", c.url, w.Code, w.Body)
+		}
+	}
+	checkFrame(t, mgetTest(t, bs, []string{key})[0], http.StatusForbidden, "")
+}
+
+func TestSignHandlerDisabled(t *testing.T) {
+	bs := newTestBinStore(t)
+	key := addTestBlob(t, bs, "public", "text/plain")
+	r := httptest.NewRequest("GET", "/sign?key=" + key, nil)
+	r.Header.Set(gAdminTokenHeader, "secret")
+	w := httptest.NewRecorder()
+	bs.server.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("sign: %d", w.Code)
+	}
+}
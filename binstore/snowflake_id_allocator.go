@@ -0,0 +1,171 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"io/ioutil"
+		"os"
+		"path/filepath"
+		"strconv"
+		"strings"
+		"sync"
+		"time"
+		"errors"
+		"fmt"
+	   )
+
+/*
+   snowflake id layout:
+     0 | ms since epoch(41) | node(10) | seq(12)
+   unique as long as every node has its own node id and the clock does not go
+   back. a time ahead of every id given out is kept in snowflake_file, so a
+   restart after the clock went back waits for it instead of reusing ids.
+*/
+var (
+		gSnowflakeNodeBits = uint(10)
+		gSnowflakeSeqBits = uint(12)
+		gSnowflakeNodeMax = int64(1<<10 - 1)
+		gSnowflakeSeqMask = int64(1<<12 - 1)
+		gSnowflakeMaxBackward = 5*time.Second
+		// ms, how far ahead the kept time is moved each time
+		gSnowflakeReserveStep = int64(1000)
+	)
+
+type SnowflakeIdAllocator struct {
+	config *Config
+	file string
+	epoch int64    // ms
+	node int64
+	lastMs int64
+	seq int64
+	// ms, ids are only given out below it
+	reservedMs int64
+	lock *sync.Mutex
+}
+
+func newSnowflakeIdAllocator(config *Config) (*SnowflakeIdAllocator, error) {
+    sa := &SnowflakeIdAllocator {
+        config: config,
+		file: config.kmSnowflakeFile,
+		epoch: config.kmSnowflakeEpoch,
+		node: config.kmSnowflakeNode,
+		lock: &sync.Mutex{},
+	}
+	if sa.node < 0 || sa.node > gSnowflakeNodeMax {
+		return nil, errors.New(fmt.Sprintf("snowflake node id shall be in [0, %d], now is %d", gSnowflakeNodeMax, sa.node))
+	}
+	err := sa.init()
+	if err != nil {
+		return nil, err
+	}
+	return sa, nil
+}
+
+func (sa *SnowflakeIdAllocator) init() error {
+	err := os.MkdirAll(filepath.Dir(sa.file), 0755)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(sa.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sa.reservedMs, err = strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid snowflake file %s: %s", sa.file, err.Error()))
+	}
+	// ids up to it may have been given out before the restart
+	sa.lastMs = sa.reservedMs
+	sa.seq = gSnowflakeSeqMask
+	return nil
+}
+
+func (sa *SnowflakeIdAllocator) nowMs() int64 {
+	return time.Now().UnixNano()/int64(time.Millisecond) - sa.epoch
+}
+
+// waits for the clock without holding the lock
+func (sa *SnowflakeIdAllocator) NewId() (uint64, error) {
+	for {
+		sa.lock.Lock()
+		id, wait, err := sa.next()
+		sa.lock.Unlock()
+		if wait == 0 {
+			return id, err
+		}
+		time.Sleep(wait)
+	}
+}
+
+func (sa *SnowflakeIdAllocator) NewIds(n int) ([]uint64, error) {
+	ids := make([]uint64, 0, n)
+	for i := 0; i < n; i++ {
+		id, err := sa.NewId()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// the id, or how long to wait before trying again.
+// must hold sa.lock
+func (sa *SnowflakeIdAllocator) next() (uint64, time.Duration, error) {
+	now := sa.nowMs()
+	if now < sa.lastMs {
+		// clock went back, wait for it if it is not too far
+		back := time.Duration(sa.lastMs - now)*time.Millisecond
+		if back > gSnowflakeMaxBackward {
+			return 0, 0, errors.New(fmt.Sprintf("clock moved backwards by %s", back.String()))
+		}
+		return 0, back, nil
+	}
+	seq := int64(0)
+	if now == sa.lastMs {
+		seq = (sa.seq + 1) & gSnowflakeSeqMask
+		if seq == 0 {
+			// out of sequence for this ms
+			return 0, 100*time.Microsecond, nil
+		}
+	}
+	if now < 0 || now >= 1<<41 {
+		return 0, 0, errors.New(fmt.Sprintf("snowflake time out of range: %d", now))
+	}
+	if now >= sa.reservedMs {
+		reserved := now + gSnowflakeReserveStep
+		err := writeFileSynced(sa.file, []byte(strconv.FormatInt(reserved, 10)))
+		if err != nil {
+			return 0, 0, errors.New(fmt.Sprintf("fail to keep snowflake time: %s", err.Error()))
+		}
+		sa.reservedMs = reserved
+	}
+	sa.lastMs = now
+	sa.seq = seq
+	id := now<<(gSnowflakeNodeBits+gSnowflakeSeqBits) | sa.node<<gSnowflakeSeqBits | sa.seq
+	return uint64(id), 0, nil
+}
@@ -0,0 +1,112 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"path/filepath"
+		"testing"
+		"time"
+	   )
+
+func newTestSnowflakeIdAllocator(t *testing.T, file string) *SnowflakeIdAllocator {
+	sa, err := newSnowflakeIdAllocator(&Config{kmSnowflakeNode: 5, kmSnowflakeEpoch: 1420070400000, kmSnowflakeFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sa
+}
+
+func TestSnowflakeIdAllocatorUnique(t *testing.T) {
+	sa := newTestSnowflakeIdAllocator(t, filepath.Join(t.TempDir(), "snowflake"))
+	last := uint64(0)
+	// more than one ms of sequence
+	for i := 0; i < 20000; i++ {
+		id, err := sa.NewId()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id <= last {
+			t.Fatalf("id %d after %d", id, last)
+		}
+		if (id >> gSnowflakeSeqBits) & uint64(gSnowflakeNodeMax) != 5 {
+			t.Fatalf("node of %x", id)
+		}
+		last = id
+	}
+	ids, err := sa.NewIds(5)
+	if err != nil || len(ids) != 5 || ids[0] <= last {
+		t.Fatalf("ids: %v %v", ids, err)
+	}
+	_, err = newSnowflakeIdAllocator(&Config{kmSnowflakeNode: gSnowflakeNodeMax + 1, kmSnowflakeFile: sa.file})
+	if err == nil {
+		t.Fatal("node id out of range")
+	}
+}
+
+func TestSnowflakeIdAllocatorClockBack(t *testing.T) {
+	sa := newTestSnowflakeIdAllocator(t, filepath.Join(t.TempDir(), "snowflake"))
+	last, _ := sa.NewId()
+	// the clock goes back by 200ms
+	sa.epoch += 200
+	done := make(chan uint64)
+	go func() {
+		id, _ := sa.NewId()
+		done <- id
+	}()
+	time.Sleep(50*time.Millisecond)
+	// nobody else waits for the lock meanwhile
+	if !sa.lock.TryLock() {
+		t.Fatal("lock held while waiting for the clock")
+	}
+	sa.lock.Unlock()
+	id := <-done
+	if id <= last {
+		t.Fatalf("id %d after %d", id, last)
+	}
+	sa.epoch += int64(gSnowflakeMaxBackward/time.Millisecond) + 1000
+	_, err := sa.NewId()
+	if err == nil {
+		t.Fatal("clock far back")
+	}
+}
+
+func TestSnowflakeIdAllocatorRestart(t *testing.T) {
+	step := gSnowflakeReserveStep
+	gSnowflakeReserveStep = 300
+	defer func() { gSnowflakeReserveStep = step }()
+	file := filepath.Join(t.TempDir(), "data", "snowflake")
+	sa := newTestSnowflakeIdAllocator(t, file)
+	last, _ := sa.NewId()
+	// restarted with the clock 100ms back, ids wait for the kept time
+	sa = newTestSnowflakeIdAllocator(t, file)
+	sa.epoch += 100
+	start := time.Now()
+	id, err := sa.NewId()
+	if err != nil || id <= last {
+		t.Fatalf("id %d after %d, %v", id, last, err)
+	}
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("did not wait: %s", time.Since(start))
+	}
+}
@@ -0,0 +1,164 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"github.com/dzch/go-utils/logger"
+		"encoding/json"
+		"encoding/hex"
+		"net/http"
+		"hash/fnv"
+		"crypto/md5"
+		"time"
+	   )
+
+var (
+		gStatLocationBroker = "broker"
+		gStatLocationStore = "store"
+	)
+
+type StatHandler struct {
+	bs *BinStore
+}
+
+type StatResponse struct {
+	Key string `json:"key"`
+	Namespace string `json:"namespace"`
+	Id uint64 `json:"id"`
+	Partition int32 `json:"partition"`
+	Offset int64 `json:"offset"`
+	// broker or store
+	Location string `json:"location"`
+	Size int `json:"size"`
+	Md5 string `json:"md5"`
+	Fnv1a32 uint32 `json:"fnv1a32"`
+	ContentType string `json:"content_type,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Ctime int64 `json:"ctime,omitempty"`
+	Expire int64 `json:"expire,omitempty"`
+	// /get refuses it, the sweeper has not purged it yet
+	Expired bool `json:"expired,omitempty"`
+	// codec the blob is kept with, size and checksums are of the data as added
+	Encoding string `json:"encoding,omitempty"`
+	StoredSize int `json:"stored_size,omitempty"`
+	// master key the blob is encrypted under
+	KeyId string `json:"key_id,omitempty"`
+}
+
+func newStatHandler(bs *BinStore) *StatHandler {
+	return &StatHandler {bs: bs}
+}
+
+// sizes and checksums are not kept apart from the blob, so it is read
+// but never sent
+func (h *StatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    startTime := time.Now()
+	bs := h.bs
+	key := r.URL.Query().Get("key")
+	// meta tells as much as a signed link would hide, the same signature or
+	// the admin token is needed
+	ns, err := bs.namespaceOfKey(key)
+	if err == nil && ns.config.signRequired && !checkAdminToken(bs.config, r) {
+		_, ae := checkSignedGet(bs.config, r, key, time.Now())
+		if ae != nil {
+			logger.Warning("invalid query, not signed: %s, %s, %s", r.URL.String(), r.RemoteAddr, ae.Error())
+			writeApiError(w, ae)
+			return
+		}
+	}
+	res, ae := bs.statKey(key)
+	if ae != nil {
+		logger.Warning("fail to stat: %s, %s", r.URL.String(), ae.Error())
+		writeApiError(w, ae)
+		return
+	}
+	body, err := json.Marshal(res)
+	if err != nil {
+		logger.Warning("fail to json.Marshal: %s, %s", r.URL.String(), err.Error())
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(body)
+	if err != nil {
+		logger.Warning("fail to write response: %s, %s", r.URL.String(), err.Error())
+		return
+	}
+    endTime := time.Now()
+	costTimeUS := endTime.Sub(startTime)/time.Microsecond
+	logger.Notice("success process stat: %s, cost_us=%d, location=%s, datalen=%d", r.URL.String(), costTimeUS, res.Location, res.Size)
+	return
+}
+
+// what /stat and grpc Stat answer for key
+func (bs *BinStore) statKey(key string) (*StatResponse, *apiError) {
+	ns, id, partition, offset, err := bs.parseKey(key)
+	if err != nil {
+		return nil, newApiError(http.StatusBadRequest, errCodeInvalidKey, err.Error())
+	}
+	res := &StatResponse {
+        Key: key,
+		Namespace: ns.name,
+		Id: id,
+		Partition: partition,
+		Offset: offset,
+	}
+	val, meta, inBroker, err := ns.getData(id, partition, offset)
+	if inBroker {
+		res.Location = gStatLocationBroker
+	} else {
+		res.Location = gStatLocationStore
+	}
+	if err != nil {
+		status, code := dataErrorStatus(err, inBroker)
+		return nil, newApiError(status, code, err.Error())
+	}
+	if meta != nil && len(meta.Encoding) > 0 {
+		res.Encoding = meta.Encoding
+		res.StoredSize = len(val)
+		var ae *apiError
+		val, meta, ae = decodeStored(val, meta)
+		if ae != nil {
+			return nil, ae
+		}
+	}
+	res.Size = len(val)
+	sum := md5.Sum(val)
+	res.Md5 = hex.EncodeToString(sum[:])
+	fnv1a := fnv.New32a()
+	fnv1a.Write(val)
+	res.Fnv1a32 = fnv1a.Sum32()
+	if meta != nil {
+		res.ContentType = meta.ContentType
+		res.Filename = meta.Filename
+		res.Headers = meta.Headers
+		res.Ctime = meta.Ctime
+		res.Expire = meta.Expire
+		res.Expired = meta.expired(time.Now())
+		res.KeyId = meta.KeyId
+	}
+	return res, nil
+}
@@ -0,0 +1,66 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"encoding/json"
+		"net/http"
+		"testing"
+	   )
+
+func statTestBlob(t *testing.T, bs *BinStore, key string) (int, *StatResponse) {
+	w := serveTest(bs, "GET", "/stat?key=" + key, nil, 0)
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	res := &StatResponse{}
+	err := json.Unmarshal(w.Body.Bytes(), res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, res
+}
+
+func TestStatHandler(t *testing.T) {
+	bs := newTestBinStore(t)
+	key := addTestBlob(t, bs, "hello stat", "text/plain")
+	code, res := statTestBlob(t, bs, key)
+	if code != http.StatusOK {
+		t.Fatalf("stat: %d", code)
+	}
+	// md5 and fnv-1a 32 of "hello stat"
+	if res.Key != key || res.Namespace != "default" || res.Location != gStatLocationBroker || res.Size != 10 ||
+		res.Md5 != "df858e38a3f6cf4c581df7588fa824f3" || res.Fnv1a32 != 0x9e8f3053 || res.ContentType != "text/plain" || res.Ctime == 0 {
+		t.Fatalf("%+v", res)
+	}
+	code, _ = statTestBlob(t, bs, "ff5837garbage")
+	if code != http.StatusBadRequest {
+		t.Fatalf("invalid key: %d", code)
+	}
+	missing, _ := bs.namespaces[0].km.generateKey(1<<20, 0, 99)
+	code, _ = statTestBlob(t, bs, missing)
+	if code != http.StatusNotFound {
+		t.Fatalf("missing: %d", code)
+	}
+}
@@ -24,23 +24,18 @@
 package binstore
 
 import (
-		"gopkg.in/mgo.v2"
-		"gopkg.in/mgo.v2/bson"
-		"strings"
+		"github.com/dzch/go-utils/logger"
+		"time"
 	   )
 
 type Store struct {
 	config *Config
-	dialSession *mgo.Session
+	backend BlobBackend
 }
 
-type QueryResponse struct {
-	Data []byte "data"
-}
-
-func newStore(bs *BinStore) (*Store, error) {
+func newStore(config *Config) (*Store, error) {
     store := &Store {
-        config: bs.config,
+        config: config,
 	}
 	err := store.init()
 	if err != nil {
@@ -50,46 +45,99 @@ func newStore(bs *BinStore) (*Store, error) {
 }
 
 func (store *Store) init() error {
-    err := store.initDialSession()
+    err := store.initBackend()
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (store *Store) initDialSession() error {
-    servers := strings.Join(store.config.storeServerList, ",")
-    url := "mongodb://" + servers
-    s, err := mgo.DialWithTimeout(url, store.config.storeConnTimeout)
-	if err != nil {
-		return err
-	}
-	s.SetSyncTimeout(store.config.storeOperationTimeout)
-	s.SetSocketTimeout(store.config.storeSocketTimeout)
-	s.SetSafe(&mgo.Safe{W: store.config.storeWriteConcern})
-	s.SetMode(mgo.Eventual, false)
-	s.SetPoolLimit(store.config.storeMgoPoolSize)
-	store.dialSession = s
-	return nil
+func (store *Store) initBackend() error {
+	var err error
+	store.backend, err = newBlobBackend(store.config)
+	return err
 }
 
 func (store *Store) addNewData(sr *StoreReq) error {
 	// can do many times repeateadly for one req
-    s := store.dialSession.Copy()
-	defer s.Close()
-	c := s.DB(store.config.storeDbName).C(store.config.storeCollName)
-	_, err := c.Upsert(bson.M{"id": sr.id}, bson.M{"id": sr.id, "data": sr.data})
-	return err
+	if sr.meta != nil && sr.meta.expired(time.Now()) {
+		// archived too late, nothing to keep
+		return nil
+	}
+	return store.backend.Put(sr.id, sr.data, sr.meta)
+}
+
+func (store *Store) getData(id uint64) ([]byte, *ObjectMeta, error) {
+	return store.backend.Get(id)
+}
+
+func (store *Store) getDataMany(ids []uint64) ([][]byte, []*ObjectMeta, []error) {
+	return store.backend.GetMany(ids)
+}
+
+func (store *Store) deleteData(id uint64) error {
+	return store.backend.Delete(id)
 }
 
-func (store *Store) getData(id uint64) ([]byte, error) {
-    s := store.dialSession.Copy()
-	defer s.Close()
-	res := &QueryResponse{}
-	c := s.DB(store.config.storeDbName).C(store.config.storeCollName)
-	err := c.Find(bson.M{"id": id}).One(res)
+func (store *Store) isDeleted(id uint64) (bool, error) {
+	deleted, err := store.backend.Deleted([]uint64{id})
 	if err != nil {
-		return nil, err
+		return false, err
+	}
+	return deleted[0], nil
+}
+
+func (store *Store) areDeleted(ids []uint64) ([]bool, error) {
+	return store.backend.Deleted(ids)
+}
+
+// purges expired blobs every storeSweepInterval. blobs that expire never
+// get a dedup entry (see DeDup.checkDup), so there is none to drop here.
+func (store *Store) runSweeper() {
+	for {
+		time.Sleep(store.config.storeSweepInterval)
+		n, err := store.sweep()
+		if err != nil {
+			logger.Warning("fail to sweep expired blobs: ns=%s, %s", store.config.nsName, err.Error())
+			continue
+		}
+		if n > 0 {
+			logger.Notice("success sweep expired blobs: ns=%s, purged=%d", store.config.nsName, n)
+		}
+		store.compact()
+	}
+}
+
+func (store *Store) compact() {
+	bc, ok := store.backend.(blobCompacter)
+	if !ok {
+		return
+	}
+	for {
+		freed, err := bc.Compact()
+		if err != nil {
+			logger.Warning("fail to compact store: ns=%s, %s", store.config.nsName, err.Error())
+			return
+		}
+		if freed == 0 {
+			return
+		}
+		logger.Notice("success compact store: ns=%s, freed=%d", store.config.nsName, freed)
+	}
+}
+
+func (store *Store) sweep() (int, error) {
+	ids, err := store.backend.Expired(time.Now().Unix(), store.config.storeSweepBatch)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids {
+		err = store.backend.Purge(id)
+		if err != nil {
+			return n, err
+		}
+		n ++
 	}
-	return res.Data, nil
+	return n, nil
 }
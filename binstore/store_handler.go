@@ -32,6 +32,7 @@ import (
 		"bytes"
 		"fmt"
 		"errors"
+		"strconv"
 	   )
 
 type StoreHandler struct {
@@ -43,6 +44,12 @@ type StoreReq struct {
 	reqBuffer *bytes.Buffer
 	data []byte
 	id uint64
+	method string
+	manifest map[string]interface{}
+	meta *ObjectMeta
+	// where the archiver read it from, -1 if not given
+	partition int32
+	offset int64
 }
 
 func newStoreHandler(bs *BinStore) (*StoreHandler, error) {
@@ -95,7 +102,14 @@ func (h *StoreHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	/* check query */
 	if r.ContentLength <= 0 {
 		logger.Warning("invalid query, need post data: %s", r.URL.String())
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "need post data")
+		return
+	}
+	// the archiver of a namespace's topic passes ?ns=
+	ns, err := h.bs.namespaceOf(r)
+	if err != nil {
+		logger.Warning("invalid query, unknown namespace: %s", r.URL.String())
+		writeError(w, http.StatusBadRequest, errCodeUnknownNamespace, err.Error())
 		return
 	}
     // qv := r.URL.Query()
@@ -104,21 +118,47 @@ func (h *StoreHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	nr, err := sr.reqBuffer.ReadFrom(r.Body)
 	if int64(nr) != r.ContentLength || err != nil {
 		logger.Warning("fail to read body: %s, %s", r.URL.String(), err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "fail to read body")
 		return
 	}
 	err = h.parseReq(sr)
 	if err != nil {
 		logger.Warning("invalid query, parseReq failed : %s, %s", r.URL.String(), err.Error())
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
 		return
 	}
-	err = h.bs.store.addNewData(sr)
+	err = h.parseLocation(sr, r)
 	if err != nil {
-		logger.Warning("fail to write response: %s, %s", r.URL.String(), err.Error())
-	    w.WriteHeader(http.StatusInternalServerError)
+		logger.Warning("invalid query, parseLocation failed : %s, %s", r.URL.String(), err.Error())
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
 		return
 	}
+	if sr.manifest != nil {
+		// chunks are still in the broker, the archiver goes in order
+		sr.data, err = ns.broker.assemble(sr.manifest)
+		if err != nil {
+			logger.Warning("fail to assemble chunks: %s, id=%d, %s", r.URL.String(), sr.id, err.Error())
+			writeError(w, http.StatusServiceUnavailable, errCodeBrokerUnavailable, "fail to assemble chunks")
+			return
+		}
+	}
+	// a chunk is stored with its manifest
+	if sr.method != gBrokerMethodChunk {
+		err = ns.store.addNewData(sr)
+		if err != nil {
+			logger.Warning("fail to write response: %s, %s", r.URL.String(), err.Error())
+			writeError(w, http.StatusServiceUnavailable, errCodeStoreUnavailable, "fail to add data to store")
+			return
+		}
+	}
+	if sr.partition >= 0 {
+		err = ns.ao.recordArchived(sr.partition, sr.offset)
+		if err != nil {
+			logger.Warning("fail to record archived offset: %s, id=%d, %s", r.URL.String(), sr.id, err.Error())
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+			return
+		}
+	}
 	w.WriteHeader(http.StatusOK)
     endTime := time.Now()
 	costTimeUS := endTime.Sub(startTime)/time.Microsecond
@@ -137,11 +177,24 @@ func (h *StoreHandler) parseReq(sr *StoreReq) error {
 	if !ok {
         return errors.New(fmt.Sprintf("invalid data from storeReq: data need be map"))
 	}
-	datai, ok := req["data"]
-	if !ok {
-        return errors.New(fmt.Sprintf("invalid data from storeReq: data not exist"))
+	sr.manifest = nil
+	sr.meta = metaFromMap(req["meta"])
+	sr.method, _ = req["method"].(string)
+	switch sr.method {
+		case gBrokerMethodManifest:
+			sr.manifest = req
+		case gBrokerMethodChunk:
+			// nothing to keep until the manifest comes
+		default:
+			datai, ok := req["data"]
+			if !ok {
+				return errors.New(fmt.Sprintf("invalid data from storeReq: data not exist"))
+			}
+			sr.data, ok = datai.([]byte)
+			if !ok {
+				return errors.New(fmt.Sprintf("invalid data from storeReq: data is not bytes"))
+			}
 	}
-	sr.data = datai.([]byte)
 	idi, ok := req["id"]
 	if !ok {
         return errors.New(fmt.Sprintf("invalid data from storeReq: id not exist"))
@@ -156,3 +209,26 @@ func (h *StoreHandler) parseReq(sr *StoreReq) error {
 	}
 	return nil
 }
+
+// the archiver passes ?partition=&offset= of the message, so /store can
+// track the archived watermark itself
+func (h *StoreHandler) parseLocation(sr *StoreReq, r *http.Request) error {
+	sr.partition = -1
+	sr.offset = -1
+    qv := r.URL.Query()
+	ps, ofs := qv.Get("partition"), qv.Get("offset")
+	if len(ps) == 0 && len(ofs) == 0 {
+		return nil
+	}
+	partition, err := strconv.ParseInt(ps, 10, 32)
+	if err != nil || partition < 0 || partition > int64(gPartitionMaxValue) {
+		return errors.New(fmt.Sprintf("invalid partition: %s", ps))
+	}
+	offset, err := strconv.ParseInt(ofs, 10, 64)
+	if err != nil || offset < 0 {
+		return errors.New(fmt.Sprintf("invalid offset: %s", ofs))
+	}
+	sr.partition = int32(partition)
+	sr.offset = offset
+	return nil
+}
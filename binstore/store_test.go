@@ -0,0 +1,126 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"net/http"
+		"strings"
+		"testing"
+		"time"
+	   )
+
+func newTestStore(t *testing.T) *Store {
+	c := &Config {
+		storeBackend: "pack",
+		storePackDir: t.TempDir(),
+		storePackMaxSize: 1 << 20,
+		storeSweepBatch: 2,
+	}
+	store, err := newStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestStoreSweep(t *testing.T) {
+	store := newTestStore(t)
+	past := time.Now().Unix() - 1
+	for id := uint64(1); id <= 5; id++ {
+		err := store.backend.Put(id, []byte("expired"), &ObjectMeta{Expire: past})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.backend.Put(6, []byte("later"), &ObjectMeta{Expire: past + 3600})
+	store.backend.Put(7, []byte("never"), &ObjectMeta{})
+	store.deleteData(5)
+	// a batch at a time
+	total := 0
+	for {
+		n, err := store.sweep()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 2 {
+			t.Fatalf("%d purged, batch is 2", n)
+		}
+		if n == 0 {
+			break
+		}
+		total += n
+	}
+	if total != 4 {
+		t.Fatalf("purged %d", total)
+	}
+	for id := uint64(1); id <= 4; id++ {
+		_, _, err := store.getData(id)
+		if err != ErrBlobNotFound {
+			t.Fatalf("%d: %v", id, err)
+		}
+	}
+	// a tombstone is not purged, the blob stays deleted
+	deleted, _ := store.isDeleted(5)
+	if !deleted {
+		t.Fatal("tombstone purged")
+	}
+	for _, id := range []uint64{6, 7} {
+		_, _, err := store.getData(id)
+		if err != nil {
+			t.Fatalf("%d: %v", id, err)
+		}
+	}
+	// archived after it expired, it is not kept
+	err := store.addNewData(&StoreReq{id: 8, data: []byte("late"), meta: &ObjectMeta{Expire: past}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = store.getData(8)
+	if err != ErrBlobNotFound {
+		t.Fatalf("late: %v", err)
+	}
+}
+
+func TestStoreExpiredGet(t *testing.T) {
+	bs := newTestBinStore(t)
+	w := serveTest(bs, "POST", "/add?ttl=1", strings.NewReader("short lived"), 11)
+	if w.Code != http.StatusOK {
+		t.Fatalf("add: %d %s", w.Code, w.Body)
+	}
+	key := w.Body.String()
+	w = getTestBlob(bs, "GET", key, nil)
+	if w.Code != http.StatusOK || len(w.Header().Get("Expires")) == 0 {
+		t.Fatalf("get: %d %v", w.Code, w.Header())
+	}
+	time.Sleep(1100 * time.Millisecond)
+	// refused before the sweeper purges it
+	w = getTestBlob(bs, "GET", key, nil)
+	if w.Code != http.StatusGone {
+		t.Fatalf("expired: %d", w.Code)
+	}
+	w = serveTest(bs, "POST", "/add?ttl=1&expire=2000000000", strings.NewReader("both"), 4)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("ttl and expire: %d", w.Code)
+	}
+}
@@ -0,0 +1,211 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"io/ioutil"
+		"os"
+		"path/filepath"
+		"strings"
+		"strconv"
+		"sync"
+		"bytes"
+		"errors"
+		"fmt"
+	   )
+
+// StoreWatermarkOffsetSource is fed by /store itself: the archiver passes the partition
+// and offset of every message it archives. the watermark of a partition only moves over
+// offsets archived or missing from the log, ones archived ahead of a hole wait in pending.
+// both are saved to a local file on every Load so they survive restarts. the log is
+// local too, so it is only used with the segment log: a kafka topic is shared by all
+// nodes while each node would only see the /store calls it gets.
+type StoreWatermarkOffsetSource struct {
+	config *Config
+	file string
+	log MessageLog
+	watermarks []int64
+	pending []map[int64]bool
+	dirty bool
+	lock *sync.Mutex
+}
+
+func newStoreWatermarkOffsetSource(config *Config, log MessageLog) (*StoreWatermarkOffsetSource, error) {
+    ws := &StoreWatermarkOffsetSource {
+        config: config,
+		file: config.archiveWatermarkFile,
+		log: log,
+		watermarks: make([]int64, gPartitionMaxValue+1),
+		pending: make([]map[int64]bool, gPartitionMaxValue+1),
+		lock: &sync.Mutex{},
+	}
+	err := ws.init()
+	if err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// file format: one "partition offset [pending offset...]" per line
+func (ws *StoreWatermarkOffsetSource) init() error {
+	err := os.MkdirAll(filepath.Dir(ws.file), 0755)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(ws.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return errors.New(fmt.Sprintf("invalid line in %s: %s", ws.file, line))
+		}
+		partition, err := strconv.Atoi(fields[0])
+		if err != nil || partition < 0 || partition > int(gPartitionMaxValue) {
+			return errors.New(fmt.Sprintf("invalid partition in %s: %s", ws.file, line))
+		}
+		for i, field := range fields[1:] {
+			offset, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				return errors.New(fmt.Sprintf("invalid offset in %s: %s", ws.file, line))
+			}
+			if i == 0 {
+				ws.watermarks[partition] = offset
+				continue
+			}
+			if ws.pending[partition] == nil {
+				ws.pending[partition] = make(map[int64]bool)
+			}
+			ws.pending[partition][offset] = true
+		}
+	}
+	return nil
+}
+
+func (ws *StoreWatermarkOffsetSource) record(partition int32, offset int64) error {
+	if partition < 0 || partition > gPartitionMaxValue {
+		return errors.New(fmt.Sprintf("invalid partition: %d", partition))
+	}
+	// an offset never appended would hold the watermark back for good
+	_, high, err := ws.log.Watermarks(partition)
+	if err != nil {
+		return err
+	}
+	if offset >= high {
+		return errors.New(fmt.Sprintf("offset %d is not in the log yet, partition %d ends at %d", offset, partition, high))
+	}
+	ws.lock.Lock()
+	if offset < ws.watermarks[partition] {
+		ws.lock.Unlock()
+		return nil
+	}
+	if ws.pending[partition] == nil {
+		ws.pending[partition] = make(map[int64]bool)
+	}
+	ws.pending[partition][offset] = true
+	ws.dirty = true
+	ws.lock.Unlock()
+	ws.advance(partition)
+	return nil
+}
+
+// takes ws.lock, the log is probed without it
+func (ws *StoreWatermarkOffsetSource) advance(partition int32) {
+	for {
+		ws.lock.Lock()
+		pending := ws.pending[partition]
+		w := ws.watermarks[partition]
+		for pending[w] {
+			delete(pending, w)
+			w++
+		}
+		ws.watermarks[partition] = w
+		if len(pending) == 0 {
+			ws.lock.Unlock()
+			return
+		}
+		ws.lock.Unlock()
+		// never written, e.g. skipped after a crash, or dropped: nothing to archive there
+		_, err := ws.log.Fetch(partition, w)
+		if err != errLogNoMessage {
+			return
+		}
+		ws.lock.Lock()
+		// another record may have moved it meanwhile
+		if ws.watermarks[partition] == w {
+			ws.watermarks[partition] = w+1
+		}
+		ws.lock.Unlock()
+	}
+}
+
+func (ws *StoreWatermarkOffsetSource) Load(offsets []int64) error {
+	ws.lock.Lock()
+	copy(offsets, ws.watermarks)
+	dirty := ws.dirty
+	ws.dirty = false
+	var content []byte
+	if dirty {
+		content = ws.encode()
+	}
+	ws.lock.Unlock()
+	if !dirty {
+		return nil
+	}
+	err := ws.save(content)
+	if err != nil {
+		ws.lock.Lock()
+		ws.dirty = true
+		ws.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// must hold ws.lock
+func (ws *StoreWatermarkOffsetSource) encode() []byte {
+	var buf bytes.Buffer
+	for partition, offset := range ws.watermarks {
+		if offset == 0 && len(ws.pending[partition]) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "%d %d", partition, offset)
+		for p := range ws.pending[partition] {
+			fmt.Fprintf(&buf, " %d", p)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func (ws *StoreWatermarkOffsetSource) save(content []byte) error {
+	return writeFileSynced(ws.file, content)
+}
@@ -0,0 +1,107 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package binstore
+
+import (
+		"path/filepath"
+		"testing"
+		"fmt"
+	   )
+
+func newTestWatermark(t *testing.T, c *Config, sl *SegmentLog) *StoreWatermarkOffsetSource {
+	ws, err := newStoreWatermarkOffsetSource(c, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func checkWatermark(t *testing.T, ws *StoreWatermarkOffsetSource, partition int32, want int64) {
+	offsets := make([]int64, gPartitionMaxValue+1)
+	err := ws.Load(offsets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offsets[partition] != want {
+		t.Fatalf("watermark of %d: %d, want %d", partition, offsets[partition], want)
+	}
+}
+
+func TestStoreWatermarkAdvance(t *testing.T) {
+	c := testSegmentConfig(t, false)
+	c.brokerSegmentMaxSize = 1 << 20
+	c.archiveWatermarkFile = filepath.Join(t.TempDir(), "watermark")
+	sl := newTestSegmentLog(t, c)
+	for i := 0; i < 3; i++ {
+		sl.Append(0, []byte(fmt.Sprintf("value-%d", i)))
+		sl.Append(1, []byte(fmt.Sprintf("value-%d", i)))
+	}
+	ws := newTestWatermark(t, c, sl)
+	// nothing was appended there yet
+	err := ws.record(0, 3)
+	if err == nil {
+		t.Fatal("offset past the log end recorded")
+	}
+	// ahead of 0 it waits
+	ws.record(0, 1)
+	checkWatermark(t, ws, 0, 0)
+	ws.record(0, 0)
+	checkWatermark(t, ws, 0, 2)
+	// already passed
+	ws.record(0, 1)
+	checkWatermark(t, ws, 0, 2)
+	ws.record(1, 2)
+	checkWatermark(t, ws, 1, 0)
+	// the watermark and what waits are kept over a restart
+	ws = newTestWatermark(t, c, sl)
+	checkWatermark(t, ws, 0, 2)
+	ws.record(1, 0)
+	ws.record(1, 1)
+	checkWatermark(t, ws, 1, 3)
+}
+
+func TestStoreWatermarkHole(t *testing.T) {
+	c := testSegmentConfig(t, false)
+	c.brokerSegmentMaxSize = 1 << 20
+	c.archiveWatermarkFile = filepath.Join(t.TempDir(), "watermark")
+	sl := newTestSegmentLog(t, c)
+	for i := 0; i < 3; i++ {
+		sl.Append(0, []byte(fmt.Sprintf("value-%d", i)))
+	}
+	// offset 2 is lost in a crash, the next append is past the reservation
+	seg := activeSegment(sl, 0)
+	seg.log.Truncate(seg.size - 2)
+	sl = newTestSegmentLog(t, c)
+	_, o, err := sl.Append(0, []byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := newTestWatermark(t, c, sl)
+	ws.record(0, 0)
+	ws.record(0, 1)
+	checkWatermark(t, ws, 0, 2)
+	// the hole is probed and passed once something beyond it is archived
+	ws.record(0, o)
+	checkWatermark(t, ws, 0, o+1)
+}
@@ -24,13 +24,10 @@
 package binstore
 
 import (
-		"github.com/dzch/go-utils/logger"
 		zookeeper "github.com/samuel/go-zookeeper/zk"
 		"fmt"
-		"sync"
 		"strconv"
 		"errors"
-		"time"
 	   )
 
 
@@ -38,42 +35,21 @@ var (
 		gConsumerName = "binstore"
 	)
 
-type ZK struct {
+// offsets committed to zk by the old high level kafka consumer of the archiver
+type ZKOffsetSource struct {
 	config *Config
 	offsetPPath string
-	offsets []int64
-	offsetsTmp []int64
-	offsetsLock *sync.RWMutex
 }
 
-func newZK(bs *BinStore) (*ZK, error) {
-    zk := &ZK {
-        config: bs.config,
-		offsetPPath: fmt.Sprintf("%s/consumers/%s/offsets/%s", bs.config.zkChroot, gConsumerName, gBrokerTopic),
-		offsetsLock: &sync.RWMutex{},
-	}
-	err := zk.init()
-	if err != nil {
-		return nil, err
+func newZKOffsetSource(config *Config) (*ZKOffsetSource, error) {
+    zk := &ZKOffsetSource {
+        config: config,
+		offsetPPath: fmt.Sprintf("%s/consumers/%s/offsets/%s", config.zkChroot, gConsumerName, config.brokerTopic),
 	}
     return zk, nil
 }
 
-func (zk *ZK) init() error {
-    err := zk.initOffsets()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (zk *ZK) initOffsets() error {
-	zk.offsets = make([]int64, gPartitionMaxValue)
-	zk.offsetsTmp = make([]int64, gPartitionMaxValue)
-    return zk.updateOffsets()
-}
-
-func (zk *ZK) updateOffsets() error {
+func (zk *ZKOffsetSource) Load(offsets []int64) error {
 	conn, _, err := zookeeper.Connect(zk.config.zkHosts, zk.config.zkSessionTimeout)
 	if err != nil {
 		return err
@@ -102,34 +78,10 @@ func (zk *ZK) updateOffsets() error {
 		if err != nil {
 			return err
 		}
-		zk.offsetsTmp[partition] = offset
-	}
-	zk.offsetsLock.Lock()
-	defer zk.offsetsLock.Unlock()
-	copy(zk.offsets, zk.offsetsTmp)
-	return nil
-}
-
-func (zk *ZK) run() {
-	for {
-        err := zk.updateOffsets()
-		if err != nil {
-			logger.Warning("fail to zk.updateOffsets: %s", err.Error())
-			time.Sleep(zk.config.zkFailRetryInterval)
+		if partition < 0 || partition >= len(offsets) {
+			return errors.New(fmt.Sprintf("partition %d out of range", partition))
 		}
-		time.Sleep(zk.config.zkUpdateInterval)
+		offsets[partition] = offset
 	}
-}
-
-func (zk *ZK) dataInBroker(partition int32, offset int64) (bool, error) {
-	if partition > gPartitionMaxValue {
-		return false, errors.New("partition is toooo big")
-	}
-	zk.offsetsLock.RLock()
-	defer zk.offsetsLock.RUnlock()
-	// consumer offset is next need to be commit, so need =
-	if offset >= zk.offsets[partition] {
-		return true, nil
-	}
-	return false, nil
+	return nil
 }
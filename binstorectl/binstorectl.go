@@ -0,0 +1,284 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package main
+
+import (
+		"github.com/dzch/binstore/binstore"
+		"github.com/dzch/binstore/binstore/client"
+		"encoding/json"
+		"errors"
+		"path/filepath"
+		"strings"
+		"flag"
+		"fmt"
+		"io"
+		"os"
+	   )
+
+var (
+		gUsage = `usage: binstorectl [-s servers] [-ns namespace] [-token admin_token] <command> [args]
+commands:
+  upload [-type content_type] [-ttl duration] path...
+        add files, directories are walked, prints "path key" for each file
+  download [-o file] key
+        write the blob to file, stdout if no -o
+  stat key...
+        size, checksums and meta of keys as json
+  locate key...
+        prints "key broker" or "key store", where the key is served from now
+  sign [-ttl duration] [-ip client_ip] key...
+        prints "key url", a /get url that works for ttl, needs -token
+  decode-key [-f binstore.yaml] key...
+        id, partition and offset of keys, with the key tags and fcrypt keys
+        of the config, no server is asked
+servers are host:port separated by ",", $BINSTORE_SERVERS if no -s.
+`
+		errUsage = errors.New("unknown command")
+	)
+
+type ctl struct {
+	servers string
+	namespace string
+	token string
+	c *client.Client
+	// where results are printed, errors go to stderr
+	out io.Writer
+}
+
+func main() {
+	ct := &ctl{out: os.Stdout}
+	flag.StringVar(&ct.servers, "s", os.Getenv("BINSTORE_SERVERS"), "binstore servers, host:port separated by \",\"")
+	flag.StringVar(&ct.namespace, "ns", "", "namespace of uploads, the default one if empty")
+	flag.StringVar(&ct.token, "token", os.Getenv("BINSTORE_TOKEN"), "admin token")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, gUsage)
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	err := ct.run(flag.Arg(0), flag.Args()[1:])
+	if err == errUsage {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "binstorectl:", err)
+		os.Exit(1)
+	}
+}
+
+func (ct *ctl) run(cmd string, args []string) error {
+	var err error
+	switch cmd {
+		case "upload":
+			err = ct.upload(args)
+		case "download":
+			err = ct.download(args)
+		case "stat":
+			err = ct.stat(args)
+		case "locate":
+			err = ct.locate(args)
+		case "sign":
+			err = ct.sign(args)
+		case "decode-key":
+			err = ct.decodeKey(args)
+		default:
+			err = errUsage
+	}
+	return err
+}
+
+func (ct *ctl) client() (*client.Client, error) {
+	if ct.c != nil {
+		return ct.c, nil
+	}
+	if len(ct.servers) == 0 {
+		return nil, errors.New("no servers, give -s or set BINSTORE_SERVERS")
+	}
+	c, err := client.NewClient(strings.Split(ct.servers, ","))
+	if err != nil {
+		return nil, err
+	}
+	c.Namespace = ct.namespace
+	c.AdminToken = ct.token
+	ct.c = c
+	return c, nil
+}
+
+// one failed file does not stop the rest, the error returned says how many
+func (ct *ctl) upload(args []string) error {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	contentType := fs.String("type", "", "content type of every file, sniffed by binstore if empty")
+	ttl := fs.Duration("ttl", 0, "expire the blobs after ttl, never if 0")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("upload: no path")
+	}
+	c, err := ct.client()
+	if err != nil {
+		return err
+	}
+	opts := &client.AddOptions {
+        ContentType: *contentType,
+		TTL: *ttl,
+	}
+	nfail := 0
+	for _, root := range fs.Args() {
+		err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			key, err := c.AddFile(path, opts)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", path, err.Error())
+				nfail ++
+				return nil
+			}
+			fmt.Fprintf(ct.out, "%s %s\n", path, key)
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", root, err.Error())
+			nfail ++
+		}
+	}
+	if nfail > 0 {
+		return errors.New(fmt.Sprintf("upload: %d failed", nfail))
+	}
+	return nil
+}
+
+func (ct *ctl) download(args []string) error {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	out := fs.String("o", "", "file to write, stdout if empty")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("download: need one key")
+	}
+	c, err := ct.client()
+	if err != nil {
+		return err
+	}
+	rc, _, err := c.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	w := ct.out
+	if len(*out) > 0 {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+func (ct *ctl) stat(args []string) error {
+	if len(args) == 0 {
+		return errors.New("stat: no key")
+	}
+	c, err := ct.client()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(ct.out)
+	for _, key := range args {
+		res, err := c.Stat(key)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", key, err.Error()))
+		}
+		enc.Encode(res)
+	}
+	return nil
+}
+
+func (ct *ctl) locate(args []string) error {
+	if len(args) == 0 {
+		return errors.New("locate: no key")
+	}
+	c, err := ct.client()
+	if err != nil {
+		return err
+	}
+	for _, key := range args {
+		res, err := c.Stat(key)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", key, err.Error()))
+		}
+		fmt.Fprintf(ct.out, "%s %s\n", key, res.Location)
+	}
+	return nil
+}
+
+func (ct *ctl) sign(args []string) error {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	ttl := fs.Duration("ttl", 0, "how long the url works, the default of the server if 0")
+	ip := fs.String("ip", "", "the only client ip the url works for, any if empty")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("sign: no key")
+	}
+	c, err := ct.client()
+	if err != nil {
+		return err
+	}
+	for _, key := range fs.Args() {
+		u, err := c.Sign(key, *ttl, *ip)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", key, err.Error()))
+		}
+		fmt.Fprintf(ct.out, "%s %s\n", key, u)
+	}
+	return nil
+}
+
+func (ct *ctl) decodeKey(args []string) error {
+	fs := flag.NewFlagSet("decode-key", flag.ExitOnError)
+	confFile := fs.String("f", "./conf/binstore.yaml", "binstore config file")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("decode-key: no key")
+	}
+	kd, err := binstore.NewKeyDecoder(*confFile)
+	if err != nil {
+		return err
+	}
+	for _, key := range fs.Args() {
+		info, err := kd.Decode(key)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", key, err.Error()))
+		}
+		fmt.Fprintf(ct.out, "%s ns=%s id=%d partition=%d offset=%d\n", key, info.Namespace, info.Id, info.Partition, info.Offset)
+	}
+	return nil
+}
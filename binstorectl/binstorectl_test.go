@@ -0,0 +1,164 @@
+/*
+    The MIT License (MIT)
+    
+	Copyright (c) 2015 myhug.cn and zhouwench (zhouwench@gmail.com)
+    
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+    
+    The above copyright notice and this permission notice shall be included in all
+    copies or substantial portions of the Software.
+    
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+package main
+
+import (
+		"encoding/json"
+		"net/http"
+		"net/http/httptest"
+		"io/ioutil"
+		"path/filepath"
+		"strings"
+		"bytes"
+		"sync"
+		"testing"
+		"fmt"
+	   )
+
+// what binstore answers, blobs are kept by the key handed out
+type fakeBinStore struct {
+	lock sync.Mutex
+	blobs map[string][]byte
+}
+
+func (fb *fakeBinStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	key := r.URL.Query().Get("key")
+	switch r.URL.Path {
+		case "/add":
+			data, _ := ioutil.ReadAll(r.Body)
+			key = fmt.Sprintf("ff5837%032x", len(fb.blobs)+1)
+			fb.blobs[key] = data
+			w.Write([]byte(key))
+		case "/get":
+			data, ok := fb.blobs[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"code":"not_found","message":"blob not found"}`))
+				return
+			}
+			w.Write(data)
+		case "/stat":
+			json.NewEncoder(w).Encode(map[string]interface{}{"key": key, "size": len(fb.blobs[key]), "location": "broker"})
+		case "/sign":
+			if r.Header.Get("X-Binstore-Token") != "secret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"url": "/get?key=" + key + "&expires=1&sig=x"})
+	}
+}
+
+func newTestCtl(t *testing.T) (*ctl, *fakeBinStore, *bytes.Buffer) {
+	fb := &fakeBinStore{blobs: make(map[string][]byte)}
+	srv := httptest.NewServer(fb)
+	t.Cleanup(srv.Close)
+	out := &bytes.Buffer{}
+	ct := &ctl {
+        servers: strings.TrimPrefix(srv.URL, "http://"),
+		token: "secret",
+		out: out,
+	}
+	return ct, fb, out
+}
+
+func TestCtlUploadDownload(t *testing.T) {
+	ct, fb, out := newTestCtl(t)
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("aaa"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("bbbb"), 0644)
+	err := ct.run("upload", []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || len(fb.blobs) != 2 {
+		t.Fatalf("%q", out)
+	}
+	keys := make(map[string]string)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		keys[filepath.Base(fields[0])] = fields[1]
+	}
+	out.Reset()
+	err = ct.run("download", []string{keys["a.txt"]})
+	if err != nil || out.String() != "aaa" {
+		t.Fatalf("download: %q %v", out, err)
+	}
+	path := filepath.Join(dir, "got")
+	err = ct.run("download", []string{"-o", path, keys["b.txt"]})
+	data, _ := ioutil.ReadFile(path)
+	if err != nil || string(data) != "bbbb" {
+		t.Fatalf("download -o: %q %v", data, err)
+	}
+	err = ct.run("download", []string{fmt.Sprintf("ff5837%032x", 99)})
+	if err == nil {
+		t.Fatal("missing key downloaded")
+	}
+	err = ct.run("upload", []string{filepath.Join(dir, "none")})
+	if err == nil {
+		t.Fatal("missing path uploaded")
+	}
+}
+
+func TestCtlStatLocateSign(t *testing.T) {
+	ct, fb, out := newTestCtl(t)
+	key := fmt.Sprintf("ff5837%032x", 1)
+	fb.blobs[key] = []byte("hello")
+	err := ct.run("stat", []string{key})
+	if err != nil || !strings.Contains(out.String(), `"size":5`) {
+		t.Fatalf("stat: %q %v", out, err)
+	}
+	out.Reset()
+	err = ct.run("locate", []string{key})
+	if err != nil || out.String() != key + " broker\n" {
+		t.Fatalf("locate: %q %v", out, err)
+	}
+	out.Reset()
+	err = ct.run("sign", []string{"-ttl", "1m", key})
+	if err != nil || !strings.HasPrefix(out.String(), key + " http://") || !strings.Contains(out.String(), "sig=x") {
+		t.Fatalf("sign: %q %v", out, err)
+	}
+	ct.token = ""
+	ct.c = nil
+	err = ct.run("sign", []string{key})
+	if err == nil {
+		t.Fatal("signed without token")
+	}
+	for _, args := range [][]string{{"stat"}, {"stat", "not-a-key"}, {"locate"}, {"download"}} {
+		err = ct.run(args[0], args[1:])
+		if err == nil {
+			t.Fatalf("%v accepted", args)
+		}
+	}
+	if ct.run("frobnicate", nil) != errUsage {
+		t.Fatal("unknown command")
+	}
+	ct = &ctl{out: out}
+	err = ct.run("stat", []string{key})
+	if err == nil || !strings.Contains(err.Error(), "no servers") {
+		t.Fatalf("no servers: %v", err)
+	}
+}